@@ -59,20 +59,23 @@ func (req *SocketConnectWithDataEvent) GetVersion() uint32 {
 	return 1
 }
 
+//RSocketAcceptedEvent echoes the secret of the login which advertised the
+//reverse socket address
 type RSocketAcceptedEvent struct {
 	Server string
+	Secret string
 	EventHeader
 }
 
 func (req *RSocketAcceptedEvent) Encode(buffer *bytes.Buffer) {
 	EncodeStringValue(buffer, req.Server)
+	EncodeStringValue(buffer, req.Secret)
 }
 func (req *RSocketAcceptedEvent) Decode(buffer *bytes.Buffer) (err error) {
-	req.Server, err = DecodeStringValue(buffer)
-	if err != nil {
-		return
+	if req.Server, err = DecodeStringValue(buffer); nil == err {
+		req.Secret, err = DecodeStringValue(buffer)
 	}
-	return nil
+	return
 }
 
 func (req *RSocketAcceptedEvent) GetType() uint32 {
@@ -162,3 +165,42 @@ func (req *UserLoginEvent) GetType() uint32 {
 func (req *UserLoginEvent) GetVersion() uint32 {
 	return 1
 }
+
+//UserLoginEventV2 also advertises an address the server should dial back
+//for reverse socket connections
+type UserLoginEventV2 struct {
+	User            string
+	RSocketAddr     string
+	RSocketServer   string
+	RSocketPoolSize uint32
+	//echoed by the server on every reverse socket connection
+	RSocketSecret string
+	EventHeader
+}
+
+func (req *UserLoginEventV2) Encode(buffer *bytes.Buffer) {
+	EncodeStringValue(buffer, req.User)
+	EncodeStringValue(buffer, req.RSocketAddr)
+	EncodeStringValue(buffer, req.RSocketServer)
+	EncodeUInt32Value(buffer, req.RSocketPoolSize)
+	EncodeStringValue(buffer, req.RSocketSecret)
+}
+func (req *UserLoginEventV2) Decode(buffer *bytes.Buffer) (err error) {
+	if req.User, err = DecodeStringValue(buffer); nil == err {
+		if req.RSocketAddr, err = DecodeStringValue(buffer); nil == err {
+			if req.RSocketServer, err = DecodeStringValue(buffer); nil == err {
+				if req.RSocketPoolSize, err = DecodeUInt32Value(buffer); nil == err {
+					req.RSocketSecret, err = DecodeStringValue(buffer)
+				}
+			}
+		}
+	}
+	return
+}
+
+func (req *UserLoginEventV2) GetType() uint32 {
+	return EVENT_USER_LOGIN_TYPE
+}
+func (req *UserLoginEventV2) GetVersion() uint32 {
+	return 2
+}
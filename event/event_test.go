@@ -99,3 +99,30 @@ func TestXYZ(t *testing.T) {
 	t.Errorf("Cost %dns to loop %d to encode&decode", (end - start), loopcount)
 
 }
+
+func TestSequentialChunkEvent(t *testing.T) {
+	Init()
+	for _, content := range [][]byte{[]byte("hello"), make([]byte, 70000), nil} {
+		chunk := &SequentialChunkEvent{Sequence: 300, Content: content}
+		chunk.SetHash(7)
+		var buf bytes.Buffer
+		EncodeEvent(&buf, chunk)
+		err, ev := DecodeEvent(&buf)
+		if nil != err {
+			t.Fatal(err)
+		}
+		decoded, ok := ev.(*SequentialChunkEvent)
+		if !ok || decoded.Sequence != 300 || decoded.GetHash() != 7 || !bytes.Equal(decoded.Content, content) {
+			t.Fatalf("unexpected event:%v", ev)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("%d bytes left", buf.Len())
+		}
+	}
+	var buf bytes.Buffer
+	EncodeEvent(&buf, &SequentialChunkEvent{Sequence: 1, Content: []byte("hello")})
+	truncated := bytes.NewBuffer(buf.Bytes()[:buf.Len()-1])
+	if err, _ := DecodeEvent(truncated); nil == err {
+		t.Fatal("truncated event should fail")
+	}
+}
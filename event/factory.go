@@ -76,9 +76,11 @@ func Init() {
 	RegistEvent(&RequestAppIDResponseEvent{})
 	RegistEvent(&HTTPConnectionEvent{})
 	RegistEvent(&HTTPErrorEvent{})
+	RegistEvent(&SequentialChunkEvent{})
 	RegistEvent(&TCPChunkEvent{})
 	RegistEvent(&SocketConnectionEvent{})
 	RegistEvent(&UserLoginEvent{})
+	RegistEvent(&UserLoginEventV2{})
 	RegistEvent(&RSocketAcceptedEvent{})
 	RegistEvent(&AdminResponseEvent{})
 	RegistEvent(&RequestAppIDEvent{})
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"container/list"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
@@ -209,6 +210,45 @@ func (req *HTTPChunkEvent) GetVersion() uint32 {
 	return 1
 }
 
+//HTTP_CHUNKED_BODY_HEADER marks a request whose body does not fit in one event.
+//The request event carries the first part of the body, the rest follows as
+//SequentialChunkEvents with the same hash and sequence 1,2,3...; a chunk with
+//empty content terminates the body. The server keeps the parts until the
+//terminating chunk arrives, then fetches the reassembled request and answers
+//that last event with the HTTPResponseEvent. Every other event is answered
+//with an HTTPConnectionEvent ack.
+const HTTP_CHUNKED_BODY_HEADER = "X-Snova-Chunked-Body"
+
+type SequentialChunkEvent struct {
+	Sequence uint32
+	Content  []byte
+	EventHeader
+}
+
+func (chunk *SequentialChunkEvent) Encode(buffer *bytes.Buffer) {
+	EncodeUInt32Value(buffer, chunk.Sequence)
+	EncodeBytesValue(buffer, chunk.Content)
+}
+func (chunk *SequentialChunkEvent) Decode(buffer *bytes.Buffer) (err error) {
+	chunk.Sequence, err = DecodeUInt32Value(buffer)
+	if err != nil {
+		return
+	}
+	//a truncated chunk must not pass as a shorter part of the body
+	var content bytes.Buffer
+	if err = DecodeByteBufferValue(buffer, &content); nil == err {
+		chunk.Content = content.Bytes()
+	}
+	return
+}
+
+func (chunk *SequentialChunkEvent) GetType() uint32 {
+	return EVENT_SEQUENTIAL_CHUNK_TYPE
+}
+func (chunk *SequentialChunkEvent) GetVersion() uint32 {
+	return 1
+}
+
 type HTTPRequestEvent struct {
 	HTTPMessageEvent
 	Method string
@@ -303,9 +343,20 @@ func (req *HTTPRequestEvent) GetVersion() uint32 {
 type HTTPResponseEvent struct {
 	HTTPMessageEvent
 	Status uint32
+	//rest of the body which is still arriving after Content, may be nil
+	Stream io.ReadCloser
 	rawRes *http.Response
 }
 
+type streamBody struct {
+	io.Reader
+	stream io.Closer
+}
+
+func (body *streamBody) Close() error {
+	return body.stream.Close()
+}
+
 func (res *HTTPResponseEvent) Encode(buffer *bytes.Buffer) {
 	EncodeUInt64Value(buffer, uint64(res.Status))
 	res.DoEncode(buffer)
@@ -327,7 +378,19 @@ func (res *HTTPResponseEvent) ToResponse() *http.Response {
 	raw.ContentLength = int64(res.Content.Len())
 	raw.Header = make(http.Header)
 	raw.StatusCode = int(res.Status)
-	res.SetHeader("Content-Length", strconv.Itoa(res.Content.Len()))
+	if nil == res.Stream {
+		res.SetHeader("Content-Length", strconv.Itoa(res.Content.Len()))
+	} else {
+		res.RemoveHeader("Transfer-Encoding")
+		if len(res.GetHeader("Content-Length")) > 0 {
+			raw.ContentLength = int64(res.GetContentLength())
+		} else {
+			//length unknown, relay it to the client as chunked body
+			raw.ProtoMinor = 1
+			raw.ContentLength = -1
+			raw.TransferEncoding = []string{"chunked"}
+		}
+	}
 	for i := 0; i < len(res.Headers); i++ {
 		header := res.Headers[i]
 		if strings.EqualFold(header.Name, "Set-Cookie") || strings.EqualFold(header.Name, "Set-Cookie2") {
@@ -359,7 +422,9 @@ func (res *HTTPResponseEvent) ToResponse() *http.Response {
 			raw.Header.Add(header.Name, header.Value)
 		}
 	}
-	if raw.ContentLength > 0 {
+	if nil != res.Stream {
+		raw.Body = &streamBody{io.MultiReader(&res.Content, res.Stream), res.Stream}
+	} else if raw.ContentLength > 0 {
 		raw.Body = &util.BufferCloseWrapper{&res.Content}
 	}
 	return raw
@@ -28,11 +28,11 @@ const (
 	REQUEST_ALL_SHARED_APPID_EVENT_TYPE    = 2021
 	//	EVENT_TRANSACTION_COMPLETE_TYPE        = 11505
 	//
-	//	EVENT_SEQUNCEIAL_CHUNK_TYPE            = 11504
 	//	EVENT_SOCKET_CONNECT_RES_TYPE          = 11503
 	//	EVENT_SOCKET_CONNECT_REQ_TYPE          = 11502
 	//	EVENT_REST_NOTIFY_TYPE                 = 11501
 	//	EVENT_REST_REQEUST_TYPE                = 11500
+	EVENT_SEQUENTIAL_CHUNK_TYPE         = 11504
 	EVENT_RSOCKET_ACCEPTED_TYPE         = 11506
 	EVENT_TCP_CONNECTION_TYPE           = 12000
 	EVENT_TCP_CHUNK_TYPE                = 12001
@@ -3,12 +3,15 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
-	"sync/atomic"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/zyxar/gsnova/common"
@@ -22,24 +25,23 @@ const (
 	MAX_READ_CHUNK_SIZE = 8192
 )
 
-var seed uint32 = 0
-
-func handleConn(conn *net.TCPConn, proxyServerType int) {
-	sessionID := atomic.AddUint32(&seed, 1)
-	proxy.HandleConn(sessionID, conn, proxyServerType)
+func handleConn(conn *net.TCPConn, proxyServer string) {
+	proxy.HandleConn(proxy.NewSessionID(), conn, proxyServer)
 }
 
-func handleServer(lp *net.TCPListener, proxyServerType int) {
+func handleServer(lp *net.TCPListener, proxyServer string) {
 	for {
 		conn, err := lp.AcceptTCP()
 		if nil != err {
 			continue
 		}
-		go handleConn(conn, proxyServerType)
+		go handleConn(conn, proxyServer)
 	}
 }
 
-func startLocalProxyServer(addr string, proxyServerType int) bool {
+//startLocalProxyServer listens on addr, proxyServer is the backend serving
+//all the connections, empty for the SPAC selected ones
+func startLocalProxyServer(addr string, proxyServer string) bool {
 	tcpaddr, err := net.ResolveTCPAddr("tcp", addr)
 	if nil != err {
 		return false
@@ -51,7 +53,7 @@ func startLocalProxyServer(addr string, proxyServerType int) bool {
 		return false
 	}
 	log.Printf("Listen on address %s\n", addr)
-	handleServer(lp, proxyServerType)
+	handleServer(lp, proxyServer)
 	return true
 }
 
@@ -83,6 +85,30 @@ func isDirExists(path string) (bool, error) {
 	return false, err
 }
 
+//remove the gateway port mappings before exit
+func handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	<-ch
+	proxy.StopUPnP()
+	proxy.StopGAE()
+	os.Exit(0)
+}
+
+//explainSpac prints how the proxy of "[METHOD] URL" is selected
+func explainSpac(v string) {
+	method := "GET"
+	if fields := strings.Fields(v); len(fields) == 2 {
+		method, v = fields[0], fields[1]
+	}
+	e, err := proxy.ExplainSpac(method, v, "")
+	if nil != err {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(e)
+}
+
 func main() {
 	var err error
 	if err = mkConfigDir(common.Home); err != nil {
@@ -90,6 +116,7 @@ func main() {
 	}
 	as_server := flag.Bool("server", false, "Run as remote proxy server")
 	conf := flag.String("file", filepath.Join(common.Home, common.Product+".conf"), "Specify config file for gsnova")
+	explain := flag.String("explain", "", "Explain the SPAC proxy selection of \"[METHOD] URL\" and exit")
 	event.Init()
 	flag.Parse()
 	if *as_server {
@@ -100,46 +127,30 @@ func main() {
 	common.InitLogger()
 	common.InitConfig()
 	proxy.InitHosts()
+	proxy.InitChains()
 	proxy.InitSpac()
-	proxy.InitGoogle()
-	runtime.GOMAXPROCS(runtime.NumCPU())
-
-	var gae proxy.GAE
-	var c4 proxy.C4
-
-	err = c4.Init()
-	if nil != err {
-		log.Printf("[WARN]Failed to init C4:%s\n", err.Error())
+	if len(*explain) > 0 {
+		proxy.InitExplain()
+		explainSpac(*explain)
+		return
 	}
+	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	err = proxy.InitSSH()
+	err = proxy.InitUPnP()
 	if nil != err {
-		log.Printf("[WARN]Failed to init SSH:%s\n", err.Error())
+		log.Printf("[WARN]Failed to init UPnP:%s\n", err.Error())
 	}
+	go handleSignals()
 
-	err = gae.Init()
-	if nil != err {
-		log.Printf("[WARN]Failed to init GAE:%s\n", err.Error())
-	}
+	proxy.InitBackends()
+	proxy.InitPortForward()
 	proxy.InitSelfWebServer()
 	proxy.PostInitSpac()
 
 	log.Printf("=============Start %s %s==============\n", common.Product, common.Version)
-	if proxy.C4Enable {
-		if addr, exist := common.Cfg.GetProperty("C4", "Listen"); exist {
-			go startLocalProxyServer(addr, proxy.C4_PROXY_SERVER)
-		}
-	}
-	if proxy.SSHEnable {
-		if addr, exist := common.Cfg.GetProperty("SSH", "Listen"); exist {
-			go startLocalProxyServer(addr, proxy.SSH_PROXY_SERVER)
-		}
-	}
-	if proxy.GAEEnable {
-		//init fake cert if GAE inited success
-		common.LoadRootCA()
-		if addr, exist := common.Cfg.GetProperty("GAE", "Listen"); exist {
-			go startLocalProxyServer(addr, proxy.GAE_PROXY_SERVER)
+	for _, backend := range proxy.Backends() {
+		if addr, exist := backend.ListenAddr(); exist {
+			go startLocalProxyServer(addr, backend.Name)
 		}
 	}
 	addr, exist := common.Cfg.GetProperty("LocalServer", "Listen")
@@ -153,7 +164,7 @@ func main() {
 		}()
 	}
 	testEntry()
-	startLocalProxyServer(addr, proxy.GLOBAL_PROXY_SERVER)
+	startLocalProxyServer(addr, "")
 	//launchSystemTray()
 
 }
@@ -3,6 +3,7 @@ package gfwlist
 import (
 	"bufio"
 	"encoding/base64"
+	"errors"
 	"log"
 	"net/http"
 	"regexp"
@@ -11,162 +12,236 @@ import (
 	"github.com/zyxar/gsnova/util"
 )
 
-type gfwListRule interface {
-	init(rule string) error
-	match(req *http.Request) bool
+//Rule is a parsed AutoProxy rule, it is shared by the runtime matching and
+//the PAC generation so that both of them agree on the grammar:
+//
+//	!comment, [AutoProxy x.x.x]   ignored
+//	@@rule                        exception of any rule below
+//	||domain/path                 url of the domain or its subdomains
+//	|http://prefix, suffix|       start or end anchor of the url
+//	/regex/                       raw regex tested against the url
+//	keyword*                      http url containing the keyword
+//	^                             separator, a char not in [\w\-.%] or the end
+//	rule$option,~option           adblock options, parsed and ignored
+type Rule struct {
+	Raw       string
+	Exception bool
+	//Regexp is valid in both go and javascript and matches the url case
+	//insensitively, it is the raw regex of /regex/ as it is
+	Regexp string
+	//Domain is set for ||domain and ||domain^, which is matched against the
+	//url authority without Regexp
+	Domain    string
+	Separator bool
+	//Keyword is the longest literal in lower case a matched url contains,
+	//it is empty for the raw regexes
+	Keyword string
+	//the rules without anchor match the http urls only
+	OnlyHttp bool
+	Options  []string
+	//the rule is a plain keyword matched by Keyword only
+	keywordOnly bool
 }
 
-type hostUrlWildcardRule struct {
-	only_http bool
-	host_rule string
-	url_rule  string
+const (
+	domainAnchorRegexp = `^[\w\-]+:\/+(?:[^\/]+\.)?`
+	separatorRegexp    = `(?:[^\w\-.%]|$)`
+)
+
+var optionsRegexp = regexp.MustCompile(`^~?[\w\-]+(=[^,]*)?(,~?[\w\-]+(=[^,]*)?)*$`)
+var domainRegexp = regexp.MustCompile(`^[\w\-.]+\^?$`)
+
+//wildcardToRegexp converts the wildcards and the separators, the other
+//punctuations are escaped which are literal in both go and javascript
+func wildcardToRegexp(pattern string) string {
+	var buffer []byte
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*':
+			if i == 0 || pattern[i-1] != '*' {
+				buffer = append(buffer, ".*"...)
+			}
+		case c == '^':
+			buffer = append(buffer, separatorRegexp...)
+		case c >= 0x80 || c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			buffer = append(buffer, c)
+		default:
+			buffer = append(buffer, '\\', c)
+		}
+	}
+	return string(buffer)
 }
 
-func (r *hostUrlWildcardRule) init(rule string) (err error) {
-	if !strings.Contains(rule, "/") {
-		r.host_rule = rule
-		return
+//ParseRule parses a line of AutoProxy rules, it returns nil for the
+//comments and the empty lines
+func ParseRule(line string) (*Rule, error) {
+	str := strings.TrimSpace(line)
+	if len(str) == 0 || strings.HasPrefix(str, "!") || strings.HasPrefix(str, "[") {
+		return nil, nil
 	}
-	rules := strings.SplitN(rule, "/", 2)
-	r.host_rule = rules[0]
-	if nil != err {
-		return
+	rule := &Rule{Raw: str}
+	if strings.HasPrefix(str, "@@") {
+		rule.Exception = true
+		str = str[2:]
 	}
-	if len(rules) == 2 && len(rules[1]) > 0 {
-		r.url_rule = rules[1]
+	if len(str) > 2 && strings.HasPrefix(str, "/") && strings.HasSuffix(str, "/") {
+		rule.Regexp = str[1 : len(str)-1]
+		return rule, nil
 	}
-	return
-}
-
-func (r *hostUrlWildcardRule) match(req *http.Request) bool {
-	if r.only_http && strings.EqualFold(req.Method, "Connect") {
-		return false
+	if index := strings.LastIndex(str, "$"); index >= 0 && optionsRegexp.MatchString(str[index+1:]) {
+		rule.Options = strings.Split(str[index+1:], ",")
+		str = str[:index]
 	}
-	if ret := util.WildcardMatch(req.Host, r.host_rule); !ret {
-		return false
+	prefix, suffix := "", ""
+	if strings.HasPrefix(str, "||") {
+		prefix = domainAnchorRegexp
+		str = str[2:]
+		if domainRegexp.MatchString(str) {
+			rule.Separator = strings.HasSuffix(str, "^")
+			rule.Domain = strings.ToLower(strings.TrimSuffix(str, "^"))
+		}
+	} else if strings.HasPrefix(str, "|") {
+		prefix = "^"
+		str = str[1:]
+	} else {
+		rule.OnlyHttp = true
+	}
+	if strings.HasSuffix(str, "|") {
+		suffix = "$"
+		str = str[:len(str)-1]
+		rule.Domain = ""
 	}
-	if len(r.url_rule) > 0 {
-		return util.WildcardMatch(req.URL.RequestURI(), r.url_rule)
+	for _, literal := range strings.FieldsFunc(str, func(c rune) bool {
+		return c == '*' || c == '^'
+	}) {
+		if len(literal) > len(rule.Keyword) {
+			rule.Keyword = strings.ToLower(literal)
+		}
+	}
+	rule.keywordOnly = rule.OnlyHttp && len(suffix) == 0 && rule.Keyword == strings.ToLower(strings.Trim(str, "*"))
+	regex := wildcardToRegexp(str)
+	if len(prefix) == 0 {
+		regex = strings.TrimPrefix(regex, ".*")
+	}
+	if len(suffix) == 0 {
+		regex = strings.TrimSuffix(regex, ".*")
+	}
+	if len(regex) == 0 {
+		return nil, errors.New("Rule matches all urls:" + rule.Raw)
 	}
-	return true
+	rule.Regexp = prefix + regex + suffix
+	return rule, nil
 }
 
-type urlWildcardRule struct {
-	url_rule string
+//JSCondition returns the javascript condition of the rule tested in
+//FindProxyForURL(url, host)
+func (r *Rule) JSCondition() string {
+	cond := "/" + r.Regexp + "/i.test(url)"
+	if r.OnlyHttp {
+		cond = `url.substring(0, 5) == "http:" && ` + cond
+	}
+	return cond
 }
 
-func (r *urlWildcardRule) init(rule string) (err error) {
-	if !strings.Contains(rule, "*") {
-		rule = "*" + rule
-	}
-	r.url_rule = rule
-	return
+type gfwListRule struct {
+	*Rule
+	url_reg *regexp.Regexp
 }
 
-func (r *urlWildcardRule) match(req *http.Request) bool {
-	return util.WildcardMatch(util.GetURLString(req, false), r.url_rule)
+func (r *gfwListRule) init() (err error) {
+	if len(r.Domain) == 0 {
+		r.url_reg, err = regexp.Compile("(?i)" + r.Regexp)
+	}
+	return
 }
 
-type urlRegexRule struct {
-	is_raw_regex bool
-	url_reg      *regexp.Regexp
+func isSeparator(c byte) bool {
+	return !(c == '_' || c == '-' || c == '.' || c == '%' || c >= 0x80 || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'))
 }
 
-func (r *urlRegexRule) init(rule string) (err error) {
-	if r.is_raw_regex {
-		r.url_reg, err = regexp.Compile(rule)
-	} else {
-		r.url_reg, err = util.PrepareRegexp(rule, false)
+//matchDomain finds the domain in the authority at the start or after a dot
+func (r *gfwListRule) matchDomain(authority string) bool {
+	for from := 0; ; {
+		index := strings.Index(authority[from:], r.Domain)
+		if index < 0 {
+			return false
+		}
+		index += from
+		end := index + len(r.Domain)
+		if (index == 0 || authority[index-1] == '.') && (!r.Separator || end == len(authority) || isSeparator(authority[end])) {
+			return true
+		}
+		from = index + 1
 	}
-	return
 }
 
-func (r *urlRegexRule) match(req *http.Request) bool {
-	ret := r.url_reg.MatchString(util.GetURLString(req, false))
-	//	if ret{
-	//	   log.Printf("url is %s, rule is %s\n", util.GetURLString(req, false), r.url_reg.String())
-	//	}
-	return ret
+//match tests the url, the authority is lower case
+func (r *gfwListRule) match(url, authority string) bool {
+	if r.OnlyHttp && !(len(url) >= 5 && strings.EqualFold(url[:5], "http:")) {
+		return false
+	}
+	if len(r.Domain) > 0 {
+		return r.matchDomain(authority)
+	}
+	return r.url_reg.MatchString(url)
 }
 
 type GFWList struct {
-	white_list []gfwListRule
-	black_list []gfwListRule
+	white_list *ruleSet
+	black_list *ruleSet
 }
 
-func (gfw *GFWList) IsBlockedByGFW(req *http.Request) bool {
-	for _, rule := range gfw.white_list {
-		if rule.match(req) {
-			return false
-		}
+//urlAuthority returns the lower case host and port of the url
+func urlAuthority(url string) string {
+	if index := strings.Index(url, "://"); index >= 0 {
+		url = url[index+3:]
 	}
-	for _, rule := range gfw.black_list {
-		if rule.match(req) {
-			//log.Printf("matched for :%v for %v\n", req.URL, rule)
-			return true
-		}
+	if index := strings.Index(url, "/"); index >= 0 {
+		url = url[:index]
 	}
-	return false
+	return strings.ToLower(url)
+}
+
+//IsBlockedURL tests the url against the exceptions first
+func (gfw *GFWList) IsBlockedURL(url string) bool {
+	authority := urlAuthority(url)
+	return !gfw.white_list.match(url, authority) && gfw.black_list.match(url, authority)
+}
+
+func (gfw *GFWList) IsBlockedByGFW(req *http.Request) bool {
+	return gfw.IsBlockedURL(util.GetURLString(req, false))
 }
 
 func Parse(rules string) (*GFWList, error) {
 	reader := bufio.NewReader(strings.NewReader(rules))
-	gfw := new(GFWList)
-	//i := 0
+	gfw := &GFWList{white_list: newRuleSet(), black_list: newRuleSet()}
 	for {
 		line, _, err := reader.ReadLine()
 		if nil != err {
 			break
 		}
-		str := strings.TrimSpace(string(line))
-		//comment
-		if strings.HasPrefix(str, "!") || len(str) == 0 {
+		rule, err := ParseRule(string(line))
+		if nil != err {
+			log.Printf("Failed to parse rule:%s for %v\n", string(line), err)
 			continue
 		}
-		if strings.HasPrefix(str, "@@||") {
-			rule := new(hostUrlWildcardRule)
-			err := rule.init(str[4:])
-			if nil != err {
-				log.Printf("Failed to init exclude rule:%s for %v\n", str[4:], err)
-				continue
-			}
-			gfw.white_list = append(gfw.white_list, rule)
-		} else if strings.HasPrefix(str, "||") {
-			rule := new(hostUrlWildcardRule)
-			err := rule.init(str[2:])
-			if nil != err {
-				log.Printf("Failed to init host url rule:%s for %v\n", str[2:], err)
-				continue
-			}
-			gfw.black_list = append(gfw.black_list, rule)
-		} else if strings.HasPrefix(str, "|http") {
-			rule := new(urlWildcardRule)
-			err := rule.init(str[1:])
-			if nil != err {
-				log.Printf("Failed to init url rule:%s for %v\n", str[1:], err)
-				continue
-			}
-			gfw.black_list = append(gfw.black_list, rule)
-		} else if strings.HasPrefix(str, "/") && strings.HasSuffix(str, "/") {
-			rule := new(urlRegexRule)
-			rule.is_raw_regex = true
-			err := rule.init(str[1 : len(str)-1])
-			if nil != err {
-				log.Printf("Failed to init url rule:%s for %v\n", str[1:len(str)-1], err)
-				continue
-			}
-			gfw.black_list = append(gfw.black_list, rule)
+		if nil == rule {
+			continue
+		}
+		r := &gfwListRule{Rule: rule}
+		if err = r.init(); nil != err {
+			log.Printf("Failed to init rule:%s for %v\n", rule.Raw, err)
+			continue
+		}
+		if rule.Exception {
+			gfw.white_list.add(r)
 		} else {
-			rule := new(hostUrlWildcardRule)
-			rule.only_http = true
-			err := rule.init(str)
-			if nil != err {
-				log.Printf("Failed to init host url rule:%s for %v\n", str, err)
-				continue
-			}
-			gfw.black_list = append(gfw.black_list, rule)
+			gfw.black_list.add(r)
 		}
 	}
+	gfw.white_list.keywords.build()
+	gfw.black_list.keywords.build()
 	return gfw, nil
 }
 
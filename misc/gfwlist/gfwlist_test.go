@@ -0,0 +1,243 @@
+package gfwlist
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+//conformance of the AutoProxy grammar, rule/url/expected
+var conformance = []struct {
+	rule    string
+	url     string
+	blocked bool
+}{
+	//keywords match the http urls only
+	{"example.com", "http://www.example.com/", true},
+	{"example.com", "https://www.example.com/", false},
+	{"example.com", "http://example.org/?q=example.com", true},
+	{"example.com/news", "http://www.example.com/news/1", true},
+	{"example.com/news", "http://www.example.com/", false},
+	{"*.example.com", "http://a.example.com/", true},
+	{"example*.org/a", "http://example.test.org/a", true},
+	{"Example.COM", "http://www.example.com/", true},
+
+	//domain anchor
+	{"||example.com", "http://example.com/", true},
+	{"||example.com", "https://www.example.com/", true},
+	{"||example.com", "https://www.example.com:443", true},
+	{"||example.com", "https://wwwexample.com/", false},
+	{"||example.com", "http://example.org/example.com", false},
+	{"||example.com", "http://example.com.cn/", true},
+	{"||example.com^", "http://example.com.cn/", false},
+	{"||example.com^", "http://example.com:8080/", true},
+	{"||example.com^", "https://example.com", true},
+	{"||EXAMPLE.com", "http://www.example.COM/", true},
+	{"||example.com/path", "https://www.example.com/path/1", true},
+	{"||example.com/path", "https://www.example.com/other", false},
+	{"||*.example.com", "https://a.b.example.com/", true},
+	{"||example.co", "http://www.example.com/", true},
+	{"||example.co^", "http://www.example.com/", false},
+	{"||com", "http://example.com/", true},
+
+	//start and end anchors
+	{"|http://example.com", "http://example.com/", true},
+	{"|http://example.com", "https://example.com/", false},
+	{"|http://example.com", "http://www.example.org/?http://example.com", false},
+	{"|https://example.com/", "https://example.com/", true},
+	{"example.com/a.js|", "http://example.com/a.js", true},
+	{"example.com/a.js|", "http://example.com/a.js?v=1", false},
+	{"|http://example.com/|", "http://example.com/", true},
+	{"|http://example.com/|", "http://example.com/a", false},
+
+	//separators
+	{"example.com^news", "http://example.com/news", true},
+	{"example.com^news", "http://example.com?news", true},
+	{"example.com^news", "http://example.comnews", false},
+	{"||example.com^*/video", "https://example.com:443/a/video", true},
+	{"^example.com^", "http://a-example.com/", false},
+
+	//raw regexes match any url
+	{`/^https?:\/\/[^\/]+example\.com/`, "https://www.example.com/", true},
+	{`/^https?:\/\/[^\/]+example\.com/`, "http://example.com/", false},
+
+	//options are ignored
+	{"||example.com^$third-party", "https://www.example.com/", true},
+	{"example.com$domain=a.com|~b.com,image", "http://example.com/", true},
+	{"|http://example.com/$", "http://example.com/$", true},
+
+	//exceptions of any rule
+	{"||example.com\n@@||www.example.com", "https://www.example.com/", false},
+	{"||example.com\n@@||www.example.com", "https://mail.example.com/", true},
+	{"||example.com\n@@|http://example.com/open", "http://example.com/open/1", false},
+	{"||example.com\n@@|http://example.com/open", "https://example.com/open/1", true},
+	{"||example.com\n@@/open/", "https://example.com/open", false},
+	{"||example.com\n@@open", "https://example.com/open", true},
+	{"||example.com\n@@||example.com/a|", "http://example.com/a", false},
+
+	//comments
+	{"[AutoProxy 0.2.9]\n!||example.com", "https://example.com/", false},
+}
+
+//matchRegexp tests the url by Regexp only, like the generated javascript
+func matchRegexp(rule *Rule, url string) bool {
+	if rule.OnlyHttp && !strings.HasPrefix(url, "http:") {
+		return false
+	}
+	return regexp.MustCompile("(?i)" + rule.Regexp).MatchString(url)
+}
+
+func TestConformance(t *testing.T) {
+	for _, c := range conformance {
+		gfw, _ := Parse(c.rule)
+		if blocked := gfw.IsBlockedURL(c.url); blocked != c.blocked {
+			t.Fatalf("%q %s:expected %v", c.rule, c.url, c.blocked)
+		}
+		//Regexp agrees with the matching of the domain rules
+		blocked := false
+		for _, line := range strings.Split(c.rule, "\n") {
+			rule, err := ParseRule(line)
+			if nil != err {
+				t.Fatal(err)
+			}
+			if nil != rule && matchRegexp(rule, c.url) {
+				blocked = !rule.Exception
+				if rule.Exception {
+					break
+				}
+			}
+		}
+		if blocked != c.blocked {
+			t.Fatalf("%q %s:expected %v by Regexp", c.rule, c.url, c.blocked)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	for _, v := range []string{"", "  ", "! comment", "[AutoProxy 0.2.9]"} {
+		if r, err := ParseRule(v); nil != r || nil != err {
+			t.Fatalf("%q should be ignored", v)
+		}
+	}
+	for _, v := range []string{"*", "||", "@@|", "$image"} {
+		if _, err := ParseRule(v); nil == err {
+			t.Fatalf("%q should be invalid", v)
+		}
+	}
+	r, _ := ParseRule("@@||Example.com^$third-party,~image")
+	if !r.Exception || r.Domain != "example.com" || !r.Separator || len(r.Options) != 2 || r.OnlyHttp {
+		t.Fatalf("unexpected rule:%+v", r)
+	}
+	if c := r.JSCondition(); c != `/^[\w\-]+:\/+(?:[^\/]+\.)?Example\.com(?:[^\w\-.%]|$)/i.test(url)` {
+		t.Fatalf("unexpected condition:%s", c)
+	}
+	r, _ = ParseRule("example.com")
+	if c := r.JSCondition(); c != `url.substring(0, 5) == "http:" && /example\.com/i.test(url)` {
+		t.Fatalf("unexpected condition:%s", c)
+	}
+}
+
+//syntheticList mixes the rule kinds like the gfwlist
+func syntheticList(n int) string {
+	lines := []string{"[AutoProxy 0.2.9]"}
+	for i := 0; i < n; i++ {
+		switch i % 10 {
+		case 6:
+			lines = append(lines, fmt.Sprintf("||site%d.org^", i))
+		case 7:
+			lines = append(lines, fmt.Sprintf("keyword%dx", i))
+		case 8:
+			lines = append(lines, fmt.Sprintf("|http://www.page%d.net/a*b", i))
+		case 9:
+			lines = append(lines, fmt.Sprintf("*.cdn%d.net/*.js", i), fmt.Sprintf("@@||ok.site%d.com", i-9))
+		default:
+			lines = append(lines, fmt.Sprintf("||site%d.com", i))
+		}
+	}
+	lines = append(lines, `/^https?:\/\/[^\/]+\.blog\d+\.com/`, "@@/\\/allowed\\//")
+	return strings.Join(lines, "\n")
+}
+
+func syntheticURLs() []string {
+	return []string{
+		"http://www.site0.com/", "https://site10.com:443", "https://ok.site0.com/", "http://site10.com.cn/",
+		"https://site6.org/", "https://site6.org.cn/", "http://a.b/keyword7x/c", "https://a.b/keyword7x",
+		"http://www.page8.net/a/b", "http://www.page8.net/b", "http://x.cdn19.net/a/b.js", "http://x.cdn19.net/a.css",
+		"https://a.blog1.com/", "https://a.blog.com/", "http://www.site0.com/allowed/", "http://unknown.example/",
+		"http://site999999.com/", "HTTP://WWW.SITE20.COM/", "http://KEYWORD27X.org",
+	}
+}
+
+//linearRules compiles the rules without the index
+func linearRules(content string) (white, black []*gfwListRule) {
+	for _, line := range strings.Split(content, "\n") {
+		if rule, _ := ParseRule(line); nil != rule {
+			r := &gfwListRule{Rule: rule}
+			if nil != r.init() {
+				continue
+			}
+			if rule.Exception {
+				white = append(white, r)
+			} else {
+				black = append(black, r)
+			}
+		}
+	}
+	return
+}
+
+func linearMatch(white, black []*gfwListRule, url string) bool {
+	authority := urlAuthority(url)
+	for _, r := range white {
+		if r.match(url, authority) {
+			return false
+		}
+	}
+	for _, r := range black {
+		if r.match(url, authority) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIndexedRules(t *testing.T) {
+	content := syntheticList(1000)
+	gfw, _ := Parse(content)
+	white, black := linearRules(content)
+	count := 0
+	for _, url := range syntheticURLs() {
+		blocked := gfw.IsBlockedURL(url)
+		if blocked != linearMatch(white, black, url) {
+			t.Fatalf("%s:expected %v", url, !blocked)
+		}
+		if blocked {
+			count++
+		}
+	}
+	if count != 10 {
+		t.Fatalf("unexpected blocked urls:%d", count)
+	}
+	if n := len(gfw.black_list.linear); n != 1 {
+		t.Fatalf("unexpected linear rules:%d", n)
+	}
+}
+
+func BenchmarkGFWListLinear(b *testing.B) {
+	white, black := linearRules(syntheticList(5000))
+	urls := syntheticURLs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linearMatch(white, black, urls[i%len(urls)])
+	}
+}
+
+func BenchmarkGFWList(b *testing.B) {
+	gfw, _ := Parse(syntheticList(5000))
+	urls := syntheticURLs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gfw.IsBlockedURL(urls[i%len(urls)])
+	}
+}
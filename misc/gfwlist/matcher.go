@@ -0,0 +1,210 @@
+package gfwlist
+
+import (
+	"strings"
+)
+
+//domainTrie indexes the ||domain rules by their reversed labels. A domain
+//is found in the authority at the start or after a dot, so its labels are
+//the labels of the authority except the last one which may be a prefix,
+//like ||example.co is found in example.com.
+type domainTrie struct {
+	children map[string]*domainTrie
+	//rules ending here, with or without the separator
+	any, separator bool
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{children: make(map[string]*domainTrie)}
+}
+
+func (t *domainTrie) insert(domain string, separator bool) {
+	labels := strings.Split(domain, ".")
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, exist := node.children[labels[i]]
+		if !exist {
+			child = newDomainTrie()
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if separator {
+		node.separator = true
+	} else {
+		node.any = true
+	}
+}
+
+//lookup tests every label of the authority as the end of the domains
+func (t *domainTrie) lookup(authority string) bool {
+	if len(t.children) == 0 {
+		return false
+	}
+	starts := []int{0}
+	for i := 0; i < len(authority); i++ {
+		if authority[i] == '.' {
+			starts = append(starts, i+1)
+		}
+	}
+	for j := len(starts) - 1; j >= 0; j-- {
+		labelEnd := len(authority)
+		if j+1 < len(starts) {
+			labelEnd = starts[j+1] - 1
+		}
+		for end := starts[j]; end <= labelEnd; end++ {
+			node, exist := t.children[authority[starts[j]:end]]
+			if !exist {
+				continue
+			}
+			matchSeparator := end == len(authority) || isSeparator(authority[end])
+			for i := j; ; {
+				if node.any || (node.separator && matchSeparator) {
+					return true
+				}
+				if i == 0 {
+					break
+				}
+				i--
+				if node = node.children[authority[starts[i]:starts[i+1]-1]]; nil == node {
+					break
+				}
+			}
+		}
+	}
+	return false
+}
+
+type acState struct {
+	next map[byte]int32
+	fail int32
+	//the nearest state by the failure links having outputs
+	dict   int32
+	output []int32
+}
+
+//acMatcher is an Aho-Corasick automaton of the rule keywords
+type acMatcher struct {
+	states []acState
+}
+
+func newACMatcher() *acMatcher {
+	return &acMatcher{states: []acState{{next: make(map[byte]int32), dict: -1}}}
+}
+
+func (m *acMatcher) insert(keyword string, rule int32) {
+	state := int32(0)
+	for i := 0; i < len(keyword); i++ {
+		next, exist := m.states[state].next[keyword[i]]
+		if !exist {
+			next = int32(len(m.states))
+			m.states = append(m.states, acState{next: make(map[byte]int32), dict: -1})
+			m.states[state].next[keyword[i]] = next
+		}
+		state = next
+	}
+	m.states[state].output = append(m.states[state].output, rule)
+}
+
+//build links the failure transitions by breadth first search
+func (m *acMatcher) build() {
+	queue := []int32{}
+	for _, next := range m.states[0].next {
+		queue = append(queue, next)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, next := range m.states[state].next {
+			fail := m.states[state].fail
+			for {
+				if target, exist := m.states[fail].next[c]; exist {
+					m.states[next].fail = target
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = m.states[fail].fail
+			}
+			if f := m.states[next].fail; len(m.states[f].output) > 0 {
+				m.states[next].dict = f
+			} else {
+				m.states[next].dict = m.states[f].dict
+			}
+			queue = append(queue, next)
+		}
+	}
+}
+
+//scan calls found with the rules of the keywords in text until it is true
+func (m *acMatcher) scan(text string, found func(rule int32) bool) bool {
+	state := int32(0)
+	for i := 0; i < len(text); i++ {
+		for {
+			if next, exist := m.states[state].next[text[i]]; exist {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = m.states[state].fail
+		}
+		for s := state; s > 0; s = m.states[s].dict {
+			for _, rule := range m.states[s].output {
+				if found(rule) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+//ruleSet matches the domain rules by the trie, the rules having a keyword
+//are verified after the keyword is found, only the rest are linear
+type ruleSet struct {
+	domains  *domainTrie
+	keywords *acMatcher
+	indexed  []*gfwListRule
+	linear   []*gfwListRule
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{domains: newDomainTrie(), keywords: newACMatcher()}
+}
+
+func (s *ruleSet) add(r *gfwListRule) {
+	switch {
+	case len(r.Domain) > 0:
+		s.domains.insert(r.Domain, r.Separator)
+	case len(r.Keyword) > 0:
+		s.keywords.insert(r.Keyword, int32(len(s.indexed)))
+		s.indexed = append(s.indexed, r)
+	default:
+		s.linear = append(s.linear, r)
+	}
+}
+
+func (s *ruleSet) match(url, authority string) bool {
+	isHttp := len(url) >= 5 && strings.EqualFold(url[:5], "http:")
+	if s.domains.lookup(authority) {
+		return true
+	}
+	if len(s.indexed) > 0 && s.keywords.scan(strings.ToLower(url), func(i int32) bool {
+		r := s.indexed[i]
+		if r.keywordOnly {
+			return isHttp
+		}
+		return r.match(url, authority)
+	}) {
+		return true
+	}
+	for _, r := range s.linear {
+		if r.match(url, authority) {
+			return true
+		}
+	}
+	return false
+}
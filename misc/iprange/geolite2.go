@@ -0,0 +1,304 @@
+package iprange
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+//The MaxMind DB format of GeoLite2 is a binary search tree of the address
+//bits followed by the data section, the metadata is at the end after the
+//marker. See http://maxmind.github.io/MaxMind-DB/
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+type mmdbDecoder struct {
+	buffer []byte
+}
+
+//decodeControl returns the type and the size of the field at offset, the
+//offset of the payload is returned
+func (d *mmdbDecoder) decodeControl(offset uint) (uint, uint, uint, error) {
+	if offset >= uint(len(d.buffer)) {
+		return 0, 0, 0, errors.New("Unexpected end of MaxMind DB")
+	}
+	ctrl := d.buffer[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == 0 {
+		if offset >= uint(len(d.buffer)) {
+			return 0, 0, 0, errors.New("Unexpected end of MaxMind DB")
+		}
+		typ = 7 + uint(d.buffer[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if typ == 1 {
+		//the size bits of a pointer are a part of it
+		return typ, size, offset, nil
+	}
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.buffer)) {
+			return 0, 0, 0, errors.New("Unexpected end of MaxMind DB")
+		}
+		v := uint(0)
+		for _, b := range d.buffer[offset : offset+n] {
+			v = v<<8 | uint(b)
+		}
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + v
+		case 30:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+	return typ, size, offset, nil
+}
+
+func (d *mmdbDecoder) uint(offset, size uint) uint64 {
+	v := uint64(0)
+	for _, b := range d.buffer[offset : offset+size] {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+//decode returns the value at offset and the offset of the next field
+func (d *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("Too deep data in MaxMind DB")
+	}
+	typ, size, offset, err := d.decodeControl(offset)
+	if nil != err {
+		return nil, 0, err
+	}
+	if typ == 1 {
+		n := (size>>3)&0x3 + 1
+		if offset+n > uint(len(d.buffer)) {
+			return nil, 0, errors.New("Unexpected end of MaxMind DB")
+		}
+		pointer := uint(d.uint(offset, n))
+		switch n {
+		case 1:
+			pointer |= (size & 0x7) << 8
+		case 2:
+			pointer = pointer | (size&0x7)<<16 + 2048
+		case 3:
+			pointer = pointer | (size&0x7)<<24 + 526336
+		}
+		v, _, err := d.decode(pointer, depth+1)
+		return v, offset + n, err
+	}
+	switch typ {
+	case 7:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			if key, offset, err = d.decode(offset, depth+1); nil != err {
+				return nil, 0, err
+			}
+			if value, offset, err = d.decode(offset, depth+1); nil != err {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("Invalid map key in MaxMind DB")
+			}
+			m[k] = value
+		}
+		return m, offset, nil
+	case 11:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			if value, offset, err = d.decode(offset, depth+1); nil != err {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(d.buffer)) {
+		return nil, 0, errors.New("Unexpected end of MaxMind DB")
+	}
+	payload := d.buffer[offset : offset+size]
+	switch typ {
+	case 2:
+		return string(payload), offset + size, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, errors.New("Invalid double in MaxMind DB")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), offset + size, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, errors.New("Invalid float in MaxMind DB")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(payload)), offset + size, nil
+	case 5, 6, 9:
+		if size > 8 {
+			return nil, 0, errors.New("Invalid unsigned integer in MaxMind DB")
+		}
+		return d.uint(offset, size), offset + size, nil
+	case 8:
+		return int32(d.uint(offset, size)), offset + size, nil
+	case 4, 10:
+		return payload, offset + size, nil
+	}
+	return nil, 0, errors.New("Unsupported data type in MaxMind DB")
+}
+
+func metadataUint(metadata map[string]interface{}, key string) uint {
+	v, _ := metadata[key].(uint64)
+	return uint(v)
+}
+
+//mmdbCountry returns the iso code of the country, or the registered
+//country if the country is absent
+func mmdbCountry(record interface{}) string {
+	m, _ := record.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := m[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+type mmdbReader struct {
+	tree       []byte
+	nodeCount  uint
+	recordSize uint
+	data       *mmdbDecoder
+	countries  map[uint]string
+	holder     *IPRangeHolder
+}
+
+func (r *mmdbReader) record(node, index uint) uint {
+	b := r.tree[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[index*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if index == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	b = b[index*4:]
+	return uint(binary.BigEndian.Uint32(b))
+}
+
+//walk adds the networks under node, bits is the prefix length of node
+func (r *mmdbReader) walk(node uint, ip []byte, bits int) error {
+	//::ffff:0:0/96 and 2002::/16 are aliases of the IPv4 subtree ::/96
+	if len(ip) == 16 && ((bits == 96 && bytes.Equal(ip[:12], v4InV6Prefix)) || (bits == 16 && ip[0] == 0x20 && ip[1] == 0x02)) {
+		return nil
+	}
+	for index := uint(0); index < 2; index++ {
+		child := make([]byte, len(ip))
+		copy(child, ip)
+		if index == 1 {
+			child[bits/8] |= 0x80 >> uint(bits%8)
+		}
+		value := r.record(node, index)
+		switch {
+		case value < r.nodeCount:
+			if bits+1 >= len(ip)*8 {
+				return errors.New("Invalid search tree in MaxMind DB")
+			}
+			if err := r.walk(value, child, bits+1); nil != err {
+				return err
+			}
+		case value > r.nodeCount:
+			offset := value - r.nodeCount - 16
+			country, exist := r.countries[offset]
+			if !exist {
+				v, _, err := r.data.decode(offset, 0)
+				if nil != err {
+					return err
+				}
+				country = mmdbCountry(v)
+				r.countries[offset] = country
+			}
+			if len(country) > 0 {
+				r.addNetwork(child, bits+1, country)
+			}
+		}
+	}
+	return nil
+}
+
+var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
+func (r *mmdbReader) addNetwork(ip []byte, bits int, country string) {
+	end := make([]byte, len(ip))
+	copy(end, ip)
+	for i := bits; i < len(ip)*8; i++ {
+		end[i/8] |= 0x80 >> uint(i%8)
+	}
+	start := net.IP(ip)
+	//the IPv4 addresses are stored as ::a.b.c.d in an IPv6 tree
+	if len(ip) == 16 && bits >= 96 && bytes.Equal(ip[:12], make([]byte, 12)) {
+		start, end = net.IP(ip[12:]), end[12:]
+	}
+	r.holder.add(start, net.IP(end), country)
+}
+
+//ParseGeoLite2 loads the countries of a MaxMind DB like
+//GeoLite2-Country.mmdb, both IPv4 and IPv6 databases are supported
+func ParseGeoLite2(name string) (*IPRangeHolder, error) {
+	content, err := ioutil.ReadFile(name)
+	if nil != err {
+		return nil, err
+	}
+	index := bytes.LastIndex(content, mmdbMetadataMarker)
+	if index < 0 {
+		return nil, errors.New("Invalid MaxMind DB without metadata")
+	}
+	meta := &mmdbDecoder{content[index+len(mmdbMetadataMarker):]}
+	v, _, err := meta.decode(0, 0)
+	if nil != err {
+		return nil, err
+	}
+	metadata, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Invalid MaxMind DB metadata")
+	}
+	r := &mmdbReader{
+		nodeCount:  metadataUint(metadata, "node_count"),
+		recordSize: metadataUint(metadata, "record_size"),
+		countries:  make(map[uint]string),
+		holder:     new(IPRangeHolder),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, errors.New("Unsupported record size of MaxMind DB")
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if r.nodeCount == 0 || treeSize+16 > uint(index) {
+		return nil, errors.New("Invalid search tree in MaxMind DB")
+	}
+	r.tree = content[:treeSize]
+	r.data = &mmdbDecoder{content[treeSize+16 : index]}
+	ip := make([]byte, 16)
+	if metadataUint(metadata, "ip_version") == 4 {
+		ip = make([]byte, 4)
+	}
+	if err = r.walk(0, ip, 0); nil != err {
+		return nil, err
+	}
+	r.holder.sort()
+	return r.holder, nil
+}
@@ -6,16 +6,18 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"math/big"
+	"net"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
-
-	"github.com/zyxar/gsnova/util"
 )
 
+//IPRange is a range of addresses in the 16 bytes form, the IPv4 ranges are
+//IPv4-mapped so both families are kept in one sorted table
 type IPRange struct {
-	Start, End uint64
+	Start, End [16]byte
 	Country    string
 }
 
@@ -23,6 +25,41 @@ type IPRangeHolder struct {
 	ranges []*IPRange
 }
 
+func ipKey(ip net.IP) ([16]byte, bool) {
+	var key [16]byte
+	ip16 := ip.To16()
+	if nil == ip16 {
+		return key, false
+	}
+	copy(key[:], ip16)
+	return key, true
+}
+
+func (h *IPRangeHolder) add(start, end net.IP, country string) {
+	r := &IPRange{Country: strings.ToUpper(country)}
+	var ok1, ok2 bool
+	r.Start, ok1 = ipKey(start)
+	r.End, ok2 = ipKey(end)
+	if ok1 && ok2 && bytes.Compare(r.Start[:], r.End[:]) <= 0 {
+		h.ranges = append(h.ranges, r)
+	}
+}
+
+//addCount adds the range of count addresses from start
+func (h *IPRangeHolder) addCount(start net.IP, count *big.Int, country string) {
+	if ip4 := start.To4(); nil != ip4 {
+		start = ip4
+	}
+	v := new(big.Int).SetBytes(start)
+	v.Add(v, count).Sub(v, big.NewInt(1))
+	end := v.Bytes()
+	if len(end) > len(start) {
+		return
+	}
+	end = append(make([]byte, len(start)-len(end)), end...)
+	h.add(start, net.IP(end), country)
+}
+
 func (h *IPRangeHolder) Len() int {
 	return len(h.ranges)
 }
@@ -30,10 +67,10 @@ func (h *IPRangeHolder) Len() int {
 // Less returns whether the element with index i should sort
 // before the element with index j.
 func (h *IPRangeHolder) Less(i, j int) bool {
-	if h.ranges[i].Start != h.ranges[j].Start {
-		return h.ranges[i].Start < h.ranges[j].Start
+	if c := bytes.Compare(h.ranges[i].Start[:], h.ranges[j].Start[:]); c != 0 {
+		return c < 0
 	}
-	return h.ranges[i].End < h.ranges[j].End
+	return bytes.Compare(h.ranges[i].End[:], h.ranges[j].End[:]) < 0
 }
 
 // Swap swaps the elements with indexes i and j.
@@ -43,33 +80,66 @@ func (h *IPRangeHolder) Swap(i, j int) {
 	h.ranges[j] = tmp
 }
 
-func (h *IPRangeHolder) sort() {
-	sort.Sort(h)
+func uint32ToIP(v uint32) net.IP {
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
 }
 
-func (h *IPRangeHolder) FindCountry(ip string) (string, error) {
-	v, err := util.IPv42Int(ip)
-	if nil != err {
-		log.Printf("Failed to convert ip to int for reason:%v\n", err)
-		return "", err
+func nextKey(key [16]byte) [16]byte {
+	for i := 15; i >= 0; i-- {
+		key[i]++
+		if key[i] != 0 {
+			break
+		}
 	}
+	return key
+}
 
-	compare := func(i int) bool {
-		return h.ranges[i].Start > uint64(v) || h.ranges[i].Start <= uint64(v) && h.ranges[i].End >= uint64(v)
+//sort sorts the ranges and merges the adjacent ranges of the same country
+func (h *IPRangeHolder) sort() {
+	sort.Sort(h)
+	merged := h.ranges[:0]
+	for _, r := range h.ranges {
+		if n := len(merged); n > 0 {
+			last := merged[n-1]
+			next := nextKey(last.End)
+			if last.Country == r.Country && bytes.Compare(next[:], r.Start[:]) >= 0 && next != [16]byte{} {
+				if bytes.Compare(r.End[:], last.End[:]) > 0 {
+					last.End = r.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
 	}
-	index := sort.Search(len(h.ranges), compare)
-	if index == len(h.ranges) {
-		return "", nil
+	h.ranges = merged
+}
+
+//Country returns the country code of the ip, empty if it is unknown
+func (h *IPRangeHolder) Country(ip net.IP) string {
+	key, ok := ipKey(ip)
+	if !ok {
+		return ""
 	}
-	if index > 0 {
-		if h.ranges[index].Start > uint64(v) || h.ranges[index].End < uint64(v) {
-			return "", nil
-		}
-		return h.ranges[index].Country, nil
+	index := sort.Search(len(h.ranges), func(i int) bool {
+		return bytes.Compare(h.ranges[i].Start[:], key[:]) > 0
+	}) - 1
+	if index >= 0 && bytes.Compare(h.ranges[index].End[:], key[:]) >= 0 {
+		return h.ranges[index].Country
 	}
-	return "", fmt.Errorf("No record found.")
+	return ""
 }
 
+func (h *IPRangeHolder) FindCountry(ip string) (string, error) {
+	addr := net.ParseIP(ip)
+	if nil == addr {
+		return "", fmt.Errorf("Invalid IP:%s", ip)
+	}
+	return h.Country(addr), nil
+}
+
+//ParseApnic parses the delegated stats of the RIRs like
+//apnic|JP|ipv4|1.0.16.0|4096|20110412|allocated
+//apnic|JP|ipv6|2001:200::|35|19990813|allocated
 func ParseApnic(name string) (*IPRangeHolder, error) {
 	var file *os.File
 	var err error
@@ -92,12 +162,21 @@ func ParseApnic(name string) (*IPRangeHolder, error) {
 			line := buffer.String()
 			buffer.Reset()
 			sp := strings.Split(line, "|")
-			if len(sp) >= 6 {
-				if sp[1] == "CN" && sp[2] == "ipv4" {
-					startip, _ := util.IPv42Int(sp[3])
-					ipcount, _ := strconv.ParseUint(sp[4], 10, 32)
-					tmp := &IPRange{uint64(startip), uint64(startip) + uint64(ipcount-1), sp[1]}
-					holder.ranges = append(holder.ranges, tmp)
+			if len(sp) < 6 || len(sp[1]) != 2 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			start := net.ParseIP(sp[3])
+			if nil == start {
+				continue
+			}
+			switch sp[2] {
+			case "ipv4":
+				if ipcount, err := strconv.ParseUint(sp[4], 10, 32); nil == err && ipcount > 0 {
+					holder.addCount(start, new(big.Int).SetUint64(ipcount), sp[1])
+				}
+			case "ipv6":
+				if bits, err := strconv.Atoi(sp[4]); nil == err && bits >= 0 && bits <= 128 {
+					holder.addCount(start, new(big.Int).Lsh(big.NewInt(1), uint(128-bits)), sp[1])
 				}
 			}
 		}
@@ -145,18 +224,17 @@ func ParseWipmania(name string) (*IPRangeHolder, error) {
 				buffer.Reset()
 				sp := strings.Split(line, ",")
 				if len(sp) >= 5 {
-					start, _ := strconv.ParseUint(strings.Trim(sp[2], "\""), 10, 32)
-					end, _ := strconv.ParseUint(strings.Trim(sp[3], "\""), 10, 32)
+					start, err1 := strconv.ParseUint(strings.Trim(sp[2], "\""), 10, 32)
+					end, err2 := strconv.ParseUint(strings.Trim(sp[3], "\""), 10, 32)
 					country := strings.Trim(sp[4], "\"")
-					if strings.EqualFold(country, "CN") {
-						tmp := &IPRange{start, end, country}
-						holder.ranges = append(holder.ranges, tmp)
+					if nil == err1 && nil == err2 && len(country) == 2 {
+						holder.add(uint32ToIP(uint32(start)), uint32ToIP(uint32(end)), country)
 					}
 				}
 			}
 		}
 		rc.Close()
-		holder.sort()
 	}
+	holder.sort()
 	return holder, nil
 }
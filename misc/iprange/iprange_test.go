@@ -0,0 +1,206 @@
+package iprange
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseApnic(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "iprange")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "delegated-apnic-latest")
+	ioutil.WriteFile(name, []byte(`2|apnic|20140101|40000|19830613|20131231|+1000
+#comment
+apnic|*|ipv4|*|30000|summary
+apnic|CN|ipv4|1.0.1.0|256|20110414|allocated
+apnic|CN|ipv4|1.0.2.0|512|20110414|allocated
+apnic|JP|ipv4|1.0.16.0|4096|20110412|allocated
+apnic|JP|ipv6|2001:200::|35|19990813|allocated
+apnic|CN|ipv6|240e::|20|20130821|allocated
+apnic|CN|asn|4134|1|20000101|allocated
+`), 0644)
+	holder, err := ParseApnic(name)
+	if nil != err {
+		t.Fatal(err)
+	}
+	//the adjacent CN ranges are merged
+	if holder.Len() != 4 {
+		t.Fatalf("unexpected ranges:%d", holder.Len())
+	}
+	for ip, expected := range map[string]string{
+		"1.0.1.0":             "CN",
+		"1.0.2.255":           "CN",
+		"1.0.3.255":           "CN",
+		"1.0.4.0":             "",
+		"1.0.31.255":          "JP",
+		"1.0.32.0":            "",
+		"0.0.0.1":             "",
+		"2001:200:1fff::1":    "JP",
+		"2001:200:2000::":     "",
+		"240e:fff:ffff::":     "CN",
+		"::ffff:1.0.16.1":     "JP",
+		"ffff:ffff::":         "",
+		"2001:200::ffff:ffff": "JP",
+	} {
+		if country, err := holder.FindCountry(ip); nil != err || country != expected {
+			t.Fatalf("%s:expected %s, got %s %v", ip, expected, country, err)
+		}
+	}
+	if _, err := holder.FindCountry("not an ip"); nil == err {
+		t.Fatal("invalid ip should fail")
+	}
+}
+
+//mmdbNode builds the search tree of a test database, a record is a child
+//node or a data offset
+type mmdbNode struct {
+	children [2]*mmdbNode
+	data     [2]int
+}
+
+func newMMDBNode() *mmdbNode {
+	return &mmdbNode{data: [2]int{-1, -1}}
+}
+
+func (n *mmdbNode) insert(ip net.IP, bits int, data int) {
+	node := n
+	for i := 0; i < bits; i++ {
+		bit := (ip[i/8] >> uint(7-i%8)) & 1
+		if i == bits-1 {
+			node.data[bit] = data
+			return
+		}
+		if nil == node.children[bit] {
+			node.children[bit] = newMMDBNode()
+		}
+		node = node.children[bit]
+	}
+}
+
+//path returns the node of the prefix, the nodes are created on the way
+func (n *mmdbNode) path(ip net.IP, bits int) *mmdbNode {
+	node := n
+	for i := 0; i < bits; i++ {
+		bit := (ip[i/8] >> uint(7-i%8)) & 1
+		if nil == node.children[bit] {
+			node.children[bit] = newMMDBNode()
+		}
+		node = node.children[bit]
+	}
+	return node
+}
+
+func mmdbControl(typ, size int) []byte {
+	if typ > 7 {
+		return []byte{byte(size), byte(typ - 7)}
+	}
+	return []byte{byte(typ<<5 | size)}
+}
+
+func mmdbString(s string) []byte {
+	return append(mmdbControl(2, len(s)), s...)
+}
+
+func mmdbUint(typ int, v uint) []byte {
+	return append(mmdbControl(typ, 2), byte(v>>8), byte(v))
+}
+
+func mmdbMap(pairs ...[]byte) []byte {
+	b := mmdbControl(7, len(pairs)/2)
+	for _, p := range pairs {
+		b = append(b, p...)
+	}
+	return b
+}
+
+//buildMMDB writes an IPv6 database of record size 24, the IPv4 subtree is
+//aliased by ::ffff:0:0/96
+func buildMMDB() []byte {
+	var data []byte
+	jp := len(data)
+	data = append(data, mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString("JP")))...)
+	//the registered country only, the key is a pointer to "iso_code" above
+	iso := jp + len(mmdbControl(7, 1)) + len(mmdbString("country")) + len(mmdbControl(7, 1))
+	cn := len(data)
+	data = append(data, mmdbMap(mmdbString("registered_country"), mmdbMap([]byte{0x20 | byte(iso>>8), byte(iso)}, mmdbString("CN")))...)
+
+	root := newMMDBNode()
+	root.insert(net.ParseIP("::1.0.0.0"), 104, jp)
+	root.insert(net.ParseIP("2001:200::"), 32, cn)
+	ipv4 := root.path(net.ParseIP("::"), 96)
+	root.path(net.ParseIP("::ffff:0:0"), 95).children[1] = ipv4
+
+	ids := map[*mmdbNode]int{}
+	nodes := []*mmdbNode{}
+	var number func(n *mmdbNode)
+	number = func(n *mmdbNode) {
+		if _, exist := ids[n]; exist || nil == n {
+			return
+		}
+		ids[n] = len(nodes)
+		nodes = append(nodes, n)
+		number(n.children[0])
+		number(n.children[1])
+	}
+	number(root)
+	var tree []byte
+	for _, n := range nodes {
+		for i := 0; i < 2; i++ {
+			v := len(nodes)
+			if nil != n.children[i] {
+				v = ids[n.children[i]]
+			} else if n.data[i] >= 0 {
+				v = len(nodes) + 16 + n.data[i]
+			}
+			tree = append(tree, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	var buffer bytes.Buffer
+	buffer.Write(tree)
+	buffer.Write(make([]byte, 16))
+	buffer.Write(data)
+	buffer.Write(mmdbMetadataMarker)
+	buffer.Write(mmdbMap(
+		mmdbString("node_count"), mmdbUint(6, uint(len(nodes))),
+		mmdbString("record_size"), mmdbUint(5, 24),
+		mmdbString("ip_version"), mmdbUint(5, 6),
+		mmdbString("database_type"), mmdbString("GeoLite2-Country"),
+	))
+	return buffer.Bytes()
+}
+
+func TestParseGeoLite2(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "iprange")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "GeoLite2-Country.mmdb")
+	ioutil.WriteFile(name, buildMMDB(), 0644)
+	holder, err := ParseGeoLite2(name)
+	if nil != err {
+		t.Fatal(err)
+	}
+	//the aliased IPv4 subtree is not loaded twice
+	if holder.Len() != 2 {
+		t.Fatalf("unexpected ranges:%d", holder.Len())
+	}
+	for ip, expected := range map[string]string{
+		"1.2.3.4":         "JP",
+		"1.255.255.255":   "JP",
+		"2.0.0.0":         "",
+		"::ffff:1.2.3.4":  "JP",
+		"2001:200:ffff::": "CN",
+		"2001:300::1":     "",
+	} {
+		if country := holder.Country(net.ParseIP(ip)); country != expected {
+			t.Fatalf("%s:expected %s, got %s", ip, expected, country)
+		}
+	}
+
+	ioutil.WriteFile(name, []byte("not a database"), 0644)
+	if _, err := ParseGeoLite2(name); nil == err {
+		t.Fatal("invalid database should fail")
+	}
+}
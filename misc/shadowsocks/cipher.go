@@ -0,0 +1,92 @@
+/*
+Package shadowsocks implements the client side of the shadowsocks AEAD
+protocol, see https://shadowsocks.org/doc/aead.html
+
+Example:
+
+	cipher, _ := shadowsocks.NewCipher("aes-256-gcm", "password")
+	conn, err := shadowsocks.Dial("tcp", "server:8388", "www.google.com:443", cipher)
+*/
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+var ErrUnsupportedMethod = errors.New("unsupported shadowsocks cipher method")
+
+type Cipher struct {
+	Method  string
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if nil != err {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//NewCipher creates the cipher of the method, the master key is derived from
+//the password the same way as OpenSSL's EVP_BytesToKey.
+func NewCipher(method, password string) (*Cipher, error) {
+	c := &Cipher{Method: strings.ToLower(method)}
+	keySize := 0
+	switch c.Method {
+	case "aes-128-gcm", "aead_aes_128_gcm":
+		keySize = 16
+		c.newAEAD = newAESGCM
+	case "aes-256-gcm", "aead_aes_256_gcm":
+		keySize = 32
+		c.newAEAD = newAESGCM
+	case "chacha20-ietf-poly1305", "aead_chacha20_poly1305":
+		keySize = chacha20poly1305.KeySize
+		c.newAEAD = chacha20poly1305.New
+	default:
+		return nil, ErrUnsupportedMethod
+	}
+	c.key = kdf(password, keySize)
+	return c, nil
+}
+
+func kdf(password string, keySize int) []byte {
+	var b, prev []byte
+	h := md5.New()
+	for len(b) < keySize {
+		h.Write(prev)
+		h.Write([]byte(password))
+		b = h.Sum(b)
+		prev = b[len(b)-h.Size():]
+		h.Reset()
+	}
+	return b[:keySize]
+}
+
+//SaltSize is the length of the salt sent at the start of each direction.
+func (c *Cipher) SaltSize() int {
+	if len(c.key) < 16 {
+		return 16
+	}
+	return len(c.key)
+}
+
+//aead creates the per session cipher with the subkey derived from the salt.
+func (c *Cipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	r := hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey"))
+	if _, err := io.ReadFull(r, subkey); nil != err {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
@@ -0,0 +1,257 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//payload size limit of a chunk defined by the protocol
+const maxPayloadSize = 0x3FFF
+
+//ErrChunkSize is returned for a chunk longer than the protocol allows, the
+//higher two bits of the length are reserved as zero
+var ErrChunkSize = errors.New("shadowsocks: invalid chunk size")
+
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+//Conn encrypts everything written into chunks of [encrypted length][length
+//tag][encrypted payload][payload tag] after a random salt, and decrypts the
+//stream of the peer the same way.
+type Conn struct {
+	net.Conn
+	cipher *Cipher
+
+	write_mutex sync.Mutex
+	writer      cipher.AEAD
+	write_nonce []byte
+	write_buf   []byte
+
+	reader     cipher.AEAD
+	read_nonce []byte
+	read_buf   []byte
+	leftover   []byte
+}
+
+func NewConn(c net.Conn, cipher *Cipher) *Conn {
+	return &Conn{Conn: c, cipher: cipher}
+}
+
+func (c *Conn) initWriter() ([]byte, error) {
+	salt := make([]byte, c.cipher.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); nil != err {
+		return nil, err
+	}
+	aead, err := c.cipher.aead(salt)
+	if nil != err {
+		return nil, err
+	}
+	c.writer = aead
+	c.write_nonce = make([]byte, aead.NonceSize())
+	c.write_buf = make([]byte, len(salt)+2+aead.Overhead()+maxPayloadSize+aead.Overhead())
+	return salt, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.write_mutex.Lock()
+	defer c.write_mutex.Unlock()
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var salt []byte
+	if nil == c.writer {
+		var err error
+		if salt, err = c.initWriter(); nil != err {
+			return 0, err
+		}
+	}
+	n := 0
+	for len(b) > 0 {
+		size := len(b)
+		if size > maxPayloadSize {
+			size = maxPayloadSize
+		}
+		buf := c.write_buf[:0]
+		buf = append(buf, salt...)
+		buf = c.writer.Seal(buf, c.write_nonce, []byte{byte(size >> 8), byte(size)}, nil)
+		increment(c.write_nonce)
+		buf = c.writer.Seal(buf, c.write_nonce, b[:size], nil)
+		increment(c.write_nonce)
+		if _, err := c.Conn.Write(buf); nil != err {
+			return n, err
+		}
+		salt = nil
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+func (c *Conn) initReader() error {
+	salt := make([]byte, c.cipher.SaltSize())
+	if _, err := io.ReadFull(c.Conn, salt); nil != err {
+		return err
+	}
+	aead, err := c.cipher.aead(salt)
+	if nil != err {
+		return err
+	}
+	c.reader = aead
+	c.read_nonce = make([]byte, aead.NonceSize())
+	c.read_buf = make([]byte, maxPayloadSize+aead.Overhead())
+	return nil
+}
+
+//readChunk decrypts the next chunk into read_buf
+func (c *Conn) readChunk() ([]byte, error) {
+	overhead := c.reader.Overhead()
+	buf := c.read_buf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); nil != err {
+		return nil, err
+	}
+	if _, err := c.reader.Open(buf[:0], c.read_nonce, buf, nil); nil != err {
+		return nil, err
+	}
+	increment(c.read_nonce)
+	size := int(buf[0])<<8 | int(buf[1])
+	if size > maxPayloadSize {
+		return nil, ErrChunkSize
+	}
+	buf = c.read_buf[:size+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); nil != err {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	payload, err := c.reader.Open(buf[:0], c.read_nonce, buf, nil)
+	if nil != err {
+		return nil, err
+	}
+	increment(c.read_nonce)
+	return payload, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if nil == c.reader {
+		if err := c.initReader(); nil != err {
+			return 0, err
+		}
+	}
+	for len(c.leftover) == 0 {
+		payload, err := c.readChunk()
+		if nil != err {
+			return 0, err
+		}
+		c.leftover = payload
+	}
+	n := copy(b, c.leftover)
+	c.leftover = c.leftover[n:]
+	return n, nil
+}
+
+const (
+	addrTypeIPv4   = 1
+	addrTypeDomain = 3
+	addrTypeIPv6   = 4
+)
+
+//MarshalAddr encodes host:port as the socks5 style target address.
+func MarshalAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if nil != err {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if nil != err {
+		return nil, err
+	}
+	var b []byte
+	if ip := net.ParseIP(host); nil != ip {
+		if ip4 := ip.To4(); nil != ip4 {
+			b = append([]byte{addrTypeIPv4}, ip4...)
+		} else {
+			b = append([]byte{addrTypeIPv6}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("too long host name")
+		}
+		b = append([]byte{addrTypeDomain, byte(len(host))}, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+//ReadAddr decodes the socks5 style target address.
+func ReadAddr(r io.Reader) (string, error) {
+	b := make([]byte, 256)
+	if _, err := io.ReadFull(r, b[:1]); nil != err {
+		return "", err
+	}
+	var host string
+	switch b[0] {
+	case addrTypeIPv4:
+		if _, err := io.ReadFull(r, b[:4]); nil != err {
+			return "", err
+		}
+		host = net.IP(b[:4]).String()
+	case addrTypeIPv6:
+		if _, err := io.ReadFull(r, b[:16]); nil != err {
+			return "", err
+		}
+		host = net.IP(b[:16]).String()
+	case addrTypeDomain:
+		if _, err := io.ReadFull(r, b[:1]); nil != err {
+			return "", err
+		}
+		n := int(b[0])
+		if _, err := io.ReadFull(r, b[:n]); nil != err {
+			return "", err
+		}
+		host = string(b[:n])
+	default:
+		return "", errors.New("invalid address type")
+	}
+	if _, err := io.ReadFull(r, b[:2]); nil != err {
+		return "", err
+	}
+	port := int(b[0])<<8 | int(b[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+//Dial connects the target through the shadowsocks server.
+func Dial(network, server, target string, cipher *Cipher) (net.Conn, error) {
+	c, err := net.DialTimeout(network, server, 10*time.Second)
+	if nil != err {
+		return nil, err
+	}
+	return Client(c, target, cipher)
+}
+
+//Client requests the target over c which is connected to the shadowsocks
+//server, c is closed on failure.
+func Client(c net.Conn, target string, cipher *Cipher) (net.Conn, error) {
+	addr, err := MarshalAddr(target)
+	if nil != err {
+		c.Close()
+		return nil, err
+	}
+	conn := NewConn(c, cipher)
+	if _, err = conn.Write(addr); nil != err {
+		c.Close()
+		return nil, err
+	}
+	return conn, nil
+}
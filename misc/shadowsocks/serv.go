@@ -0,0 +1,36 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+)
+
+//ServConn relays the target requested by the client of c, c is closed after
+//either side is done
+func ServConn(c net.Conn, cipher *Cipher) error {
+	conn := NewConn(c, cipher)
+	defer conn.Close()
+	target, err := ReadAddr(conn)
+	if nil != err {
+		return err
+	}
+	remote, err := net.Dial("tcp", target)
+	if nil != err {
+		return err
+	}
+	defer remote.Close()
+	go io.Copy(remote, conn)
+	_, err = io.Copy(conn, remote)
+	return err
+}
+
+//Serve runs ServConn for every connection accepted by l until l is closed
+func Serve(l net.Listener, cipher *Cipher) error {
+	for {
+		c, err := l.Accept()
+		if nil != err {
+			return err
+		}
+		go ServConn(c, cipher)
+	}
+}
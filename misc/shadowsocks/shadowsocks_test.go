@@ -0,0 +1,162 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+//startServer runs a shadowsocks server relaying to the requested targets
+func startServer(t *testing.T, cipher *Cipher) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	go Serve(l, cipher)
+	return l
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestRelay(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	for _, method := range []string{"aes-128-gcm", "aes-256-gcm", "chacha20-ietf-poly1305"} {
+		cipher, err := NewCipher(method, "test-password")
+		if nil != err {
+			t.Fatal(err)
+		}
+		server := startServer(t, cipher)
+		conn, err := Dial("tcp", server.Addr().String(), echo.Addr().String(), cipher)
+		if nil != err {
+			t.Fatalf("%s:%v", method, err)
+		}
+		//larger than a chunk to test the splitting
+		data := make([]byte, 3*maxPayloadSize+100)
+		rand.Read(data)
+		go conn.Write(data)
+		recv := make([]byte, len(data))
+		if _, err = io.ReadFull(conn, recv); nil != err {
+			t.Fatalf("%s:%v", method, err)
+		}
+		if !bytes.Equal(data, recv) {
+			t.Fatalf("%s:echo data mismatch", method)
+		}
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	server := startServer(t, mustCipher(t, "aes-256-gcm", "right"))
+	defer server.Close()
+	conn, err := Dial("tcp", server.Addr().String(), echo.Addr().String(), mustCipher(t, "aes-256-gcm", "wrong"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	if _, err = conn.Read(make([]byte, 5)); nil == err {
+		t.Fatal("server should reject a wrong password")
+	}
+}
+
+func mustCipher(t *testing.T, method, password string) *Cipher {
+	cipher, err := NewCipher(method, password)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return cipher
+}
+
+//decode the first chunk by hand to check the wire format
+func TestWireFormat(t *testing.T) {
+	cipher := mustCipher(t, "aes-256-gcm", "password")
+	//EVP_BytesToKey("password") with md5
+	key, _ := hex.DecodeString("5f4dcc3b5aa765d61d8327deb882cf992b95990a9151374abd8ff8c5a7a0fe08")
+	if !bytes.Equal(cipher.key, key) {
+		t.Fatalf("unexpected master key:%x", cipher.key)
+	}
+	client, server := net.Pipe()
+	go func() {
+		NewConn(client, cipher).Write([]byte("hello"))
+		client.Close()
+	}()
+	wire, _ := ioutil.ReadAll(server)
+	if len(wire) != 32+2+16+5+16 {
+		t.Fatalf("unexpected wire length:%d", len(wire))
+	}
+	subkey := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha1.New, key, wire[:32], []byte("ss-subkey")), subkey)
+	aead, _ := newAESGCM(subkey)
+	nonce := make([]byte, 12)
+	length, err := aead.Open(nil, nonce, wire[32:50], nil)
+	if nil != err || !bytes.Equal(length, []byte{0, 5}) {
+		t.Fatalf("invalid length chunk:%v %v", length, err)
+	}
+	nonce[0] = 1
+	payload, err := aead.Open(nil, nonce, wire[50:], nil)
+	if nil != err || string(payload) != "hello" {
+		t.Fatalf("invalid payload chunk:%q %v", payload, err)
+	}
+}
+
+func TestAddr(t *testing.T) {
+	for _, addr := range []string{"1.2.3.4:80", "[2001:db8::1]:443", "www.example.com:8388"} {
+		b, err := MarshalAddr(addr)
+		if nil != err {
+			t.Fatal(err)
+		}
+		decoded, err := ReadAddr(bytes.NewReader(b))
+		if nil != err || decoded != addr {
+			t.Fatalf("%s decoded as %s:%v", addr, decoded, err)
+		}
+	}
+}
+
+//the reserved bits of the length are not masked off
+func TestChunkSize(t *testing.T) {
+	cipher := mustCipher(t, "aes-128-gcm", "password")
+	for _, size := range []int{maxPayloadSize + 1, 0xFFFF} {
+		client, server := net.Pipe()
+		go func() {
+			salt := make([]byte, cipher.SaltSize())
+			aead, _ := cipher.aead(salt)
+			nonce := make([]byte, aead.NonceSize())
+			chunk := aead.Seal(salt, nonce, []byte{byte(size >> 8), byte(size)}, nil)
+			client.Write(append(chunk, make([]byte, size+aead.Overhead())...))
+			client.Close()
+		}()
+		if _, err := NewConn(server, cipher).Read(make([]byte, 16)); err != ErrChunkSize {
+			t.Fatalf("%d:unexpected error %v", size, err)
+		}
+		server.Close()
+	}
+}
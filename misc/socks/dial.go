@@ -75,6 +75,8 @@ type Proxy struct {
 	Addr     string
 	Username string
 	Password string
+	// Forward dials the proxy server itself, net.Dial is used if nil.
+	Forward func(network, addr string) (net.Conn, error)
 }
 
 func (p *Proxy) Dial(network, addr string) (net.Conn, error) {
@@ -87,7 +89,11 @@ func (p *Proxy) Dial(network, addr string) (net.Conn, error) {
 		return nil, err
 	}
 
-	conn, err := net.Dial("tcp", p.Addr)
+	forward := p.Forward
+	if forward == nil {
+		forward = net.Dial
+	}
+	conn, err := forward("tcp", p.Addr)
 	if err != nil {
 		return nil, err
 	}
@@ -162,15 +168,23 @@ func (p *Proxy) Dial(network, addr string) (net.Conn, error) {
 
 	// Command / connection request
 
-	buf = buf[:7+len(host)]
+	buf = buf[:4]
 	buf[0] = protocolVersion
 	buf[1] = commandTcpConnect
 	buf[2] = 0 // reserved
-	buf[3] = addressTypeDomain
-	buf[4] = byte(len(host))
-	copy(buf[5:], host)
-	buf[5+len(host)] = byte(port >> 8)
-	buf[6+len(host)] = byte(port & 0xff)
+	// IP literals are sent as is, anything else is resolved by the proxy
+	if ip := net.ParseIP(host); ip == nil {
+		buf[3] = addressTypeDomain
+		buf = append(buf, byte(len(host)))
+		buf = append(buf, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf[3] = addressTypeIPv4
+		buf = append(buf, ip4...)
+	} else {
+		buf[3] = addressTypeIPv6
+		buf = append(buf, ip.To16()...)
+	}
+	buf = append(buf, byte(port>>8), byte(port&0xff))
 	if _, err := conn.Write(buf); err != nil {
 		conn.Close()
 		return nil, err
@@ -208,13 +222,13 @@ func (p *Proxy) Dial(network, addr string) (net.Conn, error) {
 			conn.Close()
 			return nil, err
 		}
-		paddr.host = net.IP(buf).String()
+		paddr.host = net.IP(buf[:4]).String()
 	case addressTypeIPv6:
 		if _, err := io.ReadFull(conn, buf[:16]); err != nil {
 			conn.Close()
 			return nil, err
 		}
-		paddr.host = net.IP(buf).String()
+		paddr.host = net.IP(buf[:16]).String()
 	case addressTypeDomain:
 		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
 			conn.Close()
@@ -0,0 +1,213 @@
+package upnp
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//PortMapping is the state of a port mapped on the gateway
+type PortMapping struct {
+	Protocol     string
+	ExternalPort int
+	InternalPort int
+	Description  string
+	Mapped       bool
+	LastError    string
+	Renewed      time.Time
+}
+
+//PortMapper keeps a set of port mappings alive on the gateway, every mapping
+//is renewed before its lease expires and removed on Close.
+type PortMapper struct {
+	lease time.Duration
+	//serializes the requests to the gateway, mutex only guards the state and
+	//is never held across the requests
+	request_mutex sync.Mutex
+	mutex         sync.Mutex
+	nat           NAT
+	externalIP    string
+	mappings      []*PortMapping
+	stop          chan struct{}
+	closed        bool
+}
+
+//NewPortMapper creates a mapper whose mappings are leased for the given
+//duration, a zero lease asks the gateway for a permanent mapping which is
+//still refreshed periodically in case the gateway restarted.
+func NewPortMapper(lease time.Duration) *PortMapper {
+	return &PortMapper{lease: lease, stop: make(chan struct{})}
+}
+
+func (m *PortMapper) renewInterval() time.Duration {
+	if m.lease <= 0 {
+		return 10 * time.Minute
+	}
+	//leave a third of the lease for retries
+	if interval := m.lease * 2 / 3; interval > 0 {
+		return interval
+	}
+	return m.lease
+}
+
+//Start discovers the gateway and launches the renew routine
+func (m *PortMapper) Start() error {
+	nat, err := Discover()
+	if nil != err {
+		return err
+	}
+	ip, err := nat.GetExternalIPAddress()
+	if nil != err {
+		log.Printf("[WARN]Failed to get external ip from gateway:%v\n", err)
+	}
+	m.mutex.Lock()
+	m.nat = nat
+	m.externalIP = ip
+	m.mutex.Unlock()
+	go m.renewLoop()
+	return nil
+}
+
+//addMapping requests the gateway with the mutex released, the protocol and
+//external port of a mapping never change
+func (m *PortMapper) addMapping(nat NAT, pm *PortMapping) error {
+	m.mutex.Lock()
+	internalPort, description := pm.InternalPort, pm.Description
+	m.mutex.Unlock()
+	err := nat.AddPortMapping(pm.Protocol, pm.ExternalPort, internalPort, description, int(m.lease/time.Second))
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if nil != err {
+		pm.Mapped = false
+		pm.LastError = err.Error()
+		return err
+	}
+	pm.Mapped = true
+	pm.LastError = ""
+	pm.Renewed = time.Now()
+	return nil
+}
+
+//Add maps the external port of the gateway to the internal port of this host
+func (m *PortMapper) Add(protocol string, externalPort, internalPort int, description string) error {
+	m.request_mutex.Lock()
+	defer m.request_mutex.Unlock()
+	m.mutex.Lock()
+	if nil == m.nat || m.closed {
+		m.mutex.Unlock()
+		return errors.New("UPnP port mapper not started")
+	}
+	protocol = strings.ToUpper(protocol)
+	var pm *PortMapping
+	for _, it := range m.mappings {
+		if it.Protocol == protocol && it.ExternalPort == externalPort {
+			pm = it
+			break
+		}
+	}
+	if nil == pm {
+		pm = &PortMapping{Protocol: protocol, ExternalPort: externalPort}
+		m.mappings = append(m.mappings, pm)
+	}
+	pm.InternalPort = internalPort
+	pm.Description = description
+	nat := m.nat
+	m.mutex.Unlock()
+	return m.addMapping(nat, pm)
+}
+
+//Renew refreshes all mappings and the external ip
+func (m *PortMapper) Renew() {
+	m.request_mutex.Lock()
+	defer m.request_mutex.Unlock()
+	m.mutex.Lock()
+	nat, closed := m.nat, m.closed
+	mappings := append([]*PortMapping(nil), m.mappings...)
+	m.mutex.Unlock()
+	if nil == nat || closed {
+		return
+	}
+	if ip, err := nat.GetExternalIPAddress(); nil == err {
+		m.mutex.Lock()
+		m.externalIP = ip
+		m.mutex.Unlock()
+	}
+	for _, pm := range mappings {
+		if err := m.addMapping(nat, pm); nil != err {
+			log.Printf("[WARN]Failed to renew UPnP mapping %s:%d:%v\n", pm.Protocol, pm.ExternalPort, err)
+		}
+	}
+}
+
+func (m *PortMapper) renewLoop() {
+	ticker := time.NewTicker(m.renewInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.Renew()
+		}
+	}
+}
+
+//Close removes all mappings from the gateway
+func (m *PortMapper) Close() error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.stop)
+	nat := m.nat
+	m.mutex.Unlock()
+	if nil == nat {
+		return nil
+	}
+	//wait for the running request, no request starts after closed
+	m.request_mutex.Lock()
+	defer m.request_mutex.Unlock()
+	m.mutex.Lock()
+	mappings := append([]*PortMapping(nil), m.mappings...)
+	m.mutex.Unlock()
+	var lastErr error
+	for _, pm := range mappings {
+		m.mutex.Lock()
+		mapped := pm.Mapped
+		m.mutex.Unlock()
+		if !mapped {
+			continue
+		}
+		if err := nat.DeletePortMapping(pm.Protocol, pm.ExternalPort); nil != err {
+			log.Printf("[WARN]Failed to delete UPnP mapping %s:%d:%v\n", pm.Protocol, pm.ExternalPort, err)
+			lastErr = err
+			continue
+		}
+		m.mutex.Lock()
+		pm.Mapped = false
+		m.mutex.Unlock()
+	}
+	return lastErr
+}
+
+//ExternalIP returns the external ip reported by the gateway
+func (m *PortMapper) ExternalIP() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.externalIP
+}
+
+//Mappings returns a snapshot of the mapping states
+func (m *PortMapper) Mappings() []PortMapping {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ms := make([]PortMapping, len(m.mappings))
+	for i, pm := range m.mappings {
+		ms[i] = *pm
+	}
+	return ms
+}
@@ -0,0 +1,278 @@
+package upnp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeRootDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList>
+<service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service>
+</serviceList>
+</device>
+</deviceList>
+</device>
+</deviceList>
+</device>
+</root>`
+
+//fakeIGD answers SSDP searches and the WANIPConnection SOAP actions
+type fakeIGD struct {
+	mutex    sync.Mutex
+	ssdp     *net.UDPConn
+	http     *httptest.Server
+	mappings map[string]map[string]string
+	adds     int
+	deletes  int
+	//AddPortMapping waits for it if not nil
+	block   chan struct{}
+	blocked int
+}
+
+var soapArgPattern = regexp.MustCompile(`<(New\w+)>([^<]*)</New\w+>`)
+
+func startFakeIGD(t *testing.T) *fakeIGD {
+	igd := &fakeIGD{mappings: make(map[string]map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(fakeRootDesc))
+	})
+	mux.HandleFunc("/ctl/IPConn", igd.control)
+	igd.http = httptest.NewServer(mux)
+
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	conn, err := net.ListenUDP("udp4", addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	igd.ssdp = conn
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if nil != err {
+				return
+			}
+			if !strings.HasPrefix(string(buf[0:n]), "M-SEARCH") {
+				continue
+			}
+			answer := "HTTP/1.1 200 OK\r\n" +
+				"CACHE-CONTROL: max-age=120\r\n" +
+				"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+				"Location: " + igd.http.URL + "/rootDesc.xml\r\n\r\n"
+			conn.WriteToUDP([]byte(answer), from)
+		}
+	}()
+	ssdpAddr := SSDPAddr
+	t.Cleanup(func() {
+		SSDPAddr = ssdpAddr
+	})
+	SSDPAddr = conn.LocalAddr().String()
+	return igd
+}
+
+func (igd *fakeIGD) close() {
+	igd.ssdp.Close()
+	igd.http.Close()
+}
+
+func (igd *fakeIGD) control(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	args := make(map[string]string)
+	for _, m := range soapArgPattern.FindAllStringSubmatch(string(body), -1) {
+		args[m[1]] = m[2]
+	}
+	action := req.Header.Get("SOAPAction")
+	action = strings.Trim(action[strings.Index(action, "#")+1:], "\"")
+	igd.mutex.Lock()
+	block := igd.block
+	if nil != block && action == "AddPortMapping" {
+		igd.blocked++
+		igd.mutex.Unlock()
+		<-block
+	} else {
+		igd.mutex.Unlock()
+	}
+	igd.mutex.Lock()
+	defer igd.mutex.Unlock()
+	key := args["NewProtocol"] + ":" + args["NewExternalPort"]
+	var result string
+	switch action {
+	case "AddPortMapping":
+		igd.adds++
+		igd.mappings[key] = args
+	case "DeletePortMapping":
+		if _, exist := igd.mappings[key]; !exist {
+			http.Error(w, "NoSuchEntryInArray", 500)
+			return
+		}
+		igd.deletes++
+		delete(igd.mappings, key)
+	case "GetExternalIPAddress":
+		result = "<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>"
+	default:
+		http.Error(w, "Invalid Action", 401)
+		return
+	}
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%sResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">%s</u:%sResponse></s:Body></s:Envelope>`, action, result, action)
+}
+
+func (igd *fakeIGD) state() (adds, deletes int, mappings map[string]map[string]string) {
+	igd.mutex.Lock()
+	defer igd.mutex.Unlock()
+	mappings = make(map[string]map[string]string)
+	for k, v := range igd.mappings {
+		mappings[k] = v
+	}
+	return igd.adds, igd.deletes, mappings
+}
+
+func TestPortMapperFakeIGD(t *testing.T) {
+	igd := startFakeIGD(t)
+	defer igd.close()
+
+	mapper := NewPortMapper(time.Second)
+	if err := mapper.Start(); nil != err {
+		t.Fatal(err)
+	}
+	if ip := mapper.ExternalIP(); ip != "203.0.113.7" {
+		t.Fatalf("unexpected external ip:%s", ip)
+	}
+	if err := mapper.Add("tcp", 48100, 48101, "GSnova"); nil != err {
+		t.Fatal(err)
+	}
+	_, _, mappings := igd.state()
+	args, exist := mappings["TCP:48100"]
+	if !exist {
+		t.Fatalf("mapping not created:%v", mappings)
+	}
+	if args["NewInternalPort"] != "48101" || args["NewLeaseDuration"] != "1" || args["NewInternalClient"] != "127.0.0.1" {
+		t.Fatalf("unexpected mapping args:%v", args)
+	}
+	ms := mapper.Mappings()
+	if len(ms) != 1 || !ms[0].Mapped {
+		t.Fatalf("unexpected mapping status:%v", ms)
+	}
+
+	//the renew routine refreshes the mapping before the lease expires
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		adds, _, _ := igd.state()
+		if adds >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mapping not renewed, %d adds", adds)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := mapper.Close(); nil != err {
+		t.Fatal(err)
+	}
+	_, deletes, mappings := igd.state()
+	if deletes != 1 || len(mappings) != 0 {
+		t.Fatalf("mapping not removed, %d deletes, %v left", deletes, mappings)
+	}
+	if ms = mapper.Mappings(); ms[0].Mapped {
+		t.Fatal("mapping should be marked as removed")
+	}
+	if err := mapper.Add("tcp", 48102, 48102, "GSnova"); nil == err {
+		t.Fatal("closed mapper should reject new mappings")
+	}
+}
+
+func TestRenewInterval(t *testing.T) {
+	for lease, expected := range map[time.Duration]time.Duration{
+		0:                      10 * time.Minute,
+		time.Hour:              40 * time.Minute,
+		3 * time.Second:        2 * time.Second,
+		900 * time.Millisecond: 600 * time.Millisecond,
+		time.Nanosecond:        time.Nanosecond,
+	} {
+		if interval := NewPortMapper(lease).renewInterval(); interval != expected {
+			t.Fatalf("%v:unexpected interval %v", lease, interval)
+		}
+	}
+}
+
+//the state is readable while the gateway is slow, Close waits for the
+//running renew and removes what it mapped
+func TestPortMapperSlowGateway(t *testing.T) {
+	igd := startFakeIGD(t)
+	defer igd.close()
+	mapper := NewPortMapper(time.Hour)
+	if err := mapper.Start(); nil != err {
+		t.Fatal(err)
+	}
+	if err := mapper.Add("tcp", 48100, 48101, "GSnova"); nil != err {
+		t.Fatal(err)
+	}
+	block := make(chan struct{})
+	igd.mutex.Lock()
+	igd.block = block
+	igd.mutex.Unlock()
+	renewed := make(chan bool)
+	go func() {
+		mapper.Renew()
+		close(renewed)
+	}()
+	for {
+		igd.mutex.Lock()
+		blocked := igd.blocked
+		igd.mutex.Unlock()
+		if blocked > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	read := make(chan bool)
+	go func() {
+		mapper.ExternalIP()
+		mapper.Mappings()
+		close(read)
+	}()
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		t.Fatal("the state is locked during the renew")
+	}
+	closed := make(chan error)
+	go func() {
+		closed <- mapper.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("close does not wait for the renew")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(block)
+	<-renewed
+	if err := <-closed; nil != err {
+		t.Fatal(err)
+	}
+	if adds, deletes, mappings := igd.state(); adds != 2 || deletes != 1 || len(mappings) != 0 {
+		t.Fatalf("unexpected gateway state:%d %d %v", adds, deletes, mappings)
+	}
+}
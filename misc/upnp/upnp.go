@@ -8,6 +8,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -20,6 +21,9 @@ type upnpNAT struct {
 	root       *Root
 }
 
+//SSDPAddr is the multicast address searched for the gateway
+var SSDPAddr = "239.255.255.250:1900"
+
 type NAT interface {
 	AddPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (err error)
 	//AddPortMappingV2(protocol string, externalPort, internalPort int, description string, timeout int) (err error)
@@ -28,7 +32,7 @@ type NAT interface {
 }
 
 func Discover() (nat NAT, err error) {
-	ssdp, err := net.ResolveUDPAddr("udp4", "239.255.255.250:1900")
+	ssdp, err := net.ResolveUDPAddr("udp4", SSDPAddr)
 	if err != nil {
 		return
 	}
@@ -73,11 +77,11 @@ func Discover() (nat NAT, err error) {
 		// HTTP header field names are case-insensitive.
 		// http://www.w3.org/Protocols/rfc2616/rfc2616-sec4.html#sec4.2
 		locString := "\r\nlocation: "
-		answer = strings.ToLower(answer)
-		locIndex := strings.Index(answer, locString)
+		locIndex := strings.Index(strings.ToLower(answer), locString)
 		if locIndex < 0 {
 			continue
 		}
+		//keep the case of the url itself
 		loc := answer[locIndex+len(locString):]
 		endIndex := strings.Index(loc, "\r\n")
 		if endIndex < 0 {
@@ -92,7 +96,10 @@ func Discover() (nat NAT, err error) {
 			return
 		}
 		var ourIP string
-		ourIP, err = getOurIP()
+		ourIP, err = getOurIPFor(serviceURL)
+		if err != nil {
+			ourIP, err = getOurIP()
+		}
 		if err != nil {
 			return
 		}
@@ -173,6 +180,25 @@ func getOurIP() (ip string, err error) {
 	return addrs[0], nil
 }
 
+//local address of the interface which routes to the gateway
+func getOurIPFor(serviceURL string) (ip string, err error) {
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return
+	}
+	host := u.Host
+	if _, _, e := net.SplitHostPort(host); e != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+	conn, err := net.Dial("udp4", host)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	ip, _, err = net.SplitHostPort(conn.LocalAddr().String())
+	return
+}
+
 func getServiceURL(rootURL string) (ro *Root, url string, err error) {
 	r, err := http.Get(rootURL)
 	if err != nil {
@@ -180,7 +206,7 @@ func getServiceURL(rootURL string) (ro *Root, url string, err error) {
 	}
 	defer r.Body.Close()
 	if r.StatusCode >= 400 {
-		err = errors.New(string(r.StatusCode))
+		err = errors.New(strconv.Itoa(r.StatusCode))
 		return
 	}
 	decoder := xml.NewDecoder(r.Body)
@@ -308,9 +334,12 @@ func simpleUPnPcommand(url, service, action string, args map[string]string) (r *
 	//req.Header.Set("Pragma", "no-cache")
 
 	r, err = http.DefaultClient.Do(req)
-
+	if err != nil {
+		return nil, err
+	}
 	if r.StatusCode >= 400 {
 		log.Printf("%v\n", r)
+		r.Body.Close()
 		err = errors.New("Error " + strconv.Itoa(r.StatusCode) + " for " + action)
 		r = nil
 		return
@@ -338,12 +367,13 @@ func soapRequest(url, function, message string) (r *http.Response, err error) {
 	// log.Stderr("soapRequest ", req)
 
 	r, err = http.DefaultClient.Do(req)
-	if r.Body != nil {
-		defer r.Body.Close()
+	if err != nil {
+		return nil, err
 	}
 
 	if r.StatusCode >= 400 {
 		// log.Stderr(function, r.StatusCode)
+		r.Body.Close()
 		err = errors.New("Error " + strconv.Itoa(r.StatusCode) + " for " + function)
 		r = nil
 		return
@@ -374,6 +404,7 @@ func (n *upnpNAT) GetExternalIPAddress() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer response.Body.Close()
 	decoder := xml.NewDecoder(response.Body)
 	retriveIP := false
 	ip := ""
@@ -405,7 +436,7 @@ func (n *upnpNAT) AddPortMapping(protocol string, externalPort, internalPort int
 	args["NewInternalClient"] = n.ourIP
 	args["NewEnabled"] = strconv.Itoa(1)
 	args["NewPortMappingDescription"] = description
-	args["NewLeaseDuration"] = "0"
+	args["NewLeaseDuration"] = strconv.Itoa(timeout)
 	//log.Printf(n.root.Device.ServiceList.Service[0].ServiceType)
 
 	var response *http.Response
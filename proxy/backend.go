@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"log"
+	"strings"
+
+	"github.com/zyxar/gsnova/common"
+)
+
+//Backend describes a remote connection manager plugged into gsnova. The
+//backends are initialized in the order registered, a backend registers its
+//RemoteConnectionManager with RegisteRemoteConnManager in Init.
+type Backend struct {
+	//Name used in SPAC rules, matched case insensitively
+	Name string
+	//Config section, [Section] Listen is the dedicated listener of the backend,
+	//empty for the backends without one like Google
+	Section string
+	Init    func() error
+	//Health reports whether the backend is usable now, nil means always
+	Health func() bool
+	//Enabled reports whether the config enables the backend, it replaces
+	//Health if the backends are not initialized, nil means always
+	Enabled func() bool
+	//Priority to be picked by the Auto default rule, lower first, 0 never
+	Auto int
+	//Select returns the manager serving the request, the manager registered
+	//with Name is used if nil
+	Select func(isHttpsConn bool) RemoteConnectionManager
+}
+
+//explainOnly is set by InitExplain, the backends are not initialized and
+//only the config tells whether they are usable
+var explainOnly bool
+
+func (b *Backend) healthy() bool {
+	if explainOnly {
+		return nil == b.Enabled || b.Enabled()
+	}
+	return nil == b.Health || b.Health()
+}
+
+//cfgEnabled reads [section] Enable like the Init of the backend
+func cfgEnabled(section string, def bool) func() bool {
+	return func() bool {
+		if enable, exist := common.Cfg.GetIntProperty(section, "Enable"); exist {
+			return enable != 0
+		}
+		return def
+	}
+}
+
+//ListenAddr returns the dedicated listener address of a healthy backend
+func (b *Backend) ListenAddr() (string, bool) {
+	if len(b.Section) == 0 || !b.healthy() {
+		return "", false
+	}
+	addr, exist := common.Cfg.GetProperty(b.Section, "Listen")
+	return addr, exist && len(addr) > 0
+}
+
+func (b *Backend) manager(isHttpsConn bool) RemoteConnectionManager {
+	if nil != b.Select {
+		return b.Select(isHttpsConn)
+	}
+	if v, ok := registedRemoteConnManager[b.Name]; ok {
+		return v
+	}
+	return nil
+}
+
+var backends []*Backend
+
+//RegisterBackend adds a backend, the one registered later replaces the
+//backend of the same name
+func RegisterBackend(b *Backend) {
+	for i, v := range backends {
+		if strings.EqualFold(v.Name, b.Name) {
+			backends[i] = b
+			return
+		}
+	}
+	backends = append(backends, b)
+}
+
+func Backends() []*Backend {
+	return backends
+}
+
+func getBackend(name string) *Backend {
+	for _, b := range backends {
+		if strings.EqualFold(b.Name, name) {
+			return b
+		}
+	}
+	return nil
+}
+
+//InitBackends initializes the registered backends in order
+func InitBackends() {
+	for _, b := range backends {
+		if nil == b.Init {
+			continue
+		}
+		if err := b.Init(); nil != err {
+			log.Printf("[WARN]Failed to init %s:%s\n", b.Name, err.Error())
+		}
+	}
+}
+
+//InitExplain prepares to explain the SPAC selection without initializing
+//the backends, which would login the servers and start the listeners
+func InitExplain() {
+	explainOnly = true
+	PostInitSpac()
+}
+
+//autoBackend returns the healthy backend of the highest Auto priority
+func autoBackend() string {
+	var selected *Backend
+	for _, b := range backends {
+		if b.Auto > 0 && b.healthy() && (nil == selected || b.Auto < selected.Auto) {
+			selected = b
+		}
+	}
+	if nil == selected {
+		return DIRECT_NAME
+	}
+	return selected.Name
+}
+
+func init() {
+	RegisterBackend(&Backend{
+		Name: GOOGLE_NAME,
+		Init: InitGoogle,
+		Health: func() bool {
+			return google_enable
+		},
+		Enabled: cfgEnabled("Google", false),
+		Select: func(isHttpsConn bool) RemoteConnectionManager {
+			if isHttpsConn {
+				return httpsGoogleManager
+			}
+			return httpGoogleManager
+		},
+	})
+	//the managers of Google are also selected by protocol explicitly
+	for _, name := range []string{GOOGLE_HTTP_NAME, GOOGLE_HTTPS_NAME} {
+		isHttps := name == GOOGLE_HTTPS_NAME
+		RegisterBackend(&Backend{
+			Name: name,
+			Health: func() bool {
+				return google_enable
+			},
+			Enabled: cfgEnabled("Google", false),
+			Select: func(isHttpsConn bool) RemoteConnectionManager {
+				if isHttps {
+					return httpsGoogleManager
+				}
+				return httpGoogleManager
+			},
+		})
+	}
+	RegisterBackend(&Backend{
+		Name:    C4_NAME,
+		Section: "C4",
+		Init:    new(C4).Init,
+		Health: func() bool {
+			return C4Enable
+		},
+		Enabled: cfgEnabled("C4", false),
+		Auto:    2,
+	})
+	RegisterBackend(&Backend{
+		Name:    SSH_NAME,
+		Section: "SSH",
+		Init:    InitSSH,
+		Health: func() bool {
+			return SSHEnable
+		},
+		Enabled: cfgEnabled("SSH", true),
+		Auto:    3,
+	})
+	RegisterBackend(&Backend{
+		Name:    SHADOWSOCKS_NAME,
+		Section: "Shadowsocks",
+		Init:    InitShadowsocks,
+		Health: func() bool {
+			return ShadowsocksEnable
+		},
+		Enabled: cfgEnabled("Shadowsocks", false),
+		Auto:    4,
+	})
+	//GAE goes last since it fetches shared appids only if C4 and SSH are off
+	RegisterBackend(&Backend{
+		Name:    GAE_NAME,
+		Section: "GAE",
+		Init: func() error {
+			if err := new(GAE).Init(); nil != err {
+				return err
+			}
+			//the fake cert is used by the GAE listener
+			common.LoadRootCA()
+			return nil
+		},
+		Health: func() bool {
+			return GAEEnable
+		},
+		Enabled: cfgEnabled("GAE", false),
+		Auto:    1,
+	})
+}
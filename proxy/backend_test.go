@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/zyxar/gsnova/common"
+	"github.com/zyxar/gsnova/event"
+	"github.com/zyxar/gsnova/util"
+)
+
+type fakeManager struct {
+	name string
+}
+
+func (manager *fakeManager) GetRemoteConnection(ev event.Event, attrs map[string]string) (RemoteConnection, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (manager *fakeManager) RecycleRemoteConnection(conn RemoteConnection) {
+}
+
+func (manager *fakeManager) GetName() string {
+	return manager.name
+}
+
+//saveBackendRegistry restores the backends, the registered managers and
+//spac after the test
+func saveBackendRegistry(t *testing.T) {
+	saved, config := append([]*Backend(nil), backends...), spac
+	managers := make(map[string]RemoteConnectionManager)
+	for k, v := range registedRemoteConnManager {
+		managers[k] = v
+	}
+	t.Cleanup(func() {
+		backends, registedRemoteConnManager, spac = saved, managers, config
+	})
+}
+
+func TestBackendRegistry(t *testing.T) {
+	saveBackendRegistry(t)
+	healthy := true
+	RegisterBackend(&Backend{
+		Name: "Fake",
+		Init: func() error {
+			RegisteRemoteConnManager(&fakeManager{name: "Fake"})
+			return nil
+		},
+		Health: func() bool {
+			return healthy
+		},
+		Auto: 100,
+	})
+	getBackend("fake").Init()
+	spac = &SpacConfig{defaultRule: DIRECT_NAME}
+
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	session := &SessionConnection{Type: HTTP_TUNNEL, ProxyServer: "Fake"}
+	managers, _ := SelectProxy(req, session)
+	if len(managers) != 1 || managers[0].GetName() != "Fake" {
+		t.Fatalf("unexpected managers:%v", managers)
+	}
+	if manager, known := resolveProxyManager("FAKE", false); !known || nil == manager {
+		t.Fatal("backend names are matched case insensitively")
+	}
+	if name := autoBackend(); name != "Fake" {
+		t.Fatalf("unexpected auto backend:%s", name)
+	}
+
+	healthy = false
+	if manager, known := resolveProxyManager("Fake", false); !known || nil != manager {
+		t.Fatal("unhealthy backend should not be selected")
+	}
+	if name := autoBackend(); name != DIRECT_NAME {
+		t.Fatalf("unexpected auto backend:%s", name)
+	}
+	//unknown names are forwarded to the upstream proxy
+	session.ProxyServer = "127.0.0.1:8080"
+	managers, _ = SelectProxy(req, session)
+	if len(managers) != 1 || managers[0].GetName() != FORWARD_NAME+"http://127.0.0.1:8080" {
+		t.Fatalf("unexpected managers:%v", managers)
+	}
+}
+
+func TestGoogleNoListener(t *testing.T) {
+	oldCfg, oldEnable := common.Cfg, google_enable
+	defer func() {
+		common.Cfg, google_enable = oldCfg, oldEnable
+	}()
+	common.Cfg = util.NewIni()
+	common.Cfg.SetProperty("Google", "Listen", ":48200")
+	google_enable = true
+	for _, name := range []string{GOOGLE_NAME, GOOGLE_HTTP_NAME, GOOGLE_HTTPS_NAME} {
+		if addr, exist := getBackend(name).ListenAddr(); exist {
+			t.Fatalf("%s listens on %s", name, addr)
+		}
+	}
+}
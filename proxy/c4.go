@@ -37,12 +37,17 @@ type C4Config struct {
 	ReadTimeout            uint32
 	MaxConn                uint32
 	WSConnKeepAlive        uint32
+	WSPingInterval         uint32
+	WSInsecureSkipVerify   bool
 	InjectRange            []*regexp.Regexp
 	FetchLimitSize         uint32
 	ConcurrentRangeFetcher uint32
 	Proxy                  string
 	MultiRangeFetchEnable  bool
 	UseSysDNS              bool
+	RSocketListen          string
+	RSocketAdvertise       string
+	RSocketPoolSize        uint32
 }
 
 var c4_cfg *C4Config
@@ -138,11 +143,13 @@ func wrapC4RequestEvent(ev event.Event) event.Event {
 
 func (c4 *C4RemoteSession) offerRequestEvent(ev event.Event) {
 	ev = wrapC4RequestEvent(ev)
-	isWsServer := strings.HasPrefix(c4.server, "ws://")
-	if isWsServer {
+	if isWebsocketServer(c4.server) {
 		wsOfferEvent(c4.server, ev)
 		return
 	}
+	if isRSocketMode() && rsocketOfferEvent(c4.server, ev) {
+		return
+	}
 	httpOfferEvent(c4.server, ev)
 }
 
@@ -356,6 +363,16 @@ func (manager *C4) loginC4(server string) {
 	conn := &C4RemoteSession{}
 	conn.manager = manager
 	conn.server = server
+	if isRSocketMode() && !isWebsocketServer(server) {
+		login := &event.UserLoginEventV2{}
+		login.User = userToken
+		login.RSocketAddr = c4RSocketAddr
+		login.RSocketServer = server
+		login.RSocketPoolSize = c4_cfg.RSocketPoolSize
+		login.RSocketSecret = newRSocketSecret(server)
+		conn.offerRequestEvent(login)
+		return
+	}
 	login := &event.UserLoginEvent{}
 	login.User = userToken
 	conn.offerRequestEvent(login)
@@ -418,6 +435,18 @@ func initC4Config() {
 		}
 	}
 
+	c4_cfg.ConnectionMode = MODE_HTTP
+	if mode, exist := common.Cfg.GetProperty("C4", "ConnectionMode"); exist && len(mode) > 0 {
+		c4_cfg.ConnectionMode = mode
+	}
+	c4_cfg.RSocketListen = ":48105"
+	if addr, exist := common.Cfg.GetProperty("C4", "RSocketListen"); exist && len(addr) > 0 {
+		c4_cfg.RSocketListen = addr
+	}
+	if addr, exist := common.Cfg.GetProperty("C4", "RSocketAdvertise"); exist {
+		c4_cfg.RSocketAdvertise = addr
+	}
+
 	c4_cfg.ReadTimeout = 25
 	if period, exist := common.Cfg.GetIntProperty("C4", "ReadTimeout"); exist {
 		c4_cfg.ReadTimeout = uint32(period)
@@ -428,11 +457,24 @@ func initC4Config() {
 		c4_cfg.MaxConn = uint32(num)
 	}
 
+	c4_cfg.RSocketPoolSize = c4_cfg.MaxConn
+	if num, exist := common.Cfg.GetIntProperty("C4", "RSocketPoolSize"); exist && num > 0 {
+		c4_cfg.RSocketPoolSize = uint32(num)
+	}
+
 	c4_cfg.WSConnKeepAlive = 180
 	if num, exist := common.Cfg.GetIntProperty("C4", "WSConnKeepAlive"); exist {
 		c4_cfg.WSConnKeepAlive = uint32(num)
 	}
-	if tmp, exist := common.Cfg.GetProperty("C4", "Proxy"); exist {
+	c4_cfg.WSPingInterval = 30
+	if num, exist := common.Cfg.GetIntProperty("C4", "WSPingInterval"); exist && num > 0 {
+		c4_cfg.WSPingInterval = uint32(num)
+	}
+	c4_cfg.WSInsecureSkipVerify = false
+	if enable, exist := common.Cfg.GetIntProperty("C4", "WSInsecureSkipVerify"); exist {
+		c4_cfg.WSInsecureSkipVerify = (enable != 0)
+	}
+	if tmp, exist := common.Cfg.GetProperty("C4", "Proxy"); exist && !hasDialChain(C4_NAME) {
 		c4_cfg.Proxy = tmp
 	}
 	c4_cfg.ConcurrentRangeFetcher = 5
@@ -489,10 +531,9 @@ func (manager *C4) Init() error {
 
 	dial := func(n, addr string) (net.Conn, error) {
 		if len(c4_cfg.Proxy) == 0 && !c4_cfg.UseSysDNS {
-			remote := getAddressMapping(addr)
-			return net.Dial(n, remote)
+			addr = getAddressMapping(addr)
 		}
-		return net.Dial(n, addr)
+		return chainDial(C4_NAME, n, addr, 0)
 	}
 	tr := &http.Transport{
 		DisableCompression:  true,
@@ -513,6 +554,12 @@ func (manager *C4) Init() error {
 		c4WriteCBChannels[i] = make(chan event.Event, 100)
 		go writeCBLoop(i)
 	}
+	if isRSocketMode() {
+		if err := initC4RSocket(); nil != err {
+			log.Printf("[WARN]Failed to init rsocket mode, fallback to http mode:%v\n", err)
+			c4_cfg.ConnectionMode = MODE_HTTP
+		}
+	}
 
 	index := 0
 	for {
@@ -523,12 +570,13 @@ func (manager *C4) Init() error {
 		if !strings.Contains(v, "://") {
 			v = "http://" + v
 		}
-		if !strings.HasSuffix(v, "/") {
+		//websocket url may carry a path and query which must be kept as is
+		if !strings.HasSuffix(v, "/") && !isWebsocketServer(v) {
 			v = v + "/"
 		}
 		manager.servers.Add(v)
 		index = index + 1
-		if strings.HasPrefix(v, "ws://") {
+		if isWebsocketServer(v) {
 			initC4WebsocketChannel(v)
 		}
 		manager.loginC4(v)
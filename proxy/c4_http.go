@@ -193,7 +193,10 @@ func newHttpTunnelService(server string) *httpTunnelService {
 		serv.puller[i].index = i
 		u, _ = url.Parse(server)
 		serv.puller[i].server = u
-		go serv.puller[i].loop()
+		//the server writes back over the reverse connections in rsocket mode
+		if !isRSocketMode() {
+			go serv.puller[i].loop()
+		}
 	}
 	for i, _ := range serv.puller {
 		serv.pusher[i] = new(pushWorker)
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zyxar/gsnova/event"
+	"github.com/zyxar/gsnova/util"
+)
+
+//In rsocket mode the C4 server dials back to a listener of the client, so
+//no long-poll response is needed. The login event advertises the address,
+//the first event on every accepted connection is a RSocketAcceptedEvent
+//naming the worker node the connection belongs to. The listener is open to
+//anyone, so the event must echo the secret sent with the login to that node.
+
+type rsocketConn struct {
+	conn        net.Conn
+	write_mutex sync.Mutex
+}
+
+var c4RSocketTable = make(map[string][]*rsocketConn)
+var c4RSocketTableMutex sync.Mutex
+var c4RSocketAddr string
+
+//the secret of the last login to every worker node, guarded by
+//c4RSocketTableMutex
+var c4RSocketSecrets = make(map[string]string)
+
+//the accepted event is small, a peer must send it in time
+const rsocketMaxAcceptedLen = 4096
+
+var rsocketAcceptTimeout = 30 * time.Second
+
+func isRSocketMode() bool {
+	return strings.EqualFold(c4_cfg.ConnectionMode, MODE_RSOCKET)
+}
+
+func addRSocketConn(server string, c *rsocketConn) {
+	c4RSocketTableMutex.Lock()
+	defer c4RSocketTableMutex.Unlock()
+	c4RSocketTable[server] = append(c4RSocketTable[server], c)
+}
+
+func removeRSocketConn(server string, c *rsocketConn) {
+	c4RSocketTableMutex.Lock()
+	defer c4RSocketTableMutex.Unlock()
+	conns := c4RSocketTable[server]
+	for i, it := range conns {
+		if it == c {
+			c4RSocketTable[server] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+}
+
+func selectRSocketConn(server string, hash uint32) *rsocketConn {
+	c4RSocketTableMutex.Lock()
+	defer c4RSocketTableMutex.Unlock()
+	conns := c4RSocketTable[server]
+	if len(conns) == 0 {
+		return nil
+	}
+	return conns[int(hash)%len(conns)]
+}
+
+//rsocketOfferEvent returns false if the server has not connected back yet
+func rsocketOfferEvent(server string, ev event.Event) bool {
+	var buf bytes.Buffer
+	event.EncodeEvent(&buf, ev)
+	var data bytes.Buffer
+	binary.Write(&data, binary.BigEndian, uint32(buf.Len()))
+	data.Write(buf.Bytes())
+	for {
+		c := selectRSocketConn(server, ev.GetHash())
+		if nil == c {
+			return false
+		}
+		c.write_mutex.Lock()
+		_, err := c.conn.Write(data.Bytes())
+		c.write_mutex.Unlock()
+		if nil == err {
+			return true
+		}
+		log.Printf("[ERROR]Failed to write rsocket connection:%v\n", err)
+		c.conn.Close()
+		removeRSocketConn(server, c)
+	}
+}
+
+func newRSocketSecret(server string) string {
+	b := make([]byte, 16)
+	io.ReadFull(rand.Reader, b)
+	secret := hex.EncodeToString(b)
+	c4RSocketTableMutex.Lock()
+	defer c4RSocketTableMutex.Unlock()
+	c4RSocketSecrets[server] = secret
+	return secret
+}
+
+func verifyRSocketAccepted(accept *event.RSocketAcceptedEvent) bool {
+	c4RSocketTableMutex.Lock()
+	defer c4RSocketTableMutex.Unlock()
+	secret, exist := c4RSocketSecrets[accept.Server]
+	return exist && subtle.ConstantTimeCompare([]byte(secret), []byte(accept.Secret)) == 1
+}
+
+func handleRSocketConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(rsocketAcceptTimeout))
+	var length uint32
+	if err := binary.Read(reader, binary.BigEndian, &length); nil != err {
+		return
+	}
+	if length > rsocketMaxAcceptedLen {
+		log.Printf("[WARN]Reject rsocket connection from %s with %d bytes first event\n", conn.RemoteAddr(), length)
+		return
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(reader, content); nil != err {
+		return
+	}
+	err, ev := event.DecodeEvent(bytes.NewBuffer(content))
+	if nil != err {
+		log.Printf("[ERROR]Failed to decode rsocket accepted event:%v\n", err)
+		return
+	}
+	accept, ok := event.ExtractEvent(ev).(*event.RSocketAcceptedEvent)
+	if !ok {
+		log.Printf("[ERROR]Unexpected first event type:%d from rsocket connection\n", ev.GetType())
+		return
+	}
+	if !verifyRSocketAccepted(accept) {
+		log.Printf("[WARN]Reject rsocket connection from %s for server:%s with invalid secret\n", conn.RemoteAddr(), accept.Server)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	log.Printf("Accept rsocket connection from %s for server:%s\n", conn.RemoteAddr(), accept.Server)
+	c := &rsocketConn{conn: conn}
+	addRSocketConn(accept.Server, c)
+	cumulate := new(C4CumulateTask)
+	cumulate.chunkLen = -1
+	for {
+		if err = cumulate.fillContent(reader); nil != err {
+			break
+		}
+	}
+	removeRSocketConn(accept.Server, c)
+	log.Printf("Rsocket connection from %s closed\n", conn.RemoteAddr())
+}
+
+func rsocketAdvertiseAddr(l net.Listener) (string, error) {
+	if len(c4_cfg.RSocketAdvertise) > 0 {
+		return c4_cfg.RSocketAdvertise, nil
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	if nil != upnpMapper {
+		p, _ := strconv.Atoi(port)
+		if addr, err := upnpMapPort(p, "GSnova RSocket"); nil == err {
+			return addr, nil
+		}
+	}
+	for _, ip := range util.GetLocalIPs() {
+		if !util.IsPrivateIP(ip) {
+			return net.JoinHostPort(ip, port), nil
+		}
+	}
+	return "", fmt.Errorf("No public address for rsocket listener, set [C4] RSocketAdvertise")
+}
+
+func initC4RSocket() error {
+	l, err := net.Listen("tcp", c4_cfg.RSocketListen)
+	if nil != err {
+		return err
+	}
+	c4RSocketAddr, err = rsocketAdvertiseAddr(l)
+	if nil != err {
+		l.Close()
+		return err
+	}
+	log.Printf("Rsocket listen on %s, advertised as %s\n", l.Addr(), c4RSocketAddr)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if nil != err {
+				log.Printf("[ERROR]Rsocket listener stopped:%v\n", err)
+				return
+			}
+			go handleRSocketConn(conn)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zyxar/gsnova/event"
+)
+
+func rsocketFrame(ev event.Event) []byte {
+	var buf bytes.Buffer
+	event.EncodeEvent(&buf, ev)
+	frame := make([]byte, 4, 4+buf.Len())
+	binary.BigEndian.PutUint32(frame, uint32(buf.Len()))
+	return append(frame, buf.Bytes()...)
+}
+
+//dialRSocket connects a fake server to handleRSocketConn
+func dialRSocket(t *testing.T, first []byte) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); nil == err {
+			handleRSocketConn(c)
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write(first)
+	return c
+}
+
+func TestRSocketAccept(t *testing.T) {
+	event.Init()
+	channels, secrets := c4WriteCBChannels, c4RSocketSecrets
+	t.Cleanup(func() {
+		c4WriteCBChannels, c4RSocketSecrets = channels, secrets
+	})
+	received := make(chan event.Event, 1)
+	c4WriteCBChannels = map[uint32]chan event.Event{0: received}
+	c4RSocketSecrets = make(map[string]string)
+	//every login has a new secret
+	last := newRSocketSecret("node")
+	secret := newRSocketSecret("node")
+	if len(secret) != 32 || secret == last {
+		t.Fatalf("unexpected secret:%s", secret)
+	}
+
+	//the connections without the secret of the last login are closed
+	for name, first := range map[string][]byte{
+		"no secret":      rsocketFrame(&event.RSocketAcceptedEvent{Server: "node"}),
+		"unknown server": rsocketFrame(&event.RSocketAcceptedEvent{Server: "other", Secret: secret}),
+		"other event":    rsocketFrame(&event.TCPChunkEvent{Content: []byte(secret)}),
+		"too large":      {0x7f, 0xff, 0xff, 0xff},
+	} {
+		c := dialRSocket(t, first)
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("%s:the connection is not closed:%v", name, err)
+		}
+		if nil != selectRSocketConn("node", 0) || nil != selectRSocketConn("other", 0) {
+			t.Fatalf("%s:the connection is accepted", name)
+		}
+	}
+
+	c := dialRSocket(t, rsocketFrame(&event.RSocketAcceptedEvent{Server: "node", Secret: secret}))
+	for i := 0; nil == selectRSocketConn("node", 0); i++ {
+		if i > 100 {
+			t.Fatal("the connection is not accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	//the events to the node go through the connection
+	ev := &event.TCPChunkEvent{Content: []byte("request")}
+	ev.SetHash(7)
+	if !rsocketOfferEvent("node", ev) || rsocketOfferEvent("other", ev) {
+		t.Fatal("unexpected offer result")
+	}
+	expected := rsocketFrame(ev)
+	frame := make([]byte, len(expected))
+	if _, err := io.ReadFull(c, frame); nil != err || !bytes.Equal(frame, expected) {
+		t.Fatalf("unexpected frame:%v", err)
+	}
+	//the events from the server are dispatched by session
+	ev = &event.TCPChunkEvent{Content: []byte("response")}
+	ev.SetHash(7)
+	c.Write(rsocketFrame(ev))
+	select {
+	case res := <-received:
+		if chunk, ok := res.(*event.TCPChunkEvent); !ok || chunk.GetHash() != 7 || string(chunk.Content) != "response" {
+			t.Fatalf("unexpected event:%v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	c.Close()
+	for i := 0; nil != selectRSocketConn("node", 0); i++ {
+		if i > 100 {
+			t.Fatal("the closed connection is not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,27 +1,34 @@
 package proxy
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
-	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/zyxar/gsnova/event"
+	"github.com/zyxar/gsnova/util"
 )
 
-func wsReadTask(ws net.Conn, ch chan event.Event) {
+func isWebsocketServer(server string) bool {
+	return strings.HasPrefix(server, "ws://") || strings.HasPrefix(server, "wss://")
+}
+
+//wsReadTask reports the connection when it is lost, so a connection closed
+//before would not drop the reconnected one
+func wsReadTask(ws *util.WebSocketConn, lost chan *util.WebSocketConn) {
 	cumulate := new(C4CumulateTask)
 	cumulate.chunkLen = -1
 	for {
 		err := cumulate.fillContent(ws)
 		if nil != err {
-			ch <- nil
+			lost <- ws
 			return
 		}
 	}
@@ -45,79 +52,95 @@ func wsOfferEvent(server string, ev event.Event) {
 	chs[index] <- wrapC4RequestEvent(ev)
 }
 
+func wsDial(n, addr string) (net.Conn, error) {
+	if len(c4_cfg.Proxy) > 0 {
+		proxy, err := url.Parse(c4_cfg.Proxy)
+		if nil != err {
+			return nil, err
+		}
+		return util.HttpTunnelDial(n, addr, proxy)
+	}
+	if !c4_cfg.UseSysDNS {
+		addr = getAddressMapping(addr)
+	}
+	return chainDial(C4_NAME, n, addr, connTimeoutSecs)
+}
+
 func wsC4Routine(server string, index int, ch chan event.Event) error {
-	var ws net.Conn
+	var ws *util.WebSocketConn
+	lost := make(chan *util.WebSocketConn)
 	u, err := url.Parse(server)
 	if nil != err {
 		return err
 	}
+	if len(u.Path) == 0 {
+		u.Path = "/"
+	}
 	checkWsConnection := func() bool {
 		if nil == ws {
-			if len(u.Path) == 0 {
-				u.Path = "/"
+			header := make(http.Header)
+			header.Set("ConnectionIndex", strconv.Itoa(index))
+			header.Set("UserToken", userToken)
+			header.Set("Keep-Alive", strconv.Itoa(int(c4_cfg.WSConnKeepAlive)))
+			if len(c4_cfg.UA) > 0 {
+				header.Set("User-Agent", c4_cfg.UA)
 			}
-			request := fmt.Sprintf("GET / HTTP/1.1\r\nUpgrade: WebSocket\r\nHost: %s\r\nConnection: Upgrade\r\nConnectionIndex:%d\r\nUserToken:%s\r\nKeep-Alive: %d\r\n\r\n", u.Host, index, userToken, c4_cfg.WSConnKeepAlive)
-			addr := u.Host
-			if !strings.Contains(u.Host, ":") {
-				addr = net.JoinHostPort(u.Host, "80")
+			var tlscfg *tls.Config
+			if c4_cfg.WSInsecureSkipVerify {
+				//only for the servers with self signed certificates, the UserToken could be intercepted
+				tlscfg = &tls.Config{InsecureSkipVerify: true}
 			}
-			c, err := net.Dial("tcp", addr)
+			c, err := util.WebSocketDial(u, header, wsDial, tlscfg)
 			if nil != err {
-				log.Printf("[ERROR]Failed to connect websocket server:%v\n", err)
-				return false
-			}
-			c.Write([]byte(request))
-			response, err := http.ReadResponse(bufio.NewReader(c), new(http.Request))
-			//			tmpbuf := new(bytes.Buffer)
-			//			if nil != response {
-			//				response.Write(tmpbuf)
-			//				log.Printf("Recv response:%s\n", tmpbuf.String())
-			//			}
-			if nil != err || response.StatusCode != 101 {
-				log.Printf("[ERROR]Failed to handshake websocket server:%v with response:%v\n", err, response)
+				log.Printf("[ERROR]Failed to connect websocket server:%s for reason:%v\n", server, err)
 				return false
 			}
 			ws = c
-			go wsReadTask(c, ch)
+			go wsReadTask(c, lost)
 		}
 		return true
 	}
 	checkWsConnection()
+	//keep the connection alive through proxies and CDNs which drop idle websockets
+	ping := time.NewTicker(time.Duration(c4_cfg.WSPingInterval) * time.Second)
+	defer ping.Stop()
 	for {
 		select {
-		case ev := <-ch:
-			if nil == ev {
-				if nil != ws {
+		case <-ping.C:
+			if nil != ws {
+				if err := ws.Ping(nil); nil != err {
+					log.Printf("[ERROR]Failed to ping websocket server:%v\n", err)
+					//reconnect for the next event instead of pinging the closed one
 					ws.Close()
 					ws = nil
 				}
+			}
+		case c := <-lost:
+			c.Close()
+			if c == ws {
+				ws = nil
 				checkWsConnection()
 				log.Printf("Lost websocket connection:%d\n", index)
-				continue
 			}
+		case ev := <-ch:
 			buf := new(bytes.Buffer)
 			event.EncodeEvent(buf, ev)
 			chunkLen := int32(buf.Len())
-			var lenheader bytes.Buffer
-			binary.Write(&lenheader, binary.BigEndian, &chunkLen)
 			var allbuf bytes.Buffer
-			allbuf.Write(lenheader.Bytes())
+			binary.Write(&allbuf, binary.BigEndian, &chunkLen)
 			allbuf.Write(buf.Bytes())
 			data := allbuf.Bytes()
 			for {
 				for !checkWsConnection() {
 					time.Sleep(500 * time.Millisecond)
 				}
-				n, err := ws.Write(data)
+				_, err := ws.Write(data)
 				if nil != err {
 					log.Printf("[ERROR]Failed to write websocket server:%v\n", err)
 					ws.Close()
 					ws = nil
 					continue
 				}
-				if n < len(data) {
-					log.Printf("[ERROR]Unsent bytes:%d\n", len(data)-n)
-				}
 				break
 			}
 		}
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zyxar/gsnova/common"
+	"github.com/zyxar/gsnova/misc/shadowsocks"
+	"github.com/zyxar/gsnova/misc/socks"
+)
+
+//dialFunc has the signature of net.Dial
+type dialFunc func(network, addr string) (net.Conn, error)
+
+//chainHop is either an upstream proxy or a backend name, the backend is one
+//able to tunnel tcp connections or Direct
+type chainHop struct {
+	name  string
+	proxy *url.URL
+}
+
+func (hop chainHop) String() string {
+	if nil != hop.proxy {
+		return hop.proxy.Scheme + "://" + hop.proxy.Host
+	}
+	return hop.name
+}
+
+//dialChain routes the outbound dials of a backend, each hop is dialed through
+//the hops after it and the last one dials the network directly
+type dialChain struct {
+	owner string
+	hops  []chainHop
+}
+
+func (chain *dialChain) String() string {
+	s := chain.owner
+	for _, hop := range chain.hops {
+		s += " -> " + hop.String()
+	}
+	return s
+}
+
+//backends whose outbound dials may be chained
+var chainOwners = []string{GAE_NAME, C4_NAME, GOOGLE_NAME, FORWARD_NAME, SSH_NAME, SHADOWSOCKS_NAME}
+
+//backends which may be used as a hop
+var chainTunnels = []string{SSH_NAME, SHADOWSOCKS_NAME}
+
+var dialChains = make(map[string]*dialChain)
+
+func matchName(name string, names []string) (string, bool) {
+	for _, v := range names {
+		if strings.EqualFold(v, name) {
+			return v, true
+		}
+	}
+	return name, false
+}
+
+//parseDialChain parses "Owner -> hop -> ... -> Direct", a hop is a proxy url
+//of http, https, socks5 or socks5h, a tunnel backend or Direct
+func parseDialChain(v string) (*dialChain, error) {
+	ss := strings.Split(v, "->")
+	owner, ok := matchName(strings.TrimSpace(ss[0]), chainOwners)
+	if !ok {
+		return nil, fmt.Errorf("Unknown backend:%s", owner)
+	}
+	chain := &dialChain{owner: owner}
+	for i, s := range ss[1:] {
+		s = strings.TrimSpace(s)
+		last := i == len(ss)-2
+		if strings.Contains(s, "://") {
+			u, err := url.Parse(s)
+			if nil != err {
+				return nil, err
+			}
+			switch strings.ToLower(u.Scheme) {
+			case "http", "https", "socks", "socks5", "socks5h":
+			default:
+				return nil, fmt.Errorf("Unsupported proxy:%s", s)
+			}
+			if len(u.Host) == 0 {
+				return nil, fmt.Errorf("No host found in proxy:%s", s)
+			}
+			chain.hops = append(chain.hops, chainHop{proxy: u})
+			continue
+		}
+		if strings.EqualFold(s, DIRECT_NAME) {
+			if !last {
+				return nil, errors.New("Direct must be the last hop")
+			}
+			chain.hops = append(chain.hops, chainHop{name: DIRECT_NAME})
+			continue
+		}
+		name, ok := matchName(s, chainTunnels)
+		if !ok {
+			return nil, fmt.Errorf("Invalid hop:%s", s)
+		}
+		//a tunnel reaches its own server through the chain of that backend
+		if !last {
+			return nil, fmt.Errorf("%s must be the last hop", name)
+		}
+		chain.hops = append(chain.hops, chainHop{name: name})
+	}
+	if len(chain.hops) == 0 {
+		return nil, errors.New("No hop found")
+	}
+	return chain, nil
+}
+
+//chainLoop returns the loop formed by following the tunnel hops from owner
+func chainLoop(owner string) (string, bool) {
+	path := owner
+	visited := map[string]bool{owner: true}
+	for current := owner; ; {
+		chain, exist := dialChains[current]
+		if !exist {
+			return "", false
+		}
+		hop := chain.hops[len(chain.hops)-1]
+		if nil != hop.proxy || hop.name == DIRECT_NAME {
+			return "", false
+		}
+		path += " -> " + hop.name
+		if visited[hop.name] {
+			return path, true
+		}
+		visited[hop.name] = true
+		current = hop.name
+	}
+}
+
+func hasDialChain(owner string) bool {
+	_, exist := dialChains[owner]
+	return exist
+}
+
+//chainDial dials addr through the chain of the backend, or directly if it
+//has none, the timeout only applies to the connection of the first hop
+func chainDial(owner, network, addr string, timeout time.Duration) (net.Conn, error) {
+	chain, exist := dialChains[owner]
+	if !exist {
+		return net.DialTimeout(network, addr, timeout)
+	}
+	return chain.dial(0, network, addr, timeout)
+}
+
+func (chain *dialChain) dial(index int, network, addr string, timeout time.Duration) (net.Conn, error) {
+	if index >= len(chain.hops) {
+		return net.DialTimeout(network, addr, timeout)
+	}
+	hop := chain.hops[index]
+	if nil != hop.proxy {
+		next := func(n, a string) (net.Conn, error) {
+			return chain.dial(index+1, n, a, timeout)
+		}
+		return proxyDial(hop.proxy, next, network, addr)
+	}
+	switch hop.name {
+	case SSH_NAME:
+		if nil == sshManager {
+			return nil, errors.New("SSH is not enabled")
+		}
+		c := sshManager.selector.Select()
+		if nil == c {
+			return nil, errors.New("SSH not available now.")
+		}
+		return c.(*SSHRawConnection).Dial(network, addr)
+	case SHADOWSOCKS_NAME:
+		manager, ok := registedRemoteConnManager[SHADOWSOCKS_NAME].(*Shadowsocks)
+		if !ok {
+			return nil, errors.New("Shadowsocks is not enabled")
+		}
+		c := manager.selector.Select()
+		if nil == c {
+			return nil, errors.New("Shadowsocks not available now.")
+		}
+		server := c.(*shadowsocksServer)
+		conn, err := chainDial(SHADOWSOCKS_NAME, "tcp", server.Server, timeout)
+		if nil != err {
+			return nil, err
+		}
+		return shadowsocks.Client(conn, addr, server.cipher)
+	}
+	return net.DialTimeout(network, addr, timeout)
+}
+
+//proxyAddress returns host:port of the proxy url with the default port of
+//the scheme if none is given
+func proxyAddress(u *url.URL) string {
+	if _, _, err := net.SplitHostPort(u.Host); nil == err {
+		return u.Host
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+		return net.JoinHostPort(u.Host, "443")
+	case "socks", "socks5", "socks5h":
+		return net.JoinHostPort(u.Host, "1080")
+	}
+	return net.JoinHostPort(u.Host, "80")
+}
+
+//bufferedConn keeps the data read ahead while parsing the proxy response
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+//proxyDial connects addr through the proxy which is reached by forward
+func proxyDial(u *url.URL, forward dialFunc, network, addr string) (net.Conn, error) {
+	scheme := strings.ToLower(u.Scheme)
+	if strings.HasPrefix(scheme, "socks") {
+		proxy := &socks.Proxy{Addr: proxyAddress(u), Forward: forward}
+		if nil != u.User {
+			proxy.Username = u.User.Username()
+			proxy.Password, _ = u.User.Password()
+		}
+		if scheme == "socks5" {
+			if host, port, err := net.SplitHostPort(addr); nil == err && nil == net.ParseIP(host) {
+				if ips, err := net.LookupIP(host); nil == err && len(ips) > 0 {
+					addr = net.JoinHostPort(ips[0].String(), port)
+				}
+			}
+		}
+		return proxy.Dial(network, addr)
+	}
+	auth := getProxyAuth(u)
+	var c net.Conn
+	var reader *bufio.Reader
+	for retry := 0; ; retry++ {
+		if nil == c {
+			var err error
+			if c, err = forward("tcp", proxyAddress(u)); nil != err {
+				return nil, err
+			}
+			if scheme == "https" {
+				tlsConn := tls.Client(c, &tls.Config{ServerName: u.Hostname()})
+				if err = tlsConn.Handshake(); nil != err {
+					c.Close()
+					return nil, err
+				}
+				c = tlsConn
+			}
+			reader = bufio.NewReader(c)
+		}
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if nil != auth {
+			req.Header.Set("Proxy-Authorization", auth.authorization("CONNECT", addr))
+		}
+		if err := req.Write(c); nil != err {
+			c.Close()
+			return nil, err
+		}
+		res, err := http.ReadResponse(reader, req)
+		if nil != err {
+			c.Close()
+			return nil, err
+		}
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			return &bufferedConn{c, reader}, nil
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusProxyAuthRequired || nil == auth || retry > 0 || !auth.challenge(res) {
+			c.Close()
+			return nil, fmt.Errorf("Proxy %s refused to connect %s:%s", u.Host, addr, res.Status)
+		}
+		if res.Close {
+			c.Close()
+			c = nil
+		}
+	}
+}
+
+//InitChains loads the [Chain] section, it has to be done before the backends
+//are initialized since a chain replaces the Proxy option of its backend
+func InitChains() {
+	for index := 0; ; index++ {
+		v, exist := common.Cfg.GetProperty("Chain", "Chain["+strconv.Itoa(index)+"]")
+		if !exist || len(v) == 0 {
+			break
+		}
+		chain, err := parseDialChain(v)
+		if nil != err {
+			log.Printf("[WARN]Invalid chain:%s for reason:%v\n", v, err)
+			continue
+		}
+		if _, exist := dialChains[chain.owner]; exist {
+			log.Printf("[WARN]Duplicate chain of %s:%s\n", chain.owner, v)
+			continue
+		}
+		dialChains[chain.owner] = chain
+		if loop, found := chainLoop(chain.owner); found {
+			log.Printf("[WARN]Chain:%s ignored since it forms a loop:%s\n", v, loop)
+			delete(dialChains, chain.owner)
+			continue
+		}
+		log.Printf("Chain %s\n", chain)
+	}
+}
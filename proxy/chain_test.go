@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseDialChain(t *testing.T) {
+	chain, err := parseDialChain("ssh -> socks5h://u:p@127.0.0.1:1080 -> http://proxy -> Direct")
+	if nil != err || chain.String() != "SSH -> socks5h://127.0.0.1:1080 -> http://proxy -> Direct" {
+		t.Fatalf("unexpected chain:%v %v", chain, err)
+	}
+	for _, v := range []string{
+		"Unknown -> Direct",
+		"GAE",
+		"GAE -> Direct -> SSH",
+		"GAE -> SSH -> Direct",
+		"GAE -> ftp://proxy",
+		"GAE -> GAE",
+	} {
+		if _, err := parseDialChain(v); nil == err {
+			t.Fatalf("%s should be invalid", v)
+		}
+	}
+}
+
+func TestDialChainLoop(t *testing.T) {
+	defer func() {
+		dialChains = make(map[string]*dialChain)
+	}()
+	for _, v := range []string{"GAE -> SSH", "SSH -> Shadowsocks", "Shadowsocks -> http://proxy -> Direct"} {
+		chain, _ := parseDialChain(v)
+		dialChains[chain.owner] = chain
+	}
+	if loop, found := chainLoop(GAE_NAME); found {
+		t.Fatalf("unexpected loop:%s", loop)
+	}
+	chain, _ := parseDialChain("Shadowsocks -> SSH")
+	dialChains[chain.owner] = chain
+	if loop, found := chainLoop(SHADOWSOCKS_NAME); !found || loop != "Shadowsocks -> SSH -> Shadowsocks" {
+		t.Fatalf("loop not found:%s", loop)
+	}
+}
+
+func TestDialChainProxies(t *testing.T) {
+	defer func() {
+		dialChains = make(map[string]*dialChain)
+	}()
+	//the target speaks first, which must not be lost with the proxy response
+	target, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if nil == err {
+			c.Write([]byte("banner"))
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+	inner := new(digestProxy)
+	outer := new(digestProxy)
+	innerServer := httptest.NewServer(inner)
+	defer innerServer.Close()
+	outerServer := httptest.NewServer(outer)
+	defer outerServer.Close()
+
+	chain, err := parseDialChain("Forward -> http://user:pass@" + innerServer.Listener.Addr().String() +
+		" -> http://user:pass@" + outerServer.Listener.Addr().String() + " -> Direct")
+	if nil != err {
+		t.Fatal(err)
+	}
+	dialChains[chain.owner] = chain
+	c, err := chainDial(FORWARD_NAME, "tcp", target.Addr().String(), time.Second)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	banner := make([]byte, 6)
+	if _, err = io.ReadFull(c, banner); nil != err || string(banner) != "banner" {
+		t.Fatalf("unexpected banner:%q %v", banner, err)
+	}
+	c.Write([]byte("ping"))
+	pong := make([]byte, 4)
+	if _, err = io.ReadFull(c, pong); nil != err || string(pong) != "ping" {
+		t.Fatalf("unexpected echo:%q %v", pong, err)
+	}
+	if atomic.LoadInt32(&inner.challenges) != 1 || atomic.LoadInt32(&outer.challenges) != 1 {
+		t.Fatalf("unexpected challenges:%d %d", inner.challenges, outer.challenges)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/zyxar/gsnova/event"
@@ -25,11 +26,6 @@ const (
 	STATE_RECV_TCP        = 3
 	STATE_SESSION_CLOSE   = 4
 
-	GLOBAL_PROXY_SERVER = 1
-	GAE_PROXY_SERVER    = 2
-	C4_PROXY_SERVER     = 3
-	SSH_PROXY_SERVER    = 4
-
 	GAE_NAME                 = "GAE"
 	C4_NAME                  = "C4"
 	GOOGLE_NAME              = "Google"
@@ -38,6 +34,7 @@ const (
 	GOOGLE_HTTPS_DIRECT_NAME = "GoogleHttpsDirect"
 	FORWARD_NAME             = "Forward"
 	SSH_NAME                 = "SSH"
+	SHADOWSOCKS_NAME         = "Shadowsocks"
 	AUTO_NAME                = "Auto"
 	DIRECT_NAME              = "Direct"
 	DEFAULT_NAME             = "Default"
@@ -50,6 +47,7 @@ const (
 	ATTR_SYS_DNS        = "SysDNS"
 	ATTR_PREFER_HOSTS   = "PreferHosts"
 	ATTR_APP            = "App"
+	ATTR_LEARNING       = "Learning"
 
 	MODE_HTTP    = "http"
 	MODE_HTTPS   = "httpS"
@@ -59,6 +57,13 @@ const (
 
 var total_proxy_conn_num uint32
 
+var session_seed uint32
+
+//NewSessionID returns the id of a new local session
+func NewSessionID() uint32 {
+	return atomic.AddUint32(&session_seed, 1)
+}
+
 type RemoteConnection interface {
 	Request(conn *SessionConnection, ev event.Event) (err error, res event.Event)
 	GetConnectionManager() RemoteConnectionManager
@@ -78,7 +83,7 @@ type SessionConnection struct {
 	RemoteConn      RemoteConnection
 	State           uint32
 	Type            uint32
-	ProxyServerType int
+	ProxyServer     string
 }
 
 func newSessionConnection(sessionId uint32, conn net.Conn, reader *bufio.Reader) *SessionConnection {
@@ -131,8 +136,7 @@ func (session *SessionConnection) processHttpEvent(ev *event.HTTPRequestEvent) e
 		rmanager := session.RemoteConn.GetConnectionManager()
 		matched := false
 		for _, proxy := range proxies {
-			proxyName := adjustProxyName(proxy.GetName(), session.Type == HTTPS_TUNNEL)
-			if rmanager.GetName() == proxyName {
+			if rmanager.GetName() == proxy.GetName() {
 				matched = true
 				break
 			}
@@ -188,6 +192,8 @@ func (session *SessionConnection) process() error {
 			req, e := http.ReadRequest(session.LocalBufferConn)
 			if nil != req {
 				req.Header.Del("Proxy-Connection")
+				//the Client rules of SPAC match the browser address
+				req.RemoteAddr = session.LocalRawConn.RemoteAddr().String()
 			}
 			if needCheckRemote {
 				var zero time.Time
@@ -257,7 +263,9 @@ func (f *ForwardSocksDialer) DialTCP(n string, laddr *net.TCPAddr, raddr string)
 	return conn, err
 }
 
-func HandleConn(sessionId uint32, conn net.Conn, proxyServerType int) {
+//HandleConn serves a local connection, proxyServer is the backend name of a
+//dedicated listener, or empty for the SPAC selected proxies
+func HandleConn(sessionId uint32, conn net.Conn, proxyServer string) {
 	total_proxy_conn_num = total_proxy_conn_num + 1
 	defer func() {
 		total_proxy_conn_num = total_proxy_conn_num - 1
@@ -286,7 +294,7 @@ func HandleConn(sessionId uint32, conn net.Conn, proxyServerType int) {
 	}
 
 	session := newSessionConnection(sessionId, conn, bufreader)
-	session.ProxyServerType = proxyServerType
+	session.ProxyServer = proxyServer
 	if strings.EqualFold(string(b), "Connect") {
 		session.Type = HTTPS_TUNNEL
 	} else {
@@ -1,11 +1,15 @@
 package proxy
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
 	"net"
+	"strings"
 	"sync"
 	"time"
-
-	"github.com/yinqiwen/godns"
 )
 
 var blockVerifyCache = make(map[string]bool)
@@ -64,48 +68,231 @@ func isTCPAddressBlocked(ip, port string) bool {
 	return false
 }
 
-func trustedDNSLookup(host string) (string, bool) {
-	net := "tcp"
-	//for DNSEncrypt
-	if len(trustedDNS) > 0 && trustedDNS[0] == "127.0.0.1" {
-		net = "udp"
-	}
-	options := &godns.LookupOptions{
-		DNSServers: trustedDNS,
-		Net:        net,
-		CacheTTL:   godns.DNS_CACHE_TTL_SELF,
-		OnlyIPv4:   true}
-	if ips, err := godns.LookupIP(host, options); nil == err {
-		for _, ip := range ips {
-			if nil != ip.To4() {
-				return ip.String(), true
-			}
+//trustedDNSIPv4 returns the IPv4 addresses of host resolved by the trusted
+//DNS, the answers are shared with the SPAC filters by spacDNS
+func trustedDNSIPv4(host string) []net.IP {
+	ips, _ := spacDNS.lookup(host, 0)
+	var v4 []net.IP
+	for _, ip := range ips {
+		if nil != ip.To4() {
+			v4 = append(v4, ip)
 		}
 	}
+	return v4
+}
+
+func trustedDNSLookup(host string) (string, bool) {
+	if ips := trustedDNSIPv4(host); len(ips) > 0 {
+		return ips[0].String(), true
+	}
 	return host, false
 }
 
 func trustedDNSQuery(host string, port string) (string, bool) {
-	net := "tcp"
+	for _, ip := range trustedDNSIPv4(host) {
+		blocked := isTCPAddressBlocked(ip.String(), port)
+		if !blocked {
+			return ip.String(), true
+		}
+	}
+	return "", false
+}
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+var errDNSTruncated = errors.New("Truncated DNS response")
+var errDNSMismatch = errors.New("Mismatched DNS response")
+
+//dnsQueryMessage builds the query of the records of host in qtype
+func dnsQueryMessage(id uint16, host string, qtype uint16) ([]byte, error) {
+	msg := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.New("Invalid domain name:" + host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1), nil
+}
+
+//skipDNSName returns the offset after the name at offset
+func skipDNSName(msg []byte, offset int) (int, error) {
+	for offset < len(msg) {
+		switch n := int(msg[offset]); {
+		case n == 0:
+			return offset + 1, nil
+		case n&0xc0 == 0xc0:
+			return offset + 2, nil
+		default:
+			offset += n + 1
+		}
+	}
+	return 0, errors.New("Invalid DNS message")
+}
+
+//parseDNSResponse returns the records of the type in the query and the
+//minimal TTL of the answer, the TTL of a negative answer is from the SOA
+//record if there is one, it is negative if the answer has no TTL. The
+//response must have the id and the question of the query.
+func parseDNSResponse(query, msg []byte) ([]net.IP, time.Duration, error) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return nil, 0, errors.New("Invalid DNS response")
+	}
+	question := query[12:]
+	if !bytes.Equal(msg[:2], query[:2]) || binary.BigEndian.Uint16(msg[4:]) != 1 || len(msg) < 12+len(question) || !bytes.EqualFold(msg[12:12+len(question)], question) {
+		return nil, 0, errDNSMismatch
+	}
+	if msg[2]&0x02 != 0 {
+		return nil, 0, errDNSTruncated
+	}
+	rcode := msg[3] & 0x0f
+	if rcode != 0 && rcode != 3 {
+		return nil, 0, errors.New("DNS server failure")
+	}
+	qtype := binary.BigEndian.Uint16(question[len(question)-4:])
+	offset := 12 + len(question)
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	records := answers + int(binary.BigEndian.Uint16(msg[8:]))
+	var ips []net.IP
+	var err error
+	ttl := time.Duration(-1)
+	for i := 0; i < records; i++ {
+		if offset, err = skipDNSName(msg, offset); nil != err {
+			return nil, 0, err
+		}
+		if offset+10 > len(msg) {
+			return nil, 0, errors.New("Invalid DNS message")
+		}
+		typ := binary.BigEndian.Uint16(msg[offset:])
+		recordTTL := time.Duration(binary.BigEndian.Uint32(msg[offset+4:])) * time.Second
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return nil, 0, errors.New("Invalid DNS message")
+		}
+		rdata := msg[offset : offset+length]
+		offset += length
+		switch {
+		case i < answers && typ == qtype && typ == dnsTypeA && length == net.IPv4len:
+			ips = append(ips, net.IPv4(rdata[0], rdata[1], rdata[2], rdata[3]))
+		case i < answers && typ == qtype && typ == dnsTypeAAAA && length == net.IPv6len:
+			ips = append(ips, net.IP(append([]byte{}, rdata...)))
+		case i < answers && typ == 5:
+			//the CNAME chain expires with any of its records
+		case i >= answers && typ == 6 && length >= 20 && len(ips) == 0:
+			//the minimum field of SOA limits the TTL of a negative answer
+			if minimum := time.Duration(binary.BigEndian.Uint32(rdata[length-4:])) * time.Second; minimum < recordTTL {
+				recordTTL = minimum
+			}
+		default:
+			continue
+		}
+		if ttl < 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	return ips, ttl, nil
+}
+
+//dnsExchange queries the records of host in qtype, the truncated answer
+//over udp is queried again over tcp
+func dnsExchange(server, network, host string, qtype uint16, timeout time.Duration) ([]net.IP, time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); nil != err {
+		server = net.JoinHostPort(server, "53")
+	}
+	id := uint16(rand.Intn(65536))
+	query, err := dnsQueryMessage(id, host, qtype)
+	if nil != err {
+		return nil, 0, err
+	}
+	c, err := net.DialTimeout(network, server, timeout)
+	if nil != err {
+		return nil, 0, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	msg := make([]byte, 65536)
+	if network == "udp" {
+		if _, err = c.Write(query); nil != err {
+			return nil, 0, err
+		}
+		//the mismatched responses are ignored until the deadline
+		for {
+			n, err := c.Read(msg)
+			if nil != err {
+				return nil, 0, err
+			}
+			ips, ttl, err := parseDNSResponse(query, msg[:n])
+			switch err {
+			case errDNSMismatch:
+				continue
+			case errDNSTruncated:
+				c.Close()
+				return dnsExchange(server, "tcp", host, qtype, timeout)
+			}
+			return ips, ttl, err
+		}
+	}
+	length := []byte{byte(len(query) >> 8), byte(len(query))}
+	if _, err = c.Write(append(length, query...)); nil != err {
+		return nil, 0, err
+	}
+	if _, err = io.ReadFull(c, length); nil != err {
+		return nil, 0, err
+	}
+	msg = msg[:binary.BigEndian.Uint16(length)]
+	if _, err = io.ReadFull(c, msg); nil != err {
+		return nil, 0, err
+	}
+	return parseDNSResponse(query, msg)
+}
+
+//dnsResolve queries the A and AAAA records of host at the same time, the
+//failure of AAAA is ignored for the servers without IPv6
+func dnsResolve(server, network, host string, timeout time.Duration) ([]net.IP, time.Duration, error) {
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	v6 := make(chan answer, 1)
+	go func() {
+		ips, ttl, err := dnsExchange(server, network, host, dnsTypeAAAA, timeout)
+		v6 <- answer{ips, ttl, err}
+	}()
+	ips, ttl, err := dnsExchange(server, network, host, dnsTypeA, timeout)
+	res := <-v6
+	if nil != err {
+		return nil, 0, err
+	}
+	if nil == res.err {
+		ips = append(ips, res.ips...)
+		if ttl < 0 || (res.ttl >= 0 && res.ttl < ttl) {
+			ttl = res.ttl
+		}
+	}
+	return ips, ttl, nil
+}
+
+//trustedDNSResolve queries the trusted DNS servers, the TTL of the answer is
+//returned for the caches
+func trustedDNSResolve(host string, timeout time.Duration) ([]net.IP, time.Duration, error) {
+	network := "tcp"
 	//for DNSEncrypt
 	if len(trustedDNS) > 0 && trustedDNS[0] == "127.0.0.1" {
-		net = "udp"
-	}
-	options := &godns.LookupOptions{
-		DNSServers: trustedDNS,
-		Net:        net,
-		CacheTTL:   godns.DNS_CACHE_TTL_SELF,
-		OnlyIPv4:   true}
-	if ips, err := godns.LookupIP(host, options); nil == err {
-		for _, ip := range ips {
-			if nil != ip.To4() {
-				blocked := isTCPAddressBlocked(ip.String(), port)
-				if !blocked {
-					return ip.String(), true
-				}
-			}
+		network = "udp"
+	}
+	err := errors.New("No trusted DNS server")
+	for _, server := range trustedDNS {
+		var ips []net.IP
+		var ttl time.Duration
+		if ips, ttl, err = dnsResolve(server, network, host, timeout); nil == err {
+			return ips, ttl, nil
 		}
-		return "", false
 	}
-	return "", false
+	return nil, 0, err
 }
@@ -3,6 +3,7 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
@@ -35,6 +36,8 @@ type ForwardConnection struct {
 	prefer_hosts     bool
 	closed           bool
 	checkChannel     chan int
+	//learn the blocked hosts from the direct requests
+	learning bool
 }
 
 func (conn *ForwardConnection) Close() error {
@@ -61,6 +64,10 @@ func (conn *ForwardConnection) dialRemote(addr string, lookup_trusted_dns bool)
 	//			lookup_trusted_dns = true
 	//		}
 	//	}
+	//nothing to look up for ip addresses
+	if host, _, err := net.SplitHostPort(addr); nil == err && nil != net.ParseIP(host) {
+		lookup_trusted_dns = false
+	}
 	if lookup_trusted_dns {
 		if newaddr, success := lookupAvailableAddress(addr, !conn.prefer_hosts); !success {
 			return nil, fmt.Errorf("No available IP found for %s", addr)
@@ -69,16 +76,44 @@ func (conn *ForwardConnection) dialRemote(addr string, lookup_trusted_dns bool)
 			addr = newaddr
 		}
 	}
-	c, err := net.DialTimeout("tcp", addr, timeout)
+	dial := net.DialTimeout
+	if conn.manager.overProxy {
+		dial = func(network, addr string, timeout time.Duration) (net.Conn, error) {
+			return chainDial(FORWARD_NAME, network, addr, timeout)
+		}
+	}
+	c, err := dial("tcp", addr, timeout)
 	if nil != err && !lookup_trusted_dns {
 		if tmp, success := lookupAvailableAddress(addr, !conn.prefer_hosts); success {
 			//conn.try_inject_crlf = true
-			c, err = net.DialTimeout("tcp", tmp, timeout)
+			c, err = dial("tcp", tmp, timeout)
 		}
 	}
 	return c, err
 }
 
+//resolveLocally resolves the host of addr before handing it to a socks5 proxy
+func (conn *ForwardConnection) resolveLocally(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if nil != err || nil != net.ParseIP(host) {
+		return addr
+	}
+	if !conn.use_sys_dns {
+		if newaddr, success := lookupAvailableAddress(addr, !conn.prefer_hosts); success {
+			return newaddr
+		}
+	}
+	if ips, err := net.LookupIP(host); nil == err && len(ips) > 0 {
+		return net.JoinHostPort(ips[0].String(), port)
+	}
+	return addr
+}
+
+//viaHttpProxy is true if requests are relayed by an upstream http/https proxy
+func (conn *ForwardConnection) viaHttpProxy() bool {
+	return conn.manager.overProxy && !strings.HasPrefix(strings.ToLower(conn.conn_url.Scheme), "socks")
+}
+
 func (conn *ForwardConnection) initForwardConn(proxyAddr string, isHttps bool) error {
 	if !strings.Contains(proxyAddr, ":") {
 		proxyAddr = proxyAddr + ":80"
@@ -96,7 +131,8 @@ func (conn *ForwardConnection) initForwardConn(proxyAddr string, isHttps bool) e
 		return err
 	}
 
-	addr := conn.conn_url.Host
+	scheme := strings.ToLower(conn.conn_url.Scheme)
+	addr := proxyAddress(conn.conn_url)
 	lookup_trusted_dns := false
 	if !conn.manager.overProxy {
 		if isHttps || (conn.manager.inject_crlf) {
@@ -108,16 +144,37 @@ func (conn *ForwardConnection) initForwardConn(proxyAddr string, isHttps bool) e
 		lookup_trusted_dns = false
 	}
 
-	isSocks := strings.HasPrefix(strings.ToLower(conn.conn_url.Scheme), "socks")
-	if !isSocks {
-		conn.forward_conn, err = conn.dialRemote(addr, lookup_trusted_dns)
-	} else {
-		proxy := &socks.Proxy{Addr: conn.conn_url.Host}
+	switch scheme {
+	case "socks", "socks5", "socks5h":
+		proxy := &socks.Proxy{Addr: addr, Forward: func(network, addr string) (net.Conn, error) {
+			return chainDial(FORWARD_NAME, network, addr, 10*time.Second)
+		}}
 		if nil != conn.conn_url.User {
 			proxy.Username = conn.conn_url.User.Username()
 			proxy.Password, _ = conn.conn_url.User.Password()
 		}
-		conn.forward_conn, err = proxy.Dial("tcp", proxyAddr)
+		target := proxyAddr
+		//like curl, socks5:// resolves the target locally while socks5h:// and
+		//socks:// leave the name to the proxy
+		if scheme == "socks5" {
+			target = conn.resolveLocally(proxyAddr)
+		}
+		conn.forward_conn, err = proxy.Dial("tcp", target)
+	case "https":
+		var c net.Conn
+		if c, err = conn.dialRemote(addr, lookup_trusted_dns); nil == err {
+			tlsConn := tls.Client(c, &tls.Config{ServerName: conn.conn_url.Hostname()})
+			c.SetDeadline(time.Now().Add(10 * time.Second))
+			if err = tlsConn.Handshake(); nil != err {
+				c.Close()
+			} else {
+				var zero time.Time
+				c.SetDeadline(zero)
+				conn.forward_conn = tlsConn
+			}
+		}
+	default:
+		conn.forward_conn, err = conn.dialRemote(addr, lookup_trusted_dns)
 	}
 	if nil != err {
 		log.Printf("Failed to dial address:%s for reason:%s\n", addr, err.Error())
@@ -138,11 +195,80 @@ func (conn *ForwardConnection) GetConnectionManager() RemoteConnectionManager {
 	return conn.manager
 }
 
+//proxyRequestURI is the request uri written by http.Request.WriteProxy
+func proxyRequestURI(req *http.Request) string {
+	if len(req.URL.Scheme) == 0 || len(req.URL.Opaque) > 0 {
+		return req.URL.RequestURI()
+	}
+	host := req.Host
+	if len(host) == 0 {
+		host = req.URL.Host
+	}
+	return req.URL.Scheme + "://" + host + req.URL.RequestURI()
+}
+
+//connectProxy asks the upstream http/https proxy for a tunnel to addr,
+//answering one authentication challenge if the proxy sends one
+func (conn *ForwardConnection) connectProxy(addr string) error {
+	auth := getProxyAuth(conn.conn_url)
+	for retry := 0; ; retry++ {
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if nil != auth {
+			req.Header.Set("Proxy-Authorization", auth.authorization("CONNECT", addr))
+		}
+		if err := req.Write(conn.forward_conn); nil != err {
+			return err
+		}
+		res, err := http.ReadResponse(conn.buf_forward_conn, req)
+		if nil != err {
+			return err
+		}
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			return nil
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusProxyAuthRequired || nil == auth || retry > 0 || !auth.challenge(res) {
+			return fmt.Errorf("Proxy %s refused to connect %s:%s", conn.conn_url.Host, addr, res.Status)
+		}
+		if res.Close {
+			conn.Close()
+			if err = conn.initForwardConn(addr, true); nil != err {
+				return err
+			}
+		}
+	}
+}
+
+//dialTunnel connects addr directly or through the upstream proxy and returns
+//the raw stream, it is closed with the connection
+func (conn *ForwardConnection) dialTunnel(addr string) (net.Conn, error) {
+	if err := conn.initForwardConn(addr, true); nil != err {
+		return nil, err
+	}
+	if conn.viaHttpProxy() {
+		if err := conn.connectProxy(addr); nil != err {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &bufferedConn{Conn: conn.forward_conn, reader: conn.buf_forward_conn}, nil
+}
+
 func (conn *ForwardConnection) writeHttpRequest(req *http.Request) error {
 	var err error
 	index := 0
 	for {
-		if conn.manager.overProxy {
+		if conn.viaHttpProxy() {
+			if auth := getProxyAuth(conn.conn_url); nil != auth {
+				req.Header.Set("Proxy-Authorization", auth.authorization(req.Method, proxyRequestURI(req)))
+			}
+			err = req.WriteProxy(conn.forward_conn)
+		} else if conn.manager.overProxy {
 			err = req.WriteProxy(conn.forward_conn)
 		} else {
 			err = req.Write(conn.forward_conn)
@@ -188,14 +314,31 @@ func (auto *ForwardConnection) Request(conn *SessionConnection, ev event.Event)
 		err = auto.initForwardConn(addr, conn.Type == HTTPS_TUNNEL)
 		if nil != err {
 			log.Printf("Failed to connect forward address for %s.\n", addr)
+			if auto.learning {
+				learnBlocked(addr, err, conn.Type != HTTPS_TUNNEL || auto.use_sys_dns)
+			}
 			return err, nil
 		}
 		if conn.Type == HTTPS_TUNNEL {
 			log.Printf("Session[%d]Request %s\n", req.GetHash(), util.GetURLString(req.RawReq, true))
-			if !auto.manager.overProxy || strings.HasPrefix(auto.conn_url.Scheme, "socks") {
-				conn.LocalRawConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
-			} else {
-				auto.writeHttpRequest(req.RawReq)
+			if auto.viaHttpProxy() {
+				if err = auto.connectProxy(addr); nil != err {
+					log.Printf("Session[%d]Failed to connect %s for reason:%v\n", req.GetHash(), addr, err)
+					auto.Close()
+					return err, nil
+				}
+			}
+			conn.LocalRawConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			if auto.learning {
+				if err = auto.probeTunnel(conn, addr); nil != err {
+					log.Printf("Session[%d]Tunnel to %s is blocked for reason:%v\n", req.GetHash(), addr, err)
+					auto.Close()
+					return err, nil
+				}
+			}
+			if n := auto.buf_forward_conn.Buffered(); n > 0 {
+				data, _ := auto.buf_forward_conn.Peek(n)
+				conn.LocalRawConn.Write(data)
 			}
 			go f(conn.LocalRawConn, auto.forward_conn)
 			go f(auto.forward_conn, conn.LocalRawConn)
@@ -224,8 +367,30 @@ func (auto *ForwardConnection) Request(conn *SessionConnection, ev event.Event)
 			resp, err := http.ReadResponse(auto.buf_forward_conn, req.RawReq)
 			if err != nil {
 				log.Printf("Session[%d]Recv response with error %v\n", ev.GetHash(), err)
+				if auto.learning && isResetError(err) {
+					learnBlocked(addr, err, false)
+				}
 				return err, nil
 			}
+			//requests with a body can not be replayed, the proxy's 407 goes to the client then
+			if resp.StatusCode == http.StatusProxyAuthRequired && auto.viaHttpProxy() && req.RawReq.ContentLength == 0 {
+				if auth := getProxyAuth(auto.conn_url); nil != auth && auth.challenge(resp) {
+					resp.Body.Close()
+					if resp.Close {
+						auto.Close()
+						if err = auto.initForwardConn(addr, false); nil != err {
+							return err, nil
+						}
+					}
+					if err = auto.writeHttpRequest(req.RawReq); nil != err {
+						return err, nil
+					}
+					if resp, err = http.ReadResponse(auto.buf_forward_conn, req.RawReq); nil != err {
+						log.Printf("Session[%d]Recv response with error %v\n", ev.GetHash(), err)
+						return err, nil
+					}
+				}
+			}
 			//log.Printf("Session[%d]Recv response  %v\n", ev.GetHash(), resp)
 			err = resp.Write(conn.LocalRawConn)
 			resp.Body.Close()
@@ -282,6 +447,9 @@ func (manager *Forward) GetRemoteConnection(ev event.Event, attrs map[string]str
 	if containsAttr(attrs, ATTR_PREFER_HOSTS) {
 		g.prefer_hosts = true
 	}
+	if containsAttr(attrs, ATTR_LEARNING) && !manager.overProxy {
+		g.learning = true
+	}
 	atomic.AddInt32(&total_forwared_conn_num, 1)
 	return g, nil
 }
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+//proxyAuth answers the Proxy-Authenticate challenges of an upstream proxy with
+//the credentials given in the proxy url. Basic is sent preemptively, Digest
+//is used once the proxy asked for it.
+type proxyAuth struct {
+	user   string
+	pass   string
+	mutex  sync.Mutex
+	digest map[string]string
+	nc     uint32
+}
+
+var proxyAuthTable = make(map[string]*proxyAuth)
+var proxyAuthMutex sync.Mutex
+
+//getProxyAuth returns the shared auth state of the upstream proxy, or nil if
+//there is no user info in the url
+func getProxyAuth(u *url.URL) *proxyAuth {
+	if nil == u || nil == u.User {
+		return nil
+	}
+	key := u.User.String() + "@" + u.Host
+	proxyAuthMutex.Lock()
+	defer proxyAuthMutex.Unlock()
+	auth, exist := proxyAuthTable[key]
+	if !exist {
+		auth = &proxyAuth{user: u.User.Username()}
+		auth.pass, _ = u.User.Password()
+		proxyAuthTable[key] = auth
+	}
+	return auth
+}
+
+//parseAuthParams parses the comma separated key=value or key="value" list
+//after the scheme of a challenge
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			end := 1
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' {
+					end++
+				}
+			}
+			if end > len(s) {
+				end = len(s)
+			}
+			value = strings.Replace(s[1:end], "\\", "", -1)
+			if end < len(s) {
+				end++
+			}
+			s = s[end:]
+		} else {
+			end := strings.Index(s, ",")
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
+
+//challenge checks the Proxy-Authenticate headers of a 407 response, it
+//returns true if the request should be retried with new credentials
+func (auth *proxyAuth) challenge(res *http.Response) bool {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	for _, v := range res.Header[http.CanonicalHeaderKey("Proxy-Authenticate")] {
+		v = strings.TrimSpace(v)
+		if len(v) < 7 || !strings.EqualFold(v[:7], "Digest ") {
+			continue
+		}
+		params := parseAuthParams(v[7:])
+		if algorithm := params["algorithm"]; len(algorithm) > 0 &&
+			!strings.EqualFold(algorithm, "MD5") && !strings.EqualFold(algorithm, "MD5-sess") {
+			continue
+		}
+		//a rejected nonce is only worth another try if the proxy says it is stale
+		retry := nil == auth.digest || strings.EqualFold(params["stale"], "true")
+		auth.digest = params
+		auth.nc = 0
+		return retry
+	}
+	return false
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+//authorization returns the Proxy-Authorization value of the request
+func (auth *proxyAuth) authorization(method, uri string) string {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	if nil == auth.digest {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth.user+":"+auth.pass))
+	}
+	realm, nonce := auth.digest["realm"], auth.digest["nonce"]
+	b := make([]byte, 8)
+	rand.Read(b)
+	cnonce := hex.EncodeToString(b)
+	ha1 := md5Hex(auth.user + ":" + realm + ":" + auth.pass)
+	if strings.EqualFold(auth.digest["algorithm"], "MD5-sess") {
+		ha1 = md5Hex(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := md5Hex(method + ":" + uri)
+	v := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, auth.user, realm, nonce, uri)
+	qop := ""
+	for _, q := range strings.Split(auth.digest["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	if len(qop) > 0 {
+		auth.nc++
+		nc := fmt.Sprintf("%08x", auth.nc)
+		v += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s", response="%s"`, qop, nc, cnonce,
+			md5Hex(ha1+":"+nonce+":"+nc+":"+cnonce+":"+qop+":"+ha2))
+	} else {
+		v += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+nonce+":"+ha2))
+	}
+	if algorithm := auth.digest["algorithm"]; len(algorithm) > 0 {
+		v += ", algorithm=" + algorithm
+	}
+	if opaque, exist := auth.digest["opaque"]; exist {
+		v += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return v
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zyxar/gsnova/event"
+)
+
+//digestProxy is an upstream proxy requiring digest auth of user:pass
+type digestProxy struct {
+	challenges int32
+}
+
+func (p *digestProxy) authorized(r *http.Request) bool {
+	v := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(v, "Digest ") {
+		return false
+	}
+	params := parseAuthParams(v[7:])
+	if params["username"] != "user" || params["nonce"] != "abc" {
+		return false
+	}
+	ha1 := md5Hex("user:gsnova:pass")
+	ha2 := md5Hex(r.Method + ":" + params["uri"])
+	expected := md5Hex(ha1 + ":abc:" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+	return params["response"] == expected
+}
+
+func (p *digestProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.authorized(r) {
+		atomic.AddInt32(&p.challenges, 1)
+		w.Header().Set("Proxy-Authenticate", `Digest realm="gsnova", nonce="abc", qop="auth"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == "CONNECT" {
+		remote, err := net.Dial("tcp", r.Host)
+		if nil != err {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		local, buf, _ := w.(http.Hijacker).Hijack()
+		go io.Copy(remote, buf)
+		io.Copy(local, remote)
+		local.Close()
+		return
+	}
+	res, err := http.DefaultTransport.RoundTrip(&http.Request{Method: r.Method, URL: r.URL, Header: make(http.Header)})
+	if nil != err {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+func newForwardSession(target string) (*Forward, *SessionConnection, net.Conn) {
+	manager := &Forward{overProxy: true, target: target}
+	local, browser := net.Pipe()
+	session := newSessionConnection(1, local, bufio.NewReader(local))
+	return manager, session, browser
+}
+
+func TestForwardDigestProxyHttp(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer web.Close()
+	upstream := new(digestProxy)
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	manager, session, browser := newForwardSession("http://user:pass@" + server.Listener.Addr().String())
+	req, _ := http.NewRequest("GET", web.URL+"/world", nil)
+	req.Header.Set("Connection", "close")
+	var ev event.HTTPRequestEvent
+	ev.FromRequest(req)
+	conn, _ := manager.GetRemoteConnection(&ev, nil)
+	done := make(chan error, 1)
+	go func() {
+		err, _ := conn.Request(session, &ev)
+		done <- err
+	}()
+	res, err := http.ReadResponse(bufio.NewReader(browser), req)
+	if nil != err {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "hello /world" {
+		t.Fatalf("unexpected response:%s %q", res.Status, body)
+	}
+	if err = <-done; nil != err {
+		t.Fatal(err)
+	}
+	//the first request is answered by the Basic credentials sent preemptively
+	if n := atomic.LoadInt32(&upstream.challenges); n != 1 {
+		t.Fatalf("expected one challenge, got %d", n)
+	}
+}
+
+func TestForwardDigestProxyTunnel(t *testing.T) {
+	echo, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if nil == err {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+	server := httptest.NewServer(new(digestProxy))
+	defer server.Close()
+
+	manager, session, browser := newForwardSession("http://user:pass@" + server.Listener.Addr().String())
+	session.Type = HTTPS_TUNNEL
+	req, _ := http.NewRequest("CONNECT", "http://"+echo.Addr().String(), nil)
+	var ev event.HTTPRequestEvent
+	ev.FromRequest(req)
+	conn, _ := manager.GetRemoteConnection(&ev, nil)
+	go conn.Request(session, &ev)
+	reader := bufio.NewReader(browser)
+	line, _ := reader.ReadString('\n')
+	if !strings.Contains(line, "200") {
+		t.Fatalf("unexpected tunnel response:%q", line)
+	}
+	reader.ReadString('\n')
+	browser.Write([]byte("ping"))
+	pong := make([]byte, 4)
+	if _, err := io.ReadFull(reader, pong); nil != err || string(pong) != "ping" {
+		t.Fatalf("unexpected echo:%q %v", pong, err)
+	}
+	browser.Close()
+}
+
+func TestForwardProxyWrongPassword(t *testing.T) {
+	server := httptest.NewServer(new(digestProxy))
+	defer server.Close()
+	manager, session, _ := newForwardSession("http://user:wrong@" + server.Listener.Addr().String())
+	session.Type = HTTPS_TUNNEL
+	req, _ := http.NewRequest("CONNECT", "http://127.0.0.1:1", nil)
+	var ev event.HTTPRequestEvent
+	ev.FromRequest(req)
+	conn, _ := manager.GetRemoteConnection(&ev, nil)
+	if err, _ := conn.Request(session, &ev); nil == err {
+		t.Fatal("tunnel should fail with a wrong password")
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	params := parseAuthParams(`realm="a, \"b\"", nonce=xyz, qop="auth,auth-int"`)
+	if params["realm"] != `a, "b"` || params["nonce"] != "xyz" || params["qop"] != "auth,auth-int" {
+		t.Fatalf("unexpected params:%v", params)
+	}
+}
@@ -14,6 +14,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zyxar/gsnova/common"
@@ -33,6 +35,7 @@ type GAEConfig struct {
 	ConnectionMode         string
 	ConnectionPoolSize     uint32
 	FetchLimitSize         uint32
+	RequestChunkSize       uint32
 	RangeFetchRetryLimit   uint32
 	MasterAppID            string
 	ConcurrentRangeFetcher uint32
@@ -57,12 +60,12 @@ func initGAEClient() {
 
 	dial := func(n, addr string) (net.Conn, error) {
 		remote := getAddressMapping(addr)
-		conn, err := net.DialTimeout(n, remote, connTimeoutSecs)
+		conn, err := chainDial(GAE_NAME, n, remote, connTimeoutSecs)
 		if err != nil {
 			expireBlockVerifyCache(addr)
 			//try again
 			remote = getAddressMapping(addr)
-			conn, err = net.DialTimeout(n, remote, connTimeoutSecs)
+			conn, err = chainDial(GAE_NAME, n, remote, connTimeoutSecs)
 		}
 		if err != nil {
 			expireBlockVerifyCache(addr)
@@ -77,7 +80,7 @@ func initGAEClient() {
 		var conn net.Conn
 		for i := 0; i < 3; i++ {
 			remote = getAddressMapping(addr)
-			conn, err = net.DialTimeout(n, remote, connTimeoutSecs)
+			conn, err = chainDial(GAE_NAME, n, remote, connTimeoutSecs)
 			if err != nil {
 				expireBlockVerifyCache(addr)
 			}
@@ -131,6 +134,11 @@ type GAEAuth struct {
 	passwd         string
 	token          string
 	support_tunnel bool
+	//the appid over quota at startup has no token, it is authenticated
+	//after the quota reset
+	unauthed    bool
+	quota       gaeQuotaState
+	quota_mutex sync.Mutex
 }
 
 func (auth *GAEAuth) parse(line string) error {
@@ -158,6 +166,7 @@ func (auth *GAEAuth) parse(line string) error {
 type GAEHttpConnection struct {
 	//auth               GAEAuth
 	gaeAuth        *GAEAuth
+	auth_mutex     sync.Mutex
 	support_tunnel bool
 	over_tunnel    bool
 	inject_range   bool
@@ -213,9 +222,9 @@ func (conn *GAEHttpConnection) Auth(auth *GAEAuth) error {
 }
 
 func (gae *GAEHttpConnection) requestEvent(client *http.Client, conn *SessionConnection, ev event.Event) (err error, res event.Event) {
-	auth := gae.gaeAuth
+	auth := gae.selectedAuth()
 	if nil == auth {
-		auth = gae.manager.auths.Select().(*GAEAuth)
+		return errGAENoAvailableAppID, nil
 	}
 	domain := auth.appid + ".appspot.com"
 	if strings.Contains(auth.appid, ".") {
@@ -247,6 +256,7 @@ func (gae *GAEHttpConnection) requestEvent(client *http.Client, conn *SessionCon
 		encrypt.Ev = ev
 		event.EncodeEvent(&buf, &encrypt)
 	}
+	sent := buf.Len()
 	req := &http.Request{
 		Method:        "POST",
 		URL:           &url.URL{Scheme: scheme, Host: addr, Path: "/invoke"},
@@ -272,9 +282,21 @@ func (gae *GAEHttpConnection) requestEvent(client *http.Client, conn *SessionCon
 		return err, nil
 	} else {
 		if response.StatusCode != 200 {
+			body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+			response.Body.Close()
+			if isOverQuotaResponse(response, body) {
+				auth.markOverQuota()
+				gae.dropAuth(auth)
+				return errGAEOverQuota, nil
+			}
 			log.Printf("Session[%d]Invalid response:%d\n", ev.GetHash(), response.StatusCode)
 			return fmt.Errorf("Invalid response:%d", response.StatusCode), nil
 		} else {
+			if len(response.Header.Get(GAE_STREAM_HEADER)) > 0 {
+				auth.recordUsage(sent, 0)
+				stream := &gaeStreamBody{body: response.Body, reader: bufio.NewReader(response.Body), auth: auth}
+				return gae.readStreamResponse(stream, &tags)
+			}
 			var buf bytes.Buffer
 			n, err := io.Copy(&buf, response.Body)
 			if int64(n) < response.ContentLength {
@@ -284,6 +306,7 @@ func (gae *GAEHttpConnection) requestEvent(client *http.Client, conn *SessionCon
 				return err, nil
 			}
 			response.Body.Close()
+			auth.recordUsage(sent, int(n))
 			if !tags.Decode(&buf) {
 				return fmt.Errorf("Failed to decode event tag"), nil
 			}
@@ -311,11 +334,7 @@ func (gae *GAEHttpConnection) doRangeFetch(req *http.Request, firstChunkRes *htt
 		ev := new(event.HTTPRequestEvent)
 		ev.FromRequest(preq)
 		ev.SetHash(gae.sess.SessionID)
-		err, xres := gae.requestEvent(gaeHttpClient, gae.sess, ev)
-		if nil != err {
-			//try again
-			err, xres = gae.requestEvent(gaeHttpClient, gae.sess, ev)
-		}
+		err, xres := gae.requestHttpEvent(gae.sess, ev)
 		if nil == err {
 			httpresev := xres.(*event.HTTPResponseEvent)
 			httpres := httpresev.ToResponse()
@@ -375,8 +394,8 @@ func (gae *GAEHttpConnection) Request(conn *SessionConnection, ev event.Event) (
 	if gae.over_tunnel {
 		return gae.requestOverTunnel(conn, ev)
 	}
-	if nil == gae.gaeAuth {
-		gae.gaeAuth = gae.manager.auths.Select().(*GAEAuth)
+	if nil == gae.selectedAuth() {
+		return errGAENoAvailableAppID, nil
 	}
 	if ev.GetType() == event.HTTP_REQUEST_EVENT_TYPE {
 		httpreq := ev.(*event.HTTPRequestEvent)
@@ -398,10 +417,16 @@ func (gae *GAEHttpConnection) Request(conn *SessionConnection, ev event.Event) (
 			conn.Type = HTTPS_TUNNEL
 			return nil, nil
 		} else {
+			chunked := false
 			if httpreq.Content.Len() == 0 {
-				body := make([]byte, httpreq.RawReq.ContentLength)
-				io.ReadFull(httpreq.RawReq.Body, body)
-				httpreq.Content.Write(body)
+				if httpreq.RawReq.ContentLength >= 0 && httpreq.RawReq.ContentLength <= int64(gae_cfg.RequestChunkSize) {
+					body := make([]byte, httpreq.RawReq.ContentLength)
+					io.ReadFull(httpreq.RawReq.Body, body)
+					httpreq.Content.Write(body)
+				} else {
+					//large or 'Transfer-Encoding: chunked' body
+					chunked = true
+				}
 			}
 			scheme := "http://"
 			if conn.Type == HTTPS_TUNNEL {
@@ -420,10 +445,11 @@ func (gae *GAEHttpConnection) Request(conn *SessionConnection, ev event.Event) (
 					return nil, nil
 				}
 			}
-			err, res = gae.requestEvent(gaeHttpClient, conn, ev)
-			if nil != err {
-				//try again
-				err, res = gae.requestEvent(gaeHttpClient, conn, ev)
+			if chunked {
+				//body is consumed while sending, no retry
+				err, res = gae.requestChunkedBody(conn, httpreq)
+			} else {
+				err, res = gae.requestHttpEvent(conn, ev)
 			}
 			if nil != err || nil == res {
 				return
@@ -484,6 +510,9 @@ func (manager *GAE) GetRemoteConnection(ev event.Event, attrs map[string]string)
 	if !GAEEnable {
 		return nil, fmt.Errorf("No GAE connection available.")
 	}
+	if !manager.hasAvailableAuth() {
+		return nil, errGAENoAvailableAppID
+	}
 	gae := new(GAEHttpConnection)
 	//gae.authToken = gae.auth.token
 	gae.manager = manager
@@ -501,7 +530,7 @@ func (manager *GAE) GetRemoteConnection(ev event.Event, attrs map[string]string)
 		appid := attrs[ATTR_APP]
 		for _, tmp := range manager.auths.ArrayValues() {
 			auth := tmp.(*GAEAuth)
-			if auth.appid == appid {
+			if auth.appid == appid && auth.available() {
 				gae.gaeAuth = auth
 				//found = true
 				break
@@ -554,6 +583,10 @@ func initGAEConfig() {
 	if limit, exist := common.Cfg.GetIntProperty("GAE", "RangeFetchLimitSize"); exist {
 		gae_cfg.FetchLimitSize = uint32(limit)
 	}
+	gae_cfg.RequestChunkSize = 256000
+	if limit, exist := common.Cfg.GetIntProperty("GAE", "RequestChunkSize"); exist && limit > 0 {
+		gae_cfg.RequestChunkSize = uint32(limit)
+	}
 	gae_cfg.RangeFetchRetryLimit = 1
 	if limit, exist := common.Cfg.GetIntProperty("GAE", "RangeFetchRetryLimit"); exist {
 		gae_cfg.RangeFetchRetryLimit = uint32(limit)
@@ -566,7 +599,7 @@ func initGAEConfig() {
 	if master, exist := common.Cfg.GetProperty("GAE", "MasterAppID"); exist {
 		gae_cfg.MasterAppID = master
 	}
-	if proxy, exist := common.Cfg.GetProperty("GAE", "Proxy"); exist {
+	if proxy, exist := common.Cfg.GetProperty("GAE", "Proxy"); exist && !hasDialChain(GAE_NAME) {
 		gae_cfg.Proxy = proxy
 	}
 
@@ -635,6 +668,7 @@ func (manager *GAE) Init() error {
 			authArray = append(authArray, &auth)
 		}
 	}
+	loadGAEQuotaState(authArray)
 	for _, auth := range authArray {
 		conn := new(GAEHttpConnection)
 		//conn.auth = *auth
@@ -646,7 +680,11 @@ func (manager *GAE) Init() error {
 			log.Printf("Failed first to auth appid:%s\n", err.Error())
 			err = conn.Auth(auth)
 		}
-		if nil != err {
+		if err == errGAEOverQuota {
+			//keep it, it would be authenticated again after quota reset
+			log.Printf("Appid:%s is over quota now\n", auth.appid)
+			auth.unauthed = true
+		} else if nil != err {
 			log.Printf("Failed to auth appid:%s\n", err.Error())
 			continue
 		}
@@ -659,5 +697,7 @@ func (manager *GAE) Init() error {
 		GAEEnable = false
 		return fmt.Errorf("No valid appid found.")
 	}
+	atomic.StoreInt32(&gaeQuotaReady, 1)
+	go gaeQuotaPersistLoop()
 	return nil
 }
@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zyxar/gsnova/common"
+	"github.com/zyxar/gsnova/event"
+)
+
+const (
+	GAE_QUOTA_FILE = "gae_quota.json"
+
+	GAE_APPID_ACTIVE    = "Active"
+	GAE_APPID_EXHAUSTED = "OverQuota"
+)
+
+var errGAEOverQuota = errors.New("GAE appid is over quota")
+var errGAENoAvailableAppID = errors.New("No GAE appid available, all appids are over quota")
+var errGAENoTunnel = errors.New("No GAE appid supports tunnel")
+
+//GAE resets daily quotas at midnight Pacific time
+var gaeQuotaZone = func() *time.Location {
+	if loc, err := time.LoadLocation("America/Los_Angeles"); nil == err {
+		return loc
+	}
+	return time.FixedZone("PST", -8*3600)
+}()
+
+var gaeQuotaDirty int32
+//set when the appids are loaded, the state is not saved before
+var gaeQuotaReady int32
+var gaeQuotaFileMutex sync.Mutex
+
+//closed by StopGAE
+var gaeQuotaStop = make(chan bool)
+var gaeQuotaStopOnce sync.Once
+
+func gaeQuotaDay(t time.Time) string {
+	return t.In(gaeQuotaZone).Format("2006-01-02")
+}
+
+func nextGAEQuotaReset(t time.Time) time.Time {
+	y, m, d := t.In(gaeQuotaZone).Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, gaeQuotaZone)
+}
+
+type gaeQuotaState struct {
+	Day            string
+	BytesSent      uint64
+	BytesRecv      uint64
+	Requests       uint64
+	ExhaustedUntil time.Time
+}
+
+//reset counters when the quota day changed, caller must hold quota_mutex
+func (auth *GAEAuth) checkQuotaDay(now time.Time) {
+	day := gaeQuotaDay(now)
+	if auth.quota.Day != day {
+		auth.quota = gaeQuotaState{Day: day}
+		atomic.StoreInt32(&gaeQuotaDirty, 1)
+	}
+}
+
+func (auth *GAEAuth) recordUsage(sent, recv int) {
+	auth.quota_mutex.Lock()
+	defer auth.quota_mutex.Unlock()
+	auth.checkQuotaDay(time.Now())
+	auth.quota.BytesSent += uint64(sent)
+	auth.quota.BytesRecv += uint64(recv)
+	auth.quota.Requests++
+	atomic.StoreInt32(&gaeQuotaDirty, 1)
+}
+
+//bytes of a streamed response arriving after its request was counted
+func (auth *GAEAuth) recordRecv(recv int) {
+	auth.quota_mutex.Lock()
+	defer auth.quota_mutex.Unlock()
+	auth.checkQuotaDay(time.Now())
+	auth.quota.BytesRecv += uint64(recv)
+	atomic.StoreInt32(&gaeQuotaDirty, 1)
+}
+
+func (auth *GAEAuth) markOverQuota() {
+	now := time.Now()
+	auth.quota_mutex.Lock()
+	auth.checkQuotaDay(now)
+	auth.quota.ExhaustedUntil = nextGAEQuotaReset(now)
+	until := auth.quota.ExhaustedUntil
+	atomic.StoreInt32(&gaeQuotaDirty, 1)
+	auth.quota_mutex.Unlock()
+	log.Printf("[WARN]GAE appid:%s is over quota, disabled until %v\n", auth.appid, until)
+	go saveGAEQuotaState()
+}
+
+func (auth *GAEAuth) isExhausted() bool {
+	auth.quota_mutex.Lock()
+	defer auth.quota_mutex.Unlock()
+	return time.Now().Before(auth.quota.ExhaustedUntil)
+}
+
+//available is false if the appid is over quota or not authenticated
+func (auth *GAEAuth) available() bool {
+	auth.quota_mutex.Lock()
+	defer auth.quota_mutex.Unlock()
+	return !auth.unauthed && !time.Now().Before(auth.quota.ExhaustedUntil)
+}
+
+func (auth *GAEAuth) quotaSnapshot() gaeQuotaState {
+	auth.quota_mutex.Lock()
+	defer auth.quota_mutex.Unlock()
+	auth.checkQuotaDay(time.Now())
+	return auth.quota
+}
+
+//GAE answers with '503 Over Quota' once the daily quota of an appid is used up
+func isOverQuotaResponse(res *http.Response, body []byte) bool {
+	if res.StatusCode != 503 {
+		return false
+	}
+	return strings.Contains(strings.ToLower(string(body)), "quota")
+}
+
+func (manager *GAE) selectAuth() *GAEAuth {
+	for i := 0; i < manager.auths.Size(); i++ {
+		tmp := manager.auths.Select()
+		if nil == tmp {
+			break
+		}
+		auth := tmp.(*GAEAuth)
+		if auth.available() {
+			return auth
+		}
+	}
+	return nil
+}
+
+//selectedAuth returns the appid bound to the connection, an available one
+//is selected if there is none
+func (gae *GAEHttpConnection) selectedAuth() *GAEAuth {
+	gae.auth_mutex.Lock()
+	defer gae.auth_mutex.Unlock()
+	if nil == gae.gaeAuth {
+		gae.gaeAuth = gae.manager.selectAuth()
+	}
+	return gae.gaeAuth
+}
+
+//dropAuth unbinds the appid found over quota from the connection
+func (gae *GAEHttpConnection) dropAuth(auth *GAEAuth) {
+	gae.auth_mutex.Lock()
+	defer gae.auth_mutex.Unlock()
+	if gae.gaeAuth == auth {
+		gae.gaeAuth = nil
+	}
+}
+
+//useTunnel binds an appid supporting the tunnel, the port forwarding can
+//only carry raw tcp streams over the tunnel
+func (gae *GAEHttpConnection) useTunnel() error {
+	gae.auth_mutex.Lock()
+	defer gae.auth_mutex.Unlock()
+	if nil == gae.gaeAuth || !gae.gaeAuth.support_tunnel {
+		gae.gaeAuth = nil
+		for _, tmp := range gae.manager.auths.ArrayValues() {
+			auth := tmp.(*GAEAuth)
+			if auth.available() && auth.support_tunnel {
+				gae.gaeAuth = auth
+				break
+			}
+		}
+	}
+	if nil == gae.gaeAuth {
+		return errGAENoTunnel
+	}
+	gae.over_tunnel = true
+	return nil
+}
+
+//requestHttpEvent sends an event which does not depend on the appid of the
+//previous ones, it is tried again once on failure and on the next available
+//appid as long as the appid is over quota
+func (gae *GAEHttpConnection) requestHttpEvent(conn *SessionConnection, ev event.Event) (err error, res event.Event) {
+	retried := false
+	for {
+		err, res = gae.requestEvent(gaeHttpClient, conn, ev)
+		switch {
+		case nil == err:
+			return
+		case err == errGAEOverQuota:
+			//the appid is disabled now, so every appid is tried once at most
+			if !gae.manager.hasAvailableAuth() {
+				return errGAENoAvailableAppID, nil
+			}
+		case retried:
+			return
+		default:
+			retried = true
+		}
+	}
+}
+
+func (manager *GAE) hasAvailableAuth() bool {
+	for _, tmp := range manager.auths.ArrayValues() {
+		if tmp.(*GAEAuth).available() {
+			return true
+		}
+	}
+	return false
+}
+
+func loadGAEQuotaState(auths []*GAEAuth) {
+	content, err := ioutil.ReadFile(filepath.Join(common.Home, GAE_QUOTA_FILE))
+	if nil != err {
+		return
+	}
+	states := make(map[string]gaeQuotaState)
+	if err = json.Unmarshal(content, &states); nil != err {
+		log.Printf("[WARN]Failed to load GAE quota state for reason:%v\n", err)
+		return
+	}
+	today := gaeQuotaDay(time.Now())
+	for _, auth := range auths {
+		if state, exist := states[auth.appid]; exist && state.Day == today {
+			auth.quota_mutex.Lock()
+			auth.quota = state
+			auth.quota_mutex.Unlock()
+		}
+	}
+}
+
+func saveGAEQuotaState() {
+	if atomic.LoadInt32(&gaeQuotaReady) == 0 {
+		return
+	}
+	gaeQuotaFileMutex.Lock()
+	defer gaeQuotaFileMutex.Unlock()
+	states := make(map[string]gaeQuotaState)
+	for _, tmp := range singleton_gae.auths.ArrayValues() {
+		auth := tmp.(*GAEAuth)
+		states[auth.appid] = auth.quotaSnapshot()
+	}
+	atomic.StoreInt32(&gaeQuotaDirty, 0)
+	content, err := json.MarshalIndent(states, "", " ")
+	if nil == err {
+		err = ioutil.WriteFile(filepath.Join(common.Home, GAE_QUOTA_FILE), content, 0666)
+	}
+	if nil != err {
+		log.Printf("[WARN]Failed to save GAE quota state for reason:%v\n", err)
+	}
+}
+
+//reauthGAEAppIDs authenticates the appids which were over quota at startup
+//once their quota is reset
+func reauthGAEAppIDs() {
+	for _, tmp := range singleton_gae.auths.ArrayValues() {
+		auth := tmp.(*GAEAuth)
+		auth.quota_mutex.Lock()
+		pending := auth.unauthed && !time.Now().Before(auth.quota.ExhaustedUntil)
+		auth.quota_mutex.Unlock()
+		if !pending {
+			continue
+		}
+		//the appid is never selected before unauthed is cleared
+		conn := &GAEHttpConnection{manager: singleton_gae}
+		if err := conn.Auth(auth); nil != err {
+			log.Printf("[WARN]Failed to auth appid:%s after quota reset:%v\n", auth.appid, err)
+			continue
+		}
+		auth.quota_mutex.Lock()
+		auth.unauthed = false
+		auth.quota_mutex.Unlock()
+		log.Printf("Appid:%s is available after quota reset\n", auth.appid)
+	}
+}
+
+func gaeQuotaPersistLoop() {
+	tick := time.NewTicker(1 * time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if atomic.LoadInt32(&gaeQuotaDirty) != 0 {
+				saveGAEQuotaState()
+			}
+			reauthGAEAppIDs()
+		case <-gaeQuotaStop:
+			return
+		}
+	}
+}
+
+//StopGAE stops the persist routine and saves the quota state of the appids
+func StopGAE() {
+	gaeQuotaStopOnce.Do(func() {
+		close(gaeQuotaStop)
+	})
+	saveGAEQuotaState()
+}
+
+type gaeAppIDStat struct {
+	AppID     string
+	State     string
+	BytesSent uint64
+	BytesRecv uint64
+	Requests  uint64
+	ResetAt   string
+}
+
+func gaeAppIDStats() []gaeAppIDStat {
+	stats := make([]gaeAppIDStat, 0)
+	if nil == singleton_gae || nil == singleton_gae.auths {
+		return stats
+	}
+	for _, tmp := range singleton_gae.auths.ArrayValues() {
+		auth := tmp.(*GAEAuth)
+		state := auth.quotaSnapshot()
+		stat := gaeAppIDStat{AppID: auth.appid, State: GAE_APPID_ACTIVE}
+		stat.BytesSent = state.BytesSent
+		stat.BytesRecv = state.BytesRecv
+		stat.Requests = state.Requests
+		if time.Now().Before(state.ExhaustedUntil) {
+			stat.State = GAE_APPID_EXHAUSTED
+			stat.ResetAt = state.ExhaustedUntil.Local().Format("2006-01-02 15:04:05")
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zyxar/gsnova/common"
+	"github.com/zyxar/gsnova/event"
+	"github.com/zyxar/gsnova/util"
+)
+
+//newFakeGAE answers '/invoke' like the GAE server, handle gets the event
+//decoded from the request
+func newFakeGAE(handle func(w http.ResponseWriter, ev event.Event)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		buf := bytes.NewBuffer(body)
+		var tags event.EventHeaderTags
+		if !tags.Decode(buf) {
+			http.Error(w, "Invalid tags", 400)
+			return
+		}
+		err, ev := event.DecodeEvent(buf)
+		if nil != err {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		handle(w, event.ExtractEvent(ev))
+	}))
+}
+
+//encodeGAEEvent encodes an event like the body of an '/invoke' response
+func encodeGAEEvent(ev event.Event) []byte {
+	var buf bytes.Buffer
+	var tags event.EventHeaderTags
+	tags.Encode(&buf)
+	event.EncodeEvent(&buf, ev)
+	return buf.Bytes()
+}
+
+func gaeResponseEvent(status int, body string) *event.HTTPResponseEvent {
+	res := new(event.HTTPResponseEvent)
+	res.Status = uint32(status)
+	res.Content.WriteString(body)
+	return res
+}
+
+//setupGAE registers the servers as appids of a new GAE manager, the appid
+//with a port is requested as the host of the server
+func setupGAE(t *testing.T, servers ...*httptest.Server) *GAE {
+	event.Init()
+	cfg, client, gae, ready := gae_cfg, gaeHttpClient, singleton_gae, atomic.LoadInt32(&gaeQuotaReady)
+	t.Cleanup(func() {
+		gae_cfg, gaeHttpClient, singleton_gae = cfg, client, gae
+		atomic.StoreInt32(&gaeQuotaReady, ready)
+	})
+	gae_cfg = &GAEConfig{ConnectionMode: MODE_HTTP, RequestChunkSize: 16}
+	gaeHttpClient = new(http.Client)
+	manager := &GAE{auths: new(util.ListSelector)}
+	for _, server := range servers {
+		manager.auths.Add(&GAEAuth{appid: strings.TrimPrefix(server.URL, "http://")})
+	}
+	singleton_gae = manager
+	return manager
+}
+
+func TestIsOverQuotaResponse(t *testing.T) {
+	for _, c := range []struct {
+		status   int
+		body     string
+		expected bool
+	}{
+		{503, "<h1>Over Quota</h1>This application is temporarily over its serving quota.", true},
+		{503, "OVER QUOTA", true},
+		{503, "Service Unavailable", false},
+		{500, "over quota", false},
+		{200, "quota", false},
+	} {
+		if isOverQuotaResponse(&http.Response{StatusCode: c.status}, []byte(c.body)) != c.expected {
+			t.Fatalf("%d %q:expected %v", c.status, c.body, c.expected)
+		}
+	}
+}
+
+func TestGAEQuotaReset(t *testing.T) {
+	for now, reset := range map[string]string{
+		//23:30 PST is still the same quota day
+		"2026-01-15T07:30:00Z": "2026-01-15T08:00:00Z",
+		"2026-01-15T08:00:00Z": "2026-01-16T08:00:00Z",
+		//midnight PDT in summer
+		"2026-07-01T06:59:59Z": "2026-07-01T07:00:00Z",
+		//the day starting DST is 23 hours long
+		"2026-03-08T08:00:00Z": "2026-03-09T07:00:00Z",
+	} {
+		tm, _ := time.Parse(time.RFC3339, now)
+		expected, _ := time.Parse(time.RFC3339, reset)
+		if next := nextGAEQuotaReset(tm); !next.Equal(expected) {
+			t.Fatalf("%s:expected reset at %v, got %v", now, expected, next.UTC())
+		}
+	}
+	before, _ := time.Parse(time.RFC3339, "2026-01-15T07:59:59Z")
+	after := before.Add(time.Second)
+	if gaeQuotaDay(before) != "2026-01-14" || gaeQuotaDay(after) != "2026-01-15" {
+		t.Fatalf("unexpected quota days:%s %s", gaeQuotaDay(before), gaeQuotaDay(after))
+	}
+	auth := &GAEAuth{appid: "a"}
+	auth.quota = gaeQuotaState{Day: gaeQuotaDay(before), Requests: 10, ExhaustedUntil: after}
+	auth.checkQuotaDay(before)
+	if auth.quota.Requests != 10 {
+		t.Fatal("the counters are reset in the same day")
+	}
+	auth.checkQuotaDay(after)
+	if auth.quota.Requests != 0 || !auth.quota.ExhaustedUntil.IsZero() {
+		t.Fatalf("the counters are not reset in the next day:%+v", auth.quota)
+	}
+}
+
+func TestGAEQuotaPersistence(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gae")
+	defer os.RemoveAll(dir)
+	defer func(home string) {
+		common.Home = home
+	}(common.Home)
+	common.Home = dir
+	manager := setupGAE(t)
+	a, b := &GAEAuth{appid: "a"}, &GAEAuth{appid: "b"}
+	manager.auths.Add(a)
+	manager.auths.Add(b)
+
+	a.recordUsage(100, 200)
+	b.quota = gaeQuotaState{Day: gaeQuotaDay(time.Now()), ExhaustedUntil: nextGAEQuotaReset(time.Now())}
+	//nothing is saved before the appids are loaded
+	saveGAEQuotaState()
+	if _, err := os.Stat(dir + "/" + GAE_QUOTA_FILE); nil == err {
+		t.Fatal("the state is saved before ready")
+	}
+	atomic.StoreInt32(&gaeQuotaReady, 1)
+	saveGAEQuotaState()
+	if atomic.LoadInt32(&gaeQuotaDirty) != 0 {
+		t.Fatal("the state is dirty after saved")
+	}
+
+	loaded := []*GAEAuth{{appid: "a"}, {appid: "b"}, {appid: "c"}}
+	loadGAEQuotaState(loaded)
+	if s := loaded[0].quotaSnapshot(); s.BytesSent != 100 || s.BytesRecv != 200 || s.Requests != 1 {
+		t.Fatalf("unexpected usage:%+v", s)
+	}
+	if !loaded[1].isExhausted() || loaded[0].isExhausted() || loaded[2].isExhausted() {
+		t.Fatal("unexpected exhausted appids")
+	}
+
+	//the state of another day is dropped
+	content, _ := ioutil.ReadFile(dir + "/" + GAE_QUOTA_FILE)
+	content = bytes.Replace(content, []byte(gaeQuotaDay(time.Now())), []byte("2000-01-01"), -1)
+	ioutil.WriteFile(dir+"/"+GAE_QUOTA_FILE, content, 0644)
+	loaded = []*GAEAuth{{appid: "a"}, {appid: "b"}}
+	loadGAEQuotaState(loaded)
+	if s := loaded[0].quotaSnapshot(); s.Requests != 0 || loaded[1].isExhausted() {
+		t.Fatalf("the state of another day is loaded:%+v", s)
+	}
+}
+
+func TestGAEOverQuotaRetry(t *testing.T) {
+	var overQuotaRequests, requests int32
+	overQuota := newFakeGAE(func(w http.ResponseWriter, ev event.Event) {
+		atomic.AddInt32(&overQuotaRequests, 1)
+		http.Error(w, "Over Quota", 503)
+	})
+	defer overQuota.Close()
+	available := newFakeGAE(func(w http.ResponseWriter, ev event.Event) {
+		atomic.AddInt32(&requests, 1)
+		w.Write(encodeGAEEvent(gaeResponseEvent(200, "hello")))
+	})
+	defer available.Close()
+	manager := setupGAE(t, overQuota, overQuota, available)
+
+	conn := &GAEHttpConnection{manager: manager}
+	req := new(event.HTTPRequestEvent)
+	req.Method, req.Url = "GET", "http://example.com/"
+	err, res := conn.requestHttpEvent(nil, req)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if httpres, ok := res.(*event.HTTPResponseEvent); !ok || httpres.Content.String() != "hello" {
+		t.Fatalf("unexpected response:%v", res)
+	}
+	//the over quota appids are tried once, the connection keeps the next one
+	if overQuotaRequests != 2 || requests != 1 {
+		t.Fatalf("unexpected requests:%d %d", overQuotaRequests, requests)
+	}
+	if conn.gaeAuth != manager.auths.ArrayValues()[2] {
+		t.Fatal("the connection is not bound to the available appid")
+	}
+	if err, _ = conn.requestHttpEvent(nil, req); nil != err || requests != 2 || overQuotaRequests != 2 {
+		t.Fatalf("the disabled appids are requested:%v %d", err, overQuotaRequests)
+	}
+
+	//no appid is left
+	manager = setupGAE(t, overQuota)
+	conn = &GAEHttpConnection{manager: manager}
+	if err, _ = conn.requestHttpEvent(nil, req); err != errGAENoAvailableAppID {
+		t.Fatalf("unexpected error:%v", err)
+	}
+}
+
+func TestStopGAE(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gae")
+	defer os.RemoveAll(dir)
+	defer func(home string, stop chan bool) {
+		common.Home, gaeQuotaStop, gaeQuotaStopOnce = home, stop, sync.Once{}
+	}(common.Home, gaeQuotaStop)
+	common.Home = dir
+	gaeQuotaStop, gaeQuotaStopOnce = make(chan bool), sync.Once{}
+	manager := setupGAE(t)
+	a := &GAEAuth{appid: "a"}
+	manager.auths.Add(a)
+	atomic.StoreInt32(&gaeQuotaReady, 1)
+
+	done := make(chan bool)
+	go func() {
+		gaeQuotaPersistLoop()
+		close(done)
+	}()
+	a.recordUsage(100, 200)
+	StopGAE()
+	StopGAE()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the persist routine is not stopped")
+	}
+	//the usage since the last tick is saved
+	loaded := []*GAEAuth{{appid: "a"}}
+	loadGAEQuotaState(loaded)
+	if s := loaded[0].quotaSnapshot(); s.BytesSent != 100 || s.Requests != 1 {
+		t.Fatalf("unexpected usage:%+v", s)
+	}
+}
+
+func TestGAEReauth(t *testing.T) {
+	var auths int32
+	server := newFakeGAE(func(w http.ResponseWriter, ev event.Event) {
+		if _, ok := ev.(*event.AuthRequestEvent); ok {
+			atomic.AddInt32(&auths, 1)
+			w.Write(encodeGAEEvent(&event.AuthResponseEvent{Token: "token"}))
+			return
+		}
+		w.Write(encodeGAEEvent(gaeResponseEvent(200, "hello")))
+	})
+	defer server.Close()
+	manager := setupGAE(t, server)
+	auth := manager.auths.ArrayValues()[0].(*GAEAuth)
+	auth.unauthed = true
+	auth.quota.ExhaustedUntil = time.Now().Add(time.Hour)
+
+	//the appid over quota at startup is neither selected nor authenticated
+	if nil != manager.selectAuth() || manager.hasAvailableAuth() {
+		t.Fatal("the unauthenticated appid is available")
+	}
+	reauthGAEAppIDs()
+	if auths != 0 {
+		t.Fatal("the appid is authenticated before quota reset")
+	}
+
+	auth.quota.ExhaustedUntil = time.Now().Add(-time.Second)
+	if nil != manager.selectAuth() {
+		t.Fatal("the unauthenticated appid is selected after quota reset")
+	}
+	reauthGAEAppIDs()
+	if auths != 1 || auth.token != "token" || !auth.available() {
+		t.Fatalf("the appid is not authenticated after quota reset:%d %q", auths, auth.token)
+	}
+	reauthGAEAppIDs()
+	if auths != 1 {
+		t.Fatal("the authenticated appid is authenticated again")
+	}
+	if manager.selectAuth() != auth {
+		t.Fatal("the authenticated appid is not selected")
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/zyxar/gsnova/event"
+)
+
+//GAE_STREAM_HEADER is set by the server on '/invoke' responses whose body is a
+//sequence of frames instead of a single event. Each frame is a 4 byte big
+//endian length followed by the data; the first frame holds the event tags and
+//the HTTPResponseEvent, later frames hold SequentialChunkEvents carrying the
+//rest of the body, an empty chunk ends the stream.
+const GAE_STREAM_HEADER = "X-Snova-Stream"
+
+const gaeMaxStreamFrameSize = 16 * 1024 * 1024
+
+type gaeStreamBody struct {
+	body     io.ReadCloser
+	reader   *bufio.Reader
+	auth     *GAEAuth
+	sequence uint32
+	buf      bytes.Buffer
+	done     bool
+}
+
+func (stream *gaeStreamBody) readFrame() (error, *bytes.Buffer) {
+	var length uint32
+	if err := binary.Read(stream.reader, binary.BigEndian, &length); nil != err {
+		return err, nil
+	}
+	if length > gaeMaxStreamFrameSize {
+		return fmt.Errorf("Too large stream frame:%d", length), nil
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(stream.reader, frame); nil != err {
+		return err, nil
+	}
+	stream.auth.recordRecv(int(length) + 4)
+	return nil, bytes.NewBuffer(frame)
+}
+
+func (stream *gaeStreamBody) Read(p []byte) (int, error) {
+	for stream.buf.Len() == 0 {
+		if stream.done {
+			return 0, io.EOF
+		}
+		err, frame := stream.readFrame()
+		if nil != err {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		err, ev := event.DecodeEvent(frame)
+		if nil != err {
+			return 0, err
+		}
+		ev = event.ExtractEvent(ev)
+		chunk, ok := ev.(*event.SequentialChunkEvent)
+		if !ok {
+			return 0, fmt.Errorf("Unexpected event type:%d in response stream", ev.GetType())
+		}
+		if chunk.Sequence != stream.sequence+1 {
+			return 0, fmt.Errorf("Unexpected chunk sequence:%d, expected:%d", chunk.Sequence, stream.sequence+1)
+		}
+		stream.sequence = chunk.Sequence
+		if len(chunk.Content) == 0 {
+			stream.done = true
+		}
+		stream.buf.Write(chunk.Content)
+	}
+	return stream.buf.Read(p)
+}
+
+func (stream *gaeStreamBody) Close() error {
+	return stream.body.Close()
+}
+
+//decode the head of a streamed response, the returned HTTPResponseEvent reads
+//the rest of the body from the stream while it is arriving
+func (gae *GAEHttpConnection) readStreamResponse(stream *gaeStreamBody, tags *event.EventHeaderTags) (err error, res event.Event) {
+	err, frame := stream.readFrame()
+	if nil != err {
+		stream.Close()
+		return err, nil
+	}
+	if !tags.Decode(frame) {
+		stream.Close()
+		return fmt.Errorf("Failed to decode event tag"), nil
+	}
+	err, res = event.DecodeEvent(frame)
+	if nil != err {
+		stream.Close()
+		return err, nil
+	}
+	res = event.ExtractEvent(res)
+	if httpres, ok := res.(*event.HTTPResponseEvent); ok {
+		httpres.Stream = stream
+	} else {
+		stream.Close()
+	}
+	return nil, res
+}
+
+//send a request body which is too large or has unknown length as sequential
+//chunk events, see event.HTTP_CHUNKED_BODY_HEADER
+func (gae *GAEHttpConnection) requestChunkedBody(conn *SessionConnection, req *event.HTTPRequestEvent) (err error, res event.Event) {
+	buf := make([]byte, gae_cfg.RequestChunkSize)
+	n, rerr := io.ReadFull(req.RawReq.Body, buf)
+	req.Content.Write(buf[0:n])
+	if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+		//the whole body fits in one event
+		req.SetHeader("Content-Length", strconv.Itoa(n))
+		return gae.requestHttpEvent(conn, req)
+	}
+	if nil != rerr {
+		return rerr, nil
+	}
+	req.SetHeader(event.HTTP_CHUNKED_BODY_HEADER, "1")
+	//nothing is sent to the appid before the request, it could be another one
+	if err, _ = gae.requestHttpEvent(conn, req); nil != err {
+		return
+	}
+	auth := gae.selectedAuth()
+	var sequence uint32
+	for {
+		n, rerr = io.ReadFull(req.RawReq.Body, buf)
+		if n > 0 {
+			if gae.selectedAuth() != auth {
+				//the server side parts are bound to the appid
+				return errGAEOverQuota, nil
+			}
+			sequence++
+			chunk := &event.SequentialChunkEvent{Sequence: sequence, Content: buf[0:n]}
+			chunk.SetHash(req.GetHash())
+			if err, _ = gae.requestEvent(gaeHttpClient, conn, chunk); nil != err {
+				log.Printf("Session[%d]Failed to send body chunk:%d for reason:%v\n", req.GetHash(), sequence, err)
+				return
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if nil != rerr {
+			return rerr, nil
+		}
+	}
+	if gae.selectedAuth() != auth {
+		return errGAEOverQuota, nil
+	}
+	sequence++
+	last := &event.SequentialChunkEvent{Sequence: sequence}
+	last.SetHash(req.GetHash())
+	return gae.requestEvent(gaeHttpClient, conn, last)
+}
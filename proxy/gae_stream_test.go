@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zyxar/gsnova/event"
+)
+
+//gaeStreamFrame encodes a frame of a streamed response, the head frame has
+//the event tags
+func gaeStreamFrame(ev event.Event, head bool) []byte {
+	var buf bytes.Buffer
+	if head {
+		var tags event.EventHeaderTags
+		tags.Encode(&buf)
+	}
+	event.EncodeEvent(&buf, ev)
+	frame := make([]byte, 4, 4+buf.Len())
+	binary.BigEndian.PutUint32(frame, uint32(buf.Len()))
+	return append(frame, buf.Bytes()...)
+}
+
+func gaeChunkFrame(sequence uint32, content string) []byte {
+	return gaeStreamFrame(&event.SequentialChunkEvent{Sequence: sequence, Content: []byte(content)}, false)
+}
+
+func newGAEStreamBody(frames ...[]byte) *gaeStreamBody {
+	body := ioutil.NopCloser(bytes.NewReader(bytes.Join(frames, nil)))
+	return &gaeStreamBody{body: body, reader: bufio.NewReader(body), auth: new(GAEAuth)}
+}
+
+func TestGAEStreamBody(t *testing.T) {
+	event.Init()
+	stream := newGAEStreamBody(gaeChunkFrame(1, "hello"), gaeChunkFrame(2, ""), gaeChunkFrame(3, " world"), gaeChunkFrame(4, ""))
+	//an empty chunk ends the stream, the rest is not read
+	if content, err := ioutil.ReadAll(stream); nil != err || string(content) != "hello" {
+		t.Fatalf("unexpected body:%q %v", content, err)
+	}
+	if s := stream.auth.quotaSnapshot(); s.BytesRecv != uint64(len(gaeChunkFrame(1, "hello"))+len(gaeChunkFrame(2, ""))) {
+		t.Fatalf("unexpected received bytes:%d", s.BytesRecv)
+	}
+
+	large := string(make([]byte, 100000))
+	stream = newGAEStreamBody(gaeChunkFrame(1, "a"), gaeChunkFrame(2, large), gaeChunkFrame(3, "b"), gaeChunkFrame(4, ""))
+	if content, err := ioutil.ReadAll(stream); nil != err || string(content) != "a"+large+"b" {
+		t.Fatalf("unexpected body of %d bytes:%v", len(content), err)
+	}
+
+	for name, frames := range map[string][][]byte{
+		"Unexpected chunk sequence:3":         {gaeChunkFrame(1, "a"), gaeChunkFrame(3, "b")},
+		"Unexpected chunk sequence:1":         {gaeChunkFrame(1, "a"), gaeChunkFrame(1, "a")},
+		io.ErrUnexpectedEOF.Error():           {gaeChunkFrame(1, "a"), gaeChunkFrame(2, "b")},
+		"Unexpected event type":               {gaeStreamFrame(gaeResponseEvent(200, ""), false)},
+		"Too large stream frame":              {{0x7f, 0xff, 0xff, 0xff}},
+		io.ErrUnexpectedEOF.Error() + " part": {gaeChunkFrame(1, "hello")[:10]},
+	} {
+		_, err := ioutil.ReadAll(newGAEStreamBody(frames...))
+		if nil == err || !strings.HasPrefix(err.Error(), strings.TrimSuffix(name, " part")) {
+			t.Fatalf("%s:unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestGAEStreamResponse(t *testing.T) {
+	var contentLength string
+	server := newFakeGAE(func(w http.ResponseWriter, ev event.Event) {
+		res := gaeResponseEvent(200, "he")
+		if len(contentLength) > 0 {
+			res.SetHeader("Content-Length", contentLength)
+		}
+		res.SetHeader("Transfer-Encoding", "chunked")
+		w.Header().Set(GAE_STREAM_HEADER, "1")
+		w.Write(gaeStreamFrame(res, true))
+		w.(http.Flusher).Flush()
+		w.Write(gaeChunkFrame(1, "llo"))
+		w.Write(gaeChunkFrame(2, " world"))
+		w.Write(gaeChunkFrame(3, ""))
+	})
+	defer server.Close()
+	manager := setupGAE(t, server)
+	req := new(event.HTTPRequestEvent)
+	req.Method, req.Url = "GET", "http://example.com/"
+
+	for _, length := range []string{"", "11"} {
+		contentLength = length
+		conn := &GAEHttpConnection{manager: manager}
+		err, res := conn.requestHttpEvent(nil, req)
+		if nil != err {
+			t.Fatal(err)
+		}
+		httpres := res.(*event.HTTPResponseEvent).ToResponse()
+		var buf bytes.Buffer
+		if err = httpres.Write(&buf); nil != err {
+			t.Fatal(err)
+		}
+		raw := buf.String()
+		//the body of unknown length is relayed as chunked
+		if chunked := strings.Contains(raw, "Transfer-Encoding: chunked\r\n"); chunked != (length == "") || strings.Count(raw, "Transfer-Encoding") > 1 {
+			t.Fatalf("unexpected response:%q", raw)
+		}
+		relayed, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if body, _ := ioutil.ReadAll(relayed.Body); string(body) != "hello world" {
+			t.Fatalf("unexpected body:%q", body)
+		}
+	}
+	if s := manager.auths.ArrayValues()[0].(*GAEAuth).quotaSnapshot(); s.Requests != 2 || s.BytesRecv == 0 {
+		t.Fatalf("unexpected usage:%+v", s)
+	}
+}
+
+//chunkedBodyServer reassembles the request bodies by the contract of
+//event.HTTP_CHUNKED_BODY_HEADER and echoes them
+type chunkedBodyServer struct {
+	sync.Mutex
+	bodies    map[uint32]*bytes.Buffer
+	sequences map[uint32]uint32
+	//the chunk answered with over quota
+	overQuotaAt uint32
+}
+
+func (s *chunkedBodyServer) handle(w http.ResponseWriter, ev event.Event) {
+	s.Lock()
+	defer s.Unlock()
+	ack := new(event.HTTPConnectionEvent)
+	ack.SetHash(ev.GetHash())
+	switch ev := ev.(type) {
+	case *event.HTTPRequestEvent:
+		if len(ev.GetHeader(event.HTTP_CHUNKED_BODY_HEADER)) == 0 {
+			w.Write(encodeGAEEvent(gaeResponseEvent(200, ev.Content.String())))
+			return
+		}
+		s.bodies[ev.GetHash()] = bytes.NewBuffer(ev.Content.Bytes())
+		s.sequences[ev.GetHash()] = 0
+		w.Write(encodeGAEEvent(ack))
+	case *event.SequentialChunkEvent:
+		body, exist := s.bodies[ev.GetHash()]
+		if !exist || ev.Sequence != s.sequences[ev.GetHash()]+1 {
+			http.Error(w, "Unexpected chunk", 400)
+			return
+		}
+		if ev.Sequence == s.overQuotaAt {
+			http.Error(w, "Over Quota", 503)
+			return
+		}
+		s.sequences[ev.GetHash()] = ev.Sequence
+		if len(ev.Content) > 0 {
+			body.Write(ev.Content)
+			w.Write(encodeGAEEvent(ack))
+			return
+		}
+		delete(s.bodies, ev.GetHash())
+		w.Write(encodeGAEEvent(gaeResponseEvent(200, body.String())))
+	default:
+		http.Error(w, "Unexpected event", 400)
+	}
+}
+
+func newChunkedBodyServer() *chunkedBodyServer {
+	return &chunkedBodyServer{bodies: make(map[uint32]*bytes.Buffer), sequences: make(map[uint32]uint32)}
+}
+
+//chunkedBodyRequest has a body of unknown length
+func chunkedBodyRequest(body string) *event.HTTPRequestEvent {
+	raw, _ := http.NewRequest("POST", "http://example.com/upload", strings.NewReader(body))
+	raw.ContentLength = -1
+	req := new(event.HTTPRequestEvent)
+	req.FromRequest(raw)
+	req.SetHash(9)
+	return req
+}
+
+func TestGAEChunkedBody(t *testing.T) {
+	s := newChunkedBodyServer()
+	server := newFakeGAE(s.handle)
+	defer server.Close()
+	manager := setupGAE(t, server)
+	body := strings.Repeat("0123456789", 5)
+	for _, c := range []struct {
+		body    string
+		chunked bool
+	}{
+		{body, true},
+		//a multiple of the chunk size ends with the empty chunk only
+		{body[:32], true},
+		//the end is unknown until the body is read beyond the chunk size
+		{body[:16], true},
+		{body[:15], false},
+		{"", false},
+	} {
+		conn := &GAEHttpConnection{manager: manager}
+		err, res := conn.requestChunkedBody(nil, chunkedBodyRequest(c.body))
+		if nil != err {
+			t.Fatalf("%q:%v", c.body, err)
+		}
+		if httpres, ok := res.(*event.HTTPResponseEvent); !ok || httpres.Content.String() != c.body {
+			t.Fatalf("%q:unexpected response %v", c.body, res)
+		}
+		if _, exist := s.sequences[9]; exist != c.chunked {
+			t.Fatalf("%q:expected chunked %v", c.body, c.chunked)
+		}
+		delete(s.sequences, 9)
+	}
+	if len(s.bodies) > 0 {
+		t.Fatal("the parts are not released")
+	}
+}
+
+func TestGAEChunkedBodyOverQuota(t *testing.T) {
+	s := newChunkedBodyServer()
+	s.overQuotaAt = 2
+	server := newFakeGAE(s.handle)
+	defer server.Close()
+	other := newChunkedBodyServer()
+	otherServer := newFakeGAE(other.handle)
+	defer otherServer.Close()
+	manager := setupGAE(t, server, otherServer)
+
+	conn := &GAEHttpConnection{manager: manager}
+	conn.gaeAuth = manager.auths.ArrayValues()[0].(*GAEAuth)
+	//the parts are bound to the appid, the rest is not sent to another one
+	err, _ := conn.requestChunkedBody(nil, chunkedBodyRequest(strings.Repeat("0123456789", 5)))
+	if err != errGAEOverQuota {
+		t.Fatalf("unexpected error:%v", err)
+	}
+	if len(other.sequences) > 0 {
+		t.Fatal("the chunks are sent to another appid")
+	}
+}
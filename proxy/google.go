@@ -87,11 +87,11 @@ func (google *GoogleConnection) Request(conn *SessionConnection, ev event.Event)
 				}
 			} else {
 				addr := getGoogleHostport(true)
-				proxyConn, err = net.DialTimeout("tcp", addr, connTimeoutSecs)
+				proxyConn, err = chainDial(GOOGLE_NAME, "tcp", addr, connTimeoutSecs)
 				if nil != err {
 					//try again
 					addr = getGoogleHostport(true)
-					proxyConn, err = net.DialTimeout("tcp", addr, connTimeoutSecs)
+					proxyConn, err = chainDial(GOOGLE_NAME, "tcp", addr, connTimeoutSecs)
 				}
 			}
 
@@ -204,12 +204,12 @@ func initGoogleHttpClients() {
 	tlcfg.InsecureSkipVerify = true
 	commonDial := func(n, addr string, isHttps bool) (net.Conn, error) {
 		remote := getGoogleHostport(isHttps)
-		conn, err := net.DialTimeout(n, remote, connTimeoutSecs)
+		conn, err := chainDial(GOOGLE_NAME, n, remote, connTimeoutSecs)
 		if err != nil {
 			expireBlockVerifyCache(remote)
 			//try again
 			remote = getGoogleHostport(isHttps)
-			conn, err = net.DialTimeout(n, remote, connTimeoutSecs)
+			conn, err = chainDial(GOOGLE_NAME, n, remote, connTimeoutSecs)
 		}
 		if err != nil {
 			expireBlockVerifyCache(addr)
@@ -282,7 +282,7 @@ func InitGoogle() error {
 	if tmp, exist := common.Cfg.GetIntProperty("Google", "ConnectTimeout"); exist {
 		connTimeoutSecs = time.Duration(tmp) * time.Millisecond
 	}
-	if proxy, exist := common.Cfg.GetProperty("Google", "Proxy"); exist {
+	if proxy, exist := common.Cfg.GetProperty("Google", "Proxy"); exist && !hasDialChain(GOOGLE_NAME) {
 		googleLocalProxy = proxy
 	}
 	httpGoogleManager = newGoogle(GOOGLE_HTTP_NAME)
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zyxar/gsnova/common"
+	"github.com/zyxar/gsnova/event"
+)
+
+//portForwardRule forwards the connections accepted on Local to Remote through
+//the Via backend like ssh -L
+type portForwardRule struct {
+	Local    string
+	Remote   string
+	Via      string
+	sessions int32
+	listener net.Listener
+}
+
+var portForwardRules []*portForwardRule
+
+//parsePortForwardRule parses "Local=addr Remote=host:port Via=name"
+func parsePortForwardRule(v string) (*portForwardRule, error) {
+	rule := new(portForwardRule)
+	for _, field := range strings.Fields(v) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid field:%s", field)
+		}
+		switch strings.ToLower(kv[0]) {
+		case "local":
+			rule.Local = kv[1]
+		case "remote":
+			rule.Remote = kv[1]
+		case "via":
+			rule.Via = kv[1]
+		default:
+			return nil, fmt.Errorf("Unknown field:%s", kv[0])
+		}
+	}
+	if len(rule.Local) == 0 || len(rule.Remote) == 0 {
+		return nil, errors.New("Local and Remote are required")
+	}
+	if _, _, err := net.SplitHostPort(rule.Remote); nil != err {
+		return nil, err
+	}
+	if len(rule.Via) == 0 {
+		rule.Via = DIRECT_NAME
+	}
+	return rule, nil
+}
+
+//tunnelDialer is implemented by the remote connections which dial a raw tcp
+//stream: SSH opens a channel by DialTCP, Direct and the upstream proxies
+//connect the target and Shadowsocks relays it
+type tunnelDialer interface {
+	dialTunnel(addr string) (net.Conn, error)
+}
+
+//tunnelConn drops the status the C4 server and the GAE tunnel send for the
+//CONNECT request opening the session, the connection is closed if the
+//tunnel is refused
+type tunnelConn struct {
+	net.Conn
+	header      bytes.Buffer
+	established bool
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	if c.established {
+		return c.Conn.Write(b)
+	}
+	c.header.Write(b)
+	content := c.header.Bytes()
+	end := bytes.Index(content, CRLFs)
+	if end < 0 {
+		return len(b), nil
+	}
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(content[:end+4])), nil)
+	if nil != err || res.StatusCode < 200 || res.StatusCode >= 300 {
+		c.Conn.Close()
+		return 0, fmt.Errorf("Tunnel refused:%s", strings.SplitN(string(content), "\r\n", 2)[0])
+	}
+	c.established = true
+	if rest := content[end+4:]; len(rest) > 0 {
+		if _, err = c.Conn.Write(rest); nil != err {
+			return 0, err
+		}
+	}
+	c.header.Reset()
+	return len(b), nil
+}
+
+//pipe copies between the accepted connection and the dialed stream until
+//either side is closed
+func (rule *portForwardRule) pipe(sid uint32, local net.Conn, remote RemoteConnection, dialer tunnelDialer) {
+	defer remote.Close()
+	c, err := dialer.dialTunnel(rule.Remote)
+	if nil != err {
+		log.Printf("Session[%d]Failed to forward %s via %s:%v\n", sid, rule.Remote, rule.Via, err)
+		local.Close()
+		return
+	}
+	go func() {
+		io.Copy(c, local)
+		c.Close()
+	}()
+	io.Copy(local, c)
+	local.Close()
+}
+
+func (rule *portForwardRule) handle(conn net.Conn) {
+	atomic.AddInt32(&rule.sessions, 1)
+	defer atomic.AddInt32(&rule.sessions, -1)
+	local := &tunnelConn{Conn: conn}
+	session := newSessionConnection(NewSessionID(), local, bufio.NewReader(conn))
+	session.Type = HTTPS_TUNNEL
+	raw := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", rule.Remote, rule.Remote)
+	req, _ := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	var ev event.HTTPRequestEvent
+	ev.FromRequest(req)
+	ev.SetHash(session.SessionID)
+
+	manager := getProxyManager(rule.Via, rule.Remote, true)
+	if nil == manager {
+		log.Printf("Session[%d]No proxy:%s available to forward %s\n", session.SessionID, rule.Via, rule.Remote)
+		conn.Close()
+		return
+	}
+	remote, err := manager.GetRemoteConnection(&ev, nil)
+	if nil == err {
+		if dialer, ok := remote.(tunnelDialer); ok {
+			rule.pipe(session.SessionID, conn, remote, dialer)
+			return
+		}
+		if gae, ok := remote.(*GAEHttpConnection); ok {
+			if err = gae.useTunnel(); nil != err {
+				remote.Close()
+			}
+		}
+	}
+	//C4 and the GAE tunnel carry the stream as TCPChunkEvents of a session,
+	//which is opened by the CONNECT event and closed by SocketConnectionEvent
+	if nil == err {
+		session.RemoteConn = remote
+		err, _ = remote.Request(session, &ev)
+	}
+	//the backend handles it as a http request which a raw stream is not
+	if nil == err && session.State == STATE_RECV_HTTP {
+		err = fmt.Errorf("%s can not forward tcp", manager.GetName())
+	}
+	if nil != err {
+		log.Printf("Session[%d]Failed to forward %s via %s:%v\n", session.SessionID, rule.Remote, rule.Via, err)
+		session.Close()
+		return
+	}
+	for session.State != STATE_SESSION_CLOSE {
+		if err := session.process(); nil != err {
+			break
+		}
+	}
+}
+
+func (rule *portForwardRule) serve() {
+	for {
+		conn, err := rule.listener.Accept()
+		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go rule.handle(conn)
+	}
+}
+
+//InitPortForward starts a listener for every [PortForward] Forward[n] rule
+func InitPortForward() {
+	for index := 0; ; index++ {
+		v, exist := common.Cfg.GetProperty("PortForward", "Forward["+strconv.Itoa(index)+"]")
+		if !exist || len(v) == 0 {
+			break
+		}
+		rule, err := parsePortForwardRule(v)
+		if nil == err {
+			rule.listener, err = net.Listen("tcp", rule.Local)
+		}
+		if nil != err {
+			log.Printf("[WARN]Invalid port forward:%s for reason:%v\n", v, err)
+			continue
+		}
+		log.Printf("Forward %s to %s via %s\n", rule.Local, rule.Remote, rule.Via)
+		portForwardRules = append(portForwardRules, rule)
+		go rule.serve()
+	}
+}
+
+func (rule *portForwardRule) String() string {
+	return fmt.Sprintf("%s -> %s via %s, %d sessions", rule.Local, rule.Remote, rule.Via, atomic.LoadInt32(&rule.sessions))
+}
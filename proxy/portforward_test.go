@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zyxar/gsnova/event"
+	"github.com/zyxar/gsnova/remote"
+	"github.com/zyxar/gsnova/util"
+)
+
+func startPortForward(t *testing.T, v string) *portForwardRule {
+	rule, err := parsePortForwardRule(v)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if rule.listener, err = net.Listen("tcp", rule.Local); nil != err {
+		t.Fatal(err)
+	}
+	go rule.serve()
+	return rule
+}
+
+//startGreetingService speaks first like most databases and echoes then
+func startGreetingService(t *testing.T) net.Listener {
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		service.Close()
+	})
+	go func() {
+		for {
+			c, err := service.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				c.Write([]byte("ready\n"))
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return service
+}
+
+func checkPortForward(t *testing.T, via string, service net.Listener) {
+	rule := startPortForward(t, "Local=127.0.0.1:0 Remote="+service.Addr().String()+" Via="+via)
+	defer rule.listener.Close()
+	c, err := net.Dial("tcp", rule.listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(c)
+	if line, err := reader.ReadString('\n'); nil != err || line != "ready\n" {
+		t.Fatalf("%s:unexpected greeting:%q %v", via, line, err)
+	}
+	c.Write([]byte("ping\n"))
+	if line, err := reader.ReadString('\n'); nil != err || line != "ping\n" {
+		t.Fatalf("%s:unexpected echo:%q %v", via, line, err)
+	}
+	//the session ends with the accepted connection
+	c.Close()
+	for i := 0; atomic.LoadInt32(&rule.sessions) > 0; i++ {
+		if i > 500 {
+			t.Fatalf("%s:the session is not closed", via)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//enableTestManager registers the manager of a backend for the test
+func enableTestManager(t *testing.T, manager RemoteConnectionManager, enable *bool) {
+	saveBackendRegistry(t)
+	enabled := *enable
+	t.Cleanup(func() {
+		*enable = enabled
+	})
+	RegisteRemoteConnManager(manager)
+	*enable = true
+}
+
+func TestPortForward(t *testing.T) {
+	service := startGreetingService(t)
+	upstream := httptest.NewServer(new(digestProxy))
+	defer upstream.Close()
+	for _, via := range []string{"Direct", "http://user:pass@" + upstream.Listener.Addr().String()} {
+		checkPortForward(t, via, service)
+	}
+}
+
+//the stream goes through a channel of the ssh pool
+func TestPortForwardSSH(t *testing.T) {
+	setupSSHKnownHosts(t)
+	server := startSSHServer(t, nil)
+	raw := newSSHTestConnection(t, server.Addr().String())
+	if err := raw.initPool(1); nil != err {
+		t.Fatal(err)
+	}
+	manager := new(SSH)
+	manager.selector.Add(raw)
+	enableTestManager(t, manager, &SSHEnable)
+	checkPortForward(t, "SSH", startGreetingService(t))
+	if total := atomic.LoadUint64(&raw.conns[0].total); total != 1 {
+		t.Fatalf("unexpected ssh channels:%d", total)
+	}
+}
+
+//the stream is carried as events of a C4 session, the real C4 server dials
+//the rsocket listener back so that no http pull worker is needed
+func TestPortForwardC4(t *testing.T) {
+	event.Init()
+	cfg, channels, secrets := c4_cfg, c4WriteCBChannels, c4RSocketSecrets
+	t.Cleanup(func() {
+		c4_cfg, c4WriteCBChannels, c4RSocketSecrets = cfg, channels, secrets
+	})
+	c4_cfg = &C4Config{ConnectionMode: MODE_RSOCKET, Encrypter: event.ENCRYPTER_NONE}
+	c4WriteCBChannels = map[uint32]chan event.Event{0: make(chan event.Event)}
+	c4RSocketSecrets = make(map[string]string)
+	go writeCBLoop(0)
+	//the loop has taken its channel once the event is received
+	c4WriteCBChannels[0] <- &event.SocketConnectionEvent{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/push", remote.PushCallback)
+	c4server := httptest.NewServer(mux)
+	defer c4server.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	var handlers sync.WaitGroup
+	var conns []net.Conn
+	var mutex sync.Mutex
+	//the rsocket connections are closed before the globals are restored
+	t.Cleanup(func() {
+		l.Close()
+		mutex.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		mutex.Unlock()
+		handlers.Wait()
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			mutex.Lock()
+			conns = append(conns, c)
+			handlers.Add(1)
+			mutex.Unlock()
+			go func() {
+				defer handlers.Done()
+				handleRSocketConn(c)
+			}()
+		}
+	}()
+
+	server := c4server.URL + "/"
+	manager := &C4{servers: &util.ListSelector{}}
+	manager.servers.Add(server)
+	enableTestManager(t, manager, &C4Enable)
+	user := "portforward-" + l.Addr().String()
+	login := &event.UserLoginEventV2{User: user, RSocketAddr: l.Addr().String()}
+	login.RSocketServer, login.RSocketPoolSize, login.RSocketSecret = server, 1, newRSocketSecret(server)
+	var body bytes.Buffer
+	event.EncodeEvent(&body, wrapC4RequestEvent(login))
+	req, _ := http.NewRequest("POST", server+"push", &body)
+	req.Header.Set("UserToken", user)
+	res, err := http.DefaultClient.Do(req)
+	if nil != err || res.StatusCode != 200 {
+		t.Fatalf("failed to login:%v", err)
+	}
+	res.Body.Close()
+	for i := 0; nil == selectRSocketConn(server, 0); i++ {
+		if i > 500 {
+			t.Fatal("the C4 server does not connect back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkPortForward(t, "C4", startGreetingService(t))
+}
+
+func TestPortForwardRefused(t *testing.T) {
+	upstream := httptest.NewServer(new(digestProxy))
+	defer upstream.Close()
+	rule := startPortForward(t, "Local=127.0.0.1:0 Remote=127.0.0.1:1 Via=http://user:wrong@"+upstream.Listener.Addr().String())
+	defer rule.listener.Close()
+	c, err := net.Dial("tcp", rule.listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//no proxy response should leak into the forwarded stream
+	if data, _ := ioutil.ReadAll(c); len(data) > 0 {
+		t.Fatalf("unexpected data:%q", data)
+	}
+}
+
+func TestParsePortForwardRule(t *testing.T) {
+	rule, err := parsePortForwardRule("Local=127.0.0.1:15432 Remote=db.internal:5432 Via=C4")
+	if nil != err || rule.Local != "127.0.0.1:15432" || rule.Remote != "db.internal:5432" || rule.Via != "C4" {
+		t.Fatalf("unexpected rule:%v %v", rule, err)
+	}
+	for _, v := range []string{"Local=:1", "Local=:1 Remote=db.internal", "Local=:1 Remote=db:1 Port=2"} {
+		if _, err := parsePortForwardRule(v); nil == err {
+			t.Fatalf("%s should be invalid", v)
+		}
+	}
+	if rule, _ := parsePortForwardRule("Local=:1 Remote=db:1"); !strings.EqualFold(rule.Via, DIRECT_NAME) {
+		t.Fatalf("unexpected default via:%s", rule.Via)
+	}
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha1"
 	"fmt"
 	"html/template"
 	"io"
@@ -52,11 +53,14 @@ func InitSelfWebServer() {
 		w.Header().Set("Content-Disposition", "attachment;filename=snova-gfwlist.pac")
 		http.FileServer(http.Dir(common.Home)).ServeHTTP(w, r)
 	})
+	http.HandleFunc("/pac/spac", spacPACHandler)
 
 	http.HandleFunc("/stat", statHandler)
 	http.HandleFunc("/share", shareHandler)
 	http.HandleFunc("/genrc4", rc4Handler)
 	http.HandleFunc("/exit", exitHandler)
+	http.HandleFunc("/explain", explainHandler)
+	http.HandleFunc("/blocked", blockedHandler)
 	http.HandleFunc("/", indexHandler)
 	go http.Serve(lp, nil)
 }
@@ -80,8 +84,10 @@ func indexHandler(w http.ResponseWriter, req *http.Request) {
 			Product   string
 			Version   string
 			ProxyPort string
+			AppIDs    []gaeAppIDStat
+			UPnP      *upnpStat
 		}
-		t.Execute(w, &PageContent{common.Product, common.Version, common.ProxyPort})
+		t.Execute(w, &PageContent{common.Product, common.Version, common.ProxyPort, gaeAppIDStats(), upnpStats()})
 	}
 }
 
@@ -156,6 +162,7 @@ func rc4Handler(w http.ResponseWriter, req *http.Request) {
 }
 
 func exitHandler(w http.ResponseWriter, req *http.Request) {
+	StopUPnP()
 	os.Exit(1)
 }
 
@@ -179,6 +186,74 @@ func shareHandler(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(500)
 }
 
+//spacPACHandler serves the PAC generated from SPAC, which is not sent
+//again if the ETag is not changed
+func spacPACHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Connection", "close")
+	content := generateSpacPAC()
+	etag := fmt.Sprintf("\"%x\"", sha1.Sum([]byte(content)))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Content-Disposition", "attachment;filename=snova-spac.pac")
+	io.WriteString(w, content)
+}
+
+func explainHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Connection", "close")
+	req.ParseForm()
+	type ExplainContent struct {
+		Product     string
+		Version     string
+		Method      string
+		URL         string
+		Explanation *SpacExplanation
+		Error       string
+	}
+	content := &ExplainContent{Product: common.Product, Version: common.Version}
+	content.Method = req.Form.Get("method")
+	content.URL = req.Form.Get("url")
+	if len(content.URL) > 0 {
+		e, err := ExplainSpac(content.Method, content.URL, req.RemoteAddr)
+		if nil != err {
+			content.Error = err.Error()
+		}
+		content.Explanation = e
+	}
+	t, err := template.ParseFiles(filepath.Join(common.Home, "web", "explain.html"))
+	if nil != err {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	t.Execute(w, content)
+}
+
+func blockedHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Connection", "close")
+	//unblock by the form only, a GET could be sent by any page
+	if req.Method == "POST" {
+		if host := req.PostFormValue("unblock"); len(host) > 0 && autoBlocked.remove(host) {
+			log.Printf("Unblock host:%s\n", host)
+		}
+	}
+	type BlockedContent struct {
+		Product  string
+		Version  string
+		Learning bool
+		Rules    []*AutoBlockedRule
+	}
+	t, err := template.ParseFiles(filepath.Join(common.Home, "web", "blocked.html"))
+	if nil != err {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	t.Execute(w, &BlockedContent{common.Product, common.Version, spac_learning, autoBlocked.list()})
+}
+
 func statHandler(w http.ResponseWriter, req *http.Request) {
 	runtime.GC()
 	//var stat runtime.MemStats
@@ -196,6 +271,30 @@ func statHandler(w http.ResponseWriter, req *http.Request) {
 	buf.WriteString(fmt.Sprintf("NumForwardConn: %d\n", total_forwared_routine_num))
 	buf.WriteString(fmt.Sprintf("NumForwardGoroutine: %d\n", total_forwared_routine_num))
 	buf.WriteString(fmt.Sprintf("GOMAXPROCS: %d\n", runtime.GOMAXPROCS(runtime.NumCPU())))
+	for _, stat := range gaeAppIDStats() {
+		buf.WriteString(fmt.Sprintf("GAEAppID[%s]: State:%s Sent:%d Recv:%d Requests:%d", stat.AppID, stat.State, stat.BytesSent, stat.BytesRecv, stat.Requests))
+		if len(stat.ResetAt) > 0 {
+			buf.WriteString(fmt.Sprintf(" ResetAt:%s", stat.ResetAt))
+		}
+		buf.WriteString("\n")
+	}
+	for _, stat := range sshConnStats() {
+		buf.WriteString(stat.String())
+		buf.WriteString("\n")
+	}
+	for _, rule := range portForwardRules {
+		buf.WriteString(fmt.Sprintf("PortForward[%s]\n", rule))
+	}
+	if stat := upnpStats(); nil != stat {
+		buf.WriteString(fmt.Sprintf("UPnPExternalIP: %s\n", stat.ExternalIP))
+		for _, m := range stat.Mappings {
+			buf.WriteString(fmt.Sprintf("UPnPMapping[%s:%d->%d]: Mapped:%v", m.Protocol, m.ExternalPort, m.InternalPort, m.Mapped))
+			if len(m.LastError) > 0 {
+				buf.WriteString(fmt.Sprintf(" Error:%s", m.LastError))
+			}
+			buf.WriteString("\n")
+		}
+	}
 
 	//	if content, err := json.MarshalIndent(&stat, "", " "); nil == err {
 	//		buf.Write(content)
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zyxar/gsnova/common"
+	"github.com/zyxar/gsnova/event"
+	"github.com/zyxar/gsnova/misc/shadowsocks"
+	"github.com/zyxar/gsnova/util"
+)
+
+var ShadowsocksEnable bool
+
+type shadowsocksServer struct {
+	Server string
+	cipher *shadowsocks.Cipher
+}
+
+type ShadowsocksConnection struct {
+	server            *shadowsocksServer
+	manager           *Shadowsocks
+	proxy_conn        net.Conn
+	proxy_conn_reader *bufio.Reader
+	proxy_addr        string
+}
+
+func (conn *ShadowsocksConnection) initProxyConn(proxy_addr string, isHttps bool) error {
+	if !strings.Contains(proxy_addr, ":") {
+		if isHttps {
+			proxy_addr = proxy_addr + ":443"
+		} else {
+			proxy_addr = proxy_addr + ":80"
+		}
+	}
+	if nil != conn.proxy_conn && conn.proxy_addr == proxy_addr {
+		return nil
+	}
+	conn.Close()
+	conn.proxy_addr = proxy_addr
+	var err error
+	if conn.proxy_conn, err = chainDial(SHADOWSOCKS_NAME, "tcp", conn.server.Server, 10*time.Second); nil == err {
+		conn.proxy_conn, err = shadowsocks.Client(conn.proxy_conn, proxy_addr, conn.server.cipher)
+	}
+	if nil == err && !isHttps {
+		conn.proxy_conn_reader = bufio.NewReader(conn.proxy_conn)
+	}
+	return err
+}
+
+//dialTunnel returns the stream relayed to addr by the server, it is closed
+//with the connection
+func (conn *ShadowsocksConnection) dialTunnel(addr string) (net.Conn, error) {
+	if err := conn.initProxyConn(addr, true); nil != err {
+		return nil, err
+	}
+	return conn.proxy_conn, nil
+}
+
+func (conn *ShadowsocksConnection) Request(sess *SessionConnection, ev event.Event) (err error, res event.Event) {
+	f := func(local, remote net.Conn, ch chan int) {
+		io.Copy(remote, local)
+		local.Close()
+		remote.Close()
+		ch <- 1
+	}
+	switch ev.GetType() {
+	case event.HTTP_REQUEST_EVENT_TYPE:
+		req := ev.(*event.HTTPRequestEvent)
+		if err := conn.initProxyConn(req.RawReq.Host, sess.Type == HTTPS_TUNNEL); nil != err {
+			return err, nil
+		}
+		log.Printf("Session[%d]Request %s\n", req.GetHash(), util.GetURLString(req.RawReq, true))
+		if sess.Type == HTTPS_TUNNEL {
+			sess.LocalRawConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			ch := make(chan int)
+			go f(sess.LocalRawConn, conn.proxy_conn, ch)
+			go f(conn.proxy_conn, sess.LocalRawConn, ch)
+			<-ch
+			<-ch
+			conn.Close()
+			sess.State = STATE_SESSION_CLOSE
+		} else {
+			err := req.RawReq.Write(conn.proxy_conn)
+			if nil != err {
+				conn.Close()
+				return err, nil
+			}
+			conn.proxy_conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			resp, err := http.ReadResponse(conn.proxy_conn_reader, req.RawReq)
+			if nil != err {
+				conn.Close()
+				return err, nil
+			}
+			var zero time.Time
+			conn.proxy_conn.SetReadDeadline(zero)
+			err = resp.Write(sess.LocalRawConn)
+			if nil == err {
+				err = resp.Body.Close()
+			}
+			if nil != err || !util.IsResponseKeepAlive(resp) || !util.IsRequestKeepAlive(req.RawReq) {
+				sess.LocalRawConn.Close()
+				conn.Close()
+				sess.State = STATE_SESSION_CLOSE
+			} else {
+				sess.State = STATE_RECV_HTTP
+			}
+		}
+	default:
+	}
+	return nil, nil
+}
+
+func (conn *ShadowsocksConnection) GetConnectionManager() RemoteConnectionManager {
+	return conn.manager
+}
+
+func (conn *ShadowsocksConnection) Close() error {
+	if nil != conn.proxy_conn {
+		conn.proxy_conn.Close()
+		conn.proxy_conn = nil
+	}
+	return nil
+}
+
+type Shadowsocks struct {
+	selector util.ListSelector
+}
+
+func (manager *Shadowsocks) RecycleRemoteConnection(conn RemoteConnection) {
+}
+
+func (manager *Shadowsocks) GetRemoteConnection(ev event.Event, attrs map[string]string) (RemoteConnection, error) {
+	c := manager.selector.Select()
+	if nil == c {
+		return nil, errors.New("Shadowsocks not available now.")
+	}
+	conn := &ShadowsocksConnection{manager: manager,
+		server: c.(*shadowsocksServer)}
+	return conn, nil
+}
+
+func (manager *Shadowsocks) GetName() string {
+	return SHADOWSOCKS_NAME
+}
+
+//parseShadowsocksServer parses ss://method:password@host:port, the user info
+//may also be base64 encoded as SIP002 defines
+func parseShadowsocksServer(v string) (*shadowsocksServer, error) {
+	u, err := url.Parse(v)
+	if nil != err {
+		return nil, err
+	}
+	if nil == u.User {
+		return nil, errors.New("No method and password found in url")
+	}
+	method := u.User.Username()
+	password, exist := u.User.Password()
+	if !exist {
+		info, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(method, "="))
+		if nil != err {
+			return nil, fmt.Errorf("Invalid user info:%v", err)
+		}
+		ss := strings.SplitN(string(info), ":", 2)
+		if len(ss) != 2 {
+			return nil, errors.New("No password found in url")
+		}
+		method, password = ss[0], ss[1]
+	}
+	if !strings.Contains(u.Host, ":") {
+		return nil, errors.New("No port found in url")
+	}
+	server := &shadowsocksServer{Server: u.Host}
+	if server.cipher, err = shadowsocks.NewCipher(method, password); nil != err {
+		return nil, err
+	}
+	return server, nil
+}
+
+func InitShadowsocks() error {
+	if enable, exist := common.Cfg.GetIntProperty("Shadowsocks", "Enable"); !exist || enable == 0 {
+		return nil
+	}
+	log.Println("Init Shadowsocks.")
+	var manager Shadowsocks
+	for index := 0; ; index++ {
+		v, exist := common.Cfg.GetProperty("Shadowsocks", "Server["+strconv.Itoa(index)+"]")
+		if !exist || len(v) == 0 {
+			break
+		}
+		if server, err := parseShadowsocksServer(v); nil == err {
+			manager.selector.Add(server)
+		} else {
+			log.Printf("Invalid Shadowsocks server url:%s for reason:%v\n", v, err)
+		}
+	}
+	if manager.selector.Size() == 0 {
+		return errors.New("No configed Shadowsocks server.")
+	}
+	RegisteRemoteConnManager(&manager)
+	ShadowsocksEnable = true
+	return nil
+}
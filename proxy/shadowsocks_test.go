@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zyxar/gsnova/event"
+	"github.com/zyxar/gsnova/misc/shadowsocks"
+)
+
+func startShadowsocksServer(t *testing.T, cipher *shadowsocks.Cipher) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	go shadowsocks.Serve(l, cipher)
+	return l
+}
+
+func newShadowsocksSession(t *testing.T, server net.Listener, method string) (*Shadowsocks, *SessionConnection, net.Conn) {
+	ss, err := parseShadowsocksServer("ss://" + method + ":secret@" + server.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	manager := new(Shadowsocks)
+	manager.selector.Add(ss)
+	local, browser := net.Pipe()
+	session := newSessionConnection(1, local, bufio.NewReader(local))
+	return manager, session, browser
+}
+
+func TestShadowsocksTunnel(t *testing.T) {
+	cipher, _ := shadowsocks.NewCipher("chacha20-ietf-poly1305", "secret")
+	server := startShadowsocksServer(t, cipher)
+	defer server.Close()
+	echo, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if nil == err {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+
+	manager, session, browser := newShadowsocksSession(t, server, "chacha20-ietf-poly1305")
+	session.Type = HTTPS_TUNNEL
+	req, _ := http.NewRequest("CONNECT", "http://"+echo.Addr().String(), nil)
+	var ev event.HTTPRequestEvent
+	ev.FromRequest(req)
+	conn, err := manager.GetRemoteConnection(&ev, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		err, _ := conn.Request(session, &ev)
+		done <- err
+	}()
+	reader := bufio.NewReader(browser)
+	line, _ := reader.ReadString('\n')
+	if !strings.Contains(line, "200") {
+		t.Fatalf("unexpected tunnel response:%q", line)
+	}
+	reader.ReadString('\n')
+	browser.Write([]byte("ping"))
+	pong := make([]byte, 4)
+	if _, err = io.ReadFull(reader, pong); nil != err || string(pong) != "ping" {
+		t.Fatalf("unexpected echo:%q %v", pong, err)
+	}
+	browser.Close()
+	if err = <-done; nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestShadowsocksHttp(t *testing.T) {
+	cipher, _ := shadowsocks.NewCipher("aes-256-gcm", "secret")
+	server := startShadowsocksServer(t, cipher)
+	defer server.Close()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer web.Close()
+
+	manager, session, browser := newShadowsocksSession(t, server, "aes-256-gcm")
+	req, _ := http.NewRequest("GET", web.URL+"/world", nil)
+	req.Header.Set("Connection", "close")
+	var ev event.HTTPRequestEvent
+	ev.FromRequest(req)
+	conn, _ := manager.GetRemoteConnection(&ev, nil)
+	done := make(chan error, 1)
+	go func() {
+		err, _ := conn.Request(session, &ev)
+		done <- err
+	}()
+	res, err := http.ReadResponse(bufio.NewReader(browser), req)
+	if nil != err {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "hello /world" {
+		t.Fatalf("unexpected body:%q", body)
+	}
+	if err = <-done; nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestParseShadowsocksServer(t *testing.T) {
+	//SIP002 user info is base64 of method:password
+	server, err := parseShadowsocksServer("ss://YWVzLTI1Ni1nY206c2VjcmV0@127.0.0.1:8388")
+	if nil != err || server.cipher.Method != "aes-256-gcm" || server.Server != "127.0.0.1:8388" {
+		t.Fatalf("unexpected server:%v %v", server, err)
+	}
+	if _, err = parseShadowsocksServer("ss://rc4-md5:secret@127.0.0.1:8388"); nil == err {
+		t.Fatal("stream ciphers are not supported")
+	}
+}
@@ -14,30 +14,63 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
 	"github.com/zyxar/gsnova/common"
+	"github.com/zyxar/gsnova/misc/gfwlist"
 	"github.com/zyxar/gsnova/util"
 )
 
 var spac_script_path []string
+var spac_filter_path string
 var spac_enable bool
 
+//spacMutex guards the rules, the matcher and the user filters replaced by
+//loadSpacScript, spacLoadMutex serializes the loads
+var spacMutex sync.RWMutex
+var spacLoadMutex sync.Mutex
+
 type JsonRule struct {
-	Method       []string
-	Host         []string
-	URL          []string
-	Proxy        []string
-	Filter       []string
-	Protocol     string
-	Attr         []string
+	Method   []string
+	Host     []string
+	URL      []string
+	Proxy    []string
+	Filter   []string
+	Protocol string
+	Attr     []string
+	//destination ports like "443" or "8000-9000"
+	Port []string
+	//destination CIDRs, the host is resolved if it is not an IP
+	IP []string
+	//client source CIDRs
+	Client    []string
+	UserAgent []string
+	//header name to pattern, all of them must match
+	Header map[string]string
+	//time windows like "Mon-Fri 09:00-18:00"
+	Time []string
+	//the rule is ignored after Expire if it is set
+	Expire       time.Time
 	method_regex []*regexp.Regexp
 	host_regex   []*regexp.Regexp
 	url_regex    []*regexp.Regexp
+	port_ranges  []portRange
+	ip_nets      []*net.IPNet
+	client_nets  []*net.IPNet
+	ua_regex     []*regexp.Regexp
+	header_regex map[string]*regexp.Regexp
+	time_windows []timeWindow
+	filter_exprs []*filterExpr
+	//the script file and the index in it
+	source string
+	index  int
 }
 
 func loadSpacScript() error {
+	spacLoadMutex.Lock()
+	defer spacLoadMutex.Unlock()
 	rules := []*JsonRule{}
 	var err error
 	defer func() {
@@ -45,6 +78,9 @@ func loadSpacScript() error {
 			log.Printf("Failed to init SPAC for reason:%v", err)
 		}
 	}()
+	if e := loadSpacFilters(spac_filter_path); nil != e && !os.IsNotExist(e) {
+		log.Printf("[ERROR]Failed to load spac filters:%s for reason:%v\n", spac_filter_path, e)
+	}
 	for idx, path := range spac_script_path {
 		file, e := ioutil.ReadFile(path)
 		err = e
@@ -55,7 +91,9 @@ func loadSpacScript() error {
 				log.Printf("[ERROR]Failed to unmarshal spac script file:%s for reason:%v\n", path, err)
 				continue
 			}
-			for _, json_rule := range tmp {
+			for i, json_rule := range tmp {
+				json_rule.source = filepath.Base(path)
+				json_rule.index = i
 				err = json_rule.init()
 				if nil != err {
 					return err
@@ -63,24 +101,56 @@ func loadSpacScript() error {
 			}
 			rules = append(rules, tmp...)
 		} else {
-			//The first is hiding  file
-			if idx != 0 {
+			//The first is hiding  file, the last is created by learning
+			if idx > 0 && idx < len(spac_script_path)-1 {
 				return err
 			}
 		}
 	}
+	matcher := newSpacMatcher(rules)
+	spacMutex.Lock()
 	spac.rules = rules
+	spac.matcher = matcher
+	spacMutex.Unlock()
 	return nil
 }
 
+//matchSpacRule returns the first rule matching the request
+func matchSpacRule(req *http.Request, isHttpsConn bool) *JsonRule {
+	spacMutex.RLock()
+	defer spacMutex.RUnlock()
+	return spac.matcher.Match(req, isHttpsConn)
+}
+
+//spacReload asks reloadSpacScript to load the scripts
+var spacReload = make(chan bool, 1)
+
+//triggerSpacReload loads the scripts in background, the triggers during a
+//load are merged
+func triggerSpacReload() {
+	select {
+	case spacReload <- true:
+	default:
+	}
+}
+
 func reloadSpacScript() {
 	tick := time.NewTicker(5 * time.Second)
-	mod_times := make([]time.Time, len(spac_script_path))
+	paths := append([]string{spac_filter_path}, spac_script_path...)
+	mod_times := make([]time.Time, len(paths))
 	for {
 		select {
+		case <-spacReload:
+			//the modification is loaded now
+			for i, path := range paths {
+				if f, err := os.Stat(path); nil == err {
+					mod_times[i] = f.ModTime()
+				}
+			}
+			loadSpacScript()
 		case <-tick.C:
 			modified := false
-			for i, path := range spac_script_path {
+			for i, path := range paths {
 				f, err := os.Stat(path)
 				if nil == err {
 					if !mod_times[i].IsZero() && mod_times[i].Before(f.ModTime()) {
@@ -134,7 +204,10 @@ func (r *JsonRule) init() (err error) {
 		return
 	}
 	r.url_regex, err = initRegexSlice(r.URL)
-
+	if nil != err {
+		return
+	}
+	err = r.initPredicates()
 	return
 }
 
@@ -149,17 +222,6 @@ func (r *JsonRule) matchProtocol(req *http.Request, isHttpsConn bool) bool {
 	return true
 }
 
-func (r *JsonRule) matchFilters(req *http.Request) bool {
-	matched := true
-	for _, filter := range r.Filter {
-		matched = matched && invokeFilter(filter, req)
-		if !matched {
-			return false
-		}
-	}
-	return matched
-}
-
 func (r *JsonRule) match(req *http.Request, isHttpsConn bool) bool {
 	//    getUrl := func()string{
 	//       if strings.HasPrefix(req.RequestURI, "http://"){
@@ -167,12 +229,13 @@ func (r *JsonRule) match(req *http.Request, isHttpsConn bool) bool {
 	//       }
 	//       return "http://" + req.Host + req.RequestURI
 	//    }
-	return r.matchFilters(req) && r.matchProtocol(req, isHttpsConn) && matchRegexs(req.Method, r.method_regex) && matchRegexs(req.Host, r.host_regex) && matchRegexs(req.RequestURI, r.url_regex)
+	return r.matchProtocol(req, isHttpsConn) && matchRegexs(req.Method, r.method_regex) && matchRegexs(req.Host, r.host_regex) && matchRegexs(req.RequestURI, r.url_regex) && r.matchPredicates(req, isHttpsConn, newMatchContext()) == ""
 }
 
 type SpacConfig struct {
 	defaultRule string
 	rules       []*JsonRule
+	matcher     *spacMatcher
 }
 
 var spac *SpacConfig
@@ -202,6 +265,11 @@ function FindProxyForURL(url, host) {
 }`
 
 func load_gfwlist_rule() {
+	init_gfwlist_func(gfwlistContent())
+}
+
+//gfwlistContent returns the gfwlist followed by the user rules
+func gfwlistContent() string {
 	var buffer bytes.Buffer
 	if content, err := ioutil.ReadFile(filepath.Join(common.Home, "spac/snova-gfwlist.txt")); nil == err {
 		buffer.Write(content)
@@ -210,7 +278,7 @@ func load_gfwlist_rule() {
 	if content, err := ioutil.ReadFile(filepath.Join(common.Home, "spac/user-gfwlist.txt")); nil == err {
 		buffer.Write(content)
 	}
-	init_gfwlist_func(buffer.String())
+	return buffer.String()
 }
 
 func generatePAC(url, date, content string) string {
@@ -232,92 +300,45 @@ func generatePAC(url, date, content string) string {
 	pac.ProxyString = "PROXY " + pac_proxy
 	pac.DefaultVar = "DEFAULT"
 	pac.DefaultString = "DIRECT"
-	jscode := []string{}
-
 	if usercontent, err := ioutil.ReadFile(filepath.Join(common.Home, "spac/user-gfwlist.txt")); nil == err {
 		content = content + "\n" + string(usercontent)
 	}
+	pac.RuleListCode = strings.Join(autoProxyToJS(content, pac.ProxyVar, pac.DefaultVar), "\r\n\t")
+	t := template.Must(template.New("pacGenFormatter").Parse(pacGenFormatter))
+	var buffer bytes.Buffer
+	err := t.Execute(&buffer, pac)
+	if err != nil {
+		log.Println("Executing template:", err)
+	}
+	return buffer.String()
+}
 
+//autoProxyToJS converts the AutoProxy rules into javascript statements
+//returning proxyVar, or defaultVar for the exceptions which are tested first
+func autoProxyToJS(content, proxyVar, defaultVar string) []string {
+	jscode := []string{}
 	reader := bufio.NewReader(strings.NewReader(content))
-	i := 0
 	for {
 		line, _, err := reader.ReadLine()
 		if nil != err {
 			break
 		}
-		//from the second line
-		i = i + 1
-		if i == 1 {
+		rule, err := gfwlist.ParseRule(string(line))
+		if nil != err {
+			log.Printf("[WARN]Invalid AutoProxy rule for reason:%v\n", err)
 			continue
 		}
-		str := string(line)
-		str = strings.TrimSpace(str)
-
-		proxyVar := "PROXY"
-		//comment
-		if strings.HasPrefix(str, "!") || len(str) == 0 {
+		if nil == rule {
 			continue
 		}
-		if strings.HasPrefix(str, "@@") {
-			str = str[2:]
-			proxyVar = "DEFAULT"
-		}
-		jsRegexp := ""
-
-		if strings.HasPrefix(str, "/") && strings.HasSuffix(str, "/") {
-			jsRegexp = str[1 : len(str)-1]
-		} else {
-			if tmp, err := regexp.Compile("\\*+"); err == nil {
-				jsRegexp = tmp.ReplaceAllString(str, "*")
-			}
-
-			if tmp, err := regexp.Compile("\\^\\|$"); err == nil {
-				jsRegexp = util.RegexpReplace(jsRegexp, "^", tmp, 1)
-			}
-			if tmp, err := regexp.Compile("(\\W)"); err == nil {
-				jsRegexp = tmp.ReplaceAllString(jsRegexp, "\\$0")
-			}
-			jsRegexp = strings.Replace(jsRegexp, "\\*", ".*", -1)
-
-			if tmp, err := regexp.Compile("\\\\^"); err == nil {
-				jsRegexp = tmp.ReplaceAllString(jsRegexp, "(?:[^\\w\\-.%\u0080-\uFFFF]|$)")
-			}
-
-			if tmp, err := regexp.Compile("^\\\\\\|\\\\\\|"); err == nil {
-				jsRegexp = util.RegexpReplace(jsRegexp, "^[\\w\\-]+:\\/+(?!\\/)(?:[^\\/]+\\.)?", tmp, 1)
-			}
-			if tmp, err := regexp.Compile("^\\\\\\|"); err == nil {
-				jsRegexp = util.RegexpReplace(jsRegexp, "^", tmp, 1)
-			}
-			if tmp, err := regexp.Compile("\\\\\\|$"); err == nil {
-				jsRegexp = util.RegexpReplace(jsRegexp, "$", tmp, 1)
-			}
-			if tmp, err := regexp.Compile("^(\\.\\*)"); err == nil {
-				jsRegexp = util.RegexpReplace(jsRegexp, "", tmp, 1)
-			}
-			if tmp, err := regexp.Compile("(\\.\\*)$"); err == nil {
-				jsRegexp = util.RegexpReplace(jsRegexp, "", tmp, 1)
-			}
-			if len(jsRegexp) == 0 {
-				log.Printf("There is one rule that matches all URL, which is highly *NOT* recommended: %s\n", str)
-			}
-		}
-		jsLine := fmt.Sprintf("if(/%s/i.test(url)) return %s;", jsRegexp, proxyVar)
-		if proxyVar == "DEFAULT" {
-			//log.Printf("%s\n", jsLine)
+		if rule.Exception {
+			jsLine := fmt.Sprintf("if(%s) return %s;", rule.JSCondition(), defaultVar)
 			jscode = append(jscode[:0], append([]string{jsLine}, jscode[0:]...)...)
 		} else {
-			jscode = append(jscode, jsLine)
+			jscode = append(jscode, fmt.Sprintf("if(%s) return %s;", rule.JSCondition(), proxyVar))
 		}
 	}
-	pac.RuleListCode = strings.Join(jscode, "\r\n\t")
-	t := template.Must(template.New("pacGenFormatter").Parse(pacGenFormatter))
-	var buffer bytes.Buffer
-	err := t.Execute(&buffer, pac)
-	if err != nil {
-		log.Println("Executing template:", err)
-	}
-	return buffer.String()
+	return jscode
 }
 
 func fetchCloudSpacScript(url string) {
@@ -394,15 +415,7 @@ func generatePACFromGFWList(url string) {
 
 func PostInitSpac() {
 	if spac.defaultRule == AUTO_NAME {
-		if GAEEnable {
-			spac.defaultRule = GAE_NAME
-		} else if C4Enable {
-			spac.defaultRule = C4_NAME
-		} else if SSHEnable {
-			spac.defaultRule = SSH_NAME
-		} else {
-			spac.defaultRule = DIRECT_NAME
-		}
+		spac.defaultRule = autoBackend()
 	}
 }
 
@@ -413,8 +426,9 @@ func InitSpac() {
 	if len(spac.defaultRule) == 0 {
 		spac.defaultRule = GAE_NAME
 	}
-	//user script has higher priority
-	spac_script_path = []string{filepath.Join(common.Home, "spac/user_pre_spac.json"), filepath.Join(common.Home, "spac/cloud_spac.json"), filepath.Join(common.Home, "spac/user_spac.json")}
+	//user script has higher priority, the learned rules are the last
+	spac_script_path = []string{filepath.Join(common.Home, "spac/user_pre_spac.json"), filepath.Join(common.Home, "spac/cloud_spac.json"), filepath.Join(common.Home, "spac/user_spac.json"), filepath.Join(common.Home, "spac/auto_blocked.json")}
+	spac_filter_path = filepath.Join(common.Home, "spac/user_filters.json")
 	spac.rules = make([]*JsonRule, 0)
 	if enable, exist := common.Cfg.GetIntProperty("SPAC", "Enable"); exist {
 		spac_enable = (enable == 1)
@@ -430,63 +444,95 @@ func InitSpac() {
 	if addr, exist := common.Cfg.GetProperty("SPAC", "CloudRule"); exist {
 		go fetchCloudSpacScript(addr)
 	}
-	if url, exist := common.Cfg.GetProperty("SPAC", "IPRangeRepo"); exist {
+	//a local GeoLite2 country database is preferred to the ip range repo
+	if path, exist := common.Cfg.GetProperty("SPAC", "GeoLite2"); exist && len(strings.TrimSpace(path)) > 0 {
+		path = strings.TrimSpace(path)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(common.Home, path)
+		}
+		go init_iprange_func(path)
+	} else if url, exist := common.Cfg.GetProperty("SPAC", "IPRangeRepo"); exist {
 		go loadIPRangeFile(strings.TrimSpace(url))
 	}
+	if enable, exist := common.Cfg.GetBoolProperty("SPAC", "Learning"); exist {
+		spac_learning = enable
+	}
+	if days, exist := common.Cfg.GetIntProperty("SPAC", "LearningExpireDays"); exist && days > 0 {
+		learningExpire = time.Duration(days) * 24 * time.Hour
+	}
+	if ms, exist := common.Cfg.GetIntProperty("SPAC", "FilterDNSTimeout"); exist && ms > 0 {
+		spacDNSTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if v, exist := common.Cfg.GetBoolProperty("SPAC", "IsHostInCNDefault"); exist {
+		spacDNSInCNDefault = v
+	}
+	autoBlocked.load(spac_script_path[len(spac_script_path)-1])
 
 	if !spac_enable {
 		return
 	}
+	init_spac_func()
 	loadSpacScript()
 	go reloadSpacScript()
-	init_spac_func()
 }
 
 func selectProxyByRequest(req *http.Request, host, port string, isHttpsConn bool, proxyNames []string) ([]string, map[string]string) {
 	attrs := make(map[string]string)
-	for _, r := range spac.rules {
-		if r.match(req, isHttpsConn) {
-			for _, v := range r.Attr {
-				attrs[v] = v
-			}
-			return r.Proxy, attrs
+	if r := matchSpacRule(req, isHttpsConn); nil != r {
+		for _, v := range r.Attr {
+			attrs[v] = v
 		}
+		return r.Proxy, attrs
 	}
 
+	if names, ok := selectProxyByHosts(req, host, port, attrs); ok {
+		return names, attrs
+	}
+	return proxyNames, attrs
+}
+
+//selectProxyByHosts goes direct if the host has an available IP in hosts
+func selectProxyByHosts(req *http.Request, host, port string, attrs map[string]string) ([]string, bool) {
 	if hostsEnable != HOSTS_DISABLE {
 		if _, exist := lookupAvailableHostPort(req, net.JoinHostPort(host, port)); exist {
 			if !strings.EqualFold(req.Method, "Connect") {
 				attrs["CRLF"] = "CRLF"
 			}
-			return []string{DIRECT_NAME, spac.defaultRule}, attrs
+			return []string{DIRECT_NAME, spac.defaultRule}, true
 		} else {
 			//log.Printf("[WARN]No available IP for %s\n", host)
 		}
 	}
-	return proxyNames, attrs
+	return nil, false
 }
 
-func adjustProxyName(name string, isHttpsConn bool) string {
-	if strings.EqualFold(name, GOOGLE_NAME) {
-		if isHttpsConn {
-			return GOOGLE_HTTPS_NAME
-		} else {
-			return GOOGLE_HTTP_NAME
+//resolveProxyManager returns the manager of a backend or a registered
+//manager, known is false if the name is neither of them
+func resolveProxyManager(name string, isHttpsConn bool) (manager RemoteConnectionManager, known bool) {
+	if b := getBackend(name); nil != b {
+		if b.healthy() {
+			manager = b.manager(isHttpsConn)
 		}
+		return manager, true
 	}
-	if strings.EqualFold(name, GAE_NAME) {
-		return GAE_NAME
-	}
-	if strings.EqualFold(name, C4_NAME) {
-		return C4_NAME
-	}
-	if strings.EqualFold(name, SSH_NAME) {
-		return SSH_NAME
+	for k, v := range registedRemoteConnManager {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
 	}
-	if strings.EqualFold(name, DIRECT_NAME) {
-		return DIRECT_NAME
+	return nil, false
+}
+
+//learningProxyNames retries the blocked direct requests with the default
+//rule in learning mode
+func learningProxyNames(proxyNames []string, attrs map[string]string) []string {
+	if spac_learning && spac_enable {
+		attrs[ATTR_LEARNING] = ATTR_LEARNING
+		if len(proxyNames) == 1 && strings.EqualFold(proxyNames[0], DIRECT_NAME) {
+			return []string{DIRECT_NAME, DEFAULT_NAME}
+		}
 	}
-	return name
+	return proxyNames
 }
 
 func SelectProxy(req *http.Request, conn *SessionConnection) ([]RemoteConnectionManager, map[string]string) {
@@ -511,22 +557,15 @@ func SelectProxy(req *http.Request, conn *SessionConnection) ([]RemoteConnection
 			}
 		}
 	}
-	switch conn.ProxyServerType {
-	case GAE_PROXY_SERVER:
+	//connections accepted by the dedicated listener of a backend
+	if len(conn.ProxyServer) > 0 {
 		need_select_proxy = false
-		proxyNames = []string{GAE_NAME}
-	case C4_PROXY_SERVER:
-		need_select_proxy = false
-		proxyNames = []string{C4_NAME}
-	case SSH_PROXY_SERVER:
-		need_select_proxy = false
-		proxyNames = []string{SSH_NAME}
-	default:
-		break
+		proxyNames = []string{conn.ProxyServer}
 	}
 
 	if need_select_proxy {
 		proxyNames, attrs = selectProxyByRequest(req, host, port, isHttpsConn, proxyNames)
+		proxyNames = learningProxyNames(proxyNames, attrs)
 	}
 
 	if need_select_proxy && !isHttpsConn && containsAttr(attrs, ATTR_REDIRECT_HTTPS) {
@@ -537,51 +576,52 @@ func SelectProxy(req *http.Request, conn *SessionConnection) ([]RemoteConnection
 		log.Printf("Found %v for host:%v and url:%s\n", proxyNames, host, req.RequestURI)
 	}
 	for _, proxyName := range proxyNames {
-		if strings.HasPrefix(proxyName, GAE_NAME) || strings.HasPrefix(proxyName, C4_NAME) || strings.HasPrefix(proxyName, DEFAULT_NAME) {
-			if strings.Contains(proxyName, ":") {
-				ss := strings.SplitN(proxyName, ":", 2)
-				proxyName = ss[0]
-				attrs[ATTR_APP] = ss[1]
-			}
+		proxyName = adjustProxyName(proxyName, attrs)
+		if manager := getProxyManager(proxyName, req.Host, isHttpsConn); nil != manager {
+			proxyManagers = append(proxyManagers, manager)
+		} else {
+			log.Printf("No proxy:%s available for %s\n", proxyName, host)
+		}
+	}
+	return proxyManagers, attrs
+}
+
+//adjustProxyName resolves Default, Backend:app passes the app to the
+//backend by attrs
+func adjustProxyName(proxyName string, attrs map[string]string) string {
+	if index := strings.Index(proxyName, ":"); index > 0 {
+		if prefix := proxyName[:index]; nil != getBackend(prefix) || strings.EqualFold(prefix, DEFAULT_NAME) {
+			attrs[ATTR_APP] = proxyName[index+1:]
+			proxyName = prefix
 		}
-		if strings.EqualFold(proxyName, DEFAULT_NAME) {
-			proxyName = spac.defaultRule
+	}
+	if strings.EqualFold(proxyName, DEFAULT_NAME) {
+		proxyName = spac.defaultRule
+	}
+	return proxyName
+}
+
+//getProxyManager returns the manager of a backend, Direct or an upstream
+//proxy for the target host, nil if the backend is not available
+func getProxyManager(proxyName string, host string, isHttpsConn bool) RemoteConnectionManager {
+	if manager, known := resolveProxyManager(proxyName, isHttpsConn); known {
+		return manager
+	}
+	if strings.EqualFold(proxyName, DIRECT_NAME) {
+		forward := &Forward{overProxy: false}
+		forward.target = host
+		if !strings.Contains(forward.target, ":") {
+			forward.target = forward.target + ":80"
 		}
-		proxyName = adjustProxyName(proxyName, isHttpsConn)
-
-		switch proxyName {
-		case GAE_NAME, C4_NAME, SSH_NAME:
-			if v, ok := registedRemoteConnManager[proxyName]; ok {
-				proxyManagers = append(proxyManagers, v)
-			} else {
-				log.Printf("No proxy:%s defined for %s\n", proxyName, host)
-			}
-		case GOOGLE_HTTP_NAME:
-			if google_enable {
-				proxyManagers = append(proxyManagers, httpGoogleManager)
-			}
-		case GOOGLE_HTTPS_NAME:
-			if google_enable {
-				proxyManagers = append(proxyManagers, httpsGoogleManager)
-			}
-		case DIRECT_NAME:
-			forward := &Forward{overProxy: false}
-			forward.target = req.Host
-			if !strings.Contains(forward.target, ":") {
-				forward.target = forward.target + ":80"
-			}
-			if !strings.Contains(forward.target, "://") {
-				forward.target = "http://" + forward.target
-			}
-			proxyManagers = append(proxyManagers, forward)
-		default:
-			forward := &Forward{overProxy: true}
-			forward.target = strings.TrimSpace(proxyName)
-			if !strings.Contains(forward.target, "://") {
-				forward.target = "http://" + forward.target
-			}
-			proxyManagers = append(proxyManagers, forward)
+		if !strings.Contains(forward.target, "://") {
+			forward.target = "http://" + forward.target
 		}
+		return forward
 	}
-	return proxyManagers, attrs
+	forward := &Forward{overProxy: true}
+	forward.target = strings.TrimSpace(proxyName)
+	if !strings.Contains(forward.target, "://") {
+		forward.target = "http://" + forward.target
+	}
+	return forward
 }
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+//The SPAC filters resolve the hosts by the trusted DNS since the system DNS
+//is poisoned for the blocked hosts. The answers are cached by their TTL and
+//the failures are cached too, a lookup runs in background and the filters
+//wait for it at most spacDNSTimeout. The client in dns.go is used instead of
+//godns which does not return the TTL, the other trusted DNS lookups share
+//the cache.
+var spacDNSTimeout = 500 * time.Millisecond
+
+//the decision of IsHostInCN if the host is not resolved in time
+var spacDNSInCNDefault = false
+
+var spacDNSQueryTimeout = 3 * time.Second
+var spacDNSNegativeTTL = time.Minute
+
+//for the answers of the system DNS which have no TTL
+var spacDNSDefaultTTL = 5 * time.Minute
+var spacDNSMinTTL = 10 * time.Second
+var spacDNSCacheSize = 4096
+
+type spacDNSEntry struct {
+	ips    []net.IP
+	expire time.Time
+	//closed when the lookup is done
+	done chan struct{}
+}
+
+func (e *spacDNSEntry) resolved() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+type spacDNSCache struct {
+	sync.Mutex
+	entries map[string]*spacDNSEntry
+	resolve func(host string) ([]net.IP, time.Duration, error)
+}
+
+func newSpacDNSCache(resolve func(host string) ([]net.IP, time.Duration, error)) *spacDNSCache {
+	return &spacDNSCache{entries: make(map[string]*spacDNSEntry), resolve: resolve}
+}
+
+var spacDNS = newSpacDNSCache(spacResolve)
+
+//spacResolve uses the system DNS only if there is no trusted DNS
+func spacResolve(host string) ([]net.IP, time.Duration, error) {
+	if len(trustedDNS) > 0 {
+		return trustedDNSResolve(host, spacDNSQueryTimeout)
+	}
+	addrs, err := net.LookupHost(host)
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); nil != ip {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, -1, err
+}
+
+func (c *spacDNSCache) update(host string, e *spacDNSEntry) {
+	ips, ttl, err := c.resolve(host)
+	switch {
+	case nil != err:
+		log.Printf("[WARN]Failed to resolve %s for SPAC:%v\n", host, err)
+		ttl = spacDNSNegativeTTL
+	case ttl < 0 && len(ips) == 0:
+		ttl = spacDNSNegativeTTL
+	case ttl < 0:
+		ttl = spacDNSDefaultTTL
+	}
+	if ttl < spacDNSMinTTL {
+		ttl = spacDNSMinTTL
+	}
+	e.ips = ips
+	e.expire = time.Now().Add(ttl)
+	close(e.done)
+}
+
+//purge removes the expired entries, it is called with the lock held
+func (c *spacDNSCache) purge(now time.Time) {
+	for host, e := range c.entries {
+		if e.resolved() && now.After(e.expire) {
+			delete(c.entries, host)
+		}
+	}
+}
+
+//lookup returns the IPs of host, it is false if the host is not resolved in
+//timeout while the lookup goes on for the next requests, a non-positive
+//timeout waits until the lookup is done
+func (c *spacDNSCache) lookup(host string, timeout time.Duration) ([]net.IP, bool) {
+	now := time.Now()
+	c.Lock()
+	e, exist := c.entries[host]
+	if exist && e.resolved() && now.After(e.expire) {
+		exist = false
+	}
+	if !exist {
+		if len(c.entries) >= spacDNSCacheSize {
+			c.purge(now)
+		}
+		e = &spacDNSEntry{done: make(chan struct{})}
+		c.entries[host] = e
+		go c.update(host, e)
+	}
+	c.Unlock()
+	if e.resolved() {
+		return e.ips, true
+	}
+	if timeout <= 0 {
+		<-e.done
+		return e.ips, true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-e.done:
+		return e.ips, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+//spacLookupHost resolves the host for the SPAC filters, a literal IP is
+//returned as it is
+func spacLookupHost(host string) ([]net.IP, bool) {
+	if ip := net.ParseIP(host); nil != ip {
+		return []net.IP{ip}, true
+	}
+	return spacDNS.lookup(host, spacDNSTimeout)
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyxar/gsnova/misc/iprange"
+)
+
+//dnsResponse answers the query by the records, the name of the records is a
+//pointer to the question
+func dnsResponse(query []byte, rcode byte, answers, authorities [][]byte) []byte {
+	msg := append([]byte{}, query...)
+	msg[2] |= 0x80
+	msg[3] = rcode
+	msg[7] = byte(len(answers))
+	msg[9] = byte(len(authorities))
+	for _, r := range append(answers, authorities...) {
+		msg = append(msg, 0xc0, 12)
+		msg = append(msg, r...)
+	}
+	return msg
+}
+
+func dnsRecord(typ byte, ttl uint32, rdata ...byte) []byte {
+	return append([]byte{0, typ, 0, 1, byte(ttl >> 24), byte(ttl >> 16), byte(ttl >> 8), byte(ttl), 0, byte(len(rdata))}, rdata...)
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	query, _ := dnsQueryMessage(0x1234, "www.example.com", dnsTypeA)
+	msg := dnsResponse(query, 0, [][]byte{
+		dnsRecord(5, 300, 0xc0, 12),
+		dnsRecord(1, 60, 1, 2, 3, 4),
+		dnsRecord(1, 120, 1, 2, 3, 5),
+	}, nil)
+	ips, ttl, err := parseDNSResponse(query, msg)
+	if nil != err || len(ips) != 2 || !ips[1].Equal(net.ParseIP("1.2.3.5")) || ttl != time.Minute {
+		t.Fatalf("unexpected answer:%v %v %v", ips, ttl, err)
+	}
+	if _, _, err := parseDNSResponse(query, msg[:len(msg)-1]); nil == err {
+		t.Fatal("the truncated response should fail")
+	}
+	//the response of another query is rejected
+	for _, other := range []string{"www.example.org", "WWW.Example.COM"} {
+		q, _ := dnsQueryMessage(0x1234, other, dnsTypeA)
+		if _, _, err = parseDNSResponse(q, msg); (err != errDNSMismatch) != (other == "WWW.Example.COM") {
+			t.Fatalf("%s:unexpected error:%v", other, err)
+		}
+	}
+	q, _ := dnsQueryMessage(0x4321, "www.example.com", dnsTypeA)
+	if _, _, err = parseDNSResponse(q, msg); err != errDNSMismatch {
+		t.Fatal("the id should be verified")
+	}
+	q, _ = dnsQueryMessage(0x1234, "www.example.com", dnsTypeAAAA)
+	if _, _, err = parseDNSResponse(q, msg); err != errDNSMismatch {
+		t.Fatal("the type should be verified")
+	}
+	tc := append([]byte{}, msg...)
+	tc[2] |= 0x02
+	if _, _, err = parseDNSResponse(query, tc); err != errDNSTruncated {
+		t.Fatalf("unexpected error of TC:%v", err)
+	}
+
+	//the AAAA records of an AAAA query
+	v6 := net.ParseIP("2001:db8::1")
+	ips, ttl, err = parseDNSResponse(q, dnsResponse(q, 0, [][]byte{dnsRecord(1, 60, 1, 2, 3, 4), dnsRecord(28, 90, v6...)}, nil))
+	if nil != err || len(ips) != 1 || !ips[0].Equal(v6) || ttl != 90*time.Second {
+		t.Fatalf("unexpected AAAA answer:%v %v %v", ips, ttl, err)
+	}
+
+	//NXDOMAIN is cached by the minimum of SOA
+	soa := append([]byte{0xc0, 16, 0xc0, 16}, make([]byte, 20)...)
+	soa[len(soa)-1] = 30
+	ips, ttl, err = parseDNSResponse(query, dnsResponse(query, 3, nil, [][]byte{dnsRecord(6, 900, soa...)}))
+	if nil != err || len(ips) != 0 || ttl != 30*time.Second {
+		t.Fatalf("unexpected negative answer:%v %v %v", ips, ttl, err)
+	}
+	if _, _, err = parseDNSResponse(query, dnsResponse(query, 2, nil, nil)); nil == err {
+		t.Fatal("SERVFAIL should fail")
+	}
+	if _, err = dnsQueryMessage(1, "a..b", dnsTypeA); nil == err {
+		t.Fatal("invalid name should fail")
+	}
+}
+
+//dnsQueryType returns the type in the question of the query
+func dnsQueryType(query []byte) byte {
+	return query[len(query)-3]
+}
+
+func TestDNSExchange(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	v6 := net.ParseIP("2001:db8::1")
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if nil != err {
+				return
+			}
+			query := append([]byte{}, buf[:n]...)
+			//a spoofed answer of another id goes first
+			spoofed := dnsResponse(query, 0, [][]byte{dnsRecord(1, 3600, 6, 6, 6, 6)}, nil)
+			spoofed[1]++
+			c.WriteTo(spoofed, addr)
+			if dnsQueryType(query) == dnsTypeA {
+				c.WriteTo(dnsResponse(query, 0, [][]byte{dnsRecord(1, 3600, 10, 0, 0, 1)}, nil), addr)
+			} else {
+				c.WriteTo(dnsResponse(query, 0, [][]byte{dnsRecord(28, 600, v6...)}, nil), addr)
+			}
+		}
+	}()
+	ips, ttl, err := dnsResolve(c.LocalAddr().String(), "udp", "example.com", time.Second)
+	if nil != err || len(ips) != 2 || !ips[0].Equal(net.ParseIP("10.0.0.1")) || !ips[1].Equal(v6) || ttl != 10*time.Minute {
+		t.Fatalf("unexpected answer:%v %v %v", ips, ttl, err)
+	}
+}
+
+//the truncated answer over udp is queried again over tcp
+func TestDNSExchangeTruncated(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.ListenPacket("udp", l.Addr().String())
+	if nil != err {
+		t.Skipf("the udp port is in use:%v", err)
+	}
+	defer c.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := c.ReadFrom(buf)
+		if nil == err {
+			msg := dnsResponse(buf[:n], 0, nil, nil)
+			msg[2] |= 0x02
+			c.WriteTo(msg, addr)
+		}
+	}()
+	go func() {
+		conn, err := l.Accept()
+		if nil != err {
+			return
+		}
+		defer conn.Close()
+		length := make([]byte, 2)
+		if _, err = io.ReadFull(conn, length); nil != err {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err = io.ReadFull(conn, query); nil != err {
+			return
+		}
+		msg := dnsResponse(query, 0, [][]byte{dnsRecord(1, 60, 10, 0, 0, 1), dnsRecord(1, 60, 10, 0, 0, 2)}, nil)
+		conn.Write(append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...))
+	}()
+	ips, ttl, err := dnsExchange(c.LocalAddr().String(), "udp", "example.com", dnsTypeA, time.Second)
+	if nil != err || len(ips) != 2 || ttl != time.Minute {
+		t.Fatalf("unexpected answer:%v %v %v", ips, ttl, err)
+	}
+}
+
+func TestSpacDNSCache(t *testing.T) {
+	var mutex sync.Mutex
+	calls := make(map[string]int)
+	release := make(chan struct{})
+	cache := newSpacDNSCache(func(host string) ([]net.IP, time.Duration, error) {
+		mutex.Lock()
+		calls[host]++
+		mutex.Unlock()
+		switch host {
+		case "slow.example":
+			<-release
+		case "fail.example":
+			return nil, 0, errors.New("timeout")
+		}
+		return []net.IP{net.ParseIP("1.0.16.1")}, time.Hour, nil
+	})
+	for i := 0; i < 3; i++ {
+		if ips, ok := cache.lookup("a.example", time.Second); !ok || len(ips) != 1 {
+			t.Fatalf("unexpected answer:%v %v", ips, ok)
+		}
+		if ips, ok := cache.lookup("fail.example", time.Second); !ok || len(ips) != 0 {
+			t.Fatalf("unexpected negative answer:%v %v", ips, ok)
+		}
+		if _, ok := cache.lookup("slow.example", 10*time.Millisecond); ok {
+			t.Fatal("slow lookup should time out")
+		}
+	}
+	close(release)
+	if ips, ok := cache.lookup("slow.example", time.Second); !ok || len(ips) != 1 {
+		t.Fatalf("unexpected answer:%v %v", ips, ok)
+	}
+	//the expired answers are resolved again
+	cache.Lock()
+	cache.entries["a.example"].expire = time.Now().Add(-time.Second)
+	cache.Unlock()
+	cache.lookup("a.example", time.Second)
+	mutex.Lock()
+	defer mutex.Unlock()
+	for host, n := range map[string]int{"a.example": 2, "fail.example": 1, "slow.example": 1} {
+		if calls[host] != n {
+			t.Fatalf("%s:expected %d lookups, got %d", host, n, calls[host])
+		}
+	}
+}
+
+func TestIsHostInCNDefault(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	defer func(c *spacDNSCache, timeout time.Duration, v bool) {
+		spacDNS, spacDNSTimeout, spacDNSInCNDefault = c, timeout, v
+	}(spacDNS, spacDNSTimeout, spacDNSInCNDefault)
+	spacDNS = newSpacDNSCache(func(host string) ([]net.IP, time.Duration, error) {
+		<-release
+		return nil, 0, nil
+	})
+	spacDNSTimeout = 10 * time.Millisecond
+	defer func(v *iprange.IPRangeHolder) {
+		ipfunc = v
+	}(ipfunc)
+	ipfunc = new(iprange.IPRangeHolder)
+	req, _ := http.NewRequest("GET", "http://slow.example/", nil)
+	for _, v := range []bool{true, false} {
+		spacDNSInCNDefault = v
+		if isHostInCN(req) != v {
+			t.Fatalf("expected the default %v", v)
+		}
+	}
+}
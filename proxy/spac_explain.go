@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zyxar/gsnova/util"
+)
+
+//RuleMismatch tells why a rule before the selected one did not match
+type RuleMismatch struct {
+	Source string
+	Index  int
+	Reason string
+}
+
+//SpacExplanation is the dry run result of the proxy selection of a request
+type SpacExplanation struct {
+	Method string
+	URL    string
+	Https  bool
+	//what made the decision: rule, hosts, private or default
+	By string
+	//the script file and index of the matched rule
+	Source     string
+	Index      int
+	Proxy      []string
+	Attrs      map[string]string
+	Managers   []string
+	Mismatches []RuleMismatch
+}
+
+//mismatch returns the first condition the request does not match, empty if
+//the rule matches it
+func (r *JsonRule) mismatch(req *http.Request, isHttpsConn bool, ctx *matchContext) string {
+	if !r.matchProtocol(req, isHttpsConn) {
+		return "Protocol:" + r.Protocol
+	}
+	if !matchRegexs(req.Method, r.method_regex) {
+		return fmt.Sprintf("Method:%v", r.Method)
+	}
+	if !matchRegexs(req.Host, r.host_regex) {
+		return fmt.Sprintf("Host:%v", r.Host)
+	}
+	if !matchRegexs(req.RequestURI, r.url_regex) {
+		return fmt.Sprintf("URL:%v", r.URL)
+	}
+	switch r.matchPredicates(req, isHttpsConn, ctx) {
+	case "Expire":
+		return "Expire:" + r.Expire.Format(time.RFC3339)
+	case "Port":
+		return fmt.Sprintf("Port:%v", r.Port)
+	case "Client":
+		return fmt.Sprintf("Client:%v", r.Client)
+	case "UserAgent":
+		return fmt.Sprintf("UserAgent:%v", r.UserAgent)
+	case "Header":
+		return fmt.Sprintf("Header:%v", r.Header)
+	case "Time":
+		return fmt.Sprintf("Time:%v", r.Time)
+	case "Filter":
+		for i, filter := range r.filter_exprs {
+			if !filter.eval(req, ctx) {
+				return "Filter:" + r.Filter[i]
+			}
+		}
+	case "IP":
+		return fmt.Sprintf("IP:%v", r.IP)
+	}
+	return ""
+}
+
+//newExplainRequest builds the request the proxy would receive, an https url
+//is explained as the request decrypted from a https connection
+func newExplainRequest(method, rawurl, client string) (*http.Request, bool, error) {
+	method = strings.ToUpper(strings.TrimSpace(method))
+	if len(method) == 0 {
+		method = "GET"
+	}
+	rawurl = strings.TrimSpace(rawurl)
+	if method == "CONNECT" && !strings.Contains(rawurl, "://") {
+		rawurl = "https://" + rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if nil != err {
+		return nil, false, err
+	}
+	if len(u.Host) == 0 {
+		return nil, false, errors.New("No host in url:" + rawurl)
+	}
+	isHttpsConn := strings.EqualFold(u.Scheme, "https")
+	req := &http.Request{Method: method, URL: u, Host: u.Host, Header: make(http.Header), RemoteAddr: client}
+	switch {
+	case method == "CONNECT":
+		if _, _, err := net.SplitHostPort(req.Host); nil != err {
+			req.Host = net.JoinHostPort(req.Host, "443")
+		}
+		req.URL = &url.URL{Host: req.Host}
+		req.RequestURI = req.Host
+	case isHttpsConn:
+		req.RequestURI = u.RequestURI()
+	default:
+		req.RequestURI = u.String()
+	}
+	return req, isHttpsConn, nil
+}
+
+//ExplainSpac selects the proxy for the request like SelectProxy without
+//sending anything, and tells how the selection is made. client is the
+//address of the client, which is needed by the Client rules.
+func ExplainSpac(method, rawurl, client string) (*SpacExplanation, error) {
+	req, isHttpsConn, err := newExplainRequest(method, rawurl, client)
+	if nil != err {
+		return nil, err
+	}
+	e := &SpacExplanation{Method: req.Method, URL: rawurl, Https: isHttpsConn, Index: -1}
+	e.Attrs = make(map[string]string)
+	host := req.Host
+	port := "80"
+	if v, p, err := net.SplitHostPort(req.Host); nil == err {
+		host = v
+		port = p
+	}
+	if util.IsPrivateIP(host) {
+		e.By = "private"
+		e.Proxy = []string{DIRECT_NAME}
+	}
+	if len(e.By) == 0 {
+		ctx := newMatchContext()
+		spacMutex.RLock()
+		for _, r := range spac.rules {
+			reason := r.mismatch(req, isHttpsConn, ctx)
+			if len(reason) > 0 {
+				e.Mismatches = append(e.Mismatches, RuleMismatch{r.source, r.index, reason})
+				continue
+			}
+			e.By, e.Source, e.Index, e.Proxy = "rule", r.source, r.index, r.Proxy
+			for _, v := range r.Attr {
+				e.Attrs[v] = v
+			}
+			break
+		}
+		spacMutex.RUnlock()
+	}
+	if len(e.By) == 0 {
+		if names, ok := selectProxyByHosts(req, host, port, e.Attrs); ok {
+			e.By, e.Proxy = "hosts", names
+		} else {
+			e.By, e.Proxy = "default", []string{spac.defaultRule}
+		}
+	}
+	//the same as SelectProxy
+	if e.By != "private" {
+		e.Proxy = learningProxyNames(e.Proxy, e.Attrs)
+	}
+	for _, proxyName := range e.Proxy {
+		name := adjustProxyName(proxyName, e.Attrs)
+		//the backends have no manager before Init
+		if b := getBackend(name); nil != b && explainOnly {
+			if b.healthy() {
+				e.Managers = append(e.Managers, b.Name)
+			} else {
+				e.Managers = append(e.Managers, b.Name+"(unavailable)")
+			}
+			continue
+		}
+		if manager := getProxyManager(name, req.Host, isHttpsConn); nil != manager {
+			e.Managers = append(e.Managers, manager.GetName())
+		} else {
+			e.Managers = append(e.Managers, name+"(unavailable)")
+		}
+	}
+	return e, nil
+}
+
+func (e *SpacExplanation) String() string {
+	var buf bytes.Buffer
+	conn := "http"
+	if e.Https {
+		conn = "https"
+	}
+	buf.WriteString(fmt.Sprintf("Request: %s %s over %s connection\n", e.Method, e.URL, conn))
+	for _, m := range e.Mismatches {
+		buf.WriteString(fmt.Sprintf("Skip %s[%d]: %s not matched\n", m.Source, m.Index, m.Reason))
+	}
+	switch e.By {
+	case "rule":
+		buf.WriteString(fmt.Sprintf("Matched: %s[%d]\n", e.Source, e.Index))
+	case "hosts":
+		buf.WriteString("Matched: hosts has an available IP\n")
+	case "private":
+		buf.WriteString("Matched: private address\n")
+	default:
+		buf.WriteString("Matched: no rule, the default rule is used\n")
+	}
+	buf.WriteString(fmt.Sprintf("Proxy: %v\n", e.Proxy))
+	if len(e.Attrs) > 0 {
+		buf.WriteString(fmt.Sprintf("Attrs: %v\n", e.Attrs))
+	}
+	if !e.Https && containsAttr(e.Attrs, ATTR_REDIRECT_HTTPS) {
+		buf.WriteString("Redirect: the request is redirected to https\n")
+	}
+	buf.WriteString(fmt.Sprintf("Managers: %v\n", e.Managers))
+	return buf.String()
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zyxar/gsnova/common"
+	"github.com/zyxar/gsnova/util"
+)
+
+func TestExplainSpac(t *testing.T) {
+	rules := syntheticRules(10)
+	for i, r := range rules {
+		r.source, r.index = "cloud_spac.json", i
+	}
+	defer func(v *SpacConfig) {
+		spac = v
+	}(spac)
+	spac = &SpacConfig{defaultRule: DIRECT_NAME, rules: rules, matcher: newSpacMatcher(rules)}
+
+	e, err := ExplainSpac("", "http://twitter.com/home", "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if e.By != "rule" || e.Index != 2 || len(e.Mismatches) != 2 || !containsAttr(e.Attrs, ATTR_REDIRECT_HTTPS) {
+		t.Fatalf("unexpected explanation:%s", e)
+	}
+	if e.Mismatches[1].Reason != "Host:[*.google.com(.*)? *.ytimg.com*]" {
+		t.Fatalf("unexpected reason:%s", e.Mismatches[1].Reason)
+	}
+	if !strings.Contains(e.String(), "redirected to https") {
+		t.Fatalf("unexpected explanation:%s", e)
+	}
+
+	e, _ = ExplainSpac("CONNECT", "unknown.host", "")
+	if e.By != "rule" || e.Index != len(rules)-1 || len(e.Managers) != 1 || e.Managers[0] != FORWARD_NAME+"http://unknown.host:443" {
+		t.Fatalf("unexpected explanation:%s", e)
+	}
+	e, _ = ExplainSpac("GET", "http://192.168.1.1/", "")
+	if e.By != "private" || len(e.Mismatches) != 0 {
+		t.Fatalf("unexpected explanation:%s", e)
+	}
+	if _, err = ExplainSpac("GET", "/path", ""); nil == err {
+		t.Fatal("url without host should be invalid")
+	}
+	//the explanation agrees with the compiled matcher
+	for _, req := range syntheticRequests() {
+		e, _ = ExplainSpac(req.Method, req.URL.String(), "")
+		req, isHttpsConn, _ := newExplainRequest(req.Method, req.URL.String(), "")
+		r := spac.matcher.Match(req, isHttpsConn)
+		if (nil == r) != (e.By != "rule") || (nil != r && r.index != e.Index) {
+			t.Fatalf("%s %s:unexpected explanation:%s", req.Method, req.URL, e)
+		}
+	}
+}
+
+//the backends are resolved by the config without Init
+func TestExplainWithoutInit(t *testing.T) {
+	saveBackendRegistry(t)
+	oldCfg := common.Cfg
+	t.Cleanup(func() {
+		common.Cfg, explainOnly = oldCfg, false
+	})
+	common.Cfg = util.NewIni()
+	common.Cfg.SetProperty("C4", "Enable", "1")
+	common.Cfg.SetProperty("GAE", "Enable", "0")
+	RegisterBackend(&Backend{
+		Name: "Fake",
+		Init: func() error {
+			t.Fatal("the backend is initialized")
+			return nil
+		},
+		Enabled: cfgEnabled("Fake", false),
+	})
+	rule := newPredicateRule(t, `{"Host":["*.example.org"], "Proxy":["Fake", "GAE", "C4"]}`)
+	spac = &SpacConfig{defaultRule: AUTO_NAME, rules: []*JsonRule{rule}, matcher: newSpacMatcher([]*JsonRule{rule})}
+	InitExplain()
+	//GAE is disabled, C4 is the next of Auto
+	e, err := ExplainSpac("GET", "http://www.example.com/", "")
+	if nil != err || e.By != "default" || len(e.Managers) != 1 || e.Managers[0] != C4_NAME {
+		t.Fatalf("unexpected explanation:%s %v", e, err)
+	}
+	e, _ = ExplainSpac("GET", "http://www.example.org/", "")
+	expected := []string{"Fake(unavailable)", GAE_NAME + "(unavailable)", C4_NAME}
+	if strings.Join(e.Managers, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected explanation:%s", e)
+	}
+}
+
+//the direct requests are retried with the default rule in learning mode
+func TestExplainLearning(t *testing.T) {
+	defer func(v *SpacConfig, learning, enable bool) {
+		spac, spac_learning, spac_enable = v, learning, enable
+	}(spac, spac_learning, spac_enable)
+	rule := newPredicateRule(t, `{"Host":["*.example.org"], "Proxy":["Direct"]}`)
+	spac = &SpacConfig{defaultRule: DIRECT_NAME, rules: []*JsonRule{rule}, matcher: newSpacMatcher([]*JsonRule{rule})}
+	spac_learning, spac_enable = true, true
+	for _, rawurl := range []string{"http://www.example.org/", "http://www.example.com/"} {
+		e, err := ExplainSpac("GET", rawurl, "")
+		if nil != err || len(e.Proxy) != 2 || e.Proxy[1] != DEFAULT_NAME || !containsAttr(e.Attrs, ATTR_LEARNING) {
+			t.Fatalf("unexpected explanation:%s %v", e, err)
+		}
+		//the same as the proxy selection
+		req, _ := http.NewRequest("GET", rawurl, nil)
+		managers, _ := SelectProxy(req, &SessionConnection{Type: HTTP_TUNNEL})
+		if len(managers) != len(e.Managers) {
+			t.Fatalf("unexpected managers:%v %v", managers, e.Managers)
+		}
+	}
+	if e, _ := ExplainSpac("GET", "http://192.168.1.1/", ""); len(e.Proxy) != 1 || containsAttr(e.Attrs, ATTR_LEARNING) {
+		t.Fatalf("unexpected explanation:%s", e)
+	}
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+//filterExpr is a compiled filter expression like
+//"HostSuffix(corp.example) && !IsHostInCN", the operators are &&, || and !
+//with parentheses
+type filterExpr struct {
+	//'&', '|', '!', or 0 for the call of a filter
+	op          byte
+	left, right *filterExpr
+	name        string
+	args        []string
+}
+
+func (e *filterExpr) String() string {
+	switch e.op {
+	case '&':
+		return "(" + e.left.String() + " && " + e.right.String() + ")"
+	case '|':
+		return "(" + e.left.String() + " || " + e.right.String() + ")"
+	case '!':
+		return "!" + e.left.String()
+	}
+	if nil == e.args {
+		return e.name
+	}
+	return e.name + "(" + strings.Join(e.args, ",") + ")"
+}
+
+type filterParser struct {
+	expr string
+	pos  int
+}
+
+func (p *filterParser) skipSpace() {
+	for p.pos < len(p.expr) && (p.expr[p.pos] == ' ' || p.expr[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *filterParser) consume(token string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.expr[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (*filterExpr, error) {
+	left, err := p.parseAnd()
+	for nil == err && p.consume("||") {
+		var right *filterExpr
+		if right, err = p.parseAnd(); nil == err {
+			left = &filterExpr{op: '|', left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) parseAnd() (*filterExpr, error) {
+	left, err := p.parseUnary()
+	for nil == err && p.consume("&&") {
+		var right *filterExpr
+		if right, err = p.parseUnary(); nil == err {
+			left = &filterExpr{op: '&', left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func isFilterNameChar(c byte) bool {
+	return c == '_' || c == '-' || c == '.' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func (p *filterParser) parseUnary() (*filterExpr, error) {
+	if p.consume("!") {
+		e, err := p.parseUnary()
+		if nil != err {
+			return nil, err
+		}
+		return &filterExpr{op: '!', left: e}, nil
+	}
+	if p.consume("(") {
+		e, err := p.parseOr()
+		if nil != err {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, fmt.Errorf("Missing ) at %d in filter:%s", p.pos, p.expr)
+		}
+		return e, nil
+	}
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.expr) && isFilterNameChar(p.expr[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		return nil, fmt.Errorf("Filter name expected at %d in filter:%s", p.pos, p.expr)
+	}
+	e := &filterExpr{name: p.expr[start:p.pos]}
+	//the arguments follow the name immediately
+	if p.pos < len(p.expr) && p.expr[p.pos] == '(' {
+		end := strings.IndexByte(p.expr[p.pos:], ')')
+		if end < 0 {
+			return nil, fmt.Errorf("Missing ) at %d in filter:%s", p.pos, p.expr)
+		}
+		e.args = []string{}
+		for _, arg := range strings.Split(p.expr[p.pos+1:p.pos+end], ",") {
+			if arg = strings.TrimSpace(arg); len(arg) > 0 {
+				e.args = append(e.args, arg)
+			}
+		}
+		p.pos += end + 1
+	}
+	return e, nil
+}
+
+//parseFilterExpr compiles a filter expression
+func parseFilterExpr(expr string) (*filterExpr, error) {
+	p := &filterParser{expr: expr}
+	e, err := p.parseOr()
+	if nil != err {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.expr) {
+		return nil, fmt.Errorf("Unexpected %q at %d in filter:%s", p.expr[p.pos:], p.pos, p.expr)
+	}
+	return e, nil
+}
+
+//user defined filters by name, loaded from spac/user_filters.json
+var user_filters = make(map[string]*filterExpr)
+
+func (e *filterExpr) eval(req *http.Request, ctx *matchContext) bool {
+	switch e.op {
+	case '&':
+		return e.left.eval(req, ctx) && e.right.eval(req, ctx)
+	case '|':
+		return e.left.eval(req, ctx) || e.right.eval(req, ctx)
+	case '!':
+		return !e.left.eval(req, ctx)
+	}
+	//the result of a call is cached for the request
+	key := e.String()
+	if matched, exist := ctx.filters[key]; exist {
+		return matched
+	}
+	matched := false
+	if user, exist := user_filters[e.name]; exist && nil == e.args {
+		matched = user.eval(req, ctx)
+	} else if filter, exist := func_table[e.name]; exist {
+		matched = filter(req, e.args)
+	}
+	ctx.filters[key] = matched
+	return matched
+}
+
+//references collects the user filters referred by the expression
+func (e *filterExpr) references(filters map[string]*filterExpr, names []string) []string {
+	if e.op != 0 {
+		names = e.left.references(filters, names)
+		if nil != e.right {
+			names = e.right.references(filters, names)
+		}
+		return names
+	}
+	if nil == e.args {
+		if _, exist := filters[e.name]; exist {
+			names = append(names, e.name)
+		}
+	}
+	return names
+}
+
+//filterLoop returns the path of a user filter referring itself
+func filterLoop(filters map[string]*filterExpr, name string, path []string) ([]string, bool) {
+	for _, v := range path {
+		if v == name {
+			return append(path, name), true
+		}
+	}
+	path = append(path, name)
+	for _, ref := range filters[name].references(filters, nil) {
+		if loop, found := filterLoop(filters, ref, path); found {
+			return loop, true
+		}
+	}
+	return nil, false
+}
+
+//loadSpacFilters loads {"Filters": {"Name": "expression"}}, the filters
+//loaded before are kept if there is any error
+func loadSpacFilters(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if nil != err {
+		return err
+	}
+	var file struct {
+		Filters map[string]string
+	}
+	if err = json.Unmarshal(content, &file); nil != err {
+		return err
+	}
+	filters := make(map[string]*filterExpr)
+	for name, expr := range file.Filters {
+		if _, exist := func_table[name]; exist {
+			return fmt.Errorf("Filter:%s conflicts with the builtin filter", name)
+		}
+		e, err := parseFilterExpr(expr)
+		if nil != err {
+			return err
+		}
+		filters[name] = e
+	}
+	for name := range filters {
+		if loop, found := filterLoop(filters, name, nil); found {
+			return fmt.Errorf("Filter loop:%s", strings.Join(loop, " -> "))
+		}
+	}
+	spacMutex.Lock()
+	user_filters = filters
+	spacMutex.Unlock()
+	log.Printf("Load %d SPAC filters from %s\n", len(filters), path)
+	return nil
+}
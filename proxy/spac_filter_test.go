@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zyxar/gsnova/misc/iprange"
+)
+
+func TestParseFilterExpr(t *testing.T) {
+	for v, expected := range map[string]string{
+		"IsHostInCN":    "IsHostInCN",
+		"!IsHostInCN":   "!IsHostInCN",
+		"A || B && !C":  "(A || (B && !C))",
+		"(A || B) && C": "((A || B) && C)",
+		"!(A||B)":       "!(A || B)",
+		"HostSuffix(corp.example, corp.local) && !IsHostInCN": "(HostSuffix(corp.example,corp.local) && !IsHostInCN)",
+	} {
+		e, err := parseFilterExpr(v)
+		if nil != err || e.String() != expected {
+			t.Fatalf("%s:unexpected expression:%v %v", v, e, err)
+		}
+	}
+	for _, v := range []string{"", "A &&", "(A || B", "A B", "HostSuffix(a", "&& A", "A | B"} {
+		if _, err := parseFilterExpr(v); nil == err {
+			t.Fatalf("%s should be invalid", v)
+		}
+	}
+}
+
+func TestUserFilters(t *testing.T) {
+	init_spac_func()
+	RegisterSpacFilter("IsMobile", func(req *http.Request, args []string) bool {
+		return req.Header.Get("User-Agent") == "mobile"
+	})
+	defer delete(func_table, "IsMobile")
+	defer func() {
+		user_filters = make(map[string]*filterExpr)
+	}()
+	dir, _ := ioutil.TempDir("", "spac")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "user_filters.json")
+
+	ioutil.WriteFile(path, []byte(`{"Filters": {
+		"Corp": "HostSuffix(corp.example) && !Mobile",
+		"Mobile": "IsMobile"
+	}}`), 0644)
+	if err := loadSpacFilters(path); nil != err {
+		t.Fatal(err)
+	}
+	r := newPredicateRule(t, `{"Filter":["Corp"], "Proxy":["SSH"]}`)
+	for _, c := range []struct {
+		host    string
+		ua      string
+		matched bool
+	}{
+		{"www.corp.example", "", true},
+		{"corp.example:8080", "desktop", true},
+		{"www.corp.example", "mobile", false},
+		{"mycorp.example", "", false},
+	} {
+		req := newPredicateRequest("GET", "http://"+c.host+"/", "")
+		req.Header.Set("User-Agent", c.ua)
+		if matched := r.matchPredicates(req, false, newMatchContext()) == ""; matched != c.matched {
+			t.Fatalf("%s %s:expected %v", c.host, c.ua, c.matched)
+		}
+	}
+
+	for _, v := range []string{
+		`{"Filters": {"A": "B", "B": "!A"}}`,
+		`{"Filters": {"IsHostInCN": "HostSuffix(cn)"}}`,
+		`{"Filters": {"A": "B &&"}}`,
+	} {
+		ioutil.WriteFile(path, []byte(v), 0644)
+		if err := loadSpacFilters(path); nil == err {
+			t.Fatalf("%s should be invalid", v)
+		}
+	}
+	//the valid filters are kept
+	if _, exist := user_filters["Corp"]; !exist {
+		t.Fatal("filters are lost by the invalid file")
+	}
+}
+
+func TestIPCountryFilter(t *testing.T) {
+	init_spac_func()
+	dir, _ := ioutil.TempDir("", "spac")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "iprange.txt")
+	ioutil.WriteFile(path, []byte("apnic|JP|ipv4|1.0.16.0|4096|20110412|allocated\napnic|CN|ipv6|240e::|20|20130821|allocated\n"), 0644)
+	defer func(v *iprange.IPRangeHolder) {
+		ipfunc = v
+	}(ipfunc)
+	init_iprange_func(path)
+
+	r := newPredicateRule(t, `{"Filter":["IPCountry(jp, KR)"], "Proxy":["Direct"]}`)
+	for host, matched := range map[string]bool{
+		"1.0.16.1":      true,
+		"1.0.16.1:8080": true,
+		"1.0.32.1":      false,
+		"[240e::1]:443": false,
+		"[2001:db8::1]": false,
+	} {
+		req := newPredicateRequest("GET", "http://"+host+"/", "")
+		if r.matchPredicates(req, false, newMatchContext()) == "" != matched {
+			t.Fatalf("%s:expected %v", host, matched)
+		}
+	}
+	req := newPredicateRequest("GET", "http://[240e::1]/", "")
+	if !isHostInCN(req) {
+		t.Fatal("IPv6 host should be in CN")
+	}
+}
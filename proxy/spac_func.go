@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"log"
-	"net"
 	"net/http"
 	"strings"
 
@@ -12,66 +11,102 @@ import (
 
 var gfwList *gfwlist.GFWList
 var ipfunc *iprange.IPRangeHolder
-var func_table = make(map[string]func(*http.Request) bool)
+
+//SpacFilter is a filter function used in SPAC filter expressions, args are
+//given like HostSuffix(corp.example,corp.local), nil if there is no (...)
+type SpacFilter func(req *http.Request, args []string) bool
+
+var func_table = make(map[string]SpacFilter)
+
+//RegisterSpacFilter registers a filter function which could be used in the
+//Filter of rules and the user defined filters
+func RegisterSpacFilter(name string, filter SpacFilter) {
+	func_table[name] = filter
+}
 
 func init_spac_func() {
-	func_table["IsHostInCN"] = isHostInCN
-	func_table["IsBlockedByGFW"] = isBlockedByGFW
+	RegisterSpacFilter("IsHostInCN", func(req *http.Request, args []string) bool {
+		return isHostInCN(req)
+	})
+	RegisterSpacFilter("IsBlockedByGFW", func(req *http.Request, args []string) bool {
+		return isBlockedByGFW(req)
+	})
+	RegisterSpacFilter("HostSuffix", hostSuffixFilter)
+	RegisterSpacFilter("IPCountry", ipCountryFilter)
 }
 
 func init_gfwlist_func(rule string) {
 	gfwList, _ = gfwlist.Parse(rule)
 }
 
+//init_iprange_func loads a GeoLite2 database(*.mmdb) or the delegated stats
+//of a RIR like apnic
 func init_iprange_func(file string) {
-	ipfunc, _ = iprange.ParseApnic(file)
+	var holder *iprange.IPRangeHolder
+	var err error
+	if strings.HasSuffix(strings.ToLower(file), ".mmdb") {
+		holder, err = iprange.ParseGeoLite2(file)
+	} else {
+		holder, err = iprange.ParseApnic(file)
+	}
+	if nil != err {
+		log.Printf("[ERROR]Failed to load ip range file:%s for reason:%v\n", file, err)
+		return
+	}
+	ipfunc = holder
+}
+
+//hostSuffixFilter matches the host or its subdomains of any args
+func hostSuffixFilter(req *http.Request, args []string) bool {
+	host, _ := requestHostPort(req, false)
+	for _, suffix := range args {
+		suffix = strings.TrimPrefix(suffix, ".")
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
 }
 
-func invokeFilter(name string, req *http.Request) bool {
-	not := false
-	if strings.HasPrefix(name, "!") {
-		name = name[1:]
-		not = true
+//ipCountryFilter matches the country of the host IP with any args like
+//IPCountry(JP,KR), it is false if the IP ranges are not loaded
+func ipCountryFilter(req *http.Request, args []string) bool {
+	if nil == ipfunc {
+		return false
 	}
-	if filter, exist := func_table[name]; exist {
-		if not {
-			return !filter(req)
+	country, _ := hostCountry(req)
+	for _, v := range args {
+		if len(country) > 0 && strings.EqualFold(strings.TrimSpace(v), country) {
+			return true
 		}
-		return filter(req)
 	}
 	return false
 }
 
+//hostCountry returns the country of the first IP of the host, it is false
+//if the host is not resolved in time
+func hostCountry(req *http.Request) (string, bool) {
+	host, _ := requestHostPort(req, false)
+	ips, resolved := spacLookupHost(host)
+	if len(ips) == 0 || nil == ipfunc {
+		return "", resolved
+	}
+	return ipfunc.Country(ips[0]), true
+}
+
 func isHostInCN(req *http.Request) bool {
 	if nil == ipfunc {
 		return true
 	}
-	host := req.Host
-	if strings.Contains(host, ":") {
-		host, _, _ = net.SplitHostPort(host)
-	}
-	//consider use trusted DNS
-	var ip string
-	var ok bool
+	host, _ := requestHostPort(req, false)
 	if strings.HasSuffix(host, ".cn") {
 		return true
-	} else {
-		if ips, err := net.LookupHost(host); nil == err && len(ips) > 0 {
-			ip = ips[0]
-			ok = true
-		}
-	}
-	if !ok || nil == ipfunc {
-		return false
 	}
-	country, err := ipfunc.FindCountry(ip)
-	if nil != err {
-		log.Printf("[WARN]Find country error:%v\n", err)
-		return false
+	country, resolved := hostCountry(req)
+	if !resolved {
+		return spacDNSInCNDefault
 	}
-	ret := strings.EqualFold(country, "CN")
-
-	return ret
+	return country == "CN"
 }
 
 func isBlockedByGFW(req *http.Request) bool {
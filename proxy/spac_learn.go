@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/zyxar/gsnova/util"
+)
+
+//learning mode retries the blocked Direct requests with the default rule
+//and records the blocked hosts into spac/auto_blocked.json
+var spac_learning bool
+var learningExpire = 30 * 24 * time.Hour
+
+//how long to wait for the response of the tls ClientHello sent directly
+var learningProbeTimeout = 10 * time.Second
+var learningProbePort = "443"
+
+//AutoBlockedRule is a rule in spac/auto_blocked.json, the fields not in
+//JsonRule are ignored by SPAC. Host is the pattern of Hostname, the learned
+//host, which matches the host and its subdomains only.
+type AutoBlockedRule struct {
+	Hostname string
+	Host     []string
+	Proxy    []string
+	Reason   string
+	Blocked  time.Time
+	Expire   time.Time
+}
+
+//the host patterns of SPAC are matched as substrings, the learned patterns
+//are anchored at a label boundary and the end of the host
+const learnedHostPrefix = "(^|.)"
+const learnedPortPattern = "(:[0-9]+)?$"
+
+func learnedHostPattern(host string) string {
+	if strings.Contains(host, ":") {
+		//the IPv6 address in brackets is matched literally
+		return "^\\[" + host + "\\]" + learnedPortPattern
+	}
+	return learnedHostPrefix + host + learnedPortPattern
+}
+
+//learnedHostLiteral returns the host of a learned pattern, it is contained
+//in the hosts matched by the pattern
+func learnedHostLiteral(pattern string) (string, bool) {
+	if !strings.HasPrefix(pattern, learnedHostPrefix) || !strings.HasSuffix(pattern, learnedPortPattern) {
+		return "", false
+	}
+	return hostLiteral(pattern[len(learnedHostPrefix) : len(pattern)-len(learnedPortPattern)])
+}
+
+type autoBlockedStore struct {
+	path  string
+	mutex sync.Mutex
+	rules map[string]*AutoBlockedRule
+}
+
+var autoBlocked = &autoBlockedStore{rules: make(map[string]*AutoBlockedRule)}
+
+func (s *autoBlockedStore) load(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.path = path
+	s.rules = make(map[string]*AutoBlockedRule)
+	content, err := ioutil.ReadFile(path)
+	if nil != err {
+		return
+	}
+	var rules []*AutoBlockedRule
+	if err = json.Unmarshal(content, &rules); nil != err {
+		log.Printf("[ERROR]Failed to unmarshal %s for reason:%v\n", path, err)
+		return
+	}
+	now := time.Now()
+	converted := false
+	for _, r := range rules {
+		//the rules saved before Hostname have the host as the pattern
+		if len(r.Hostname) == 0 && len(r.Host) > 0 {
+			r.Hostname = r.Host[0]
+			converted = true
+		}
+		if len(r.Hostname) > 0 && now.Before(r.Expire) {
+			r.Host = []string{learnedHostPattern(r.Hostname)}
+			s.rules[r.Hostname] = r
+		}
+	}
+	if converted {
+		if err = s.save(); nil != err {
+			log.Printf("[ERROR]Failed to save %s for reason:%v\n", path, err)
+		}
+	}
+}
+
+func (s *autoBlockedStore) save() error {
+	rules := make([]*AutoBlockedRule, 0, len(s.rules))
+	for _, r := range s.rules {
+		rules = append(rules, r)
+	}
+	sort.Sort(autoBlockedRules(rules))
+	content, err := json.MarshalIndent(rules, "", "  ")
+	if nil != err {
+		return err
+	}
+	return ioutil.WriteFile(s.path, content, 0666)
+}
+
+//record adds the host and reloads SPAC in background, false if it is
+//recorded already
+func (s *autoBlockedStore) record(host, reason string) bool {
+	s.mutex.Lock()
+	if r, exist := s.rules[host]; exist && time.Now().Before(r.Expire) {
+		s.mutex.Unlock()
+		return false
+	}
+	now := time.Now()
+	s.rules[host] = &AutoBlockedRule{
+		Hostname: host,
+		Host:     []string{learnedHostPattern(host)},
+		Proxy:    []string{DEFAULT_NAME},
+		Reason:   reason,
+		Blocked:  now,
+		Expire:   now.Add(learningExpire),
+	}
+	err := s.save()
+	s.mutex.Unlock()
+	if nil != err {
+		log.Printf("[ERROR]Failed to save %s for reason:%v\n", s.path, err)
+	}
+	triggerSpacReload()
+	return true
+}
+
+//remove unblocks the host, false if it is not recorded
+func (s *autoBlockedStore) remove(host string) bool {
+	s.mutex.Lock()
+	_, exist := s.rules[host]
+	if exist {
+		delete(s.rules, host)
+		if err := s.save(); nil != err {
+			log.Printf("[ERROR]Failed to save %s for reason:%v\n", s.path, err)
+		}
+	}
+	s.mutex.Unlock()
+	if exist {
+		triggerSpacReload()
+	}
+	return exist
+}
+
+//list returns the unexpired rules, the latest blocked first
+func (s *autoBlockedStore) list() []*AutoBlockedRule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	rules := make([]*AutoBlockedRule, 0, len(s.rules))
+	for _, r := range s.rules {
+		if now.Before(r.Expire) {
+			rules = append(rules, r)
+		}
+	}
+	sort.Sort(autoBlockedRules(rules))
+	return rules
+}
+
+type autoBlockedRules []*AutoBlockedRule
+
+func (r autoBlockedRules) Len() int {
+	return len(r)
+}
+
+func (r autoBlockedRules) Less(i, j int) bool {
+	return r[i].Blocked.After(r[j].Blocked)
+}
+
+func (r autoBlockedRules) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+func isResetError(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ECONNRESET
+}
+
+//dnsPoisoned is true if the system DNS fails to resolve the host or does
+//not agree with the trusted DNS
+func dnsPoisoned(host string) bool {
+	if len(trustedDNS) == 0 || nil != net.ParseIP(host) {
+		return false
+	}
+	trusted, ok := trustedDNSLookup(host)
+	if !ok {
+		return false
+	}
+	ips, err := net.LookupHost(host)
+	if nil != err {
+		return true
+	}
+	for _, ip := range ips {
+		if ip == trusted {
+			return false
+		}
+	}
+	return true
+}
+
+//learnBlocked records the host of addr if err is characteristic of blocking,
+//the DNS is checked if the host is resolved by the system DNS. The private
+//hosts are never learned since SPAC is not used for them.
+func learnBlocked(addr string, err error, checkDNS bool) bool {
+	host, _, e := net.SplitHostPort(addr)
+	if nil != e {
+		host = addr
+	}
+	reason := ""
+	switch {
+	case util.IsTimeoutError(err):
+		reason = "Timeout"
+	case isResetError(err):
+		reason = "Reset"
+	case checkDNS && dnsPoisoned(host):
+		reason = "DNS poisoned"
+	default:
+		return false
+	}
+	if autoBlocked.record(host, reason) {
+		log.Printf("[WARN]Learned blocked host:%s for reason:%s(%v)\n", host, reason, err)
+	}
+	return true
+}
+
+//retryConn replays the bytes the blocked attempt read from the browser and
+//drops the response header of the next proxy since the tunnel is
+//established already
+type retryConn struct {
+	*tunnelConn
+	replay []byte
+}
+
+func (c *retryConn) Read(b []byte) (int, error) {
+	if len(c.replay) > 0 {
+		n := copy(b, c.replay)
+		c.replay = c.replay[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+//probeTunnel sends the tls ClientHello of the browser and waits for the
+//response, a blocked tunnel is reset or timeout then. The session is
+//prepared for the next proxy if it is blocked.
+func (conn *ForwardConnection) probeTunnel(session *SessionConnection, addr string) error {
+	if _, port, _ := net.SplitHostPort(addr); port != learningProbePort {
+		return nil
+	}
+	hello := make([]byte, 8192)
+	session.LocalRawConn.SetReadDeadline(time.Now().Add(learningProbeTimeout))
+	n, err := session.LocalBufferConn.Read(hello)
+	var zero time.Time
+	session.LocalRawConn.SetReadDeadline(zero)
+	if nil != err {
+		return nil
+	}
+	hello = hello[:n]
+	if _, err = conn.forward_conn.Write(hello); nil == err {
+		conn.forward_conn.SetReadDeadline(time.Now().Add(learningProbeTimeout))
+		_, err = conn.buf_forward_conn.Peek(1)
+		conn.forward_conn.SetReadDeadline(zero)
+	}
+	if nil == err || !learnBlocked(addr, err, false) {
+		//the probe is over, the hello is sent or the tunnel is broken
+		return nil
+	}
+	local := &retryConn{tunnelConn: &tunnelConn{Conn: session.LocalRawConn}, replay: hello}
+	session.LocalRawConn = local
+	session.LocalBufferConn = bufio.NewReader(local)
+	return err
+}
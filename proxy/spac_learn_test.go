@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyxar/gsnova/event"
+)
+
+func setupLearning(t *testing.T) func() {
+	dir, _ := ioutil.TempDir("", "spac")
+	oldPath, oldSpac, oldEnable := spac_script_path, spac, spac_enable
+	spac_script_path = []string{filepath.Join(dir, "user_pre_spac.json"), filepath.Join(dir, "cloud_spac.json"), filepath.Join(dir, "auto_blocked.json")}
+	ioutil.WriteFile(spac_script_path[1], []byte(`[{"Host":["*.example.org"], "Proxy":["Direct"]}]`), 0644)
+	spac = &SpacConfig{defaultRule: DIRECT_NAME}
+	spac_enable = true
+	autoBlocked.load(spac_script_path[2])
+	loadSpacScript()
+	return func() {
+		spac_script_path, spac, spac_enable = oldPath, oldSpac, oldEnable
+		autoBlocked.load("")
+		os.RemoveAll(dir)
+		select {
+		case <-spacReload:
+		default:
+		}
+	}
+}
+
+//waitSpacReload loads the scripts like reloadSpacScript once triggered
+func waitSpacReload(t *testing.T) {
+	select {
+	case <-spacReload:
+		loadSpacScript()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reload is not triggered")
+	}
+}
+
+func TestAutoBlockedStore(t *testing.T) {
+	defer setupLearning(t)()
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	if r := matchSpacRule(req, false); nil != r {
+		t.Fatalf("unexpected rule:%v", r)
+	}
+	if !autoBlocked.record("www.example.com", "Reset") || autoBlocked.record("www.example.com", "Reset") {
+		t.Fatal("the host should be recorded once")
+	}
+	waitSpacReload(t)
+	if r := matchSpacRule(req, false); nil == r || r.Proxy[0] != DEFAULT_NAME || r.source != "auto_blocked.json" {
+		t.Fatalf("unexpected rule:%v", r)
+	}
+	//reloaded from the file
+	autoBlocked.load(spac_script_path[2])
+	if rules := autoBlocked.list(); len(rules) != 1 || rules[0].Reason != "Reset" {
+		t.Fatalf("unexpected rules:%v", rules)
+	}
+	if !autoBlocked.remove("www.example.com") || len(autoBlocked.list()) != 0 {
+		t.Fatal("failed to unblock")
+	}
+	waitSpacReload(t)
+	if r := matchSpacRule(req, false); nil != r {
+		t.Fatalf("unexpected rule:%v", r)
+	}
+
+	//the learned rules go after the user and cloud rules
+	other, _ := http.NewRequest("GET", "http://www.example.org/", nil)
+	autoBlocked.record("www.example.org", "Reset")
+	waitSpacReload(t)
+	if r := matchSpacRule(other, false); nil == r || r.Proxy[0] != DIRECT_NAME || r.source != "cloud_spac.json" {
+		t.Fatalf("unexpected rule:%v", r)
+	}
+	autoBlocked.remove("www.example.org")
+	waitSpacReload(t)
+
+	//expired rules are ignored
+	autoBlocked.record("www.example.com", "Timeout")
+	waitSpacReload(t)
+	spac.rules[len(spac.rules)-1].Expire = time.Now().Add(-time.Second)
+	if r := matchSpacRule(req, false); nil != r {
+		t.Fatalf("unexpected rule:%v", r)
+	}
+	autoBlocked.rules["www.example.com"].Expire = time.Now().Add(-time.Second)
+	if len(autoBlocked.list()) != 0 {
+		t.Fatal("expired host should not be listed")
+	}
+}
+
+//a learned host matches itself and its subdomains only
+func TestLearnedHostPattern(t *testing.T) {
+	defer setupLearning(t)()
+	autoBlocked.record("t.co", "Reset")
+	waitSpacReload(t)
+	for host, matched := range map[string]bool{
+		"t.co":          true,
+		"t.co:443":      true,
+		"www.t.co":      true,
+		"microsoft.com": false,
+		"t.com":         false,
+		"t.co.evil.com": false,
+		"st.co":         false,
+	} {
+		req, _ := http.NewRequest("GET", "http://"+host+"/", nil)
+		if r := matchSpacRule(req, false); (nil != r) != matched {
+			t.Fatalf("%s:unexpected rule:%v", host, r)
+		}
+	}
+	if c := pacHostCode([]string{learnedHostPattern("t.co")}); !c.exact || c.code != `/(^|\.)t\.co$/.test(host)` {
+		t.Fatalf("unexpected PAC:%v", c)
+	}
+
+	//the host saved as the pattern is converted
+	ioutil.WriteFile(spac_script_path[2], []byte(`[{"Host":["x.com"], "Proxy":["Default"], "Expire":"2100-01-01T00:00:00Z"}]`), 0644)
+	autoBlocked.load(spac_script_path[2])
+	if rules := autoBlocked.list(); len(rules) != 1 || rules[0].Hostname != "x.com" || rules[0].Host[0] != learnedHostPattern("x.com") {
+		t.Fatalf("unexpected rules:%v", rules)
+	}
+	if content, _ := ioutil.ReadFile(spac_script_path[2]); !strings.Contains(string(content), `"Hostname": "x.com"`) {
+		t.Fatalf("the converted rule is not saved:%s", content)
+	}
+}
+
+//the hosts are recorded, reloaded and matched by the requests at the same
+//time
+func TestAutoBlockedConcurrent(t *testing.T) {
+	defer setupLearning(t)()
+	stop := make(chan bool)
+	reloaded := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-spacReload:
+				loadSpacScript()
+			case <-stop:
+				close(reloaded)
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		host := "www" + strconv.Itoa(i) + ".example.com"
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			autoBlocked.record(host, "Reset")
+		}()
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "http://"+host+"/", nil)
+			for j := 0; j < 100; j++ {
+				matchSpacRule(req, false)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-reloaded
+	loadSpacScript()
+	//every recorded host is loaded
+	for i := 0; i < 8; i++ {
+		req, _ := http.NewRequest("GET", "http://www"+strconv.Itoa(i)+".example.com/", nil)
+		if r := matchSpacRule(req, false); nil == r || r.Proxy[0] != DEFAULT_NAME {
+			t.Fatalf("unexpected rule of %s:%v", req.Host, r)
+		}
+	}
+}
+
+func TestLearnResetTunnel(t *testing.T) {
+	defer setupLearning(t)()
+	//the blocked server resets the connection after the ClientHello
+	server, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer server.Close()
+	go func() {
+		c, err := server.Accept()
+		if nil == err {
+			c.Read(make([]byte, 1024))
+			c.(*net.TCPConn).SetLinger(0)
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(server.Addr().String())
+	defer func(v string) {
+		learningProbePort = v
+	}(learningProbePort)
+	learningProbePort = port
+
+	local, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer local.Close()
+	browser, _ := net.Dial("tcp", local.Addr().String())
+	defer browser.Close()
+	accepted, _ := local.Accept()
+	defer accepted.Close()
+
+	session := newSessionConnection(NewSessionID(), accepted, bufio.NewReader(accepted))
+	session.Type = HTTPS_TUNNEL
+	raw := "CONNECT " + server.Addr().String() + " HTTP/1.1\r\nHost: " + server.Addr().String() + "\r\n\r\n"
+	req, _ := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	var ev event.HTTPRequestEvent
+	ev.FromRequest(req)
+	remote, _ := getProxyManager(DIRECT_NAME, req.Host, true).GetRemoteConnection(&ev, map[string]string{ATTR_LEARNING: ""})
+	go browser.Write([]byte("\x16\x03\x01hello"))
+	if err, _ := remote.Request(session, &ev); nil == err {
+		t.Fatal("the blocked tunnel should fail")
+	}
+	if rules := autoBlocked.list(); len(rules) != 1 || rules[0].Hostname != "127.0.0.1" || rules[0].Reason != "Reset" {
+		t.Fatalf("unexpected rules:%v", rules)
+	}
+
+	//the next proxy gets the hello and its response header is dropped
+	hello := make([]byte, 8)
+	if _, err := io.ReadFull(session.LocalBufferConn, hello); nil != err || string(hello) != "\x16\x03\x01hello" {
+		t.Fatalf("unexpected hello:%q %v", hello, err)
+	}
+	session.LocalRawConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n\x16\x03\x03"))
+	res := make([]byte, 42)
+	if _, err := io.ReadFull(browser, res); nil != err || string(res) != "HTTP/1.1 200 Connection established\r\n\r\n\x16\x03\x03" {
+		t.Fatalf("unexpected response:%q %v", res, err)
+	}
+}
+
+//the hosts are unblocked by POST only
+func TestUnblockByPost(t *testing.T) {
+	defer setupLearning(t)()
+	autoBlocked.record("www.example.com", "Reset")
+	blockedHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/blocked?unblock=www.example.com", nil))
+	if len(autoBlocked.list()) != 1 {
+		t.Fatal("the host is unblocked by GET")
+	}
+	req := httptest.NewRequest("POST", "/blocked", strings.NewReader("unblock=www.example.com"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	blockedHandler(httptest.NewRecorder(), req)
+	if len(autoBlocked.list()) != 0 {
+		t.Fatal("the host is not unblocked by POST")
+	}
+}
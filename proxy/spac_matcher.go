@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//the http methods which are indexed by a bitmask, others fall back to the regexs
+var spacMethods = []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS", "CONNECT", "TRACE", "PATCH"}
+
+var allMethods = uint32(1)<<uint(len(spacMethods)) - 1
+
+func methodBit(method string) uint32 {
+	for i, m := range spacMethods {
+		if m == method {
+			return 1 << uint(i)
+		}
+	}
+	return 0
+}
+
+//hostLiteral returns the literal a host pattern matches as a substring.
+//Patterns are compiled unanchored by util.PrepareRegexp, so leading and
+//trailing stars are redundant and "*.google.com" behaves as a substring
+//match of ".google.com", which a trie is able to index.
+func hostLiteral(pattern string) (string, bool) {
+	literal := strings.Trim(strings.TrimSpace(pattern), "*")
+	if strings.ContainsAny(literal, "*?+()[]{}|^$\\") {
+		return "", false
+	}
+	return literal, true
+}
+
+//suffixTrie indexes the host literals by their reversed bytes, the
+//literals contained in a host are found by walking the trie backward from
+//every end position of the host. The end of the host is tried first,
+//which is where the domain patterns are found.
+type suffixTrie struct {
+	children map[byte]*suffixTrie
+	rules    []int
+}
+
+func (t *suffixTrie) insert(literal string, rule int) {
+	node := t
+	for i := len(literal) - 1; i >= 0; i-- {
+		if nil == node.children {
+			node.children = make(map[byte]*suffixTrie)
+		}
+		next, exist := node.children[literal[i]]
+		if !exist {
+			next = new(suffixTrie)
+			node.children[literal[i]] = next
+		}
+		node = next
+	}
+	if n := len(node.rules); n == 0 || node.rules[n-1] != rule {
+		node.rules = append(node.rules, rule)
+	}
+}
+
+func (t *suffixTrie) lookup(host string, rules []int) []int {
+	for end := len(host); end > 0; end-- {
+		node := t
+		for i := end - 1; i >= 0 && nil != node.children; i-- {
+			if node = node.children[host[i]]; nil == node {
+				break
+			}
+			rules = append(rules, node.rules...)
+		}
+	}
+	return rules
+}
+
+type compiledRule struct {
+	*JsonRule
+	methods uint32
+	//the host is verified by the trie already, the rules in the trie
+	//which are not indexed are verified by the host patterns
+	indexed bool
+}
+
+//spacMatcher selects the first matched rule like a linear scan of the rules
+//but only visits the rules whose host patterns are possible to match. The
+//filters and the destination IPs, which may lookup DNS, are evaluated last
+//and at most once for a request.
+type spacMatcher struct {
+	rules []compiledRule
+	hosts suffixTrie
+	//rules which could not be indexed by host, in order
+	scan []int
+}
+
+func newSpacMatcher(rules []*JsonRule) *spacMatcher {
+	m := &spacMatcher{rules: make([]compiledRule, len(rules))}
+	for i, r := range rules {
+		c := compiledRule{JsonRule: r, methods: allMethods}
+		if len(r.method_regex) > 0 {
+			c.methods = 0
+			for _, method := range spacMethods {
+				if matchRegexs(method, r.method_regex) {
+					c.methods |= methodBit(method)
+				}
+			}
+		}
+		literals := make([]string, 0, len(r.Host))
+		exact := true
+		for _, pattern := range r.Host {
+			literal, ok := hostLiteral(pattern)
+			if !ok {
+				//the learned patterns are verified after the trie
+				literal, ok = learnedHostLiteral(pattern)
+				exact = false
+			}
+			if !ok || len(literal) == 0 {
+				literals = nil
+				break
+			}
+			literals = append(literals, literal)
+		}
+		if len(literals) > 0 {
+			c.indexed = exact
+			for _, literal := range literals {
+				m.hosts.insert(literal, i)
+			}
+		} else {
+			m.scan = append(m.scan, i)
+		}
+		m.rules[i] = c
+	}
+	return m
+}
+
+func (c *compiledRule) match(req *http.Request, isHttpsConn bool, ctx *matchContext) bool {
+	if bit := methodBit(req.Method); bit > 0 {
+		if c.methods&bit == 0 {
+			return false
+		}
+	} else if !matchRegexs(req.Method, c.method_regex) {
+		return false
+	}
+	if !c.matchProtocol(req, isHttpsConn) {
+		return false
+	}
+	if !c.indexed && !matchRegexs(req.Host, c.host_regex) {
+		return false
+	}
+	if !matchRegexs(req.RequestURI, c.url_regex) {
+		return false
+	}
+	return c.matchPredicates(req, isHttpsConn, ctx) == ""
+}
+
+//Match returns the first rule matched the request, nil if none
+func (m *spacMatcher) Match(req *http.Request, isHttpsConn bool) *JsonRule {
+	if nil == m || len(m.rules) == 0 {
+		return nil
+	}
+	candidates := m.hosts.lookup(req.Host, append([]int{}, m.scan...))
+	sort.Ints(candidates)
+	ctx := newMatchContext()
+	for i, index := range candidates {
+		if i > 0 && candidates[i-1] == index {
+			continue
+		}
+		if c := &m.rules[index]; c.match(req, isHttpsConn, ctx) {
+			return c.JsonRule
+		}
+	}
+	return nil
+}
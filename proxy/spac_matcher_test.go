@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func linearMatch(rules []*JsonRule, req *http.Request, isHttpsConn bool) *JsonRule {
+	for _, r := range rules {
+		if r.match(req, isHttpsConn) {
+			return r
+		}
+	}
+	return nil
+}
+
+//syntheticRules mixes the shapes of the shipped rules, most of them are
+//domain patterns like the cloud rules
+func syntheticRules(n int) []*JsonRule {
+	rules := make([]*JsonRule, 0, n+8)
+	rules = append(rules,
+		&JsonRule{URL: []string{"www.google.*/imgres"}, Proxy: []string{"Direct"}},
+		&JsonRule{Host: []string{"*.google.com(.*)?", "*.ytimg.com*"}, Proxy: []string{"GoogleHttps"}},
+		&JsonRule{Protocol: "http", Host: []string{"twitter.com", "(www.)?facebook.com"}, Attr: []string{"RedirectHttps"}},
+		&JsonRule{Method: []string{"POST"}, Host: []string{"*.example.org"}, Proxy: []string{"C4"}},
+		&JsonRule{Host: []string{"*.example.org"}, Filter: []string{"Odd"}, Proxy: []string{"SSH"}},
+		&JsonRule{Host: []string{"mail.example.org"}, Proxy: []string{"GAE"}},
+	)
+	for i := 0; i < n; i++ {
+		rules = append(rules, &JsonRule{Host: []string{fmt.Sprintf("*.site%d.com", i), fmt.Sprintf("site%d.net", i)}, Proxy: []string{"GAE"}})
+	}
+	rules = append(rules, &JsonRule{Host: []string{"*"}, Method: []string{"CONNECT"}, Proxy: []string{"Direct"}})
+	for _, r := range rules {
+		if err := r.init(); nil != err {
+			panic(err)
+		}
+	}
+	return rules
+}
+
+func syntheticRequests() []*http.Request {
+	var reqs []*http.Request
+	for _, v := range [][2]string{
+		{"GET", "http://www.google.com.hk/imgres?q=1"},
+		{"GET", "http://www.google.com/"},
+		{"GET", "http://i.ytimg.com/vi"},
+		{"GET", "http://twitter.com/"},
+		{"GET", "http://api.twitter.com.cn/"},
+		{"GET", "http://www.facebook.com/"},
+		{"POST", "http://a.example.org/"},
+		{"GET", "http://a.example.org/"},
+		{"GET", "http://b.example.org/"},
+		{"GET", "http://mail.example.org/"},
+		{"GET", "http://www.site3.com/"},
+		{"GET", "http://site3.com/"},
+		{"GET", "http://site3.net.example.com/"},
+		{"GET", "http://asite42.net:8080/"},
+		{"GET", "http://www.site999.com/"},
+		{"get", "http://www.site1.com/"},
+		{"GET", "http://unknown.host/"},
+		{"CONNECT", "https://unknown.host:443"},
+	} {
+		req, _ := http.NewRequest(v[0], v[1], nil)
+		req.RequestURI = v[1]
+		reqs = append(reqs, req)
+	}
+	return reqs
+}
+
+func TestSpacMatcher(t *testing.T) {
+	func_table["Odd"] = func(req *http.Request, args []string) bool {
+		return len(req.Host)%2 == 1
+	}
+	defer delete(func_table, "Odd")
+	rules := syntheticRules(1000)
+	matcher := newSpacMatcher(rules)
+	for _, req := range syntheticRequests() {
+		for _, isHttpsConn := range []bool{false, true} {
+			expected := linearMatch(rules, req, isHttpsConn)
+			if r := matcher.Match(req, isHttpsConn); r != expected {
+				t.Fatalf("%s %s:expected %v, got %v", req.Method, req.RequestURI, expected, r)
+			}
+		}
+	}
+	if r := newSpacMatcher(nil).Match(syntheticRequests()[0], false); nil != r {
+		t.Fatalf("unexpected rule:%v", r)
+	}
+}
+
+func BenchmarkSpacLinear(b *testing.B) {
+	rules := syntheticRules(5000)
+	reqs := syntheticRequests()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linearMatch(rules, reqs[i%len(reqs)], false)
+	}
+}
+
+func BenchmarkSpacMatcher(b *testing.B) {
+	matcher := newSpacMatcher(syntheticRules(5000))
+	reqs := syntheticRequests()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matcher.Match(reqs[i%len(reqs)], false)
+	}
+}
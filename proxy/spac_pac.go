@@ -0,0 +1,352 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zyxar/gsnova/misc/gfwlist"
+	"github.com/zyxar/gsnova/util"
+)
+
+//The PAC generated from SPAC returns the dedicated listener of the backend
+//for a rule the browser is able to evaluate. Whatever depends on what a
+//browser does not know, like the client, the headers, the resolved IPs or
+//the attrs, is left to the [LocalServer] listener which runs SPAC again.
+
+//pacCode is a javascript condition, exact is false if the condition is
+//looser than the rule
+type pacCode struct {
+	code  string
+	exact bool
+}
+
+func pacRegexp(pattern string) (string, error) {
+	reg, err := util.PrepareRegexp(pattern, true)
+	if nil != err {
+		return "", err
+	}
+	return "/" + strings.Replace(reg.String(), "/", "\\/", -1) + "/", nil
+}
+
+func pacOr(codes []string) string {
+	if len(codes) == 1 {
+		return codes[0]
+	}
+	return "(" + strings.Join(codes, " || ") + ")"
+}
+
+//pacHostCode matches the host patterns like SPAC does, the host of PAC has
+//no port so the patterns with a port are not exact
+func pacHostCode(patterns []string) pacCode {
+	codes := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		//the optional port of the learned hosts never matches in PAC
+		pattern = strings.Replace(pattern, learnedPortPattern, "$", 1)
+		if strings.Contains(pattern, ":") {
+			return pacCode{exact: false}
+		}
+		if literal, ok := hostLiteral(pattern); ok {
+			codes = append(codes, "shExpMatch(host, "+strconv.Quote("*"+literal+"*")+")")
+			continue
+		}
+		reg, err := pacRegexp(pattern)
+		if nil != err {
+			return pacCode{exact: false}
+		}
+		codes = append(codes, reg+".test(host)")
+	}
+	return pacCode{pacOr(codes), true}
+}
+
+//pacURLCode tests the url like the request URI of a plain http request
+func pacURLCode(patterns []string) pacCode {
+	codes := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		reg, err := pacRegexp(pattern)
+		if nil != err {
+			return pacCode{exact: false}
+		}
+		codes = append(codes, reg+".test(url)")
+	}
+	return pacCode{pacOr(codes), true}
+}
+
+//pacCode translates the filter expression, the filters implemented in
+//go only are not exact
+func (e *filterExpr) pacCode() pacCode {
+	switch e.op {
+	case '&', '|':
+		left, right := e.left.pacCode(), e.right.pacCode()
+		op := " && "
+		if e.op == '|' {
+			op = " || "
+		}
+		return pacCode{"(" + left.code + op + right.code + ")", left.exact && right.exact}
+	case '!':
+		c := e.left.pacCode()
+		return pacCode{"!" + c.code, c.exact}
+	}
+	if user, exist := user_filters[e.name]; exist && nil == e.args {
+		return user.pacCode()
+	}
+	switch e.name {
+	case "IsBlockedByGFW":
+		return pacCode{"isBlockedByGFW(url, host)", true}
+	case "HostSuffix":
+		codes := make([]string, 0, len(e.args))
+		for _, suffix := range e.args {
+			suffix = strings.TrimPrefix(suffix, ".")
+			codes = append(codes, "host == "+strconv.Quote(suffix), "dnsDomainIs(host, "+strconv.Quote("."+suffix)+")")
+		}
+		return pacCode{pacOr(codes), true}
+	}
+	return pacCode{"false", false}
+}
+
+//pacCondition returns the javascript condition of the rule, the
+//conditions not exact are dropped and exact is false then
+func (r *JsonRule) pacCondition() ([]string, bool) {
+	conds := []string{}
+	exact := len(r.Method) == 0 && len(r.Port) == 0 && len(r.IP) == 0 && len(r.Client) == 0 && len(r.UserAgent) == 0 && len(r.Header) == 0 && len(r.Time) == 0
+	switch strings.ToLower(r.Protocol) {
+	case "":
+	case "https":
+		conds = append(conds, `url.substring(0, 6) == "https:"`)
+	default:
+		conds = append(conds, `url.substring(0, 5) == "http:"`)
+	}
+	codes := []pacCode{}
+	if len(r.Host) > 0 {
+		codes = append(codes, pacHostCode(r.Host))
+	}
+	if len(r.URL) > 0 {
+		codes = append(codes, pacURLCode(r.URL))
+	}
+	for _, filter := range r.filter_exprs {
+		codes = append(codes, filter.pacCode())
+	}
+	for _, c := range codes {
+		if c.exact {
+			conds = append(conds, c.code)
+		} else {
+			exact = false
+		}
+	}
+	return conds, exact
+}
+
+//pacListenAddr replaces the unspecified host of a listener with the host
+//of [SPAC] PACProxy
+func pacListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if nil != err {
+		return addr
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (nil != ip && ip.IsUnspecified()) {
+		host, _, _ = net.SplitHostPort(pac_proxy)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+//pacProxyItem returns the PAC item of a proxy name, false if the backend is
+//not available
+func pacProxyItem(name string, mainProxy string) (string, bool) {
+	if strings.EqualFold(name, DEFAULT_NAME) {
+		name = spac.defaultRule
+	}
+	if strings.EqualFold(name, DIRECT_NAME) {
+		//learning needs the retry of the [LocalServer] listener
+		if spac_learning {
+			return mainProxy, true
+		}
+		return "DIRECT", true
+	}
+	//the app of Backend:app is passed by attrs
+	if index := strings.Index(name, ":"); index > 0 && nil != getBackend(name[:index]) {
+		return mainProxy, true
+	}
+	if b := getBackend(name); nil != b {
+		if !b.healthy() {
+			return "", false
+		}
+		if addr, ok := b.ListenAddr(); ok {
+			return "PROXY " + pacListenAddr(addr), true
+		}
+		return mainProxy, true
+	}
+	if _, known := resolveProxyManager(name, false); known || strings.Contains(name, "@") {
+		return mainProxy, true
+	}
+	target := name
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if nil != err || len(u.Host) == 0 {
+		return mainProxy, true
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return "PROXY " + u.Host, true
+	case "https":
+		return "HTTPS " + u.Host, true
+	case "socks", "socks5":
+		return "SOCKS5 " + u.Host, true
+	}
+	return mainProxy, true
+}
+
+//pacProxyString joins the PAC items of the proxy names as the fallbacks
+func pacProxyString(names []string, mainProxy string) string {
+	items := []string{}
+	for _, name := range names {
+		item, ok := pacProxyItem(name, mainProxy)
+		if !ok {
+			continue
+		}
+		exist := false
+		for _, v := range items {
+			exist = exist || v == item
+		}
+		if !exist {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		return mainProxy
+	}
+	return strings.Join(items, "; ")
+}
+
+//the javascript of gfwlist is cached until the list is reloaded
+var pacGFWList struct {
+	sync.Mutex
+	list *gfwlist.GFWList
+	code []string
+}
+
+func pacGFWListCode() []string {
+	pacGFWList.Lock()
+	defer pacGFWList.Unlock()
+	if nil == gfwList {
+		return []string{"return true;"}
+	}
+	if pacGFWList.list != gfwList {
+		pacGFWList.code = append(autoProxyToJS(gfwlistContent(), "true", "false"), "return false;")
+		pacGFWList.list = gfwList
+	}
+	return pacGFWList.code
+}
+
+//pacHostsCode returns the declaration of the mapped hosts and the
+//condition of the hosts which may be mapped to available IPs, false if
+//every host may be resolved by the trusted DNS
+func pacHostsCode() (string, string, bool) {
+	if hostsEnable == HOSTS_DISABLE {
+		return "", "", true
+	}
+	if len(trustedDNS) > 0 {
+		return "", "", false
+	}
+	names := make([]string, 0, len(mapping)+len(hostMapping))
+	for k := range mapping {
+		names = append(names, strconv.Quote(k)+":1")
+	}
+	for k := range hostMapping {
+		if _, exist := mapping[k]; !exist {
+			names = append(names, strconv.Quote(k)+":1")
+		}
+	}
+	sort.Strings(names)
+	codes := []string{}
+	if len(names) > 0 {
+		codes = append(codes, "HOSTS.hasOwnProperty(host)")
+	}
+	for _, v := range regexMappingArray {
+		codes = append(codes, "/"+strings.Replace(v.regex.String(), "/", "\\/", -1)+"/.test(host)")
+	}
+	decl := "var HOSTS = {" + strings.Join(names, ", ") + "};"
+	if len(codes) == 0 {
+		return decl, "", true
+	}
+	code := pacOr(codes)
+	if hostsEnable == HOSTS_ENABLE_HTTPS {
+		code = `url.substring(0, 6) == "https:" && ` + code
+	}
+	return decl, code, true
+}
+
+//generateSpacPAC generates the PAC of the effective SPAC rules, hosts and
+//gfwlist. The result is stable for the same rules to be cached by ETag.
+func generateSpacPAC() string {
+	mainProxy := "PROXY " + pac_proxy
+	vars := map[string]string{mainProxy: "MAIN"}
+	var decls bytes.Buffer
+	decls.WriteString("var MAIN = " + strconv.Quote(mainProxy) + ";\n")
+	proxyVar := func(proxy string) string {
+		if v, exist := vars[proxy]; exist {
+			return v
+		}
+		v := "P" + strconv.Itoa(len(vars))
+		vars[proxy] = v
+		decls.WriteString("var " + v + " = " + strconv.Quote(proxy) + ";\n")
+		return v
+	}
+
+	var body bytes.Buffer
+	body.WriteString("\tif (isPlainHostName(host) || host == \"localhost\" || /^(127\\.|10\\.|192\\.168\\.|172\\.(1[6-9]|2\\d|3[01])\\.)/.test(host)) return \"DIRECT\";\n")
+	terminated := false
+	now := time.Now()
+	if spac_enable {
+		spacMutex.RLock()
+		for _, r := range spac.rules {
+			if !r.Expire.IsZero() && !r.Expire.After(now) {
+				continue
+			}
+			conds, exact := r.pacCondition()
+			ret := "MAIN"
+			if exact && len(r.Attr) == 0 {
+				ret = proxyVar(pacProxyString(r.Proxy, mainProxy))
+			}
+			body.WriteString("\t//" + r.source + "#" + strconv.Itoa(r.index) + "\n")
+			if len(conds) == 0 {
+				body.WriteString("\treturn " + ret + ";\n")
+				terminated = true
+				break
+			}
+			body.WriteString("\tif (" + strings.Join(conds, " && ") + ") return " + ret + ";\n")
+		}
+		spacMutex.RUnlock()
+	}
+	if !terminated {
+		defaultVar := proxyVar(pacProxyString([]string{spac.defaultRule}, mainProxy))
+		//the hosts are mapped by the [LocalServer] listener
+		if decl, code, exact := pacHostsCode(); !exact {
+			defaultVar = "MAIN"
+		} else if len(code) > 0 {
+			decls.WriteString(decl + "\n")
+			body.WriteString("\tif (" + code + ") return MAIN;\n")
+		}
+		body.WriteString("\treturn " + defaultVar + ";\n")
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("/*\n * Proxy Auto-Config file generated from SPAC rules\n")
+	for _, path := range spac_script_path {
+		buffer.WriteString(" *  Rule source: " + filepath.Base(path) + "\n")
+	}
+	buffer.WriteString(" */\n")
+	buffer.Write(decls.Bytes())
+	buffer.WriteString("function isBlockedByGFW(url, host) {\n\t" + strings.Join(pacGFWListCode(), "\n\t") + "\n}\n")
+	buffer.WriteString("function FindProxyForURL(url, host) {\n")
+	buffer.Write(body.Bytes())
+	buffer.WriteString("}\n")
+	return buffer.String()
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zyxar/gsnova/common"
+	"github.com/zyxar/gsnova/util"
+)
+
+func setupSpacPAC(t *testing.T, script string) func() {
+	saveBackendRegistry(t)
+	oldCfg, oldEnable, oldHosts := common.Cfg, spac_enable, hostsEnable
+	common.Cfg = util.NewIni()
+	common.Cfg.SetProperty("PACTest", "Listen", ":48199")
+	RegisterBackend(&Backend{Name: "PACTest", Section: "PACTest"})
+	rules := []*JsonRule{}
+	if err := json.Unmarshal([]byte(script), &rules); nil != err {
+		t.Fatal(err)
+	}
+	for i, r := range rules {
+		r.source, r.index = "user_spac.json", i
+		if err := r.init(); nil != err {
+			t.Fatal(err)
+		}
+	}
+	spac = &SpacConfig{defaultRule: "PACTest", rules: rules}
+	spac_enable, hostsEnable = true, HOSTS_DISABLE
+	return func() {
+		common.Cfg, spac_enable, hostsEnable = oldCfg, oldEnable, oldHosts
+	}
+}
+
+func TestGenerateSpacPAC(t *testing.T) {
+	defer setupSpacPAC(t, `[
+		{"Host":["*.example.com", "(www.)?example.org"], "Proxy":["Direct", "Default"]},
+		{"Protocol":"https", "URL":["*/secret/*"], "Proxy":["socks5://127.0.0.1:1080"]},
+		{"Filter":["HostSuffix(corp.example) && !IsBlockedByGFW"], "Proxy":["PACTest:app"]},
+		{"Host":["*.example.net"], "Attr":["Range"], "Proxy":["PACTest"]},
+		{"Host":["*.example.info"], "Client":["10.0.0.0/8"], "Proxy":["Direct"]},
+		{"Host":["*.example.io"], "Filter":["IsHostInCN"], "Proxy":["Direct"]}
+	]`)()
+	pac := generateSpacPAC()
+	for _, expected := range []string{
+		`var MAIN = "PROXY 127.0.0.1:48100";`,
+		`var P1 = "DIRECT; PROXY 127.0.0.1:48199";`,
+		`var P2 = "SOCKS5 127.0.0.1:1080";`,
+		`if ((shExpMatch(host, "*.example.com*") || /(www\.)?example\.org/.test(host))) return P1;`,
+		`if (url.substring(0, 6) == "https:" && /.*\/secret\/.*/.test(url)) return P2;`,
+		`if (((host == "corp.example" || dnsDomainIs(host, ".corp.example")) && !isBlockedByGFW(url, host))) return MAIN;`,
+		//the attrs and the client are handled by the main listener
+		`if (shExpMatch(host, "*.example.net*")) return MAIN;`,
+		`if (shExpMatch(host, "*.example.info*")) return MAIN;`,
+		`if (shExpMatch(host, "*.example.io*")) return MAIN;`,
+		`var P3 = "PROXY 127.0.0.1:48199";`,
+		"\treturn P3;\n}",
+	} {
+		if !strings.Contains(pac, expected) {
+			t.Fatalf("%s is not in PAC:\n%s", expected, pac)
+		}
+	}
+	if pac != generateSpacPAC() {
+		t.Fatal("PAC should be stable")
+	}
+
+	//an unconditional rule terminates the PAC
+	defer setupSpacPAC(t, `[{"Method":["CONNECT"], "Proxy":["Direct"]}, {"Host":["*.example.com"], "Proxy":["Direct"]}]`)()
+	if pac := generateSpacPAC(); !strings.HasSuffix(pac, "\t//user_spac.json#0\n\treturn MAIN;\n}\n") {
+		t.Fatalf("unexpected PAC:\n%s", pac)
+	}
+}
+
+func TestSpacPACHandler(t *testing.T) {
+	defer setupSpacPAC(t, `[{"Host":["*.example.com"], "Proxy":["Direct"]}]`)()
+	w := httptest.NewRecorder()
+	spacPACHandler(w, httptest.NewRequest("GET", "/pac/spac", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || len(etag) == 0 || !strings.Contains(w.Body.String(), "FindProxyForURL") {
+		t.Fatalf("unexpected response:%d %s", w.Code, etag)
+	}
+	req := httptest.NewRequest("GET", "/pac/spac", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	spacPACHandler(w, req)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("unexpected response:%d", w.Code)
+	}
+}
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type portRange struct {
+	from, to int
+}
+
+//parsePortRange parses "443" or "8000-9000"
+func parsePortRange(v string) (portRange, error) {
+	var r portRange
+	var err error
+	bounds := strings.SplitN(strings.TrimSpace(v), "-", 2)
+	if r.from, err = strconv.Atoi(strings.TrimSpace(bounds[0])); nil != err {
+		return r, fmt.Errorf("Invalid port:%s", v)
+	}
+	r.to = r.from
+	if len(bounds) == 2 {
+		if r.to, err = strconv.Atoi(strings.TrimSpace(bounds[1])); nil != err {
+			return r, fmt.Errorf("Invalid port:%s", v)
+		}
+	}
+	if r.from <= 0 || r.to > 65535 || r.from > r.to {
+		return r, fmt.Errorf("Invalid port range:%s", v)
+	}
+	return r, nil
+}
+
+//parseCIDRs parses CIDRs or single IPs
+func parseCIDRs(rules []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(rules))
+	for _, v := range rules {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if nil == ip {
+				return nil, fmt.Errorf("Invalid IP:%s", v)
+			}
+			if nil != ip.To4() {
+				v = v + "/32"
+			} else {
+				v = v + "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(v)
+		if nil != err {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+//timeWindow is in minutes of the local day, a window like 22:00-06:00 spans
+//midnight and the days are checked against the current day
+type timeWindow struct {
+	days     uint8
+	from, to int
+}
+
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(v))
+	if nil != err {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseWeekday(v string) (time.Weekday, error) {
+	key := strings.ToLower(strings.TrimSpace(v))
+	if len(key) > 3 {
+		key = key[:3]
+	}
+	if day, exist := weekdays[key]; exist {
+		return day, nil
+	}
+	return 0, fmt.Errorf("Invalid weekday:%s", v)
+}
+
+//parseTimeWindow parses "[Mon-Fri|Sat,Sun] [HH:MM-HH:MM]", either part may
+//be omitted
+func parseTimeWindow(v string) (timeWindow, error) {
+	w := timeWindow{from: 0, to: 24 * 60}
+	fields := strings.Fields(v)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("Invalid time window:%s", v)
+	}
+	for _, field := range fields {
+		if strings.Contains(field, ":") {
+			bounds := strings.SplitN(field, "-", 2)
+			if len(bounds) != 2 {
+				return w, fmt.Errorf("Invalid time window:%s", v)
+			}
+			var err error
+			if w.from, err = parseClock(bounds[0]); nil != err {
+				return w, err
+			}
+			if w.to, err = parseClock(bounds[1]); nil != err {
+				return w, err
+			}
+			if w.to == 0 {
+				w.to = 24 * 60
+			}
+			continue
+		}
+		for _, item := range strings.Split(field, ",") {
+			bounds := strings.SplitN(item, "-", 2)
+			from, err := parseWeekday(bounds[0])
+			if nil != err {
+				return w, err
+			}
+			to := from
+			if len(bounds) == 2 {
+				if to, err = parseWeekday(bounds[1]); nil != err {
+					return w, err
+				}
+			}
+			for day := from; ; day = (day + 1) % 7 {
+				w.days |= 1 << uint(day)
+				if day == to {
+					break
+				}
+			}
+		}
+	}
+	return w, nil
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	if w.days != 0 && w.days&(1<<uint(t.Weekday())) == 0 {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return minute >= w.from && minute < w.to
+	}
+	return minute >= w.from || minute < w.to
+}
+
+//matchContext caches what is expensive to get when a request is matched
+//against many rules
+type matchContext struct {
+	now time.Time
+	//results of the filter calls
+	filters  map[string]bool
+	ips      []net.IP
+	resolved bool
+}
+
+func newMatchContext() *matchContext {
+	return &matchContext{now: time.Now(), filters: make(map[string]bool)}
+}
+
+//hostIPs resolves the destination host once for a request
+func (ctx *matchContext) hostIPs(req *http.Request) []net.IP {
+	if !ctx.resolved {
+		ctx.resolved = true
+		host, _ := requestHostPort(req, false)
+		ctx.ips, _ = spacLookupHost(host)
+	}
+	return ctx.ips
+}
+
+//requestHostPort returns the destination of the request, the port defaults
+//to 443 for https
+func requestHostPort(req *http.Request, isHttpsConn bool) (string, int) {
+	host, port := req.Host, 80
+	if isHttpsConn || strings.EqualFold(req.Method, "Connect") {
+		port = 443
+	}
+	if h, p, err := net.SplitHostPort(req.Host); nil == err {
+		host = h
+		if v, err := strconv.Atoi(p); nil == err {
+			port = v
+		}
+	}
+	return strings.Trim(host, "[]"), port
+}
+
+func (r *JsonRule) initPredicates() (err error) {
+	r.port_ranges = make([]portRange, 0, len(r.Port))
+	for _, v := range r.Port {
+		pr, err := parsePortRange(v)
+		if nil != err {
+			return err
+		}
+		r.port_ranges = append(r.port_ranges, pr)
+	}
+	if r.ip_nets, err = parseCIDRs(r.IP); nil != err {
+		return
+	}
+	if r.client_nets, err = parseCIDRs(r.Client); nil != err {
+		return
+	}
+	if r.ua_regex, err = initRegexSlice(r.UserAgent); nil != err {
+		return
+	}
+	r.header_regex = make(map[string]*regexp.Regexp)
+	for name, pattern := range r.Header {
+		regexs, err := initRegexSlice([]string{pattern})
+		if nil != err {
+			return err
+		}
+		r.header_regex[http.CanonicalHeaderKey(name)] = regexs[0]
+	}
+	r.filter_exprs = make([]*filterExpr, 0, len(r.Filter))
+	for _, v := range r.Filter {
+		e, err := parseFilterExpr(v)
+		if nil != err {
+			return err
+		}
+		r.filter_exprs = append(r.filter_exprs, e)
+	}
+	r.time_windows = make([]timeWindow, 0, len(r.Time))
+	for _, v := range r.Time {
+		w, err := parseTimeWindow(v)
+		if nil != err {
+			return err
+		}
+		r.time_windows = append(r.time_windows, w)
+	}
+	return nil
+}
+
+//matchPredicates returns the name of the first field not matched, the
+//filters and the destination IPs are the most expensive and checked last
+func (r *JsonRule) matchPredicates(req *http.Request, isHttpsConn bool, ctx *matchContext) string {
+	if !r.Expire.IsZero() && ctx.now.After(r.Expire) {
+		return "Expire"
+	}
+	if len(r.port_ranges) > 0 {
+		_, port := requestHostPort(req, isHttpsConn)
+		matched := false
+		for _, pr := range r.port_ranges {
+			if port >= pr.from && port <= pr.to {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "Port"
+		}
+	}
+	if len(r.client_nets) > 0 {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		ip := net.ParseIP(host)
+		if nil != err || nil == ip || !containsIP(r.client_nets, ip) {
+			return "Client"
+		}
+	}
+	if !matchRegexs(req.UserAgent(), r.ua_regex) {
+		return "UserAgent"
+	}
+	for name, regex := range r.header_regex {
+		if !regex.MatchString(req.Header.Get(name)) {
+			return "Header"
+		}
+	}
+	if len(r.time_windows) > 0 {
+		matched := false
+		for _, w := range r.time_windows {
+			if w.contains(ctx.now) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "Time"
+		}
+	}
+	for _, filter := range r.filter_exprs {
+		if !filter.eval(req, ctx) {
+			return "Filter"
+		}
+	}
+	if len(r.ip_nets) > 0 {
+		matched := false
+		for _, ip := range ctx.hostIPs(req) {
+			if containsIP(r.ip_nets, ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "IP"
+		}
+	}
+	return ""
+}
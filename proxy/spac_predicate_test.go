@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newPredicateRule(t *testing.T, v string) *JsonRule {
+	r := new(JsonRule)
+	if err := json.Unmarshal([]byte(v), r); nil != err {
+		t.Fatal(err)
+	}
+	if err := r.init(); nil != err {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func newPredicateRequest(method, rawurl, client string) *http.Request {
+	req, _ := http.NewRequest(method, rawurl, nil)
+	req.RequestURI = rawurl
+	if method == "CONNECT" {
+		req.Host = req.URL.Host
+		req.RequestURI = req.URL.Host
+	}
+	req.RemoteAddr = client
+	return req
+}
+
+func TestSpacPredicates(t *testing.T) {
+	now := time.Date(2026, 10, 16, 10, 30, 0, 0, time.Local) //Friday
+	for _, c := range []struct {
+		rule    string
+		req     *http.Request
+		https   bool
+		matched string
+	}{
+		{`{"Port":["443"]}`, newPredicateRequest("CONNECT", "https://a.com:443", ""), true, ""},
+		{`{"Port":["443"]}`, newPredicateRequest("GET", "http://a.com/", ""), false, "Port"},
+		{`{"Port":["8000-9000"]}`, newPredicateRequest("GET", "http://a.com:8080/", ""), false, ""},
+		{`{"Port":["8000-9000", "22"]}`, newPredicateRequest("GET", "http://a.com:9001/", ""), false, "Port"},
+		{`{"Client":["192.168.1.0/24"]}`, newPredicateRequest("GET", "http://a.com/", "192.168.1.7:5000"), false, ""},
+		{`{"Client":["192.168.1.0/24", "10.0.0.1"]}`, newPredicateRequest("GET", "http://a.com/", "10.0.0.2:5000"), false, "Client"},
+		{`{"Client":["192.168.1.0/24"]}`, newPredicateRequest("GET", "http://a.com/", ""), false, "Client"},
+		{`{"IP":["8.8.8.0/24"]}`, newPredicateRequest("GET", "http://8.8.8.8/", ""), false, ""},
+		{`{"IP":["2001:db8::/32"]}`, newPredicateRequest("CONNECT", "https://[2001:db8::1]:443", ""), true, ""},
+		{`{"IP":["8.8.8.0/24"]}`, newPredicateRequest("GET", "http://1.1.1.1/", ""), false, "IP"},
+		{`{"UserAgent":["*Android*"]}`, newPredicateRequest("GET", "http://a.com/", ""), false, "UserAgent"},
+		{`{"Header":{"accept-language":"zh*"}}`, newPredicateRequest("GET", "http://a.com/", ""), false, "Header"},
+		{`{"Time":["Mon-Fri 09:00-18:00"]}`, newPredicateRequest("GET", "http://a.com/", ""), false, ""},
+		{`{"Time":["Sat,Sun", "22:00-06:00"]}`, newPredicateRequest("GET", "http://a.com/", ""), false, "Time"},
+		{`{"Time":["Thu-Sun 10:00-10:30"]}`, newPredicateRequest("GET", "http://a.com/", ""), false, "Time"},
+	} {
+		r := newPredicateRule(t, c.rule)
+		ctx := newMatchContext()
+		ctx.now = now
+		if v := r.matchPredicates(c.req, c.https, ctx); v != c.matched {
+			t.Fatalf("%s %s:expected %q, got %q", c.rule, c.req.Host, c.matched, v)
+		}
+	}
+
+	r := newPredicateRule(t, `{"UserAgent":["*Android*"], "Header":{"accept-language":"zh*"}}`)
+	req := newPredicateRequest("GET", "http://a.com/", "")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Linux; Android 14)")
+	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9")
+	if v := r.matchPredicates(req, false, newMatchContext()); len(v) > 0 {
+		t.Fatalf("unexpected mismatch:%s", v)
+	}
+}
+
+func TestParseSpacPredicates(t *testing.T) {
+	w, err := parseTimeWindow("Fri-Mon 22:00-06:00")
+	if nil != err {
+		t.Fatal(err)
+	}
+	sunday := time.Date(2026, 10, 18, 23, 0, 0, 0, time.Local)
+	if !w.contains(sunday) || !w.contains(sunday.Add(-20*time.Hour)) || w.contains(sunday.Add(-4*time.Hour)) {
+		t.Fatalf("unexpected window:%v", w)
+	}
+	if w.contains(sunday.Add(48 * time.Hour)) {
+		t.Fatal("Tuesday should not be in the window")
+	}
+	for _, v := range []string{"Someday", "10:00", "25:00-26:00", "Mon 10:00-11:00 extra", ""} {
+		if _, err := parseTimeWindow(v); nil == err {
+			t.Fatalf("%s should be invalid", v)
+		}
+	}
+	for _, v := range []string{"0", "9000-8000", "70000", "http"} {
+		if _, err := parsePortRange(v); nil == err {
+			t.Fatalf("%s should be invalid", v)
+		}
+	}
+	for _, v := range []string{`{"Port":["x"]}`, `{"IP":["1.2.3"]}`, `{"Client":["10.0.0.0/33"]}`, `{"Time":["Noday"]}`} {
+		r := new(JsonRule)
+		json.Unmarshal([]byte(v), r)
+		if err := r.init(); nil == err {
+			t.Fatalf("%s should be invalid", v)
+		}
+	}
+}
@@ -2,16 +2,9 @@ package proxy
 
 import (
 	"bufio"
-	"crypto"
-	"crypto/dsa"
-	"crypto/rsa"
-	_ "crypto/sha1"
-	"crypto/x509"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -20,16 +13,17 @@ import (
 	"strings"
 	"time"
 
-	"code.google.com/p/go.crypto/ssh"
 	"github.com/yinqiwen/godns"
 	"github.com/zyxar/gsnova/common"
 	"github.com/zyxar/gsnova/event"
 	"github.com/zyxar/gsnova/util"
+	"golang.org/x/crypto/ssh"
 )
 
 var sshLocalProxy *url.URL
 var sshResolveRemote bool
 var SSHEnable bool
+var sshManager *SSH
 
 type SSHConnection struct {
 	ssh_conn          *SSHRawConnection
@@ -52,12 +46,16 @@ func (conn *SSHConnection) initProxyConn(proxy_addr string, isHttps bool) error
 	}
 	conn.Close()
 	conn.proxy_addr = proxy_addr
-	ssh_conn, err := conn.ssh_conn.GetClientConn(false)
-	if nil != err {
-		if ssh_conn, err = conn.ssh_conn.GetClientConn(true); nil != err {
-			return err
+	if len(conn.ssh_conn.SocksServer) > 0 {
+		//the remote socks server resolves the host
+		var err error
+		conn.proxy_conn, err = conn.ssh_conn.Dial("tcp", proxy_addr)
+		if nil == err && !isHttps {
+			conn.proxy_conn_reader = bufio.NewReader(conn.proxy_conn)
 		}
+		return err
 	}
+	var err error
 	var raddr *net.TCPAddr
 	if !sshResolveRemote {
 		raddr, err = net.ResolveTCPAddr("tcp", proxy_addr)
@@ -82,13 +80,22 @@ func (conn *SSHConnection) initProxyConn(proxy_addr string, isHttps bool) error
 	if nil != err {
 		return err
 	}
-	conn.proxy_conn, err = ssh_conn.DialTCP("tcp", nil, raddr)
+	conn.proxy_conn, err = conn.ssh_conn.DialTCP("tcp", nil, raddr)
 	if nil == err && !isHttps {
 		conn.proxy_conn_reader = bufio.NewReader(conn.proxy_conn)
 	}
 	return err
 }
 
+//dialTunnel returns the channel forwarded to addr by DialTCP, it is closed
+//with the connection
+func (conn *SSHConnection) dialTunnel(addr string) (net.Conn, error) {
+	if err := conn.initProxyConn(addr, true); nil != err {
+		return nil, err
+	}
+	return conn.proxy_conn, nil
+}
+
 func (conn *SSHConnection) Request(sess *SessionConnection, ev event.Event) (err error, res event.Event) {
 	f := func(local, remote net.Conn, ch chan int) {
 		io.Copy(remote, local)
@@ -116,13 +123,15 @@ func (conn *SSHConnection) Request(sess *SessionConnection, ev event.Event) (err
 			log.Printf("Session[%d]Request %s\n", req.GetHash(), util.GetURLString(req.RawReq, true))
 			err := req.RawReq.Write(conn.proxy_conn)
 			if nil != err {
-				conn.ssh_conn.CloseConn()
+				conn.ssh_conn.CheckChannel(conn.proxy_conn)
+				conn.Close()
 				return err, nil
 			}
 			conn.proxy_conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 			resp, err := http.ReadResponse(conn.proxy_conn_reader, req.RawReq)
 			if err != nil {
-				conn.ssh_conn.CloseConn()
+				conn.ssh_conn.CheckChannel(conn.proxy_conn)
+				conn.Close()
 				return err, nil
 			}
 			var zero time.Time
@@ -179,97 +188,22 @@ func (manager *SSH) GetName() string {
 type SSHRawConnection struct {
 	ClientConfig *ssh.ClientConfig
 	Server       string
-	clientConn   *ssh.ClientConn
+	Jumps        []sshHop
+	SocksServer  string
+	conns        []*sshClientConn
 }
 
 func (conn *SSHRawConnection) RemoteResolve(name string) ([]net.IP, error) {
-	if raw, err := conn.GetClientConn(false); nil == err {
-		dial := func(net, addr string, timeout time.Duration) (net.Conn, error) {
-			return raw.Dial(net, addr)
-		}
-		options := &godns.LookupOptions{
-			DNSServers:  godns.GoogleDNSServers,
-			Net:         "tcp",
-			CacheTTL:    godns.DNS_CACHE_TTL_SELF,
-			DialTimeout: dial,
-		}
-		return godns.LookupIP(name, options)
-	} else {
-		return nil, err
-	}
-	return nil, nil
-}
-
-func (conn *SSHRawConnection) CloseConn() {
-	if nil != conn.clientConn {
-		conn.clientConn.Close()
-		conn.clientConn = nil
-	}
-}
-
-func (conn *SSHRawConnection) GetClientConn(reconnect bool) (*ssh.ClientConn, error) {
-	if !reconnect && nil != conn.clientConn {
-		return conn.clientConn, nil
-	} else {
-		if nil != conn.clientConn {
-			conn.clientConn.Close()
-		}
-		conn.clientConn = nil
-		dial := net.Dial
-		if nil != sshLocalProxy {
-			dial = func(network, addr string) (net.Conn, error) {
-				return util.HttpTunnelDial(network, addr, sshLocalProxy)
-			}
-		}
-		if c, err := dial("tcp", conn.Server); nil != err {
-			return nil, err
-		} else {
-			conn.clientConn, err = ssh.Client(c, conn.ClientConfig)
-			return conn.clientConn, err
-		}
+	dial := func(net, addr string, timeout time.Duration) (net.Conn, error) {
+		return conn.Dial(net, addr)
 	}
-	return nil, nil
-}
-
-type password string
-
-func (p password) Password(user string) (string, error) {
-	return string(p), nil
-}
-
-// keychain implements the ClientKeyring interface
-type keychain struct {
-	keys []interface{}
-}
-
-func (k *keychain) Key(i int) (ssh.PublicKey, error) {
-	if i < 0 || i >= len(k.keys) {
-		return nil, nil
-	}
-	switch key := k.keys[i].(type) {
-	case *rsa.PrivateKey:
-		return ssh.NewRSAPublicKey(&key.PublicKey), nil
-	case *dsa.PrivateKey:
-		return ssh.NewDSAPublicKey(&key.PublicKey), nil
+	options := &godns.LookupOptions{
+		DNSServers:  godns.GoogleDNSServers,
+		Net:         "tcp",
+		CacheTTL:    godns.DNS_CACHE_TTL_SELF,
+		DialTimeout: dial,
 	}
-	panic("unknown key type")
-}
-
-func (k *keychain) Sign(i int, rand io.Reader, data []byte) (sig []byte, err error) {
-	hashFunc := crypto.SHA1
-	h := hashFunc.New()
-	h.Write(data)
-	digest := h.Sum(nil)
-	switch key := k.keys[i].(type) {
-	case *rsa.PrivateKey:
-		return rsa.SignPKCS1v15(rand, key, hashFunc, digest)
-	case *dsa.PrivateKey:
-		r, s, err := dsa.Sign(rand, key, digest)
-		if nil == err {
-			return append(r.Bytes(), s.Bytes()...), nil
-		}
-	}
-	return nil, errors.New("ssh: unknown key type")
+	return godns.LookupIP(name, options)
 }
 
 func InitSSH() error {
@@ -280,15 +214,26 @@ func InitSSH() error {
 	}
 	SSHEnable = true
 	log.Println("Init SSH.")
-	if proxy, exist := common.Cfg.GetProperty("SSH", "Proxy"); exist {
+	if proxy, exist := common.Cfg.GetProperty("SSH", "Proxy"); exist && len(proxy) > 0 && !hasDialChain(SSH_NAME) {
 		sshLocalProxy, _ = url.Parse(proxy)
 	}
 	if enable, exist := common.Cfg.GetIntProperty("SSH", "RemoteResolve"); exist {
 		sshResolveRemote = (enable != 0)
 	}
+	if size, exist := common.Cfg.GetIntProperty("SSH", "ConnectionPoolSize"); exist && size > 0 {
+		sshPoolSize = int(size)
+	}
+	if period, exist := common.Cfg.GetIntProperty("SSH", "KeepAliveInterval"); exist && period > 0 {
+		sshKeepAliveInterval = time.Duration(period) * time.Second
+	}
+
+	if err := initSSHKnownHosts(); nil != err {
+		return err
+	}
 
 	var manager SSH
 	RegisteRemoteConnManager(&manager)
+	sshManager = &manager
 
 	index := 0
 	for ; ; index = index + 1 {
@@ -297,66 +242,15 @@ func InitSSH() error {
 			break
 		}
 		var ssh_conn SSHRawConnection
-		if u, err := url.Parse(v); nil == err {
-			ssh_conn.Server = u.Host
-			if !strings.Contains(u.Host, ":") {
-				ssh_conn.Server = net.JoinHostPort(u.Host, "22")
-			}
-			if u.User == nil {
-				log.Printf("Invalid SSH server url:%s, no user found in url.\n", v)
+		if hop, u, err := parseSSHHop(v); nil == err {
+			ssh_conn.Server = hop.Server
+			ssh_conn.ClientConfig = hop.ClientConfig
+			ssh_conn.SocksServer = u.Query().Get("socks")
+			if ssh_conn.Jumps, err = parseSSHJumps(u); nil != err {
+				log.Printf("Invalid SSH jump host in url:%s for reason:%v\n", v, err)
 				continue
-			} else {
-				if pass, exist := u.User.Password(); exist {
-					ssh_conn.ClientConfig = &ssh.ClientConfig{
-						User: u.User.Username(),
-						Auth: []ssh.ClientAuth{
-							ssh.ClientAuthPassword(password(pass)),
-						},
-					}
-				} else {
-					if identify := u.Query().Get("i"); len(identify) > 0 {
-						if content, err := ioutil.ReadFile(identify); nil != err {
-							log.Printf("Invalid SSH identify path:%s for reason:%v.\n", identify, err)
-							continue
-						} else {
-							block, _ := pem.Decode([]byte(content))
-							if nil == block {
-								log.Printf("Invalid pem content for path:%s.\n", identify)
-								continue
-							}
-							clientKeychain := new(keychain)
-							if strings.Contains(block.Type, "RSA") {
-								rsakey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-								if err != nil {
-									log.Printf("Invalid RSA private key for %v.\n", err)
-									continue
-								}
-								clientKeychain.keys = append(clientKeychain.keys, rsakey)
-							} else {
-								dsakey, err := util.DecodeDSAPrivateKEy(block.Bytes)
-								if err != nil {
-									log.Printf("Invalid DSA private key for %v.\n", err)
-									continue
-								}
-								clientKeychain.keys = append(clientKeychain.keys, dsakey)
-							}
-
-							ssh_conn.ClientConfig = &ssh.ClientConfig{
-								User: u.User.Username(),
-								Auth: []ssh.ClientAuth{
-									ssh.ClientAuthKeyring(clientKeychain),
-								},
-							}
-						}
-
-					} else {
-						log.Printf("Invalid SSH server url:%s, no pass/identify found in url.\n", v)
-						continue
-					}
-
-				}
 			}
-			if _, err := ssh_conn.GetClientConn(true); nil == err {
+			if err := ssh_conn.initPool(sshPoolSize); nil == err {
 				manager.selector.Add(&ssh_conn)
 				log.Printf("SSH server %s connected.\n", ssh_conn.Server)
 			} else {
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestSSHKnownHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	keys, err := newSSHHostKeys(path, false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	host, addr := "127.0.0.1:2222", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+	key, other := newSSHTestSigner(t).PublicKey(), newSSHTestSigner(t).PublicKey()
+	if algos := keys.HostKeyAlgorithms(host); len(algos) > 0 {
+		t.Fatalf("unexpected algorithms of unknown host:%v", algos)
+	}
+	//the key of an unknown host is trusted and recorded on first use
+	for i := 0; i < 2; i++ {
+		if err = keys.Check(host, addr, key); nil != err {
+			t.Fatal(err)
+		}
+	}
+	line := knownhosts.Line([]string{"[127.0.0.1]:2222"}, key) + "\n"
+	if content, _ := ioutil.ReadFile(path); string(content) != line {
+		t.Fatalf("unexpected known_hosts:%q", content)
+	}
+	if algos := keys.HostKeyAlgorithms(host); len(algos) != 1 || algos[0] != ssh.KeyAlgoED25519 {
+		t.Fatalf("unexpected algorithms:%v", algos)
+	}
+	if algos := keys.HostKeyAlgorithms("127.0.0.1:22"); len(algos) > 0 {
+		t.Fatalf("unexpected algorithms of other port:%v", algos)
+	}
+
+	//another key of the host is rejected, the recorded key is not replaced
+	var keyErr *knownhosts.KeyError
+	if err = keys.Check(host, addr, other); !errors.As(err, &keyErr) || len(keyErr.Want) != 1 {
+		t.Fatalf("mismatched host key is accepted:%v", err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != line {
+		t.Fatalf("unexpected known_hosts:%q", content)
+	}
+	if keys, err = newSSHHostKeys(path, true); nil != err {
+		t.Fatal(err)
+	}
+	if err = keys.Check(host, addr, key); nil != err {
+		t.Fatalf("recorded host key is rejected:%v", err)
+	}
+
+	//unknown hosts are rejected in strict mode
+	if err = keys.Check("127.0.0.1:2223", addr, key); nil == err || !strings.Contains(err.Error(), "Unknown host key") {
+		t.Fatalf("unknown host is accepted in strict mode:%v", err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != line {
+		t.Fatalf("unexpected known_hosts:%q", content)
+	}
+}
+
+//the handshake fails if the server presents another key after the first use
+func TestSSHHostKeyMismatch(t *testing.T) {
+	path := setupSSHKnownHosts(t)
+	server := startSSHServer(t, nil)
+	conn := newSSHTestConnection(t, server.Addr().String())
+	client, jumps, err := conn.dialChain()
+	if nil != err {
+		t.Fatal(err)
+	}
+	closeSSHClients(client, jumps)
+	recorded, _ := ioutil.ReadFile(path)
+
+	server.setConfig(newSSHServerConfig(t))
+	if client, _, err = conn.dialChain(); nil == err {
+		client.Close()
+		t.Fatal("mismatched host key is accepted")
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) != 1 {
+		t.Fatalf("unexpected error:%v", err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != string(recorded) {
+		t.Fatalf("the recorded key is changed:%q", content)
+	}
+	if err = conn.initPool(1); nil == err {
+		t.Fatal("the pool is connected with mismatched host key")
+	}
+}
+
+//startSSHAgent serves a keyring holding a new key on SSH_AUTH_SOCK
+func startSSHAgent(t *testing.T) ssh.PublicKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err = keyring.Add(agent.AddedKey{PrivateKey: key}); nil != err {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if nil != err {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go agent.ServeAgent(keyring, c)
+		}
+	}()
+	//the agent is connected once per process
+	current := sshAgent
+	t.Cleanup(func() {
+		l.Close()
+		sshAgent = current
+		sshAgentOnce = sync.Once{}
+	})
+	sshAgent = nil
+	sshAgentOnce = sync.Once{}
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	signers, _ := keyring.Signers()
+	return signers[0].PublicKey()
+}
+
+func TestSSHAgentAuth(t *testing.T) {
+	setupSSHKnownHosts(t)
+	key := startSSHAgent(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, pub ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(pub.Marshal(), key.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown public key")
+		},
+	}
+	config.AddHostKey(newSSHTestSigner(t))
+	server := startSSHServer(t, config)
+
+	//the keys of the agent are used without pass or identify file
+	hop, _, err := parseSSHHop("ssh://user@" + server.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn := &SSHRawConnection{Server: hop.Server, ClientConfig: hop.ClientConfig}
+	client, jumps, err := conn.dialChain()
+	if nil != err {
+		t.Fatal(err)
+	}
+	closeSSHClients(client, jumps)
+
+	//the agent is skipped by agent=0
+	u, _ := url.Parse("ssh://user@" + server.Addr().String() + "/?agent=0")
+	if _, err = sshAuthMethods(u); nil == err {
+		t.Fatal("auth methods without pass/identify/ssh-agent")
+	}
+	conn = newSSHTestConnection(t, server.Addr().String())
+	if client, _, err = conn.dialChain(); nil == err {
+		client.Close()
+		t.Fatal("the server accepts the password")
+	}
+}
+
+func TestSSHKeyboardInteractiveAuth(t *testing.T) {
+	setupSSHKnownHosts(t)
+	config := &ssh.ServerConfig{
+		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge("user", "login", []string{"Password:", "Verification code:"}, []bool{false, false})
+			if nil != err {
+				return nil, err
+			}
+			//the pass of the url answers every question
+			if len(answers) == 2 && answers[0] == "pass" && answers[1] == "pass" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong answers")
+		},
+	}
+	config.AddHostKey(newSSHTestSigner(t))
+	server := startSSHServer(t, config)
+	conn := newSSHTestConnection(t, server.Addr().String())
+	client, jumps, err := conn.dialChain()
+	if nil != err {
+		t.Fatal(err)
+	}
+	closeSSHClients(client, jumps)
+
+	hop, _, err := parseSSHHop("ssh://user:wrong@" + server.Addr().String() + "/?agent=0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn = &SSHRawConnection{Server: hop.Server, ClientConfig: hop.ClientConfig}
+	if client, _, err = conn.dialChain(); nil == err {
+		client.Close()
+		t.Fatal("wrong answers are accepted")
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//waitSSHClosed waits until the server side of every connection is closed
+func waitSSHClosed(t *testing.T, server *sshTestServer) {
+	for _, c := range server.serverConns() {
+		closed := make(chan bool, 1)
+		go func(c *ssh.ServerConn) {
+			c.Wait()
+			closed <- true
+		}(c)
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the connection from %s is not closed", c.RemoteAddr())
+		}
+	}
+}
+
+func TestSSHJumpChain(t *testing.T) {
+	setupSSHKnownHosts(t)
+	first, second, target := startSSHServer(t, nil), startSSHServer(t, nil), startSSHServer(t, nil)
+	echo := startEchoListener(t)
+	conn := newSSHTestConnection(t, target.Addr().String(), first.Addr().String(), second.Addr().String())
+	if len(conn.Jumps) != 2 || conn.Jumps[0].Server != first.Addr().String() {
+		t.Fatalf("unexpected jumps:%v", conn.Jumps)
+	}
+	client, jumps, err := conn.dialChain()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(jumps) != 2 {
+		t.Fatalf("unexpected jump clients:%d", len(jumps))
+	}
+	//every hop is connected once, the later ones over the former
+	for _, s := range []*sshTestServer{first, second, target} {
+		if len(s.serverConns()) != 1 {
+			t.Fatalf("%s is connected %d times", s.Addr(), len(s.serverConns()))
+		}
+	}
+	if nil == first.serverConn(jumps[0]) {
+		t.Fatal("the first hop is not connected directly")
+	}
+	ch, err := client.Dial("tcp", echo.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	sshEcho(t, ch, "hello")
+	ch.Close()
+	//the later hops are carried by the first one
+	jumps[0].Close()
+	for _, s := range []*sshTestServer{first, second, target} {
+		waitSSHClosed(t, s)
+	}
+	closeSSHClients(client, jumps)
+}
+
+//the connected jump hosts are closed if a later hop fails
+func TestSSHJumpChainFailure(t *testing.T) {
+	setupSSHKnownHosts(t)
+	first, second, target := startSSHServer(t, nil), startSSHServer(t, nil), startSSHServer(t, nil)
+	//the target refuses the password
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(newSSHTestSigner(t))
+	target.setConfig(config)
+	conn := newSSHTestConnection(t, target.Addr().String(), first.Addr().String(), second.Addr().String())
+	if _, _, err := conn.dialChain(); nil == err {
+		t.Fatal("the chain is connected")
+	}
+	if len(first.serverConns()) != 1 || len(second.serverConns()) != 1 {
+		t.Fatal("the jump hosts are not connected")
+	}
+	waitSSHClosed(t, first)
+	waitSSHClosed(t, second)
+
+	//the last jump host fails to reach the target
+	addr := target.Addr().String()
+	target.Close()
+	conn = newSSHTestConnection(t, addr, first.Addr().String(), second.Addr().String())
+	if _, _, err := conn.dialChain(); nil == err {
+		t.Fatal("the chain is connected")
+	}
+	if len(first.serverConns()) != 2 || len(second.serverConns()) != 2 {
+		t.Fatal("the jump hosts are not connected")
+	}
+	waitSSHClosed(t, first)
+	waitSSHClosed(t, second)
+}
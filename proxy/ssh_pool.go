@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zyxar/gsnova/misc/socks"
+	"golang.org/x/crypto/ssh"
+)
+
+var sshPoolSize = 2
+var sshKeepAliveInterval = 30 * time.Second
+var sshKeepAliveTimeout = 15 * time.Second
+var sshHandshakeTimeout = 30 * time.Second
+
+//sshClientConn is one of the pooled ssh connections of a server, it counts
+//the forwarded channels opened on it so that new channels go to the least
+//loaded connection
+type sshClientConn struct {
+	raw   *SSHRawConnection
+	index int
+	//serializes the connects, mutex only guards the state and is never held
+	//across the dials
+	connect_mutex sync.Mutex
+	mutex         sync.Mutex
+	client        *ssh.Client
+	jumps         []*ssh.Client
+	channels      int32
+	total         uint64
+	connects      uint32
+	last_err      error
+	check         chan bool
+}
+
+//sshChannelConn is a forwarded channel, the channel count of the owner is
+//released on close
+type sshChannelConn struct {
+	net.Conn
+	owner  *sshClientConn
+	closed int32
+}
+
+func (c *sshChannelConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt32(&c.owner.channels, -1)
+	}
+	return c.Conn.Close()
+}
+
+func (c *sshClientConn) getClient() *ssh.Client {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.client
+}
+
+func closeSSHClients(client *ssh.Client, jumps []*ssh.Client) {
+	if nil != client {
+		client.Close()
+	}
+	for i := len(jumps) - 1; i >= 0; i-- {
+		jumps[i].Close()
+	}
+}
+
+//connect returns the current client or dials the server if there is none,
+//the client connected by another routine while waiting is reused so that
+//the acquired clients are never replaced
+func (c *sshClientConn) connect() (*ssh.Client, error) {
+	c.connect_mutex.Lock()
+	defer c.connect_mutex.Unlock()
+	if client := c.getClient(); nil != client {
+		return client, nil
+	}
+	client, jumps, err := c.raw.dialChain()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if nil != err {
+		c.last_err = err
+		return nil, err
+	}
+	c.client, c.jumps = client, jumps
+	c.last_err = nil
+	c.connects++
+	return client, nil
+}
+
+//invalidate drops the client if it is still the current one
+func (c *sshClientConn) invalidate(client *ssh.Client) {
+	c.mutex.Lock()
+	if nil == client || c.client != client {
+		c.mutex.Unlock()
+		return
+	}
+	jumps := c.jumps
+	c.client, c.jumps = nil, nil
+	c.mutex.Unlock()
+	closeSSHClients(client, jumps)
+}
+
+//probe asks the keepalive routine to verify the connection now, it is
+//reconnected in background if the keepalive fails
+func (c *sshClientConn) probe() {
+	select {
+	case c.check <- true:
+	default:
+	}
+}
+
+func sshKeepAlive(client *ssh.Client) error {
+	ch := make(chan error, 1)
+	go func() {
+		//the server replies failure to unknown requests, any reply is fine
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		ch <- err
+	}()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(sshKeepAliveTimeout):
+		return errors.New("SSH keepalive timeout")
+	}
+}
+
+func (c *sshClientConn) keepAliveLoop() {
+	ticker := time.NewTicker(sshKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.check:
+		}
+		client := c.getClient()
+		if nil != client {
+			err := sshKeepAlive(client)
+			if nil == err {
+				continue
+			}
+			log.Printf("[WARN]SSH connection %s#%d keepalive failed:%v\n", c.raw.Server, c.index, err)
+			c.invalidate(client)
+		}
+		if _, err := c.connect(); nil != err {
+			log.Printf("[WARN]Failed to reconnect SSH server %s#%d:%v\n", c.raw.Server, c.index, err)
+		} else {
+			log.Printf("SSH server %s#%d reconnected.\n", c.raw.Server, c.index)
+		}
+	}
+}
+
+//initPool connects all the pooled connections and starts the keepalive routines
+func (conn *SSHRawConnection) initPool(size int) error {
+	var last_err error
+	connected := 0
+	for i := 0; i < size; i++ {
+		c := &sshClientConn{raw: conn, index: i, check: make(chan bool, 1)}
+		if _, err := c.connect(); nil != err {
+			last_err = err
+		} else {
+			connected++
+		}
+		conn.conns = append(conn.conns, c)
+	}
+	if connected == 0 {
+		conn.conns = nil
+		return last_err
+	}
+	for _, c := range conn.conns {
+		go c.keepAliveLoop()
+	}
+	return nil
+}
+
+//acquire selects the connected client with the least channels, a connection
+//is established synchronously if none is available
+func (conn *SSHRawConnection) acquire() (*sshClientConn, *ssh.Client, error) {
+	var selected *sshClientConn
+	var client *ssh.Client
+	for _, c := range conn.conns {
+		cc := c.getClient()
+		if nil == cc {
+			continue
+		}
+		if nil == selected || atomic.LoadInt32(&c.channels) < atomic.LoadInt32(&selected.channels) {
+			selected, client = c, cc
+		}
+	}
+	if nil != selected {
+		return selected, client, nil
+	}
+	var err error = errors.New("No SSH connection available")
+	for _, c := range conn.conns {
+		if client, err = c.connect(); nil == err {
+			return c, client, nil
+		}
+	}
+	return nil, nil, err
+}
+
+func (conn *SSHRawConnection) wrapChannel(c *sshClientConn, ch net.Conn, err error) (net.Conn, error) {
+	if nil != err {
+		//the target may just refuse, let the keepalive tell a broken transport
+		c.probe()
+		return nil, err
+	}
+	atomic.AddInt32(&c.channels, 1)
+	atomic.AddUint64(&c.total, 1)
+	return &sshChannelConn{Conn: ch, owner: c}, nil
+}
+
+//Dial opens a forwarded channel on the least loaded connection, the target
+//is connected by the remote socks server instead if SocksServer is set
+func (conn *SSHRawConnection) Dial(network, addr string) (net.Conn, error) {
+	c, client, err := conn.acquire()
+	if nil != err {
+		return nil, err
+	}
+	var ch net.Conn
+	if len(conn.SocksServer) > 0 {
+		proxy := &socks.Proxy{Addr: conn.SocksServer, Forward: client.Dial}
+		ch, err = proxy.Dial(network, addr)
+	} else {
+		ch, err = client.Dial(network, addr)
+	}
+	return conn.wrapChannel(c, ch, err)
+}
+
+//DialTCP is the same as Dial with a resolved address
+func (conn *SSHRawConnection) DialTCP(network string, laddr, raddr *net.TCPAddr) (net.Conn, error) {
+	if len(conn.SocksServer) > 0 {
+		return conn.Dial(network, raddr.String())
+	}
+	c, client, err := conn.acquire()
+	if nil != err {
+		return nil, err
+	}
+	ch, err := client.DialTCP(network, laddr, raddr)
+	return conn.wrapChannel(c, ch, err)
+}
+
+//CheckChannel verifies the connection carrying the channel after an io failure
+func (conn *SSHRawConnection) CheckChannel(ch net.Conn) {
+	if c, ok := ch.(*sshChannelConn); ok {
+		c.owner.probe()
+	}
+}
+
+type sshConnStat struct {
+	Server     string
+	Index      int
+	Connected  bool
+	Channels   int32
+	Total      uint64
+	Reconnects uint32
+	LastError  string
+}
+
+func sshConnStats() []sshConnStat {
+	stats := make([]sshConnStat, 0)
+	if nil == sshManager {
+		return stats
+	}
+	for _, v := range sshManager.selector.ArrayValues() {
+		raw := v.(*SSHRawConnection)
+		for _, c := range raw.conns {
+			c.mutex.Lock()
+			stat := sshConnStat{
+				Server:    raw.Server,
+				Index:     c.index,
+				Connected: nil != c.client,
+				Channels:  atomic.LoadInt32(&c.channels),
+				Total:     atomic.LoadUint64(&c.total),
+			}
+			if c.connects > 1 {
+				stat.Reconnects = c.connects - 1
+			}
+			if nil != c.last_err {
+				stat.LastError = c.last_err.Error()
+			}
+			c.mutex.Unlock()
+			stats = append(stats, stat)
+		}
+	}
+	return stats
+}
+
+func (stat *sshConnStat) String() string {
+	s := fmt.Sprintf("SSHConn[%s#%d]: Connected:%v Channels:%d Total:%d Reconnects:%d", stat.Server, stat.Index, stat.Connected, stat.Channels, stat.Total, stat.Reconnects)
+	if len(stat.LastError) > 0 {
+		s = s + " Error:" + stat.LastError
+	}
+	return s
+}
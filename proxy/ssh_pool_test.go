@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//sshTestServer is an in-process ssh server which forwards the direct-tcpip
+//channels, the default config accepts the password "pass"
+type sshTestServer struct {
+	net.Listener
+	mutex  sync.Mutex
+	config *ssh.ServerConfig
+	conns  []*ssh.ServerConn
+}
+
+func newSSHTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newSSHServerConfig(t *testing.T) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if string(pass) == "pass" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(newSSHTestSigner(t))
+	return config
+}
+
+func startSSHServer(t *testing.T, config *ssh.ServerConfig) *sshTestServer {
+	if nil == config {
+		config = newSSHServerConfig(t)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	s := &sshTestServer{Listener: l, config: config}
+	t.Cleanup(func() {
+		l.Close()
+		for _, c := range s.serverConns() {
+			c.Close()
+		}
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	return s
+}
+
+//setConfig replaces the config of the next connections
+func (s *sshTestServer) setConfig(config *ssh.ServerConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.config = config
+}
+
+func (s *sshTestServer) serverConns() []*ssh.ServerConn {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*ssh.ServerConn(nil), s.conns...)
+}
+
+//serverConn returns the server side of the client
+func (s *sshTestServer) serverConn(client *ssh.Client) *ssh.ServerConn {
+	for _, c := range s.serverConns() {
+		if c.RemoteAddr().String() == client.LocalAddr().String() {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *sshTestServer) handle(c net.Conn) {
+	s.mutex.Lock()
+	config := s.config
+	s.mutex.Unlock()
+	sconn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if nil != err {
+		c.Close()
+		return
+	}
+	s.mutex.Lock()
+	s.conns = append(s.conns, sconn)
+	s.mutex.Unlock()
+	//keepalive requests are answered with failure like openssh
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if nc.ChannelType() != "direct-tcpip" || nil != ssh.Unmarshal(nc.ExtraData(), &target) {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel")
+			continue
+		}
+		remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if nil != err {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, creqs, err := nc.Accept()
+		if nil != err {
+			remote.Close()
+			continue
+		}
+		go ssh.DiscardRequests(creqs)
+		go func() {
+			io.Copy(ch, remote)
+			ch.Close()
+		}()
+		go func() {
+			io.Copy(remote, ch)
+			remote.Close()
+		}()
+	}
+}
+
+func startEchoListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+//setupSSHKnownHosts trusts the host keys on first use in a temp file
+func setupSSHKnownHosts(t *testing.T) string {
+	keys := sshKnownHosts
+	t.Cleanup(func() {
+		sshKnownHosts = keys
+	})
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	var err error
+	if sshKnownHosts, err = newSSHHostKeys(path, false); nil != err {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newSSHTestConnection(t *testing.T, server string, jumps ...string) *SSHRawConnection {
+	hop, u, err := parseSSHHop("ssh://user:pass@" + server + "/?agent=0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, jump := range jumps {
+		u.RawQuery += "&jump=" + url.QueryEscape("ssh://user:pass@"+jump+"/?agent=0")
+	}
+	conn := &SSHRawConnection{Server: hop.Server, ClientConfig: hop.ClientConfig}
+	if conn.Jumps, err = parseSSHJumps(u); nil != err {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func sshEcho(t *testing.T, c net.Conn, msg string) {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); nil != err || string(buf) != msg {
+		t.Fatalf("unexpected echo:%q %v", buf, err)
+	}
+}
+
+func TestSSHPoolAcquire(t *testing.T) {
+	setupSSHKnownHosts(t)
+	server := startSSHServer(t, nil)
+	echo := startEchoListener(t)
+	conn := newSSHTestConnection(t, server.Addr().String())
+	if err := conn.initPool(3); nil != err {
+		t.Fatal(err)
+	}
+	//the channels are spread over the connections
+	var chs []net.Conn
+	for i := 0; i < 3; i++ {
+		ch, err := conn.Dial("tcp", echo.Addr().String())
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer ch.Close()
+		sshEcho(t, ch, "hello")
+		chs = append(chs, ch)
+	}
+	for _, c := range conn.conns {
+		if n := atomic.LoadInt32(&c.channels); n != 1 {
+			t.Fatalf("connection %d has %d channels", c.index, n)
+		}
+	}
+	//the least loaded connection gets the next channel
+	owner := chs[1].(*sshChannelConn).owner
+	chs[1].Close()
+	chs[1].Close()
+	if n := atomic.LoadInt32(&owner.channels); n != 0 {
+		t.Fatalf("the channel is not released:%d", n)
+	}
+	ch, err := conn.Dial("tcp", echo.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if ch.(*sshChannelConn).owner != owner {
+		t.Fatal("the least loaded connection is not selected")
+	}
+	if _, err = conn.Dial("tcp", "127.0.0.1:1"); nil == err {
+		t.Fatal("the refused channel is opened")
+	}
+	var channels int32
+	for _, c := range conn.conns {
+		channels += atomic.LoadInt32(&c.channels)
+	}
+	if channels != 3 {
+		t.Fatalf("the refused channel is counted:%d", channels)
+	}
+
+	//a connection is established if none is connected, the keepalive
+	//routines are not started here
+	idle := newSSHTestConnection(t, server.Addr().String())
+	for i := 0; i < 2; i++ {
+		idle.conns = append(idle.conns, &sshClientConn{raw: idle, index: i, check: make(chan bool, 1)})
+	}
+	c, client, err := idle.acquire()
+	if nil != err || c != idle.conns[0] || client != c.getClient() || c.connects != 1 {
+		t.Fatalf("unexpected acquired connection:%v", err)
+	}
+	defer client.Close()
+	if nil != idle.conns[1].getClient() {
+		t.Fatal("more connections are established")
+	}
+}
+
+func TestSSHReconnectAfterKeepAlive(t *testing.T) {
+	setupSSHKnownHosts(t)
+	server := startSSHServer(t, nil)
+	echo := startEchoListener(t)
+	conn := newSSHTestConnection(t, server.Addr().String())
+	if err := conn.initPool(1); nil != err {
+		t.Fatal(err)
+	}
+	c := conn.conns[0]
+	old := c.getClient()
+	if err := sshKeepAlive(old); nil != err {
+		t.Fatalf("keepalive failed:%v", err)
+	}
+	//the transport is broken, the failed channel asks for a keepalive
+	server.serverConn(old).Close()
+	old.Wait()
+	if _, err := conn.Dial("tcp", echo.Addr().String()); nil == err {
+		t.Fatal("the broken connection is used")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for client := c.getClient(); nil == client || client == old; client = c.getClient() {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection is not reconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ch, err := conn.Dial("tcp", echo.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	sshEcho(t, ch, "hello")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.connects != 2 || nil != c.last_err {
+		t.Fatalf("unexpected reconnects:%d %v", c.connects, c.last_err)
+	}
+}
+
+//the concurrent acquires of an idle connection share one connect
+func TestSSHConcurrentConnect(t *testing.T) {
+	setupSSHKnownHosts(t)
+	server := startSSHServer(t, nil)
+	echo := startEchoListener(t)
+	conn := newSSHTestConnection(t, server.Addr().String())
+	c := &sshClientConn{raw: conn, check: make(chan bool, 1)}
+	conn.conns = []*sshClientConn{c}
+	var wg sync.WaitGroup
+	chs := make([]net.Conn, 8)
+	errs := make([]error, 8)
+	for i := range chs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			chs[i], errs[i] = conn.Dial("tcp", echo.Addr().String())
+		}(i)
+	}
+	wg.Wait()
+	client := c.getClient()
+	defer client.Close()
+	for i, ch := range chs {
+		if nil != errs[i] {
+			t.Fatal(errs[i])
+		}
+		defer ch.Close()
+		//the channels are alive, none of them is on a replaced client
+		sshEcho(t, ch, "hello")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.connects != 1 || len(server.serverConns()) != 1 {
+		t.Fatalf("unexpected connects:%d %d", c.connects, len(server.serverConns()))
+	}
+}
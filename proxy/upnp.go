@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zyxar/gsnova/common"
+	"github.com/zyxar/gsnova/misc/upnp"
+)
+
+var upnpMapper *upnp.PortMapper
+
+type upnpStat struct {
+	ExternalIP string
+	Mappings   []upnp.PortMapping
+}
+
+func listenPort(addr string) (int, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if nil != err {
+		return 0, err
+	}
+	return strconv.Atoi(port)
+}
+
+//InitUPnP discovers the gateway and maps the configured local ports on it
+func InitUPnP() error {
+	if enable, exist := common.Cfg.GetIntProperty("UPnP", "Enable"); !exist || enable == 0 {
+		return nil
+	}
+	lease := 3600
+	if v, exist := common.Cfg.GetIntProperty("UPnP", "Lease"); exist && v >= 0 {
+		lease = int(v)
+	}
+	mapper := upnp.NewPortMapper(time.Duration(lease) * time.Second)
+	if err := mapper.Start(); nil != err {
+		return err
+	}
+	upnpMapper = mapper
+	log.Printf("UPnP gateway found, external ip:%s\n", mapper.ExternalIP())
+
+	ports := make([]int, 0)
+	if enable, exist := common.Cfg.GetIntProperty("UPnP", "MapLocalServer"); exist && enable != 0 {
+		if addr, exist := common.Cfg.GetProperty("LocalServer", "Listen"); exist {
+			if port, err := listenPort(addr); nil == err {
+				ports = append(ports, port)
+			}
+		}
+	}
+	if v, exist := common.Cfg.GetProperty("UPnP", "Ports"); exist {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			if len(s) == 0 {
+				continue
+			}
+			if port, err := strconv.Atoi(s); nil == err {
+				ports = append(ports, port)
+			} else {
+				log.Printf("[WARN]Invalid UPnP port:%s\n", s)
+			}
+		}
+	}
+	for _, port := range ports {
+		upnpMapPort(port, "GSnova")
+	}
+	return nil
+}
+
+//upnpMapPort maps the local tcp port to the same port of the gateway and
+//returns the external address
+func upnpMapPort(port int, description string) (string, error) {
+	if nil == upnpMapper {
+		return "", errors.New("UPnP is not enabled")
+	}
+	if err := upnpMapper.Add("TCP", port, port, description); nil != err {
+		log.Printf("[WARN]Failed to map port:%d by UPnP:%v\n", port, err)
+		return "", err
+	}
+	ip := upnpMapper.ExternalIP()
+	if len(ip) == 0 {
+		return "", errors.New("No external ip from UPnP gateway")
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(port)), nil
+}
+
+func upnpStats() *upnpStat {
+	if nil == upnpMapper {
+		return nil
+	}
+	return &upnpStat{upnpMapper.ExternalIP(), upnpMapper.Mappings()}
+}
+
+//StopUPnP removes all mappings from the gateway
+func StopUPnP() {
+	if nil != upnpMapper {
+		upnpMapper.Close()
+	}
+}
@@ -1,9 +1,9 @@
 package remote
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/zyxar/gsnova/event"
+	"github.com/zyxar/gsnova/util"
 )
 
 var port = func() string {
@@ -27,127 +28,26 @@ var port = func() string {
 	return tmpport
 }
 
-type ProxySession struct {
-	closed   bool
-	id       uint32
-	conn     net.Conn
-	addr     string
-	user     string
-	recv_evs chan event.Event
-}
-
-func (serv *ProxySession) closeSession() {
-	serv.closed = true
-	if nil != serv.conn {
-		log.Printf("[%d]Close session", serv.id)
-		serv.conn.Close()
-		serv.conn = nil
-	}
-}
-
-func (serv *ProxySession) initConn(method, addr string) (err error) {
-	if !strings.Contains(addr, ":") {
-		if strings.EqualFold(method, "Connect") {
-			addr = addr + ":443"
-		} else {
-			addr = addr + ":80"
-		}
-	}
-
-	if nil == serv.conn || serv.addr != addr {
-		if nil != serv.conn {
-			serv.conn.Close()
-			serv.conn = nil
-		}
-	}
-	if nil != serv.conn {
-		return nil
-	}
-	serv.addr = addr
-	log.Printf("[%d]Connect remote:%s for method:%s", serv.id, addr, method)
-	serv.conn, err = net.Dial("tcp", addr)
-	if nil == err {
-		//		log.Printf("[%d]Connect remote:%s success", serv.id, addr)
-		go serv.readLoop()
-		//}
-		return nil
-	} else {
-		ev := &event.SocketConnectionEvent{Status: event.TCP_CONN_CLOSED}
-		ev.Addr = addr
-		ev.SetHash(serv.id)
-		offerSendEvent(ev, serv.user)
-		log.Printf("Failed to connect %s for reason:%v\n", addr, err)
-	}
-
-	return err
-}
-
-func (serv *ProxySession) readLoop() {
-	if nil == serv.conn {
-		return
-	}
-	remote := serv.addr
-	var sequence uint32
-	sequence = 0
-	buf := make([]byte, 8*1024)
-	for !serv.closed {
-		if nil == serv.conn {
-			//log.Println("[%d]Null conn.\n", serv.id)
-			break
-		}
-		n, err := serv.conn.Read(buf)
-		if n > 0 {
-			content := make([]byte, n)
-			copy(content, buf[0:n])
-			ev := &event.TCPChunkEvent{Content: content, Sequence: sequence}
-			ev.SetHash(serv.id)
-			offerSendEvent(ev, serv.user)
-			sequence = sequence + 1
-			//log.Printf("[%d]Offer chunk with %d bytes\n", serv.id, n)
-		}
-		if nil != err {
-			break
-		}
-	}
-	ev := &event.SocketConnectionEvent{Status: event.TCP_CONN_CLOSED}
-	ev.Addr = remote
-	ev.SetHash(serv.id)
-	offerSendEvent(ev, serv.user)
-}
-
-func recvEventLoop(user string) {
-	evchan := recv_evs[user]
-	tick := time.NewTicker(10 * time.Millisecond)
-	for {
-		select {
-		case <-tick.C:
-			continue
-		case ev := <-evchan:
-			if nil == ev {
-				return
-			}
-			processRecvEvent(ev, user)
-		}
-	}
-}
-
-var proxySessionMap map[string]map[uint32]*ProxySession = make(map[string]map[uint32]*ProxySession)
-var send_evs map[string][]chan event.Event = make(map[string][]chan event.Event)
-var recv_evs map[string]chan event.Event = make(map[string]chan event.Event)
-var rsock_conns map[string][]net.Conn = make(map[string][]net.Conn)
-var rosck_write_routine_started = false
-
-func processRecvEvent(ev event.Event, user string) {
-	serv := getProxySession(user, ev.GetHash())
+func processRecvEvent(ev event.Event, user *proxyUser) {
+	serv := user.getSession(ev.GetHash())
+	serv.touch()
 	ev = event.ExtractEvent(ev)
 	switch ev.GetType() {
 	case event.EVENT_USER_LOGIN_TYPE:
-		req := ev.(*event.UserLoginEvent)
-		closeProxyUser(req.User)
+		//client restarted, sessions of its last run are useless
+		user.closeSessions()
+		if login, ok := ev.(*event.UserLoginEventV2); ok && len(login.RSocketAddr) > 0 {
+			addr, err := rsocketDialAddr(login.RSocketAddr, user.peerIP())
+			if nil != err {
+				log.Printf("[WARN]Refuse rsocket of user:%s for reason:%v\n", user.name, err)
+				return
+			}
+			startRSocket(user, login.RSocketServer, addr, int(login.RSocketPoolSize), login.RSocketSecret)
+		}
 	case event.EVENT_TCP_CONNECTION_TYPE:
 		req := ev.(*event.SocketConnectionEvent)
 		if req.Status == event.TCP_CONN_CLOSED {
-			deleteProxySession(user, ev.GetHash())
+			user.deleteSession(ev.GetHash())
 		}
 	case event.HTTP_REQUEST_EVENT_TYPE:
 		req := ev.(*event.HTTPRequestEvent)
@@ -155,22 +55,23 @@ func processRecvEvent(ev event.Event, user string) {
 		if nil != err {
 			log.Printf("Failed to init conn for reason:%v\n", err)
 		}
+		conn := serv.getConn()
 		if strings.EqualFold(req.Method, "Connect") {
 			res := &event.TCPChunkEvent{}
 			res.SetHash(ev.GetHash())
-			if nil == serv.conn {
+			if nil == conn {
 				res.Content = []byte("HTTP/1.1 503 ServiceUnavailable\r\n\r\n")
 			} else {
 				res.Content = []byte("HTTP/1.1 200 OK\r\n\r\n")
 				//log.Printf("Return established.\n")
 			}
-			offerSendEvent(res, user)
+			user.offerSendEvent(res, serv.done)
 		} else {
-			if nil != serv.conn {
-				err := req.Write(serv.conn)
+			if nil != conn {
+				err := req.Write(conn)
 				if nil != err {
 					log.Printf("Failed to write http request %v\n", err)
-					deleteProxySession(user, serv.id)
+					user.deleteSession(serv.id)
 					return
 				}
 
@@ -178,287 +79,460 @@ func processRecvEvent(ev event.Event, user string) {
 				res := &event.TCPChunkEvent{}
 				res.SetHash(ev.GetHash())
 				res.Content = []byte("HTTP/1.1 503 ServiceUnavailable\r\n\r\n")
-				offerSendEvent(res, serv.user)
+				user.offerSendEvent(res, serv.done)
 			}
 		}
 	case event.EVENT_TCP_CHUNK_TYPE:
-		if nil == serv.conn {
+		conn := serv.getConn()
+		if nil == conn {
 			//log.Printf("[%d]No session conn %d", ev.GetHash())
-			deleteProxySession(serv.user, serv.id)
+			user.deleteSession(serv.id)
 			return
 		}
 		chunk := ev.(*event.TCPChunkEvent)
 		//.Printf("[%d]Chunk has %d", ev.GetHash(), len(chunk.Content))
-		_, err := serv.conn.Write(chunk.Content)
+		_, err := conn.Write(chunk.Content)
 		if nil != err {
 			log.Printf("Failed to write chunk %v\n", err)
-			serv.closeSession()
+			user.deleteSession(serv.id)
 			return
 		}
 	}
 }
 
-func check_rsock_conn(user, server, addr string, pool_size int) {
-	_, sock_exist := rsock_conns[user]
-	if !sock_exist {
-		rsock_conns[user] = make([]net.Conn, 0)
+//RSocketAllowedNets may be dialed back besides the IP of the client login,
+//e.g. the client is behind NAT, it is set by the env RSOCKET_ALLOWED_NETS as
+//comma separated CIDRs
+var RSocketAllowedNets []*net.IPNet
+
+func parseAllowedNets(s string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if nil != err {
+			log.Printf("[WARN]Invalid rsocket allowed net:%s\n", cidr)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+//rsocketDialAddr resolves the advertised address, the server only dials the
+//IP of the login peer or the allowed nets so that a client can not make it
+//connect anywhere else. The resolved IP is dialed later.
+func rsocketDialAddr(addr, peer string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if nil != err {
+		return "", err
+	}
+	ips, err := net.LookupIP(host)
+	if nil != err {
+		return "", err
+	}
+	peerIP := net.ParseIP(peer)
+	for _, ip := range ips {
+		if ip.Equal(peerIP) {
+			return net.JoinHostPort(ip.String(), port), nil
+		}
+		for _, n := range RSocketAllowedNets {
+			if n.Contains(ip) {
+				return net.JoinHostPort(ip.String(), port), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Rsocket address:%s is neither the login peer:%s nor allowed", addr, peer)
+}
+
+//startRSocket records the address advertised by the client, the server then
+//keeps a pool of connections dialed to the client to carry the events
+func startRSocket(user *proxyUser, server, addr string, pool_size int, secret string) {
+	if pool_size <= 0 {
+		pool_size = 1
+	}
+	if pool_size > maxSendQueues {
+		pool_size = maxSendQueues
+	}
+	user.mutex.Lock()
+	user.rsock_server = server
+	user.rsock_addr = addr
+	user.rsock_pool = pool_size
+	user.rsock_secret = secret
+	started := user.rsock_started
+	if !started {
+		user.rsock_started = true
+		for i := range user.send_evs {
+			go rosck_write_routine(user, i)
+		}
+		user.growSendQueues(1)
+	}
+	user.mutex.Unlock()
+	log.Printf("User:%s advertised rsocket address:%s with pool size:%d\n", user.name, addr, pool_size)
+	if !started {
+		go rsock_keep_routine(user)
+	}
+}
 
+func rsock_keep_routine(user *proxyUser) {
+	tick := time.NewTicker(10 * time.Second)
+	defer tick.Stop()
+	for {
+		check_rsock_conn(user)
+		select {
+		case <-user.done:
+			return
+		case <-tick.C:
+		}
 	}
-	//conn_created := false
-	conns := rsock_conns[user]
-	for len(conns) < pool_size {
-		conn, err := net.Dial("tcp", addr)
+}
+
+func check_rsock_conn(user *proxyUser) {
+	user.mutex.Lock()
+	server, addr, pool_size, secret := user.rsock_server, user.rsock_addr, user.rsock_pool, user.rsock_secret
+	user.mutex.Unlock()
+	for user.rsockConnCount() < pool_size {
+		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
 		if nil != err {
 			log.Printf("Failed to connect %s\n", addr)
 			return
 		}
 		log.Printf("Connect %s success\n", addr)
-		conns = append(conns, conn)
-		rsock_conns[user] = conns
-		go rosck_read_routine(user, conn)
-		_, ok := send_evs[user]
-		if !ok {
-			send_evs[user] = make([]chan event.Event, pool_size)
-			for i, _ := range send_evs[user] {
-				send_evs[user][i] = make(chan event.Event, 1024)
-				go rosck_write_routine(user, i)
-			}
-		}
+		//tell the client which server the connection belongs to
 		accept := &event.RSocketAcceptedEvent{}
 		accept.Server = server
-		send_evs[user][len(conns)-1] <- accept
+		accept.Secret = secret
+		if err = writeLengthPrefixedEvent(conn, accept); nil != err {
+			conn.Close()
+			return
+		}
+		user.addRSockConn(conn)
+		go rosck_read_routine(user, conn)
 	}
 }
 
-func rosck_read_routine(user string, conn net.Conn) {
-	defer conn.Close()
-	readEvent := func(buf *bytes.Buffer, length uint32) (error, event.Event, uint32) {
-		if length == 0 {
-			if buf.Len() > 4 {
-				err := binary.Read(buf, binary.BigEndian, &length)
-				if nil != err {
-					log.Printf("read len error %v\n", err)
-				}
-			} else {
-				return errors.New("Not sufficient space"), nil, 0
-			}
-		}
-		if buf.Len() < int(length) {
-			return errors.New("Not sufficient space"), nil, length
-		}
-		//log.Printf("Read Event length is %d\n", length)
-		err, ev := event.DecodeEvent(buf)
-		return err, ev, 0
+//the same limit as the websocket frames
+const maxLengthPrefixedEvent = 16 * 1024 * 1024
+
+func readLengthPrefixedEvent(reader io.Reader) (error, event.Event) {
+	var length uint32
+	if err := binary.Read(reader, binary.BigEndian, &length); nil != err {
+		return err, nil
 	}
-	decodebuf := &(bytes.Buffer{})
-	tmpbuf := make([]byte, 8192)
-	var lastEvLength uint32
-	lastEvLength = 0
+	if length > maxLengthPrefixedEvent {
+		return fmt.Errorf("Too large event:%d", length), nil
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(reader, content); nil != err {
+		return err, nil
+	}
+	return event.DecodeEvent(bytes.NewBuffer(content))
+}
+
+func writeLengthPrefixedEvent(writer io.Writer, ev event.Event) error {
+	var buf bytes.Buffer
+	event.EncodeEvent(&buf, ev)
+	var data bytes.Buffer
+	binary.Write(&data, binary.BigEndian, uint32(buf.Len()))
+	data.Write(buf.Bytes())
+	_, err := writer.Write(data.Bytes())
+	return err
+}
+
+func rosck_read_routine(user *proxyUser, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
 	for {
-		n, err := conn.Read(tmpbuf)
+		err, ev := readLengthPrefixedEvent(reader)
 		if nil != err {
 			break
 		}
-		decodebuf.Write(tmpbuf[0:n])
-		var ev event.Event
-		for decodebuf.Len() > 0 {
-			err, ev, lastEvLength = readEvent(decodebuf, lastEvLength)
-			if nil != err {
-				//log.Printf("Failed to read decode event: %v\n", err)
-				break
-			}
-			processRecvEvent(ev, user)
-		}
-		if decodebuf.Len() == 0 {
-			decodebuf.Reset()
-		}
-	}
-	conns := rsock_conns[user]
-	for i, it := range conns {
-		if conn == it {
-			conns = append(conns[:i], conns[i+1:]...)
-			rsock_conns[user] = conns
+		if err = user.offerRecvEvent(ev); nil != err {
 			break
 		}
 	}
-	//delete(rsock_conns, user)
+	user.removeRSockConn(conn)
 }
 
-func rosck_write_routine(user string, index int) {
-	send_ev := send_evs[user][index]
+func rosck_write_routine(user *proxyUser, index int) {
+	send_ev := user.sendChannel(index)
 	for {
 		select {
+		case <-user.done:
+			return
 		case ev := <-send_ev:
-			conns, ok := rsock_conns[user]
-			if !ok {
-				continue
-			}
 			if nil == ev {
-				return
-			}
-			var buf bytes.Buffer
-			event.EncodeEvent(&buf, ev)
-			length := uint32(buf.Len())
-			conn := conns[int(ev.GetHash())%len(conns)]
-			er := binary.Write(conn, binary.BigEndian, &length)
-			if nil != er {
-				log.Printf("write len error %v\n", er)
+				continue
 			}
-			//log.Printf("Write Event length is %d\n", length)
-			_, err := conn.Write(buf.Bytes())
-			if nil != err {
-
+			for {
+				conn := user.selectRSockConn(ev.GetHash())
+				if nil != conn {
+					err := writeLengthPrefixedEvent(conn, ev)
+					if nil == err {
+						break
+					}
+					log.Printf("Failed to write rsocket for reason:%v\n", err)
+					conn.Close()
+					user.removeRSockConn(conn)
+					continue
+				}
+				//wait the keeper to dial again
+				select {
+				case <-user.done:
+					return
+				case <-time.After(100 * time.Millisecond):
+				}
 			}
 		}
 	}
 }
 
-func closeProxyUser(name string) {
-	sessions, exist := proxySessionMap[name]
-	if exist {
-		for _, sess := range sessions {
-			sess.closeSession()
+//C4MiscInfo is '<index>_<timeout>' sent by the push/pull workers
+func parseC4MiscInfo(req *http.Request) (idx int, timeout int, err error) {
+	timeout = 25
+	fmt.Sscanf(req.Header.Get("C4MiscInfo"), "%d_%d", &idx, &timeout)
+	if idx < 0 || idx >= maxSendQueues {
+		err = errInvalidQueue
+	}
+	if timeout <= 0 {
+		timeout = 25
+	}
+	return
+}
+
+func decodeRecvEvents(buf *bytes.Buffer, user *proxyUser) error {
+	for buf.Len() > 0 {
+		err, ev := event.DecodeEvent(buf)
+		if nil != err {
+			log.Printf("Decode event  error:%v", err)
+			return err
+		}
+		if err = user.offerRecvEvent(ev); nil != err {
+			return err
 		}
-		delete(proxySessionMap, name)
 	}
-	//	evchans, exist := send_evs[name]
-	//	if exist {
-	//		//close(evchan)
-	//		//delete(send_evs, name)
-	//	}
+	return nil
 }
 
-func sessionExist(name string, sessionID uint32) bool {
-	_, exist := proxySessionMap[name]
-	if exist {
-		_, exist := proxySessionMap[name][sessionID]
-		if exist {
-			return true
+//writeSendEvents writes the events taken from the queue idx, the unwritten
+//ones are held for the next fetcher of the queue
+func writeSendEvents(user *proxyUser, idx int, writer io.Writer, evs ...event.Event) error {
+	for i, ev := range evs {
+		if nil == ev || !user.sessionExist(ev.GetHash()) {
+			continue
+		}
+		if err := writeLengthPrefixedEvent(writer, ev); nil != err {
+			user.holdSendEvents(idx, evs[i:])
+			return err
 		}
 	}
-	return false
+	return nil
 }
 
-func deleteProxySession(name string, sessionID uint32) {
-	sessions, exist := proxySessionMap[name]
-	if exist {
-		sess, exist := proxySessionMap[name][sessionID]
-		if exist {
-			sess.closeSession()
-			delete(sessions, sessionID)
+//encode events until the buffer is large enough, the channel has nothing
+//ready or the user is closed
+func drainSendEvents(user *proxyUser, send_ev chan event.Event, buf *bytes.Buffer, limit int) {
+	for buf.Len() < limit {
+		select {
+		case ev := <-send_ev:
+			if nil != ev && user.sessionExist(ev.GetHash()) {
+				event.EncodeEvent(buf, ev)
+			}
+		default:
+			return
 		}
 	}
 }
 
-func offerSendEvent(ev event.Event, user string) {
-	switch ev.GetType() {
-	case event.EVENT_TCP_CHUNK_TYPE:
-		var compress event.CompressEventV2
-		compress.SetHash(ev.GetHash())
-		compress.Ev = ev
-		compress.CompressType = event.COMPRESSOR_SNAPPY
-		ev = &compress
-	}
-	var encrypt event.EncryptEventV2
-	encrypt.SetHash(ev.GetHash())
-	encrypt.EncryptType = event.ENCRYPTER_SE1
-	encrypt.Ev = ev
-	ev = &encrypt
-	idx := int(ev.GetHash()) % len(send_evs[user])
-	send_evs[user][idx] <- ev
+//PushCallback receives the events written by the client push workers
+func PushCallback(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	idx, _, err := parseC4MiscInfo(req)
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user := sessionMgr.getUser(req.Header.Get("UserToken"), idx+1)
+	user.setPeer(req.RemoteAddr)
+	if err = decodeRecvEvents(bytes.NewBuffer(body), user); nil != err {
+		//tell the client to retry later
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(200)
 }
 
-func getProxySession(name string, sessionID uint32) *ProxySession {
-	_, exist := proxySessionMap[name]
-	if !exist {
-		proxySessionMap[name] = make(map[uint32]*ProxySession)
+//PullCallback streams events to the client pull worker as 4 byte length
+//prefixed chunks until the timeout in C4MiscInfo expires
+func PullCallback(w http.ResponseWriter, req *http.Request) {
+	io.Copy(ioutil.Discard, req.Body)
+	idx, timeout, err := parseC4MiscInfo(req)
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	sess, exist := proxySessionMap[name][sessionID]
-	if !exist {
-		sess = &ProxySession{closed: false, id: sessionID, user: name, recv_evs: make(chan event.Event, 4096)}
-		proxySessionMap[name][sessionID] = sess
+	user := sessionMgr.getUser(req.Header.Get("UserToken"), idx+1)
+	send_ev := user.sendChannel(idx)
+	flusher, _ := w.(http.Flusher)
+	var closeNotify <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closeNotify = notifier.CloseNotify()
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(200)
+	//the events failed to write to the last fetcher go first
+	if err = writeSendEvents(user, idx, w, user.takeHeldEvents(idx)...); nil != err {
+		log.Printf("Failed to write pull response for reason:%v\n", err)
+		return
+	}
+	if nil != flusher {
+		flusher.Flush()
+	}
+	//finish a little earlier than the client read timeout
+	deadline := time.After(time.Duration(timeout)*time.Second - 500*time.Millisecond)
+	for {
+		select {
+		case <-deadline:
+			return
+		case <-closeNotify:
+			return
+		case <-user.done:
+			return
+		case ev := <-send_ev:
+			user.touch()
+			if err := writeSendEvents(user, idx, w, ev); nil != err {
+				log.Printf("Failed to write pull response for reason:%v\n", err)
+				return
+			}
+			if nil != flusher {
+				flusher.Flush()
+			}
+		}
 	}
-	return sess
 }
 
 func InvokeCallback(w http.ResponseWriter, req *http.Request) {
 	body, err := ioutil.ReadAll(req.Body)
 	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	user := req.Header.Get("UserToken")
 	index := req.Header.Get("FetcherIndex")
 	if len(index) == 0 {
 		index = "0:1"
 	}
 	var idx, poolSize uint32
 	fmt.Sscanf(index, "%d:%d", &idx, &poolSize)
-	send_ev_array, exist := send_evs[user]
-	if !exist {
-		send_evs[user] = make([]chan event.Event, poolSize)
-		for i, _ := range send_evs[user] {
-			send_evs[user][i] = make(chan event.Event, 1024)
-		}
-	}
-	recv_ev, ok := recv_evs[user]
-	if !ok {
-		recv_ev = make(chan event.Event, 4096)
-		recv_evs[user] = recv_ev
-		go recvEventLoop(user)
+	if idx >= maxSendQueues || poolSize > maxSendQueues {
+		http.Error(w, errInvalidQueue.Error(), http.StatusBadRequest)
+		return
 	}
+	user := sessionMgr.getUser(req.Header.Get("UserToken"), int(poolSize))
+	user.setPeer(req.RemoteAddr)
+	send_ev := user.sendChannel(int(idx))
 	//log.Printf("#####%d\n",len(body))
-	buf := bytes.NewBuffer(body)
-	for {
-		if buf.Len() == 0 {
-			break
-		}
-		err, ev := event.DecodeEvent(buf)
-		if nil != err {
-			log.Printf("Decode event  error:%v", err)
-			break
-		}
-		recv_ev <- ev
-		//recv_evs[]
-		//getProxySession(user, ev.GetHash()).recv_evs <- ev
+	if err = decodeRecvEvents(bytes.NewBuffer(body), user); nil != err {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	}
 	var send_content bytes.Buffer
-	start := time.Now().UnixNano()
-	tick := time.NewTicker(10 * time.Millisecond)
-	expectedData := true
-	for expectedData {
-		select {
-		case <-tick.C:
-			if time.Now().UnixNano()-start >= 100000*1000 {
-				expectedData = false
-				break
-			}
-			continue
-		case ev := <-send_ev_array[idx]:
-			if nil == ev {
-				expectedData = false
-				break
-			}
-			if sessionExist(user, ev.GetHash()) {
-				event.EncodeEvent(&send_content, ev)
-			}
-			if send_content.Len() >= 16*1024 {
-				expectedData = false
-				break
-			}
+	timer := time.NewTimer(100 * time.Second)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-user.done:
+	case ev := <-send_ev:
+		if nil != ev && user.sessionExist(ev.GetHash()) {
+			event.EncodeEvent(&send_content, ev)
 		}
+		//take what is ready without waiting again
+		drainSendEvents(user, send_ev, &send_content, 16*1024)
 	}
 	//strconv.Itoa()
 	w.Header().Set("Content-Length", strconv.Itoa(send_content.Len()))
 	w.Write(send_content.Bytes())
 }
 
+//WebsocketInvokeCallback serves the websocket client, every binary message
+//carries 4 byte length prefixed events in both directions
+func WebsocketInvokeCallback(w http.ResponseWriter, req *http.Request) {
+	name := req.Header.Get("UserToken")
+	idx, _ := strconv.Atoi(req.Header.Get("ConnectionIndex"))
+	if idx < 0 || idx >= maxSendQueues {
+		http.Error(w, errInvalidQueue.Error(), http.StatusBadRequest)
+		return
+	}
+	ws, err := util.WebSocketUpgrade(w, req)
+	if nil != err {
+		log.Printf("Failed to upgrade websocket for reason:%v\n", err)
+		return
+	}
+	defer ws.Close()
+	user := sessionMgr.getUser(name, idx+1)
+	user.setPeer(req.RemoteAddr)
+	send_ev := user.sendChannel(idx)
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+		for {
+			err, ev := readLengthPrefixedEvent(ws)
+			if nil != err {
+				if err != io.EOF {
+					log.Printf("Failed to read websocket for reason:%v\n", err)
+				}
+				return
+			}
+			if err = user.offerRecvEvent(ev); nil != err {
+				return
+			}
+		}
+	}()
+	if err = writeSendEvents(user, idx, ws, user.takeHeldEvents(idx)...); nil != err {
+		log.Printf("Failed to write websocket for reason:%v\n", err)
+		return
+	}
+	for {
+		select {
+		case <-closed:
+			return
+		case <-user.done:
+			return
+		case ev := <-send_ev:
+			user.touch()
+			if err := writeSendEvents(user, idx, ws, ev); nil != err {
+				log.Printf("Failed to write websocket for reason:%v\n", err)
+				return
+			}
+		}
+	}
+}
+
 // hello world, the web server
 func IndexCallback(w http.ResponseWriter, req *http.Request) {
+	//websocket clients may use any path, e.g. behind a CDN or reverse proxy
+	if util.IsWebSocketRequest(req) {
+		WebsocketInvokeCallback(w, req)
+		return
+	}
 	io.WriteString(w, html)
 }
 
 func LaunchC4HttpServer() {
 	http.HandleFunc("/", IndexCallback)
 	http.HandleFunc("/invoke", InvokeCallback)
+	http.HandleFunc("/push", PushCallback)
+	http.HandleFunc("/pull", PullCallback)
+	http.HandleFunc("/ws", WebsocketInvokeCallback)
+	RSocketAllowedNets = parseAllowedNets(os.Getenv("RSOCKET_ALLOWED_NETS"))
+	go sessionMgr.reapLoop()
 	err := http.ListenAndServe(":"+port(), nil)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err.Error())
@@ -0,0 +1,293 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zyxar/gsnova/event"
+	"github.com/zyxar/gsnova/util"
+)
+
+func TestParseC4MiscInfo(t *testing.T) {
+	for misc, expected := range map[string]struct {
+		idx, timeout int
+		valid        bool
+	}{
+		"":            {0, 25, true},
+		"2_10":        {2, 10, true},
+		"63_0":        {63, 25, true},
+		"64_1":        {64, 1, false},
+		"100000000_1": {100000000, 1, false},
+		"-1_1":        {-1, 1, false},
+	} {
+		req, _ := http.NewRequest("POST", "/pull", nil)
+		req.Header.Set("C4MiscInfo", misc)
+		idx, timeout, err := parseC4MiscInfo(req)
+		if idx != expected.idx || timeout != expected.timeout || (nil == err) != expected.valid {
+			t.Fatalf("%q:unexpected %d %d %v", misc, idx, timeout, err)
+		}
+	}
+}
+
+//the fetchers with a huge index are rejected before any queue is made
+func TestInvalidFetcherIndex(t *testing.T) {
+	server := startC4Server()
+	defer server.Close()
+	user := sessionMgr.getUser("index-user", 1)
+	if err := pullQueue(server.URL, "index-user", "100000000_1", nil); nil == err || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("unexpected pull result:%v", err)
+	}
+	req, _ := http.NewRequest("POST", server.URL+"/push", nil)
+	req.Header.Set("UserToken", "index-user")
+	req.Header.Set("C4MiscInfo", "64_1")
+	if res, err := http.DefaultClient.Do(req); nil != err || res.StatusCode != 400 {
+		t.Fatalf("unexpected push result:%v", err)
+	}
+	for _, header := range []string{"FetcherIndex", "ConnectionIndex"} {
+		req = httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("UserToken", "index-user")
+		req.Header.Set(header, "100000000")
+		handler := InvokeCallback
+		if header == "ConnectionIndex" {
+			handler = WebsocketInvokeCallback
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != 400 {
+			t.Fatalf("%s:unexpected status %d", header, w.Code)
+		}
+	}
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	if len(user.send_evs) != 1 {
+		t.Fatalf("unexpected queues:%d", len(user.send_evs))
+	}
+	user.growSendQueues(100000000)
+	if len(user.send_evs) != maxSendQueues {
+		t.Fatalf("the queues are not bounded:%d", len(user.send_evs))
+	}
+}
+
+func offerChunks(user *proxyUser, content string, ids ...uint32) {
+	for _, id := range ids {
+		user.getSession(id)
+		ev := &event.TCPChunkEvent{Content: []byte(fmt.Sprintf("%s%d", content, id))}
+		ev.SetHash(id)
+		user.offerSendEvent(ev, nil)
+	}
+}
+
+//the events of a session always go through the same queue
+func TestSendQueueRouting(t *testing.T) {
+	server := startC4Server()
+	defer server.Close()
+	user := sessionMgr.getUser("routing-user", 3)
+	offerChunks(user, "chunk", 1, 2, 3, 4, 5, 6, 7)
+	for idx, expected := range [][]uint32{{3, 6}, {1, 4, 7}, {2, 5}} {
+		var ids []uint32
+		err := pullQueue(server.URL, "routing-user", fmt.Sprintf("%d_1", idx), func(ev event.Event) {
+			ids = append(ids, ev.GetHash())
+		})
+		if nil != err {
+			t.Fatal(err)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		if fmt.Sprint(ids) != fmt.Sprint(expected) {
+			t.Fatalf("queue %d:unexpected sessions %v", idx, ids)
+		}
+	}
+}
+
+type failWriter struct {
+	left int
+}
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if w.left < len(p) {
+		return 0, errors.New("broken pipe")
+	}
+	w.left -= len(p)
+	return len(p), nil
+}
+
+//the events taken by a broken fetcher are sent by the next one first
+func TestHeldSendEvents(t *testing.T) {
+	server := startC4Server()
+	defer server.Close()
+	user := sessionMgr.getUser("held-user", 1)
+	offerChunks(user, "first", 1, 2)
+	var evs []event.Event
+	for i := 0; i < 2; i++ {
+		evs = append(evs, <-user.sendChannel(0))
+	}
+	//the first event is written, the second is held
+	var first bytes.Buffer
+	writeLengthPrefixedEvent(&first, evs[0])
+	if err := writeSendEvents(user, 0, &failWriter{left: first.Len()}, evs...); nil == err {
+		t.Fatal("the write should fail")
+	}
+	offerChunks(user, "second", 1)
+
+	var contents []string
+	handler := func(ev event.Event) {
+		contents = append(contents, string(ev.(*event.TCPChunkEvent).Content))
+	}
+	if err := pullQueue(server.URL, "held-user", "0_1", handler); nil != err {
+		t.Fatal(err)
+	}
+	if strings.Join(contents, ",") != "first2,second1" {
+		t.Fatalf("unexpected events:%v", contents)
+	}
+
+	//the websocket fetcher sends the held events too
+	offerChunks(user, "third", 2)
+	evs = []event.Event{<-user.sendChannel(0)}
+	writeSendEvents(user, 0, &failWriter{}, evs...)
+	offerChunks(user, "fourth", 1)
+	wsServer := httptest.NewServer(http.HandlerFunc(IndexCallback))
+	defer wsServer.Close()
+	u, _ := url.Parse(strings.Replace(wsServer.URL, "http", "ws", 1))
+	header := make(http.Header)
+	header.Set("UserToken", "held-user")
+	header.Set("ConnectionIndex", "0")
+	ws, err := util.WebSocketDial(u, header, nil, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	contents = nil
+	for len(contents) < 2 {
+		err, ev := readLengthPrefixedEvent(ws)
+		if nil != err {
+			t.Fatal(err)
+		}
+		handler(event.ExtractEvent(ev))
+	}
+	if strings.Join(contents, ",") != "third2,fourth1" {
+		t.Fatalf("unexpected events:%v", contents)
+	}
+}
+
+func TestRSocketDialAddr(t *testing.T) {
+	defer func(nets []*net.IPNet) {
+		RSocketAllowedNets = nets
+	}(RSocketAllowedNets)
+	RSocketAllowedNets = parseAllowedNets("10.0.0.0/8, invalid, ::1/128")
+	if len(RSocketAllowedNets) != 2 {
+		t.Fatalf("unexpected allowed nets:%v", RSocketAllowedNets)
+	}
+	for _, c := range []struct {
+		addr, peer, expected string
+	}{
+		{"1.2.3.4:48105", "1.2.3.4", "1.2.3.4:48105"},
+		{"10.1.2.3:48105", "1.2.3.4", "10.1.2.3:48105"},
+		{"[::1]:48105", "1.2.3.4", "[::1]:48105"},
+		//the server must not be made to connect any other host
+		{"169.254.169.254:80", "1.2.3.4", ""},
+		{"127.0.0.1:6379", "1.2.3.4", ""},
+		{"1.2.3.4", "1.2.3.4", ""},
+	} {
+		addr, err := rsocketDialAddr(c.addr, c.peer)
+		if addr != c.expected || (nil == err) != (len(c.expected) > 0) {
+			t.Fatalf("%s:unexpected %s %v", c.addr, addr, err)
+		}
+	}
+}
+
+//the length prefix is checked before the content is allocated
+func TestReadLengthPrefixedEventLimit(t *testing.T) {
+	ev := &event.TCPChunkEvent{Content: []byte("hello")}
+	var buf bytes.Buffer
+	if err := writeLengthPrefixedEvent(&buf, ev); nil != err {
+		t.Fatal(err)
+	}
+	if err, res := readLengthPrefixedEvent(&buf); nil != err || string(res.(*event.TCPChunkEvent).Content) != "hello" {
+		t.Fatalf("unexpected event:%v %v", res, err)
+	}
+	for _, length := range []uint32{0xFFFFFFFF, maxLengthPrefixedEvent + 1} {
+		header := []byte{byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)}
+		if err, _ := readLengthPrefixedEvent(bytes.NewReader(header)); nil == err || err == io.ErrUnexpectedEOF {
+			t.Fatalf("the length %d is accepted:%v", length, err)
+		}
+	}
+}
+
+func readRSocketEvent(t *testing.T, reader io.Reader) event.Event {
+	err, ev := readLengthPrefixedEvent(reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return event.ExtractEvent(ev)
+}
+
+//the server dials the login peer back, echoes the secret and carries the
+//events of the sessions over the connection
+func TestRSocketHandshake(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	server := startC4Server()
+	defer server.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	login := &event.UserLoginEventV2{User: "rsocket-user", RSocketAddr: l.Addr().String()}
+	login.RSocketServer, login.RSocketPoolSize, login.RSocketSecret = "node", 1, "secret"
+	if err = pushEvents(server.URL, "rsocket-user", login); nil != err {
+		t.Fatal(err)
+	}
+	user := sessionMgr.findUser("rsocket-user")
+	defer user.close()
+	c, err := l.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(c)
+	accept, ok := readRSocketEvent(t, reader).(*event.RSocketAcceptedEvent)
+	if !ok || accept.Server != "node" || accept.Secret != "secret" {
+		t.Fatalf("unexpected accepted event:%v", accept)
+	}
+
+	req := &event.HTTPRequestEvent{Method: "CONNECT", Url: echo.Addr().String()}
+	req.SetHeader("Host", echo.Addr().String())
+	req.SetHash(5)
+	writeLengthPrefixedEvent(c, req)
+	if chunk, ok := readRSocketEvent(t, reader).(*event.TCPChunkEvent); !ok || chunk.GetHash() != 5 || !strings.Contains(string(chunk.Content), "200 OK") {
+		t.Fatalf("unexpected response:%v", chunk)
+	}
+	data := &event.TCPChunkEvent{Content: []byte("hello")}
+	data.SetHash(5)
+	writeLengthPrefixedEvent(c, data)
+	if chunk, ok := readRSocketEvent(t, reader).(*event.TCPChunkEvent); !ok || chunk.GetHash() != 5 || string(chunk.Content) != "hello" {
+		t.Fatalf("unexpected echo:%v", chunk)
+	}
+
+	//another host is not dialed
+	login = &event.UserLoginEventV2{User: "rsocket-other", RSocketAddr: "169.254.169.254:80", RSocketPoolSize: 1}
+	if err = pushEvents(server.URL, "rsocket-other", login); nil != err {
+		t.Fatal(err)
+	}
+	other := sessionMgr.findUser("rsocket-other")
+	defer other.close()
+	time.Sleep(100 * time.Millisecond)
+	other.mutex.Lock()
+	defer other.mutex.Unlock()
+	if other.rsock_started {
+		t.Fatal("rsocket is started for another host")
+	}
+}
@@ -0,0 +1,497 @@
+package remote
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zyxar/gsnova/event"
+)
+
+//SessionIdleTimeout closes proxy sessions without any traffic, UserIdleTimeout
+//drops users which have no session left and no fetcher polling
+var SessionIdleTimeout = 5 * time.Minute
+var UserIdleTimeout = 30 * time.Minute
+
+//QueueOfferTimeout bounds how long a producer is blocked on a full queue
+var QueueOfferTimeout = 30 * time.Second
+
+const (
+	sendQueueSize = 1024
+	recvQueueSize = 4096
+	//bound of the fetcher index and pool size told by the clients
+	maxSendQueues = 64
+)
+
+var errQueueFull = errors.New("Event queue is full")
+var errUserClosed = errors.New("User is closed")
+var errInvalidQueue = errors.New("Invalid fetcher index")
+
+type ProxySession struct {
+	id     uint32
+	user   *proxyUser
+	mutex  sync.Mutex
+	conn   net.Conn
+	addr   string
+	closed bool
+	done   chan struct{}
+	active int64
+}
+
+func (serv *ProxySession) touch() {
+	atomic.StoreInt64(&serv.active, time.Now().UnixNano())
+}
+
+func (serv *ProxySession) idleTime(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&serv.active)))
+}
+
+func (serv *ProxySession) getConn() net.Conn {
+	serv.mutex.Lock()
+	defer serv.mutex.Unlock()
+	return serv.conn
+}
+
+func (serv *ProxySession) closeSession() {
+	serv.mutex.Lock()
+	if !serv.closed {
+		serv.closed = true
+		close(serv.done)
+	}
+	c := serv.conn
+	serv.conn = nil
+	serv.mutex.Unlock()
+	if nil != c {
+		log.Printf("[%d]Close session", serv.id)
+		c.Close()
+	}
+}
+
+func (serv *ProxySession) initConn(method, addr string) (err error) {
+	if !strings.Contains(addr, ":") {
+		if strings.EqualFold(method, "Connect") {
+			addr = addr + ":443"
+		} else {
+			addr = addr + ":80"
+		}
+	}
+	serv.mutex.Lock()
+	defer serv.mutex.Unlock()
+	if serv.closed {
+		return errors.New("Session closed")
+	}
+	if nil != serv.conn && serv.addr != addr {
+		serv.conn.Close()
+		serv.conn = nil
+	}
+	if nil != serv.conn {
+		return nil
+	}
+	serv.addr = addr
+	log.Printf("[%d]Connect remote:%s for method:%s", serv.id, addr, method)
+	var c net.Conn
+	c, err = net.Dial("tcp", addr)
+	if nil == err {
+		serv.conn = c
+		serv.touch()
+		go serv.readLoop(c, addr)
+		return nil
+	}
+	ev := &event.SocketConnectionEvent{Status: event.TCP_CONN_CLOSED}
+	ev.Addr = addr
+	ev.SetHash(serv.id)
+	go serv.user.offerSendEvent(ev, nil)
+	log.Printf("Failed to connect %s for reason:%v\n", addr, err)
+	return err
+}
+
+func (serv *ProxySession) readLoop(conn net.Conn, remote string) {
+	var sequence uint32
+	buf := make([]byte, 8*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			serv.touch()
+			content := make([]byte, n)
+			copy(content, buf[0:n])
+			ev := &event.TCPChunkEvent{Content: content, Sequence: sequence}
+			ev.SetHash(serv.id)
+			//blocks while the client is not fetching, which stops reading the remote
+			if oerr := serv.user.offerSendEvent(ev, serv.done); nil != oerr {
+				log.Printf("[%d]Failed to offer chunk for reason:%v\n", serv.id, oerr)
+				break
+			}
+			sequence = sequence + 1
+		}
+		if nil != err {
+			break
+		}
+	}
+	conn.Close()
+	serv.mutex.Lock()
+	current := serv.conn == conn
+	if current {
+		serv.conn = nil
+	}
+	serv.mutex.Unlock()
+	if !current {
+		//replaced by a connection to another address
+		return
+	}
+	ev := &event.SocketConnectionEvent{Status: event.TCP_CONN_CLOSED}
+	ev.Addr = remote
+	ev.SetHash(serv.id)
+	serv.user.offerSendEvent(ev, nil)
+}
+
+type proxyUser struct {
+	name     string
+	mutex    sync.Mutex
+	sessions map[uint32]*ProxySession
+	send_evs []chan event.Event
+	//events taken from the send queues whose write failed
+	send_held   [][]event.Event
+	recv_ev     chan event.Event
+	rsock_conns []net.Conn
+	//IP of the last fetcher, the login comes from it
+	peer_ip string
+	//reverse socket address advertised by the client login
+	rsock_server  string
+	rsock_addr    string
+	rsock_pool    int
+	rsock_secret  string
+	rsock_started bool
+	done          chan struct{}
+	closed        bool
+	active        int64
+}
+
+func newProxyUser(name string) *proxyUser {
+	user := &proxyUser{name: name}
+	user.sessions = make(map[uint32]*ProxySession)
+	user.recv_ev = make(chan event.Event, recvQueueSize)
+	user.done = make(chan struct{})
+	user.touch()
+	return user
+}
+
+func (user *proxyUser) setPeer(remoteAddr string) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if nil != err {
+		host = remoteAddr
+	}
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	user.peer_ip = host
+}
+
+func (user *proxyUser) peerIP() string {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	return user.peer_ip
+}
+
+func (user *proxyUser) touch() {
+	atomic.StoreInt64(&user.active, time.Now().UnixNano())
+}
+
+func (user *proxyUser) idleTime(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&user.active)))
+}
+
+func (user *proxyUser) getSession(id uint32) *ProxySession {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	sess, exist := user.sessions[id]
+	if !exist {
+		sess = &ProxySession{id: id, user: user, done: make(chan struct{})}
+		sess.touch()
+		user.sessions[id] = sess
+	}
+	return sess
+}
+
+func (user *proxyUser) sessionExist(id uint32) bool {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	_, exist := user.sessions[id]
+	return exist
+}
+
+func (user *proxyUser) sessionCount() int {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	return len(user.sessions)
+}
+
+func (user *proxyUser) deleteSession(id uint32) {
+	user.mutex.Lock()
+	sess, exist := user.sessions[id]
+	if exist {
+		delete(user.sessions, id)
+	}
+	user.mutex.Unlock()
+	if exist {
+		sess.closeSession()
+	}
+}
+
+func (user *proxyUser) closeSessions() {
+	user.mutex.Lock()
+	sessions := user.sessions
+	user.sessions = make(map[uint32]*ProxySession)
+	user.mutex.Unlock()
+	for _, sess := range sessions {
+		sess.closeSession()
+	}
+}
+
+//send queue serving the fetcher with the given index, the queue array grows
+//on demand since push/pull and websocket clients do not tell the pool size
+func (user *proxyUser) sendChannel(idx int) chan event.Event {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	user.growSendQueues(idx + 1)
+	return user.send_evs[idx]
+}
+
+//caller must hold the mutex, the queues never exceed maxSendQueues
+func (user *proxyUser) growSendQueues(n int) {
+	if n > maxSendQueues {
+		n = maxSendQueues
+	}
+	for len(user.send_evs) < n {
+		user.send_evs = append(user.send_evs, make(chan event.Event, sendQueueSize))
+		user.send_held = append(user.send_held, nil)
+		if user.rsock_started {
+			//every queue needs a writer in reverse socket mode
+			go rosck_write_routine(user, len(user.send_evs)-1)
+		}
+	}
+}
+
+//holdSendEvents keeps the events of the queue idx for its next fetcher
+func (user *proxyUser) holdSendEvents(idx int, evs []event.Event) {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	user.growSendQueues(idx + 1)
+	user.send_held[idx] = append(user.send_held[idx], evs...)
+}
+
+func (user *proxyUser) takeHeldEvents(idx int) []event.Event {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	if idx >= len(user.send_held) {
+		return nil
+	}
+	evs := user.send_held[idx]
+	user.send_held[idx] = nil
+	return evs
+}
+
+func wrapSendEvent(ev event.Event) event.Event {
+	switch ev.GetType() {
+	case event.EVENT_TCP_CHUNK_TYPE:
+		var compress event.CompressEventV2
+		compress.SetHash(ev.GetHash())
+		compress.Ev = ev
+		compress.CompressType = event.COMPRESSOR_SNAPPY
+		ev = &compress
+	}
+	var encrypt event.EncryptEventV2
+	encrypt.SetHash(ev.GetHash())
+	encrypt.EncryptType = event.ENCRYPTER_SE1
+	encrypt.Ev = ev
+	return &encrypt
+}
+
+//offerSendEvent queues an event for the client, it blocks while the queue is
+//full until cancel is closed, the user is closed or QueueOfferTimeout expires
+func (user *proxyUser) offerSendEvent(ev event.Event, cancel <-chan struct{}) error {
+	ev = wrapSendEvent(ev)
+	user.mutex.Lock()
+	user.growSendQueues(1)
+	ch := user.send_evs[int(ev.GetHash())%len(user.send_evs)]
+	user.mutex.Unlock()
+	select {
+	case ch <- ev:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(QueueOfferTimeout)
+	defer timer.Stop()
+	select {
+	case ch <- ev:
+		return nil
+	case <-cancel:
+		return errors.New("Session closed")
+	case <-user.done:
+		return errUserClosed
+	case <-timer.C:
+		return errQueueFull
+	}
+}
+
+//offerRecvEvent hands an event from the client to the user event loop, it
+//blocks the fetcher while the loop is busy
+func (user *proxyUser) offerRecvEvent(ev event.Event) error {
+	user.touch()
+	timer := time.NewTimer(QueueOfferTimeout)
+	defer timer.Stop()
+	select {
+	case user.recv_ev <- ev:
+		return nil
+	case <-user.done:
+		return errUserClosed
+	case <-timer.C:
+		return errQueueFull
+	}
+}
+
+func (user *proxyUser) recvEventLoop() {
+	for {
+		select {
+		case <-user.done:
+			return
+		case ev := <-user.recv_ev:
+			if nil != ev {
+				processRecvEvent(ev, user)
+			}
+		}
+	}
+}
+
+func (user *proxyUser) addRSockConn(conn net.Conn) int {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	user.rsock_conns = append(user.rsock_conns, conn)
+	return len(user.rsock_conns)
+}
+
+func (user *proxyUser) removeRSockConn(conn net.Conn) {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	for i, it := range user.rsock_conns {
+		if conn == it {
+			user.rsock_conns = append(user.rsock_conns[:i], user.rsock_conns[i+1:]...)
+			break
+		}
+	}
+}
+
+func (user *proxyUser) rsockConnCount() int {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	return len(user.rsock_conns)
+}
+
+func (user *proxyUser) selectRSockConn(hash uint32) net.Conn {
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	if len(user.rsock_conns) == 0 {
+		return nil
+	}
+	return user.rsock_conns[int(hash)%len(user.rsock_conns)]
+}
+
+func (user *proxyUser) close() {
+	user.mutex.Lock()
+	if user.closed {
+		user.mutex.Unlock()
+		return
+	}
+	user.closed = true
+	close(user.done)
+	conns := user.rsock_conns
+	user.rsock_conns = nil
+	user.mutex.Unlock()
+	user.closeSessions()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+type sessionManager struct {
+	mutex sync.Mutex
+	users map[string]*proxyUser
+}
+
+var sessionMgr = &sessionManager{users: make(map[string]*proxyUser)}
+
+//getUser returns the user with at least poolSize send queues, a new user
+//starts its event loop
+func (m *sessionManager) getUser(name string, poolSize int) *proxyUser {
+	m.mutex.Lock()
+	user, exist := m.users[name]
+	if !exist {
+		user = newProxyUser(name)
+		m.users[name] = user
+		go user.recvEventLoop()
+	}
+	m.mutex.Unlock()
+	if poolSize > maxSendQueues {
+		poolSize = maxSendQueues
+	}
+	if poolSize > 0 {
+		user.sendChannel(poolSize - 1)
+	}
+	user.touch()
+	return user
+}
+
+func (m *sessionManager) findUser(name string) *proxyUser {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.users[name]
+}
+
+//reap closes idle sessions and drops idle users
+func (m *sessionManager) reap(now time.Time) {
+	m.mutex.Lock()
+	users := make([]*proxyUser, 0, len(m.users))
+	for _, user := range m.users {
+		users = append(users, user)
+	}
+	m.mutex.Unlock()
+	for _, user := range users {
+		idles := make([]uint32, 0)
+		user.mutex.Lock()
+		for id, sess := range user.sessions {
+			if sess.idleTime(now) > SessionIdleTimeout {
+				idles = append(idles, id)
+			}
+		}
+		user.mutex.Unlock()
+		for _, id := range idles {
+			log.Printf("[%d]Session of user:%s is idle timeout\n", id, user.name)
+			user.deleteSession(id)
+		}
+		if user.sessionCount() == 0 && user.rsockConnCount() == 0 && user.idleTime(now) > UserIdleTimeout {
+			m.mutex.Lock()
+			if m.users[user.name] == user {
+				delete(m.users, user.name)
+			}
+			m.mutex.Unlock()
+			log.Printf("Remove idle user:%s\n", user.name)
+			user.close()
+		}
+	}
+}
+
+func (m *sessionManager) reapLoop() {
+	interval := SessionIdleTimeout / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	tick := time.NewTicker(interval)
+	for {
+		select {
+		case now := <-tick.C:
+			m.reap(now)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyxar/gsnova/event"
+)
+
+func init() {
+	event.Init()
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func startC4Server() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/push", PushCallback)
+	mux.HandleFunc("/pull", PullCallback)
+	return httptest.NewServer(mux)
+}
+
+func pushEvents(server, user string, evs ...event.Event) error {
+	var body bytes.Buffer
+	for _, ev := range evs {
+		event.EncodeEvent(&body, ev)
+	}
+	req, _ := http.NewRequest("POST", server+"/push", &body)
+	req.Header.Set("UserToken", user)
+	req.Header.Set("C4MiscInfo", "0_2")
+	res, err := http.DefaultClient.Do(req)
+	if nil != err {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("push response:%d", res.StatusCode)
+	}
+	return nil
+}
+
+//pull until the server ends the response, the handler is invoked for every event
+func pullEvents(server, user string, handler func(ev event.Event)) error {
+	return pullQueue(server, user, "0_1", handler)
+}
+
+//pullQueue pulls the queue told by misc as C4MiscInfo
+func pullQueue(server, user, misc string, handler func(ev event.Event)) error {
+	req, _ := http.NewRequest("POST", server+"/pull", nil)
+	req.Header.Set("UserToken", user)
+	req.Header.Set("C4MiscInfo", misc)
+	res, err := http.DefaultClient.Do(req)
+	if nil != err {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("pull response:%d", res.StatusCode)
+	}
+	reader := bufio.NewReader(res.Body)
+	for {
+		err, ev := readLengthPrefixedEvent(reader)
+		if nil != err {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		handler(event.ExtractEvent(ev))
+	}
+}
+
+func simulateClient(t *testing.T, server, user, target string, sessions int) {
+	evs := make([]event.Event, 0)
+	for i := 1; i <= sessions; i++ {
+		req := &event.HTTPRequestEvent{Method: "CONNECT", Url: target}
+		req.SetHeader("Host", target)
+		req.SetHash(uint32(i))
+		evs = append(evs, req)
+	}
+	if err := pushEvents(server, user, evs...); nil != err {
+		t.Error(err)
+		return
+	}
+	established := make(map[uint32]bool)
+	echoed := make(map[uint32]*bytes.Buffer)
+	expected := func(id uint32) string {
+		return fmt.Sprintf("hello %s:%d", user, id)
+	}
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		var chunks []event.Event
+		err := pullEvents(server, user, func(ev event.Event) {
+			chunk, ok := ev.(*event.TCPChunkEvent)
+			if !ok {
+				return
+			}
+			id := chunk.GetHash()
+			if !established[id] {
+				if !strings.Contains(string(chunk.Content), "200 OK") {
+					t.Errorf("user:%s session:%d not established:%q", user, id, chunk.Content)
+				}
+				established[id] = true
+				data := &event.TCPChunkEvent{Content: []byte(expected(id))}
+				data.SetHash(id)
+				chunks = append(chunks, data)
+				echoed[id] = new(bytes.Buffer)
+				return
+			}
+			echoed[id].Write(chunk.Content)
+		})
+		if nil != err {
+			t.Error(err)
+			return
+		}
+		if len(chunks) > 0 {
+			if err = pushEvents(server, user, chunks...); nil != err {
+				t.Error(err)
+				return
+			}
+		}
+		done := len(echoed) == sessions
+		for id, buf := range echoed {
+			if buf.String() != expected(id) {
+				done = false
+			}
+		}
+		if done {
+			closes := make([]event.Event, 0)
+			for i := 1; i <= sessions; i++ {
+				ev := &event.SocketConnectionEvent{Status: event.TCP_CONN_CLOSED}
+				ev.SetHash(uint32(i))
+				closes = append(closes, ev)
+			}
+			if err = pushEvents(server, user, closes...); nil != err {
+				t.Error(err)
+			}
+			return
+		}
+	}
+	t.Errorf("user:%s timeout with %d sessions established, %d echoed", user, len(established), len(echoed))
+}
+
+func TestConcurrentClients(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	server := startC4Server()
+	defer server.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			simulateClient(t, server.URL, fmt.Sprintf("user%d", i), echo.Addr().String(), 5)
+		}(i)
+	}
+	wg.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; i < 40; i++ {
+		user := sessionMgr.findUser(fmt.Sprintf("user%d", i))
+		if nil == user {
+			t.Fatalf("user%d not found", i)
+		}
+		for user.sessionCount() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := user.sessionCount(); n != 0 {
+			t.Errorf("user%d has %d sessions left", i, n)
+		}
+	}
+}
+
+func TestIdleSessionReaped(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	upstream := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if nil == err {
+			upstream <- c
+		}
+	}()
+	user := sessionMgr.getUser("idle-user", 1)
+	sess := user.getSession(1)
+	if err = sess.initConn("CONNECT", l.Addr().String()); nil != err {
+		t.Fatal(err)
+	}
+	c := <-upstream
+	defer c.Close()
+
+	sessionMgr.reap(time.Now())
+	if !user.sessionExist(1) {
+		t.Fatal("active session should not be reaped")
+	}
+	sessionMgr.reap(time.Now().Add(SessionIdleTimeout + time.Second))
+	if user.sessionExist(1) {
+		t.Fatal("idle session should be reaped")
+	}
+	//the upstream connection must be closed by the reaper
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF on upstream conn, got:%v", err)
+	}
+
+	sessionMgr.reap(time.Now().Add(UserIdleTimeout + time.Second))
+	if nil != sessionMgr.findUser("idle-user") {
+		t.Fatal("idle user should be removed")
+	}
+	select {
+	case <-user.done:
+	default:
+		t.Fatal("removed user should be closed")
+	}
+}
+
+func TestSendQueueBackpressure(t *testing.T) {
+	timeout := QueueOfferTimeout
+	QueueOfferTimeout = 100 * time.Millisecond
+	defer func() { QueueOfferTimeout = timeout }()
+
+	user := sessionMgr.getUser("backpressure-user", 1)
+	for i := 0; i < sendQueueSize; i++ {
+		ev := &event.TCPChunkEvent{Content: []byte("x")}
+		ev.SetHash(1)
+		if err := user.offerSendEvent(ev, nil); nil != err {
+			t.Fatalf("offer %d failed:%v", i, err)
+		}
+	}
+	ev := &event.TCPChunkEvent{Content: []byte("x")}
+	ev.SetHash(1)
+	start := time.Now()
+	if err := user.offerSendEvent(ev, nil); err != errQueueFull {
+		t.Fatalf("expected full queue, got:%v", err)
+	}
+	if time.Since(start) < QueueOfferTimeout {
+		t.Fatal("offer should block until timeout")
+	}
+
+	//a fetcher draining the queue releases the blocked producer
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		<-user.sendChannel(0)
+	}()
+	if err := user.offerSendEvent(ev, nil); nil != err {
+		t.Fatalf("offer should succeed after drain:%v", err)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if err := user.offerSendEvent(ev, cancel); nil == err || err == errQueueFull {
+		t.Fatalf("expected cancel error, got:%v", err)
+	}
+}
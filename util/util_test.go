@@ -3,6 +3,7 @@ package util
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -18,7 +19,7 @@ func TestNet(t *testing.T) {
 }
 
 func TestLocalIP(t *testing.T) {
-	t.Error("####" + GetLocalIP())
+	t.Error("####" + strings.Join(GetLocalIPs(), ","))
 }
 
 func TestIni(t *testing.T) {
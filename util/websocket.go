@@ -0,0 +1,388 @@
+package util
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//RFC 6455 websocket, only binary messages are exposed to the caller
+const (
+	WS_OP_CONTINUATION = 0x0
+	WS_OP_TEXT         = 0x1
+	WS_OP_BINARY       = 0x2
+	WS_OP_CLOSE        = 0x8
+	WS_OP_PING         = 0x9
+	WS_OP_PONG         = 0xA
+
+	WS_CLOSE_NORMAL   = 1000
+	WS_CLOSE_PROTOCOL = 1002
+
+	wsGUID            = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxFramePayload = 16 * 1024 * 1024
+	wsMaxControlFrame = 125
+)
+
+var ErrWebSocketClosed = errors.New("websocket closed")
+
+type WebSocketConn struct {
+	net.Conn
+	reader      *bufio.Reader
+	client      bool
+	remain      int64
+	mask        [4]byte
+	mask_offset int64
+	masked      bool
+	write_mutex sync.Mutex
+	closed      bool
+	//invoked for every pong frame, may be nil
+	OnPong func()
+}
+
+func NewWebSocketConn(c net.Conn, reader *bufio.Reader, client bool) *WebSocketConn {
+	if nil == reader {
+		reader = bufio.NewReader(c)
+	}
+	return &WebSocketConn{Conn: c, reader: reader, client: client}
+}
+
+func (ws *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+	length := len(payload)
+	switch {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	frame := payload
+	if ws.client {
+		//frames from client to server must be masked
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); nil != err {
+			return err
+		}
+		header[1] |= 0x80
+		header = append(header, mask[:]...)
+		frame = make([]byte, length)
+		for i := 0; i < length; i++ {
+			frame[i] = payload[i] ^ mask[i%4]
+		}
+	}
+	ws.write_mutex.Lock()
+	defer ws.write_mutex.Unlock()
+	if ws.closed && opcode != WS_OP_CLOSE {
+		return ErrWebSocketClosed
+	}
+	if _, err := ws.Conn.Write(append(header, frame...)); nil != err {
+		return err
+	}
+	return nil
+}
+
+//Write sends p as one binary message
+func (ws *WebSocketConn) Write(p []byte) (int, error) {
+	if err := ws.writeFrame(WS_OP_BINARY, p); nil != err {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ws *WebSocketConn) Ping(data []byte) error {
+	return ws.writeFrame(WS_OP_PING, data)
+}
+
+func (ws *WebSocketConn) closeWithCode(code uint16) error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	err := ws.writeFrame(WS_OP_CLOSE, payload)
+	ws.write_mutex.Lock()
+	ws.closed = true
+	ws.write_mutex.Unlock()
+	return err
+}
+
+//Close sends a close frame then closes the underlying connection
+func (ws *WebSocketConn) Close() error {
+	ws.write_mutex.Lock()
+	closed := ws.closed
+	ws.write_mutex.Unlock()
+	if !closed {
+		ws.Conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+		ws.closeWithCode(WS_CLOSE_NORMAL)
+	}
+	return ws.Conn.Close()
+}
+
+func (ws *WebSocketConn) readFrameHeader() (fin bool, opcode byte, length int64, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(ws.reader, head[:]); nil != err {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	if head[0]&0x70 != 0 {
+		err = errors.New("websocket: reserved bits set")
+		return
+	}
+	opcode = head[0] & 0x0F
+	ws.masked = head[1]&0x80 != 0
+	length = int64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.reader, ext[:]); nil != err {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.reader, ext[:]); nil != err {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if length < 0 || length > wsMaxFramePayload {
+		err = fmt.Errorf("websocket: invalid frame length:%d", length)
+		return
+	}
+	if ws.client == ws.masked {
+		//server must not mask, client must mask
+		err = errors.New("websocket: invalid frame mask")
+		return
+	}
+	if ws.masked {
+		if _, err = io.ReadFull(ws.reader, ws.mask[:]); nil != err {
+			return
+		}
+	}
+	if opcode >= WS_OP_CLOSE && (!fin || length > wsMaxControlFrame) {
+		err = errors.New("websocket: invalid control frame")
+	}
+	return
+}
+
+func (ws *WebSocketConn) readPayload(p []byte, offset int64) (int, error) {
+	n, err := ws.reader.Read(p)
+	if ws.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= ws.mask[(offset+int64(i))%4]
+		}
+	}
+	return n, err
+}
+
+func (ws *WebSocketConn) handleControl(opcode byte, length int64) error {
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); nil != err {
+		return err
+	}
+	if ws.masked {
+		for i := range payload {
+			payload[i] ^= ws.mask[i%4]
+		}
+	}
+	switch opcode {
+	case WS_OP_PING:
+		return ws.writeFrame(WS_OP_PONG, payload)
+	case WS_OP_PONG:
+		if nil != ws.OnPong {
+			ws.OnPong()
+		}
+	case WS_OP_CLOSE:
+		ws.write_mutex.Lock()
+		closed := ws.closed
+		ws.write_mutex.Unlock()
+		if !closed {
+			//echo the close frame
+			ws.closeWithCode(WS_CLOSE_NORMAL)
+		}
+		return io.EOF
+	default:
+		ws.closeWithCode(WS_CLOSE_PROTOCOL)
+		return fmt.Errorf("websocket: unknown opcode:%d", opcode)
+	}
+	return nil
+}
+
+//Read returns the payload of data frames as a byte stream, control frames are
+//handled internally
+func (ws *WebSocketConn) Read(p []byte) (int, error) {
+	for ws.remain == 0 {
+		//fragmented messages are simply concatenated
+		_, opcode, length, err := ws.readFrameHeader()
+		if nil != err {
+			return 0, err
+		}
+		switch opcode {
+		case WS_OP_CONTINUATION, WS_OP_TEXT, WS_OP_BINARY:
+			ws.remain = length
+			ws.mask_offset = 0
+		default:
+			if err = ws.handleControl(opcode, length); nil != err {
+				return 0, err
+			}
+		}
+	}
+	if int64(len(p)) > ws.remain {
+		p = p[0:ws.remain]
+	}
+	n, err := ws.readPayload(p, ws.mask_offset)
+	ws.remain -= int64(n)
+	ws.mask_offset += int64(n)
+	if err == io.EOF && ws.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+//WebSocketDial connects a ws:// or wss:// url, header is sent with the handshake.
+//The certificate of a wss:// server is verified against its host name unless
+//tlscfg says otherwise, tlscfg may be nil.
+func WebSocketDial(u *url.URL, header http.Header, dial func(network, addr string) (net.Conn, error), tlscfg *tls.Config) (*WebSocketConn, error) {
+	if nil == dial {
+		dial = net.Dial
+	}
+	addr := u.Host
+	secure := strings.EqualFold(u.Scheme, "wss") || strings.EqualFold(u.Scheme, "https")
+	if _, _, err := net.SplitHostPort(addr); nil != err {
+		if secure {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+	c, err := dial("tcp", addr)
+	if nil != err {
+		return nil, err
+	}
+	if secure {
+		if nil == tlscfg {
+			tlscfg = &tls.Config{}
+		} else {
+			tlscfg = tlscfg.Clone()
+		}
+		if len(tlscfg.ServerName) == 0 {
+			tlscfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsconn := tls.Client(c, tlscfg)
+		if err = tlsconn.Handshake(); nil != err {
+			c.Close()
+			return nil, err
+		}
+		c = tlsconn
+	}
+	nonce := make([]byte, 16)
+	io.ReadFull(rand.Reader, nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	path := u.RequestURI()
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Opaque: path},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       u.Host,
+		Header:     make(http.Header),
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err = req.Write(c); nil != err {
+		c.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(c)
+	res, err := http.ReadResponse(reader, req)
+	if nil != err {
+		c.Close()
+		return nil, err
+	}
+	if res.StatusCode != 101 || !strings.EqualFold(res.Header.Get("Upgrade"), "websocket") {
+		c.Close()
+		return nil, fmt.Errorf("websocket: bad handshake status:%d", res.StatusCode)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		c.Close()
+		return nil, errors.New("websocket: mismatch Sec-WebSocket-Accept")
+	}
+	return NewWebSocketConn(c, reader, true), nil
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func IsWebSocketRequest(req *http.Request) bool {
+	return headerContainsToken(req.Header, "Connection", "upgrade") && headerContainsToken(req.Header, "Upgrade", "websocket")
+}
+
+//WebSocketUpgrade answers the handshake of a websocket request and takes over the connection
+func WebSocketUpgrade(w http.ResponseWriter, req *http.Request) (*WebSocketConn, error) {
+	if !strings.EqualFold(req.Method, "GET") || !IsWebSocketRequest(req) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, errors.New("websocket: not a websocket handshake")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if len(key) == 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing Sec-WebSocket-Key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not support hijack")
+	}
+	c, rw, err := hj.Hijack()
+	if nil != err {
+		return nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+	if _, err = c.Write([]byte(response)); nil != err {
+		c.Close()
+		return nil, err
+	}
+	return NewWebSocketConn(c, rw.Reader, false), nil
+}
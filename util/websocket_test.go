@@ -0,0 +1,302 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+//wsFrame encodes a raw frame, the payload is masked by a fixed key if mask
+func wsFrame(fin bool, opcode byte, payload []byte, mask bool) []byte {
+	frame := []byte{opcode, 0}
+	if fin {
+		frame[0] |= 0x80
+	}
+	switch length := len(payload); {
+	case length <= 125:
+		frame[1] = byte(length)
+	case length <= 0xFFFF:
+		frame[1] = 126
+		frame = append(frame, byte(length>>8), byte(length))
+	default:
+		frame[1] = 127
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(length))
+	}
+	if !mask {
+		return append(frame, payload...)
+	}
+	key := []byte{0x12, 0x34, 0x56, 0x78}
+	frame[1] |= 0x80
+	frame = append(frame, key...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+	return frame
+}
+
+//wsPair connects a raw peer to a websocket of the other role over tcp, the
+//peer is the client if client is false
+func wsPair(t *testing.T, client bool) (net.Conn, *WebSocketConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	peer, err := net.Dial("tcp", l.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	c, err := l.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+	ws := NewWebSocketConn(c, nil, client)
+	t.Cleanup(func() {
+		peer.Close()
+		c.Close()
+	})
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return peer, ws
+}
+
+func TestWebSocketAcceptKey(t *testing.T) {
+	//the example of RFC 6455
+	if key := wsAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept key:%s", key)
+	}
+}
+
+func TestWebSocketMasking(t *testing.T) {
+	for _, size := range []int{0, 1, 125, 126, 0xFFFF, 0x10000} {
+		payload := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+		//client frames are masked, server frames are not
+		for _, client := range []bool{true, false} {
+			peer, ws := wsPair(t, client)
+			go ws.Write(payload)
+			var head [2]byte
+			io.ReadFull(peer, head[:])
+			if masked := head[1]&0x80 != 0; masked != client || head[0] != 0x80|WS_OP_BINARY {
+				t.Fatalf("%d:unexpected frame head %x", size, head)
+			}
+			length := int(head[1] & 0x7F)
+			switch length {
+			case 126:
+				var ext [2]byte
+				io.ReadFull(peer, ext[:])
+				length = int(binary.BigEndian.Uint16(ext[:]))
+			case 127:
+				var ext [8]byte
+				io.ReadFull(peer, ext[:])
+				length = int(binary.BigEndian.Uint64(ext[:]))
+			}
+			var key [4]byte
+			if client {
+				io.ReadFull(peer, key[:])
+			}
+			data := make([]byte, length)
+			io.ReadFull(peer, data)
+			for i := range data {
+				data[i] ^= key[i%4]
+			}
+			if !bytes.Equal(data, payload) {
+				t.Fatalf("%d:unexpected payload", size)
+			}
+
+			//the frames of the peer are decoded by the other role
+			peer.Write(wsFrame(true, WS_OP_BINARY, payload, !client))
+			data = make([]byte, size)
+			if _, err := io.ReadFull(ws, data); nil != err || !bytes.Equal(data, payload) {
+				t.Fatalf("%d:unexpected payload read:%v", size, err)
+			}
+		}
+	}
+}
+
+func TestWebSocketReadFrames(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		frames [][]byte
+		data   string
+		err    string
+		//frames answered by the websocket
+		replies []byte
+	}{
+		{"fragmented", [][]byte{
+			wsFrame(false, WS_OP_TEXT, []byte("hel"), true),
+			wsFrame(false, WS_OP_CONTINUATION, []byte("lo "), true),
+			wsFrame(true, WS_OP_CONTINUATION, []byte("world"), true),
+		}, "hello world", "", nil},
+		{"control in fragments", [][]byte{
+			wsFrame(false, WS_OP_BINARY, []byte("a"), true),
+			wsFrame(true, WS_OP_PING, []byte("p1"), true),
+			wsFrame(true, WS_OP_PONG, nil, true),
+			wsFrame(false, WS_OP_CONTINUATION, nil, true),
+			wsFrame(true, WS_OP_PING, []byte("p2"), true),
+			wsFrame(true, WS_OP_CONTINUATION, []byte("b"), true),
+		}, "ab", "", []byte{0x80 | WS_OP_PONG, 0x80 | WS_OP_PONG}},
+		{"close", [][]byte{
+			wsFrame(true, WS_OP_BINARY, []byte("a"), true),
+			wsFrame(true, WS_OP_CLOSE, []byte{0x03, 0xe8}, true),
+		}, "a", io.EOF.Error(), []byte{0x80 | WS_OP_CLOSE}},
+		{"unmasked", [][]byte{wsFrame(true, WS_OP_BINARY, []byte("a"), false)}, "", "websocket: invalid frame mask", nil},
+		{"fragmented control", [][]byte{wsFrame(false, WS_OP_PING, nil, true)}, "", "websocket: invalid control frame", nil},
+		{"large control", [][]byte{wsFrame(true, WS_OP_PING, make([]byte, 126), true)}, "", "websocket: invalid control frame", nil},
+		{"reserved bits", [][]byte{{0xC2, 0x80, 0, 0, 0, 0}}, "", "websocket: reserved bits set", nil},
+		{"unknown opcode", [][]byte{wsFrame(true, 0xB, nil, true)}, "", "websocket: unknown opcode:11", []byte{0x80 | WS_OP_CLOSE}},
+		{"truncated", [][]byte{wsFrame(true, WS_OP_BINARY, []byte("abc"), true)[:8]}, "ab", io.ErrUnexpectedEOF.Error(), nil},
+	} {
+		peer, ws := wsPair(t, false)
+		pongs := 0
+		ws.OnPong = func() {
+			pongs++
+		}
+		peer.Write(bytes.Join(c.frames, nil))
+		peer.(*net.TCPConn).CloseWrite()
+		data, err := ioutil.ReadAll(ws)
+		if string(data) != c.data {
+			t.Fatalf("%s:unexpected data %q", c.name, data)
+		}
+		if errString := ""; nil != err {
+			if errString = err.Error(); errString != c.err {
+				t.Fatalf("%s:unexpected error %v", c.name, err)
+			}
+		} else if c.err != io.EOF.Error() && len(c.err) > 0 {
+			t.Fatalf("%s:expected error %s", c.name, c.err)
+		}
+		if c.name == "control in fragments" && pongs != 1 {
+			t.Fatalf("unexpected pongs:%d", pongs)
+		}
+		//the pings are answered with their payload, the close frames are echoed
+		ws.Conn.(*net.TCPConn).CloseWrite()
+		reader := bufio.NewReader(peer)
+		for i, expected := range c.replies {
+			head, payload := readUnmaskedFrame(t, reader)
+			if head != expected {
+				t.Fatalf("%s:unexpected reply %x", c.name, head)
+			}
+			if head&0x0F == WS_OP_PONG && string(payload) != []string{"p1", "p2"}[i] {
+				t.Fatalf("%s:unexpected pong payload %q", c.name, payload)
+			}
+		}
+		if rest, _ := ioutil.ReadAll(reader); len(rest) > 0 {
+			t.Fatalf("%s:unexpected replies %x", c.name, rest)
+		}
+	}
+}
+
+//readUnmaskedFrame reads a frame written by the server role
+func readUnmaskedFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	ws := NewWebSocketConn(nil, r, true)
+	fin, opcode, length, err := ws.readFrameHeader()
+	if nil != err {
+		t.Fatal(err)
+	}
+	payload := make([]byte, length)
+	io.ReadFull(r, payload)
+	if fin {
+		opcode |= 0x80
+	}
+	return opcode, payload
+}
+
+func TestWebSocketPingPongClose(t *testing.T) {
+	peer, ws := wsPair(t, true)
+	server := NewWebSocketConn(peer, nil, false)
+	pong := make(chan bool, 1)
+	ws.OnPong = func() {
+		pong <- true
+	}
+	if err := ws.Ping([]byte("hi")); nil != err {
+		t.Fatal(err)
+	}
+	//the server answers the ping while reading
+	go func() {
+		io.Copy(ioutil.Discard, server)
+		server.Close()
+	}()
+	go ioutil.ReadAll(ws)
+	select {
+	case <-pong:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pong received")
+	}
+	if err := ws.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := ws.Write([]byte("a")); err != ErrWebSocketClosed {
+		t.Fatalf("unexpected error after closed:%v", err)
+	}
+}
+
+func newWebSocketEchoServer(tls bool) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := WebSocketUpgrade(w, req)
+		if nil != err {
+			return
+		}
+		defer ws.Close()
+		ws.Write([]byte(req.Header.Get("UserToken") + " " + req.URL.Path))
+		io.Copy(ws, ws)
+	})
+	if tls {
+		return httptest.NewTLSServer(handler)
+	}
+	return httptest.NewServer(handler)
+}
+
+func echoWebSocket(server *httptest.Server, scheme string, tlscfg *tls.Config) (string, error) {
+	u, _ := url.Parse(server.URL)
+	u.Scheme = scheme
+	u.Path = "/c4"
+	header := make(http.Header)
+	header.Set("UserToken", "token")
+	ws, err := WebSocketDial(u, header, nil, tlscfg)
+	if nil != err {
+		return "", err
+	}
+	defer ws.Close()
+	ws.Write([]byte(" echo"))
+	buf := make([]byte, 14)
+	_, err = io.ReadFull(ws, buf)
+	return string(buf), err
+}
+
+func TestWebSocketDial(t *testing.T) {
+	server := newWebSocketEchoServer(false)
+	defer server.Close()
+	if s, err := echoWebSocket(server, "ws", nil); nil != err || s != "token /c4 echo" {
+		t.Fatalf("unexpected echo:%q %v", s, err)
+	}
+
+	server = newWebSocketEchoServer(true)
+	defer server.Close()
+	//the certificate of the test server is not trusted by default
+	if _, err := echoWebSocket(server, "wss", nil); nil == err || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("unverified certificate is accepted:%v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	if s, err := echoWebSocket(server, "wss", &tls.Config{RootCAs: pool}); nil != err || s != "token /c4 echo" {
+		t.Fatalf("unexpected echo:%q %v", s, err)
+	}
+	//the host name is verified
+	if _, err := echoWebSocket(server, "wss", &tls.Config{RootCAs: pool, ServerName: "other.test"}); nil == err {
+		t.Fatal("mismatched host name is accepted")
+	}
+	if s, err := echoWebSocket(server, "wss", &tls.Config{InsecureSkipVerify: true}); nil != err || s != "token /c4 echo" {
+		t.Fatalf("unexpected echo:%q %v", s, err)
+	}
+}